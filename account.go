@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// accountDeletionGrace is how long a deleted account can be restored before it is purged.
+// It is configured in days with UZORG_ACCOUNT_DELETION_GRACE_DAYS.
+func accountDeletionGrace() time.Duration {
+	return time.Duration(envInt("UZORG_ACCOUNT_DELETION_GRACE_DAYS", 30)) * 24 * time.Hour
+}
+
+// runPurgeJob permanently deletes accounts whose grace period has ended, the responses
+// recorded for expired idempotency keys, expired invitations, the finished deliveries
+// of deleted webhooks, old webhook deliveries and outbox events and the archives of
+// old data exports, checking every interval
+func runPurgeJob(store UzorgStorer, interval time.Duration) {
+	for {
+		n, err := store.PurgeDeletedUsers(time.Now().Add(-accountDeletionGrace()))
+		if err != nil {
+			log.Println("Error purging deleted users: ", err)
+		} else if n > 0 {
+			log.Printf("Purged %d deleted users", n)
+		}
+
+		if _, err := store.PurgeExpiredIdempotencyKeys(); err != nil {
+			log.Println("Error purging expired idempotency keys: ", err)
+		}
+
+		if _, err := store.PurgeExpiredInvitations(); err != nil {
+			log.Println("Error purging expired invitations: ", err)
+		}
+
+		if _, err := store.PurgeOrphanedWebhookDeliveries(); err != nil {
+			log.Println("Error purging orphaned webhook deliveries: ", err)
+		}
+
+		if _, err := store.PurgeDeliveredWebhookDeliveries(time.Now().Add(-webhookDeliveryRetention)); err != nil {
+			log.Println("Error purging delivered webhook deliveries: ", err)
+		}
+
+		if _, err := store.PurgeDispatchedOutboxEvents(time.Now().Add(-outboxRetention)); err != nil {
+			log.Println("Error purging dispatched outbox events: ", err)
+		}
+
+		if _, err := store.PurgeFinishedDataExports(time.Now().Add(-exportRetention)); err != nil {
+			log.Println("Error purging finished data exports: ", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// handler for DELETE /api/users/me that deletes the logged in user's account. The account
+// can be restored during the grace period, after which it is purged. Organisations the user
+// is the sole owner of must be transferred or deleted first.
+func (h *ReqHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// the body is optional for users without a password
+	var req DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	user, err := h.uzorgStore.GetUserByID(userID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+
+	// users who only sign in through an identity provider have no password to confirm with
+	if user.Password != "" {
+		ok, _, err := h.passwords.Verify(req.Password, user.Password)
+		if err != nil || !ok {
+			log.Println("Error comparing password: ", err)
+			writeBadRequestResponse(w, http.StatusUnauthorized, "Password is incorrect")
+			return
+		}
+	}
+
+	orgs, err := h.uzorgStore.SoftDeleteUser(userID, newAuditEvent(r, AuditUserDeleted, "user", userID))
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error deleting user: %v", err))
+		return
+	}
+
+	if len(orgs) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(DeleteAccountBlockedResponse{
+			ErrorResponse: ErrorResponse{
+				ResponseStatus: ResponseStatus{
+					Status:  BadRequestStatus,
+					Message: "Transfer ownership of or delete the organisations you are the sole owner of first",
+				},
+				Code: http.StatusConflict,
+			},
+			Orgs: orgs,
+		})
+		return
+	}
+
+	response := DeleteAccountResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Account deleted, it can be restored until it is purged",
+		},
+		Data: &DeleteAccountResult{
+			PurgeAfter: time.Now().Add(accountDeletionGrace()),
+		},
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for POST /auth/restore that restores a deleted account during its grace period and logs the user in
+func (h *ReqHandler) RestoreAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req RestoreAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	user, err := h.uzorgStore.GetUserByEmail(req.Email)
+	if err != nil {
+		log.Println("Error getting user by email: ", err)
+		writeBadRequestResponse(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	ok, _, err := h.passwords.Verify(req.Password, user.Password)
+	if err != nil || !ok {
+		log.Println("Error comparing password: ", err)
+		writeBadRequestResponse(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	if user.DeletedAt == nil {
+		writeBadRequestResponse(w, http.StatusBadRequest, "Account is not deleted")
+		return
+	}
+
+	if !h.restoreDeletedUser(w, r, &user) {
+		return
+	}
+
+	token, err := h.startSession(&user, r)
+	if err != nil {
+		log.Println("Error generating token: ", err)
+		writeServerErrorResponse(w, "Error generating token")
+		return
+	}
+
+	resp := LoginResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Account restored successfully",
+		},
+		Data: &UserData{
+			Token: token,
+			User:  &user,
+		},
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// restoreDeletedUser restores the deleted account of a user who just authenticated, writing
+// the error response and returning false when its grace period has ended
+func (h *ReqHandler) restoreDeletedUser(w http.ResponseWriter, r *http.Request, user *User) bool {
+	deletedAfter := time.Now().Add(-accountDeletionGrace())
+	if user.DeletedAt.Before(deletedAfter) {
+		writeBadRequestResponse(w, http.StatusGone, "The grace period of the account has ended, it can no longer be restored")
+		return false
+	}
+
+	// the request is not authenticated, so the user restoring the account is the actor
+	ev := newAuditEvent(r, AuditUserRestored, "user", user.UserID)
+	ev.ActorID = user.UserID
+	restored, err := h.uzorgStore.RestoreUser(user.UserID, deletedAfter, ev)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error restoring user: %v", err))
+		return false
+	}
+	if !restored {
+		writeBadRequestResponse(w, http.StatusGone, "The grace period of the account has ended, it can no longer be restored")
+		return false
+	}
+
+	user.DeletedAt = nil
+	return true
+}
+
+// requireOrgRole checks that the logged in user has one of roles in an organisation,
+// writing the error response and returning false when they don't
+func (h *ReqHandler) requireOrgRole(w http.ResponseWriter, orgID, userID string, roles ...string) bool {
+	role, err := h.uzorgStore.GetMemberRole(orgID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeBadRequestResponse(w, http.StatusUnauthorized, "Unauthorized access")
+		return false
+	}
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting member role: %v", err))
+		return false
+	}
+
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	writeBadRequestResponse(w, http.StatusForbidden, fmt.Sprintf("Requires one of the roles %v", roles))
+	return false
+}
+
+// handler for POST /api/organisations/{id}/owner that transfers ownership of an organisation
+// to another member. The current owner becomes an admin.
+func (h *ReqHandler) TransferOrgOwnership(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	var req TransferOwnershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner) {
+		return
+	}
+
+	if req.UserID == userID {
+		writeBadRequestResponse(w, http.StatusBadRequest, "You already own the organisation")
+		return
+	}
+
+	ev := newAuditEvent(r, AuditOrgOwnerTransferred, "user", req.UserID)
+	ev.OrgID = orgID
+	err := h.uzorgStore.TransferOrgOwnership(orgID, userID, req.UserID, ev)
+	if errors.Is(err, ErrNotFound) {
+		writeBadRequestResponse(w, http.StatusBadRequest, "User does not belong to organisation or is scheduled for deletion")
+		return
+	}
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error transferring ownership: %v", err))
+		return
+	}
+
+	response := ResponseStatus{
+		Status:  SuccessStatus,
+		Message: "Ownership transferred successfully",
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for DELETE /api/organisations/{id} that deletes an organisation. Only owners can delete it,
+// and only the version they fetched: the request carries its ETag in If-Match.
+func (h *ReqHandler) DeleteOrg(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner) {
+		return
+	}
+
+	org, err := h.uzorgStore.GetOrg(orgID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting org: %v", err))
+		return
+	}
+
+	if !requireIfMatch(w, r, entityTag(org.Version, "")) {
+		return
+	}
+
+	ev := newAuditEvent(r, AuditOrgDeleted, "org", orgID)
+	ev.OrgID = orgID
+	deleted, err := h.uzorgStore.DeleteOrg(orgID, org.Version, ev)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error deleting org: %v", err))
+		return
+	}
+
+	if !deleted {
+		writeBadRequestResponse(w, http.StatusPreconditionFailed, "Organisation was modified by another request, fetch it again and retry")
+		return
+	}
+
+	response := ResponseStatus{
+		Status:  SuccessStatus,
+		Message: "Organisation deleted successfully",
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+// soleOwnedOrgs lists the organisations where the user is the only owner that has not deleted
+// their account. The caller holds s.mu.
+func (s *memoryStore) soleOwnedOrgs(userID string) []*Org {
+	var orgs []*Org
+	for orgID, members := range s.members {
+		if members[userID] != RoleOwner {
+			continue
+		}
+		sole := true
+		for otherID, role := range members {
+			if otherID != userID && role == RoleOwner && s.users[otherID].DeletedAt == nil {
+				sole = false
+			}
+		}
+		if sole {
+			org := *s.orgs[orgID]
+			orgs = append(orgs, &org)
+		}
+	}
+	return orgs
+}
+
+func (s *memoryStore) TransferOrgOwnership(orgID, fromUserID, toUserID string, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.members[orgID][toUserID]; !ok || s.users[toUserID].DeletedAt != nil {
+		return ErrNotFound
+	}
+	s.members[orgID][toUserID] = RoleOwner
+	s.members[orgID][fromUserID] = RoleAdmin
+	return nil
+}
+
+func (s *memoryStore) SoftDeleteUser(userID string, ev *AuditEvent) ([]*Org, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if orgs := s.soleOwnedOrgs(userID); len(orgs) > 0 {
+		return orgs, nil
+	}
+	now := time.Now()
+	s.users[userID].DeletedAt = &now
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) RestoreUser(userID string, deletedAfter time.Time, ev *AuditEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[userID]
+	if u.DeletedAt == nil || u.DeletedAt.Before(deletedAfter) {
+		return false, nil
+	}
+	u.DeletedAt = nil
+	return true, nil
+}
+
+func (s *memoryStore) PurgeDeletedUsers(deletedBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for userID, u := range s.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(deletedBefore) {
+			delete(s.users, userID)
+			for _, members := range s.members {
+				delete(members, userID)
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) PurgeExpiredIdempotencyKeys() (int64, error) {
+	return 0, nil
+}
+
+func (s *memoryStore) PurgeExpiredInvitations() (int64, error) {
+	return 0, nil
+}
+
+func (s *memoryStore) PurgeOrphanedWebhookDeliveries() (int64, error) {
+	return 0, nil
+}
+
+func TestAccountDeletion(t *testing.T) {
+	t.Setenv("UZORG_ACCOUNT_DELETION_GRACE_DAYS", "1")
+	store, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	ada := client.New(server.URL)
+	adaUser := registerTestUser(t, ada, "Ada", "ada@example.com")
+	bob := client.New(server.URL)
+	bobUser := registerTestUser(t, bob, "Bob", "bob@example.com")
+
+	shared, err := ada.CreateOrg(ctx, client.CreateOrgRequest{Name: "Shared", Description: "Ada and Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ada.AddUserToOrg(ctx, shared.OrgID, bobUser.UserID); err != nil {
+		t.Fatal(err)
+	}
+	deleteAccount := func(token, password string) *http.Response {
+		t.Helper()
+		return doTestRequest(t, http.MethodDelete, server.URL+"/api/v1/users/me", token, `{"password":"`+password+`"}`, nil)
+	}
+
+	var blocked DeleteAccountBlockedResponse
+	resp := doTestRequest(t, http.MethodDelete, server.URL+"/api/v1/users/me", ada.Token(), `{"password":"correct horse battery"}`, &blocked)
+	if resp.StatusCode != http.StatusConflict || len(blocked.Orgs) != 2 {
+		t.Fatalf("got status %d with %d orgs as a sole owner, want 409 listing both orgs", resp.StatusCode, len(blocked.Orgs))
+	}
+
+	// ownership cannot go to a member whose account is scheduled for deletion
+	dee := registerTestUser(t, client.New(server.URL), "Dee", "dee@example.com")
+	if err := ada.AddUserToOrg(ctx, shared.OrgID, dee.UserID); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	deletedAt := time.Now()
+	store.users[dee.UserID].DeletedAt = &deletedAt
+	store.mu.Unlock()
+	resp = doTestRequest(t, http.MethodPost, server.URL+"/api/v1/organisations/"+shared.OrgID+"/owner", ada.Token(), `{"userId":"`+dee.UserID+`"}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d transferring ownership to a deleted account, want 400", resp.StatusCode)
+	}
+	store.mu.Lock()
+	delete(store.members[shared.OrgID], dee.UserID)
+	store.mu.Unlock()
+
+	// hand the shared organisation over and delete the default one
+	resp = doTestRequest(t, http.MethodPost, server.URL+"/api/v1/organisations/"+shared.OrgID+"/owner", ada.Token(), `{"userId":"`+bobUser.UserID+`"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d transferring ownership, want 200", resp.StatusCode)
+	}
+	store.mu.Lock()
+	orgs := store.soleOwnedOrgs(adaUser.UserID)
+	store.mu.Unlock()
+	if len(orgs) != 1 {
+		t.Fatalf("got %d sole owned orgs after the transfer, want the default one", len(orgs))
+	}
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/api/v1/organisations/"+orgs[0].OrgID, nil)
+	req.Header.Set("Authorization", "Bearer "+ada.Token())
+	req.Header.Set("If-Match", entityTag(orgs[0].Version, ""))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %v deleting the default org", err)
+	}
+
+	if resp := deleteAccount(ada.Token(), "wrong horse battery"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d with a wrong password, want 401", resp.StatusCode)
+	}
+	var deleted DeleteAccountResponse
+	resp = doTestRequest(t, http.MethodDelete, server.URL+"/api/v1/users/me", ada.Token(), `{"password":"correct horse battery"}`, &deleted)
+	if resp.StatusCode != http.StatusOK || deleted.Data == nil || time.Until(deleted.Data.PurgeAfter) < 23*time.Hour {
+		t.Fatalf("got status %d, %+v deleting the account, want 200 with the end of the grace period", resp.StatusCode, deleted.Data)
+	}
+
+	if resp := doTestRequest(t, http.MethodGet, server.URL+"/api/v1/organisations", ada.Token(), "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d with a session of the deleted account, want 401", resp.StatusCode)
+	}
+	resp = doTestRequest(t, http.MethodPost, server.URL+"/api/v1/auth/login", "", `{"email":"ada@example.com","password":"correct horse battery"}`, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d logging in to the deleted account, want 403", resp.StatusCode)
+	}
+	members, err := bob.GetOrgUsers(ctx, shared.OrgID)
+	if err != nil || len(members) != 2 {
+		t.Errorf("got %d members, %v during the grace period, want the membership kept", len(members), err)
+	}
+
+	restore := func(password string) (*http.Response, LoginResponse) {
+		t.Helper()
+		var body LoginResponse
+		resp := doTestRequest(t, http.MethodPost, server.URL+"/api/v1/auth/restore", "", `{"email":"ada@example.com","password":"`+password+`"}`, &body)
+		return resp, body
+	}
+	if resp, _ := restore("wrong horse battery"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d restoring with a wrong password, want 401", resp.StatusCode)
+	}
+	resp, restored := restore("correct horse battery")
+	if resp.StatusCode != http.StatusOK || restored.Data == nil {
+		t.Fatalf("got status %d restoring the account, want 200", resp.StatusCode)
+	}
+	if resp := doTestRequest(t, http.MethodGet, server.URL+"/api/v1/organisations", restored.Data.Token, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d with the token of the restored account, want 200", resp.StatusCode)
+	}
+	if resp, _ := restore("correct horse battery"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d restoring an account that is not deleted, want 400", resp.StatusCode)
+	}
+
+	// accounts are purged once the grace period ends
+	if resp := deleteAccount(restored.Data.Token, "correct horse battery"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d deleting the account again, want 200", resp.StatusCode)
+	}
+	store.mu.Lock()
+	longAgo := time.Now().Add(-25 * time.Hour)
+	store.users[adaUser.UserID].DeletedAt = &longAgo
+	store.mu.Unlock()
+	unrelated := registerTestUser(t, client.New(server.URL), "Cy", "cy@example.com")
+	if resp, _ := restore("correct horse battery"); resp.StatusCode != http.StatusGone {
+		t.Errorf("got status %d restoring an account after its grace period, want 410", resp.StatusCode)
+	}
+
+	go runPurgeJob(store, time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := store.GetUserByID(adaUser.UserID); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the account was not purged after its grace period")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := store.GetUserByID(unrelated.UserID); err != nil {
+		t.Errorf("got %v for an account that was not deleted, want it kept", err)
+	}
+	if resp, _ := restore("correct horse battery"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d restoring a purged account, want 401", resp.StatusCode)
+	}
+	members, _ = bob.GetOrgUsers(ctx, shared.OrgID)
+	if len(members) != 1 {
+		t.Errorf("got %d members after the purge, want Bob only", len(members))
+	}
+}
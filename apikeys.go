@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// apiKeyPrefix marks bearer credentials that are API keys rather than JWTs
+const apiKeyPrefix = "uzk_"
+
+// generateAPIKey returns a new random API key
+func generateAPIKey() (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + token, nil
+}
+
+// hashAPIKey returns the hash under which an API key is stored.
+// API keys are high entropy so a fast hash is sufficient.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// handler for POST /api/users/me/api-keys that creates an API key for the logged in user.
+// The key can only be granted scopes the caller holds and is returned only once.
+func (h *ReqHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	// a key can not be granted more than the credential used to create it
+	missing := missingScopes(scopesFromContext(r.Context()), req.Scopes)
+	if len(missing) > 0 {
+		writeForbiddenResponse(w, "Cannot grant scopes the caller does not hold", missing)
+		return
+	}
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	key, err := generateAPIKey()
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error generating API key: %v", err))
+		return
+	}
+
+	apiKey := APIKey{
+		KeyID:   uuid.New().String(),
+		UserID:  userID,
+		Name:    req.Name,
+		Prefix:  key[:len(apiKeyPrefix)+6],
+		KeyHash: hashAPIKey(key),
+		Scopes:  req.Scopes,
+	}
+
+	err = h.uzorgStore.InsertAPIKey(&apiKey, newAuditEvent(r, AuditAPIKeyCreated, "apikey", apiKey.KeyID))
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error inserting API key: %v", err))
+		return
+	}
+
+	response := CreateAPIKeyResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "API key created successfully",
+		},
+		Data: &CreatedAPIKey{
+			APIKey: apiKey,
+			Key:    key,
+		},
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for GET /api/users/me/api-keys that lists the logged in user's API keys
+func (h *ReqHandler) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	keys, err := h.uzorgStore.GetUserAPIKeys(userID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting API keys: %v", err))
+		return
+	}
+
+	response := GetAPIKeysResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "API keys retrieved successfully",
+		},
+		Data: keys,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for DELETE /api/users/me/api-keys/{id} that revokes one of the logged in user's API keys
+func (h *ReqHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	keyID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	revoked, err := h.uzorgStore.RevokeAPIKey(userID, keyID, newAuditEvent(r, AuditAPIKeyRevoked, "apikey", keyID))
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error revoking API key: %v", err))
+		return
+	}
+
+	if !revoked {
+		writeBadRequestResponse(w, http.StatusNotFound, "API key not found")
+		return
+	}
+
+	response := ResponseStatus{
+		Status:  SuccessStatus,
+		Message: "API key revoked successfully",
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
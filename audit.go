@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditUserRegistered      = "user.registered"
+	AuditUserLogin           = "user.login"
+	AuditUserUpdated         = "user.updated"
+	AuditUserPasswordChanged = "user.password_changed"
+	AuditUserEmailChanged    = "user.email_changed"
+	AuditUserDeleted         = "user.deleted"
+	AuditUserRestored        = "user.restored"
+	AuditSessionRevoked      = "session.revoked"
+	AuditAPIKeyCreated       = "apikey.created"
+	AuditAPIKeyRevoked       = "apikey.revoked"
+	AuditSCIMTokenCreated    = "scimtoken.created"
+	AuditSCIMTokenRevoked    = "scimtoken.revoked"
+	AuditOrgCreated          = "org.created"
+	AuditOrgDeleted          = "org.deleted"
+	AuditOrgOwnerTransferred = "org.ownership_transferred"
+	AuditMemberAdded         = "member.added"
+	AuditMemberRemoved       = "member.removed"
+	AuditMemberRoleChanged   = "member.role_changed"
+	AuditInvitationCreated   = "invitation.created"
+	AuditWebhookCreated      = "webhook.created"
+	AuditWebhookDeleted      = "webhook.deleted"
+)
+
+// ActorType of events whose actor is the SCIM token of an identity provider rather than a user
+const AuditActorSCIMToken = "scimToken"
+
+const (
+	auditDefaultLimit = 50
+	auditMaxLimit     = 200
+)
+
+// newAuditEvent describes an action taken by the logged in user, or the SCIM token, in the request being handled.
+// Callers set OrgID for actions on organisations.
+func newAuditEvent(r *http.Request, action, targetType, targetID string) *AuditEvent {
+	actorID, _ := r.Context().Value("userId").(string)
+	requestID, _ := r.Context().Value("requestId").(string)
+	ev := &AuditEvent{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IPAddress:  clientIP(r),
+		RequestID:  requestID,
+	}
+	if tokenID, ok := r.Context().Value("scimTokenId").(string); ok {
+		ev.ActorID, ev.ActorType = tokenID, AuditActorSCIMToken
+	}
+	return ev
+}
+
+// encodeAuditCursor encodes the position after an event for keyset pagination
+func encodeAuditCursor(ev *AuditEvent) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(ev.CreatedAt.Format(time.RFC3339Nano) + "|" + ev.EventID))
+}
+
+func decodeAuditCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", errors.New("malformed cursor")
+	}
+	if _, err := uuid.Parse(parts[1]); err != nil {
+		return time.Time{}, "", err
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	return createdAt, parts[1], err
+}
+
+// handler for GET /api/organisations/{id}/audit that lists the audit events of an organisation, newest first.
+// Only owners and admins can read it. Events can be filtered by action, actorId, targetId, since and until,
+// and are paginated with limit and the cursor returned with the previous page.
+func (h *ReqHandler) GetOrgAuditEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	q := r.URL.Query()
+	filter := AuditEventFilter{
+		Action:   q.Get("action"),
+		ActorID:  q.Get("actorId"),
+		TargetID: q.Get("targetId"),
+		Limit:    auditDefaultLimit,
+	}
+
+	var errs []*ValidationError
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > auditMaxLimit {
+			errs = append(errs, &ValidationError{Field: "limit", Message: fmt.Sprintf("limit must be between 1 and %d", auditMaxLimit)})
+		}
+		filter.Limit = limit
+	}
+	for name, dst := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs = append(errs, &ValidationError{Field: name, Message: fmt.Sprintf("%s must be an RFC 3339 timestamp", name)})
+			}
+			*dst = &t
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		createdAt, eventID, err := decodeAuditCursor(v)
+		if err != nil {
+			errs = append(errs, &ValidationError{Field: "cursor", Message: "cursor is invalid"})
+		}
+		filter.AfterCreatedAt = &createdAt
+		filter.AfterEventID = eventID
+	}
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	// fetch one more than requested to know whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	events, err := h.uzorgStore.GetOrgAuditEvents(orgID, filter)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting audit events: %v", err))
+		return
+	}
+
+	page := &AuditEventPage{Events: events}
+	if len(events) > limit {
+		page.Events = events[:limit]
+		page.NextCursor = encodeAuditCursor(page.Events[limit-1])
+	}
+	if page.Events == nil {
+		page.Events = []*AuditEvent{}
+	}
+
+	response := GetAuditEventsResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Audit events retrieved successfully",
+		},
+		Data: page,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/utukj/user-org-crud/client"
+)
+
+// GetOrgAuditEvents filters and orders events like the SQL of UzorgPgStorer
+func (s *memoryStore) GetOrgAuditEvents(orgID string, filter AuditEventFilter) ([]*AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := func(a, b *AuditEvent) bool {
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.EventID < b.EventID
+	}
+
+	var events []*AuditEvent
+	for _, ev := range s.auditEvents {
+		switch {
+		case ev.OrgID != orgID,
+			filter.Action != "" && ev.Action != filter.Action,
+			filter.ActorID != "" && ev.ActorID != filter.ActorID,
+			filter.TargetID != "" && ev.TargetID != filter.TargetID,
+			filter.Since != nil && ev.CreatedAt.Before(*filter.Since),
+			filter.Until != nil && !ev.CreatedAt.Before(*filter.Until),
+			filter.AfterCreatedAt != nil && !before(ev, &AuditEvent{CreatedAt: *filter.AfterCreatedAt, EventID: filter.AfterEventID}):
+			continue
+		}
+		stored := *ev
+		events = append(events, &stored)
+	}
+	sort.Slice(events, func(i, j int) bool { return before(events[j], events[i]) })
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func TestOrgAuditEvents(t *testing.T) {
+	store, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	ada := client.New(server.URL)
+	adaUser := registerTestUser(t, ada, "Ada", "ada@example.com")
+	bob := client.New(server.URL)
+	bobUser := registerTestUser(t, bob, "Bob", "bob@example.com")
+	org, err := ada.CreateOrg(ctx, client.CreateOrgRequest{Name: "Audited", Description: "Watched closely"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ada.AddUserToOrg(ctx, org.OrgID, bobUser.UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	// events 4 and 5 share a timestamp so pages must also be split by event id
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var want []*AuditEvent
+	for i, at := range []int{0, 1, 2, 3, 4, 4, 5} {
+		ev := &AuditEvent{
+			EventID:    uuid.New().String(),
+			OrgID:      org.OrgID,
+			ActorID:    adaUser.UserID,
+			Action:     AuditMemberAdded,
+			TargetType: "user",
+			TargetID:   bobUser.UserID,
+			CreatedAt:  base.Add(time.Duration(at) * time.Minute),
+		}
+		if i%2 == 1 {
+			ev.ActorID, ev.Action, ev.TargetID = bobUser.UserID, AuditMemberRoleChanged, adaUser.UserID
+		}
+		want = append(want, ev)
+	}
+	store.mu.Lock()
+	store.auditEvents = append(want, &AuditEvent{EventID: uuid.New().String(), OrgID: uuid.New().String(), Action: AuditOrgCreated, CreatedAt: base})
+	store.mu.Unlock()
+	sort.Slice(want, func(i, j int) bool {
+		if !want[i].CreatedAt.Equal(want[j].CreatedAt) {
+			return want[i].CreatedAt.After(want[j].CreatedAt)
+		}
+		return want[i].EventID > want[j].EventID
+	})
+
+	get := func(token string, q url.Values) (*http.Response, GetAuditEventsResponse) {
+		t.Helper()
+		var body GetAuditEventsResponse
+		resp := doTestRequest(t, http.MethodGet, server.URL+"/api/v1/organisations/"+org.OrgID+"/audit?"+q.Encode(), token, "", &body)
+		return resp, body
+	}
+	ids := func(events []*AuditEvent) []string {
+		var ids []string
+		for _, ev := range events {
+			ids = append(ids, ev.EventID)
+		}
+		return ids
+	}
+	assertEvents := func(got, want []*AuditEvent, what string) {
+		t.Helper()
+		g, w := ids(got), ids(want)
+		if len(g) != len(w) {
+			t.Errorf("got events %v %s, want %v", g, what, w)
+			return
+		}
+		for i := range g {
+			if g[i] != w[i] {
+				t.Errorf("got events %v %s, want %v", g, what, w)
+				return
+			}
+		}
+	}
+
+	var pages [][]*AuditEvent
+	q := url.Values{"limit": {"3"}}
+	for {
+		resp, body := get(ada.Token(), q)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d listing audit events, want 200", resp.StatusCode)
+		}
+		pages = append(pages, body.Data.Events)
+		if body.Data.NextCursor == "" {
+			break
+		}
+		if len(pages) > len(want) {
+			t.Fatal("pagination does not end")
+		}
+		q.Set("cursor", body.Data.NextCursor)
+	}
+	if len(pages) != 3 || len(pages[2]) != 1 {
+		t.Errorf("got %d pages, want 3 pages of up to 3 events", len(pages))
+	}
+	var all []*AuditEvent
+	for _, page := range pages {
+		all = append(all, page...)
+	}
+	assertEvents(all, want, "across pages")
+
+	// a page ending exactly at the last event has no cursor
+	if _, body := get(ada.Token(), url.Values{"limit": {"7"}}); body.Data.NextCursor != "" || len(body.Data.Events) != 7 {
+		t.Errorf("got %d events and cursor %q for a full page, want 7 and none", len(body.Data.Events), body.Data.NextCursor)
+	}
+
+	filtered := func(keep func(ev *AuditEvent) bool) []*AuditEvent {
+		var events []*AuditEvent
+		for _, ev := range want {
+			if keep(ev) {
+				events = append(events, ev)
+			}
+		}
+		return events
+	}
+	for name, tt := range map[string]struct {
+		q    url.Values
+		keep func(ev *AuditEvent) bool
+	}{
+		"by action": {url.Values{"action": {AuditMemberRoleChanged}}, func(ev *AuditEvent) bool { return ev.Action == AuditMemberRoleChanged }},
+		"by actor":  {url.Values{"actorId": {adaUser.UserID}}, func(ev *AuditEvent) bool { return ev.ActorID == adaUser.UserID }},
+		"by target": {url.Values{"targetId": {adaUser.UserID}}, func(ev *AuditEvent) bool { return ev.TargetID == adaUser.UserID }},
+		"by time": {
+			url.Values{"since": {base.Add(time.Minute).Format(time.RFC3339)}, "until": {base.Add(4 * time.Minute).Format(time.RFC3339)}},
+			func(ev *AuditEvent) bool {
+				return !ev.CreatedAt.Before(base.Add(time.Minute)) && ev.CreatedAt.Before(base.Add(4*time.Minute))
+			},
+		},
+	} {
+		resp, body := get(ada.Token(), tt.q)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("got status %d filtering %s, want 200", resp.StatusCode, name)
+			continue
+		}
+		assertEvents(body.Data.Events, filtered(tt.keep), "filtered "+name)
+	}
+
+	for _, q := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"201"}},
+		{"since": {"yesterday"}},
+		{"cursor": {"not-a-cursor"}},
+	} {
+		if resp, _ := get(ada.Token(), q); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("got status %d for %v, want 422", resp.StatusCode, q)
+		}
+	}
+
+	if resp := doTestRequest(t, http.MethodGet, server.URL+"/api/v1/organisations/"+org.OrgID+"/audit", bob.Token(), "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d for a plain member, want 403", resp.StatusCode)
+	}
+}
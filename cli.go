@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/uuid"
+	"github.com/utukj/user-org-crud/client"
+	"golang.org/x/term"
+)
+
+const cliUsage = `Usage: uzorg <command> [flags]
+
+Without a command uzorg runs the API server.
+
+Commands:
+  serve                   run the API server
+  login                   log in and remember the token in the config file
+  logout                  forget the remembered token
+  orgs list               list your organisations
+  orgs create             create an organisation
+  members list            list the members of an organisation
+  members add             add a user to an organisation
+
+Operator commands, run against the database at UZORG_DB_URL:
+  admin migrate           create or update the tables of the server
+  admin create-user       create a user with their default organisation
+  admin reset-password    set a new password for a user and end their sessions
+  admin promote-owner     make a member an owner of an organisation
+  admin list-orgs         list every organisation
+
+Commands that print results take -o table (the default) or -o json.
+Run uzorg <command> -h for the flags of a command.
+`
+
+// cliConfig is what the CLI remembers between invocations. The password is never stored,
+// so once the token expires users run uzorg login again.
+type cliConfig struct {
+	Server string `json:"server"`
+	Email  string `json:"email"`
+	Token  string `json:"token"`
+}
+
+// cliConfigPath is the file the CLI config is kept in, $UZORG_CONFIG or uzorg/config.json
+// in the user's config directory
+func cliConfigPath() (string, error) {
+	if path := os.Getenv("UZORG_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "uzorg", "config.json"), nil
+}
+
+func loadCLIConfig() (cliConfig, error) {
+	var cfg cliConfig
+	path, err := cliConfigPath()
+	if err != nil {
+		return cfg, err
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// saveCLIConfig writes the config readable by the user only, since it holds their token
+func saveCLIConfig(cfg cliConfig) error {
+	path, err := cliConfigPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, raw, 0600)
+}
+
+// cli runs one command of the uzorg CLI
+type cli struct {
+	stdin  *bufio.Reader
+	stdout io.Writer
+	stderr io.Writer
+	// isTerminal reports whether stdin is a terminal, to read passwords without echoing them
+	isTerminal bool
+	format     string
+}
+
+// runCLI runs the command in args and returns the exit status of the process
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{
+		stdin:  bufio.NewReader(stdin),
+		stdout: stdout,
+		stderr: stderr,
+	}
+	if f, ok := stdin.(*os.File); ok {
+		c.isTerminal = term.IsTerminal(int(f.Fd()))
+	}
+
+	var err error
+	switch args[0] {
+	case "serve":
+		serve()
+	case "login":
+		err = c.login(args[1:])
+	case "logout":
+		err = c.logout(args[1:])
+	case "orgs":
+		err = c.subcommand("orgs", args[1:], map[string]func([]string) error{
+			"list":   c.listOrgs,
+			"create": c.createOrg,
+		})
+	case "members":
+		err = c.subcommand("members", args[1:], map[string]func([]string) error{
+			"list": c.listMembers,
+			"add":  c.addMember,
+		})
+	case "admin":
+		err = c.subcommand("admin", args[1:], map[string]func([]string) error{
+			"migrate":        c.adminMigrate,
+			"create-user":    c.adminCreateUser,
+			"reset-password": c.adminResetPassword,
+			"promote-owner":  c.adminPromoteOwner,
+			"list-orgs":      c.adminListOrgs,
+		})
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, cliUsage)
+	default:
+		fmt.Fprintf(stderr, "uzorg: unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if errors.Is(err, errCLIUsage) {
+		return 2
+	}
+	if err != nil {
+		// errors of the client package carry the prefix already
+		fmt.Fprintln(stderr, "uzorg:", strings.TrimPrefix(err.Error(), "uzorg: "))
+		return 1
+	}
+	return 0
+}
+
+// errCLIUsage is returned for invalid invocations, after the problem was reported
+var errCLIUsage = errors.New("invalid usage")
+
+func (c *cli) subcommand(name string, args []string, commands map[string]func([]string) error) error {
+	if len(args) == 0 {
+		fmt.Fprintf(c.stderr, "uzorg: %s needs a subcommand\n\n%s", name, cliUsage)
+		return errCLIUsage
+	}
+	run, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(c.stderr, "uzorg: unknown command %q\n\n%s", name+" "+args[0], cliUsage)
+		return errCLIUsage
+	}
+	return run(args[1:])
+}
+
+// flags returns the flag set of a command. Commands that print results get the -o flag.
+func (c *cli) flags(name string, output bool) *flag.FlagSet {
+	fs := flag.NewFlagSet("uzorg "+name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	if output {
+		fs.StringVar(&c.format, "o", "table", "output format, table or json")
+	}
+	return fs
+}
+
+// parse parses the flags of a command and checks that the required ones are set
+func (c *cli) parse(fs *flag.FlagSet, args []string, required ...string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errCLIUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(c.stderr, "%s: unexpected argument %q\n", fs.Name(), fs.Arg(0))
+		return errCLIUsage
+	}
+	for _, name := range required {
+		if fs.Lookup(name).Value.String() == "" {
+			fmt.Fprintf(c.stderr, "%s: -%s is required\n", fs.Name(), name)
+			return errCLIUsage
+		}
+	}
+	if c.format != "" && c.format != "table" && c.format != "json" {
+		fmt.Fprintf(c.stderr, "%s: unknown output format %q\n", fs.Name(), c.format)
+		return errCLIUsage
+	}
+	return nil
+}
+
+// print writes v as JSON, or header and rows as a table
+func (c *cli) print(v interface{}, header []string, rows [][]string) error {
+	if c.format == "json" {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// prompt reads a line from stdin after printing label to stderr
+func (c *cli) prompt(label string) (string, error) {
+	fmt.Fprint(c.stderr, label)
+	line, err := c.stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("reading %s: %w", strings.TrimSuffix(label, ": "), err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// readPassword returns the password from the flag, UZORG_PASSWORD or a prompt, in that order
+func (c *cli) readPassword(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	if password := os.Getenv("UZORG_PASSWORD"); password != "" {
+		return password, nil
+	}
+	if c.isTerminal {
+		fmt.Fprint(c.stderr, "Password: ")
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(c.stderr)
+		return string(password), err
+	}
+	return c.prompt("Password: ")
+}
+
+// apiClient returns a client authenticated with the remembered token
+func (c *cli) apiClient() (*client.Client, error) {
+	cfg, err := loadCLIConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("not logged in, run uzorg login first")
+	}
+	return client.New(cfg.Server, client.WithToken(cfg.Token)), nil
+}
+
+// apiError explains errors of the API in terms of the CLI
+func apiError(err error) error {
+	if client.IsUnauthorized(err) {
+		return fmt.Errorf("%w\nYour session has ended, run uzorg login again", err)
+	}
+	return err
+}
+
+func (c *cli) login(args []string) error {
+	cfg, err := loadCLIConfig()
+	if err != nil {
+		return err
+	}
+
+	server := cfg.Server
+	if server == "" {
+		server = os.Getenv("UZORG_SERVER")
+	}
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+
+	fs := c.flags("login", false)
+	fs.StringVar(&server, "server", server, "URL of the uzorg server")
+	email := fs.String("email", cfg.Email, "email to log in with")
+	password := fs.String("password", "", "password, read from UZORG_PASSWORD or prompted for when empty")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	if *email == "" {
+		if *email, err = c.prompt("Email: "); err != nil {
+			return err
+		}
+	}
+	pw, err := c.readPassword(*password)
+	if err != nil {
+		return err
+	}
+
+	api := client.New(server)
+	user, err := api.Login(context.Background(), *email, pw)
+	if err != nil {
+		return err
+	}
+
+	cfg = cliConfig{Server: server, Email: user.Email, Token: api.Token()}
+	if err := saveCLIConfig(cfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Logged in to %s as %s\n", server, user.Email)
+	return nil
+}
+
+func (c *cli) logout(args []string) error {
+	if err := c.parse(c.flags("logout", false), args); err != nil {
+		return err
+	}
+	cfg, err := loadCLIConfig()
+	if err != nil {
+		return err
+	}
+	cfg.Token = ""
+	return saveCLIConfig(cfg)
+}
+
+func orgRows(orgs []*Org) [][]string {
+	rows := make([][]string, len(orgs))
+	for i, o := range orgs {
+		rows[i] = []string{o.OrgID, o.Name, o.Description}
+	}
+	return rows
+}
+
+func clientOrgRows(orgs []*client.Org) [][]string {
+	rows := make([][]string, len(orgs))
+	for i, o := range orgs {
+		rows[i] = []string{o.OrgID, o.Name, o.Description}
+	}
+	return rows
+}
+
+var orgHeader = []string{"ID", "NAME", "DESCRIPTION"}
+
+func (c *cli) listOrgs(args []string) error {
+	if err := c.parse(c.flags("orgs list", true), args); err != nil {
+		return err
+	}
+	api, err := c.apiClient()
+	if err != nil {
+		return err
+	}
+
+	orgs, err := api.GetOrgs(context.Background())
+	if err != nil {
+		return apiError(err)
+	}
+	if orgs == nil {
+		orgs = []*client.Org{}
+	}
+	return c.print(orgs, orgHeader, clientOrgRows(orgs))
+}
+
+func (c *cli) createOrg(args []string) error {
+	fs := c.flags("orgs create", true)
+	name := fs.String("name", "", "name of the organisation")
+	description := fs.String("description", "", "description of the organisation")
+	if err := c.parse(fs, args, "name", "description"); err != nil {
+		return err
+	}
+	api, err := c.apiClient()
+	if err != nil {
+		return err
+	}
+
+	org, err := api.CreateOrg(context.Background(), client.CreateOrgRequest{Name: *name, Description: *description})
+	if err != nil {
+		return apiError(err)
+	}
+	return c.print(org, orgHeader, clientOrgRows([]*client.Org{org}))
+}
+
+func (c *cli) listMembers(args []string) error {
+	fs := c.flags("members list", true)
+	orgID := fs.String("org", "", "ID of the organisation")
+	if err := c.parse(fs, args, "org"); err != nil {
+		return err
+	}
+	api, err := c.apiClient()
+	if err != nil {
+		return err
+	}
+
+	users, err := api.GetOrgUsers(context.Background(), *orgID)
+	if err != nil {
+		return apiError(err)
+	}
+	if users == nil {
+		users = []*client.User{}
+	}
+
+	rows := make([][]string, len(users))
+	for i, u := range users {
+		rows[i] = []string{u.UserID, u.FirstName + " " + u.LastName, u.Email, u.Role}
+	}
+	return c.print(users, []string{"ID", "NAME", "EMAIL", "ROLE"}, rows)
+}
+
+func (c *cli) addMember(args []string) error {
+	fs := c.flags("members add", false)
+	orgID := fs.String("org", "", "ID of the organisation")
+	userID := fs.String("user", "", "ID of the user to add")
+	if err := c.parse(fs, args, "org", "user"); err != nil {
+		return err
+	}
+	api, err := c.apiClient()
+	if err != nil {
+		return err
+	}
+
+	if err := api.AddUserToOrg(context.Background(), *orgID, *userID); err != nil {
+		return apiError(err)
+	}
+	fmt.Fprintf(c.stdout, "Added %s to %s\n", *userID, *orgID)
+	return nil
+}
+
+// newOperatorAuditEvent describes an action taken by an operator through the CLI, which has no actor
+func newOperatorAuditEvent(action, targetType, targetID string) *AuditEvent {
+	return &AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+	}
+}
+
+// validationError reports the rejected fields of an operator command
+func validationError(errs []*ValidationError) error {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// adminStore opens the database for operator commands
+func adminStore() (*UzorgPgStorer, *sql.DB) {
+	db := openDB()
+	return &UzorgPgStorer{db: db}, db
+}
+
+func (c *cli) adminMigrate(args []string) error {
+	if err := c.parse(c.flags("admin migrate", false), args); err != nil {
+		return err
+	}
+	db := openDB()
+	defer db.Close()
+
+	migrate(db)
+	fmt.Fprintln(c.stdout, "Database is up to date")
+	return nil
+}
+
+func (c *cli) adminCreateUser(args []string) error {
+	fs := c.flags("admin create-user", true)
+	var req RegisterUserRequest
+	fs.StringVar(&req.FirstName, "first-name", "", "first name of the user")
+	fs.StringVar(&req.LastName, "last-name", "", "last name of the user")
+	fs.StringVar(&req.Email, "email", "", "email of the user")
+	fs.StringVar(&req.Phone, "phone", "", "phone number of the user in E.164 format")
+	password := fs.String("password", "", "password, read from UZORG_PASSWORD or prompted for when empty")
+	if err := c.parse(fs, args, "email"); err != nil {
+		return err
+	}
+
+	var err error
+	if req.Password, err = c.readPassword(*password); err != nil {
+		return err
+	}
+
+	errs := req.Validate()
+	if req.Password != "" {
+		errs = append(errs, loadPasswordPolicy().Check("RegisterUserRequest.Password", req.Password, req.Email, req.FirstName, req.LastName)...)
+	}
+	if len(errs) > 0 {
+		return validationError(errs)
+	}
+
+	store, db := adminStore()
+	defer db.Close()
+
+	if _, err := store.GetUserByEmail(req.Email); err == nil {
+		return fmt.Errorf("a user with email %s already exists", req.Email)
+	}
+
+	hashedPassword, err := loadPasswordHashers().Hash(req.Password)
+	if err != nil {
+		return fmt.Errorf("hashing password: %w", err)
+	}
+
+	user := User{
+		UserID:    uuid.New().String(),
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Email:     req.Email,
+		Phone:     req.Phone,
+		Password:  hashedPassword,
+	}
+	org := makeUserDefaultOrg(&user)
+
+	ev := newOperatorAuditEvent(AuditUserRegistered, "user", user.UserID)
+	ev.OrgID = org.OrgID
+	if err := store.InsertUserAndDefaultOrg(&user, &org, ev); err != nil {
+		return fmt.Errorf("inserting user: %w", err)
+	}
+
+	return c.print(&user, []string{"ID", "NAME", "EMAIL", "DEFAULT ORG"}, [][]string{
+		{user.UserID, user.FirstName + " " + user.LastName, user.Email, org.OrgID},
+	})
+}
+
+func (c *cli) adminResetPassword(args []string) error {
+	fs := c.flags("admin reset-password", false)
+	email := fs.String("email", "", "email of the user")
+	password := fs.String("password", "", "new password, generated and printed when empty")
+	if err := c.parse(fs, args, "email"); err != nil {
+		return err
+	}
+
+	store, db := adminStore()
+	defer db.Close()
+
+	user, err := store.GetUserByEmail(*email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user has email %s", *email)
+	}
+	if err != nil {
+		return err
+	}
+
+	newPassword := *password
+	if newPassword == "" {
+		if newPassword, err = randomToken(18); err != nil {
+			return err
+		}
+	} else if errs := loadPasswordPolicy().Check("password", newPassword, user.Email, user.FirstName, user.LastName); len(errs) > 0 {
+		return validationError(errs)
+	}
+
+	hashedPassword, err := loadPasswordHashers().Hash(newPassword)
+	if err != nil {
+		return fmt.Errorf("hashing password: %w", err)
+	}
+	if err := store.UpdateUserPassword(user.UserID, hashedPassword, newOperatorAuditEvent(AuditUserPasswordChanged, "user", user.UserID)); err != nil {
+		return err
+	}
+	// whoever had the old password must not stay signed in
+	if err := store.RevokeUserSessions(user.UserID, ""); err != nil {
+		return err
+	}
+
+	if *password == "" {
+		fmt.Fprintf(c.stdout, "New password of %s: %s\n", user.Email, newPassword)
+	} else {
+		fmt.Fprintf(c.stdout, "Password of %s was reset\n", user.Email)
+	}
+	return nil
+}
+
+func (c *cli) adminPromoteOwner(args []string) error {
+	fs := c.flags("admin promote-owner", false)
+	orgID := fs.String("org", "", "ID of the organisation")
+	userID := fs.String("user", "", "ID of the member to make an owner")
+	if err := c.parse(fs, args, "org", "user"); err != nil {
+		return err
+	}
+	if _, err := uuid.Parse(*orgID); err != nil {
+		return fmt.Errorf("invalid organisation ID %q", *orgID)
+	}
+	if _, err := uuid.Parse(*userID); err != nil {
+		return fmt.Errorf("invalid user ID %q", *userID)
+	}
+
+	store, db := adminStore()
+	defer db.Close()
+
+	ev := newOperatorAuditEvent(AuditMemberRoleChanged, "user", *userID)
+	ev.OrgID = *orgID
+	updated, err := store.SetMemberRole(*orgID, *userID, RoleOwner, ev)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return fmt.Errorf("user %s is not a member of organisation %s", *userID, *orgID)
+	}
+	fmt.Fprintf(c.stdout, "%s is now an owner of %s\n", *userID, *orgID)
+	return nil
+}
+
+func (c *cli) adminListOrgs(args []string) error {
+	if err := c.parse(c.flags("admin list-orgs", true), args); err != nil {
+		return err
+	}
+
+	store, db := adminStore()
+	defer db.Close()
+
+	orgs, err := store.GetAllOrgs()
+	if err != nil {
+		return err
+	}
+	if orgs == nil {
+		orgs = []*Org{}
+	}
+	return c.print(orgs, orgHeader, orgRows(orgs))
+}
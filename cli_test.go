@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+func runTestCLI(t *testing.T, stdin string, args ...string) (string, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := runCLI(args, strings.NewReader(stdin), &stdout, &stderr)
+	if code != 0 {
+		t.Logf("uzorg %s: %s", strings.Join(args, " "), stderr.String())
+	}
+	return stdout.String(), code
+}
+
+func TestCLILoginAndOrgs(t *testing.T) {
+	_, server := newClientTestServer(t)
+	t.Setenv("UZORG_CONFIG", filepath.Join(t.TempDir(), "config.json"))
+	t.Setenv("UZORG_PASSWORD", "")
+
+	registerTestUser(t, client.New(server.URL), "Lin", "lin@example.com")
+
+	if _, code := runTestCLI(t, "", "orgs", "list"); code != 1 {
+		t.Errorf("orgs list before logging in exited with %d, want 1", code)
+	}
+
+	// the password is read from stdin when it is not a terminal
+	out, code := runTestCLI(t, "correct horse battery\n", "login", "-server", server.URL, "-email", "lin@example.com")
+	if code != 0 {
+		t.Fatalf("login exited with %d", code)
+	}
+	if !strings.Contains(out, "lin@example.com") {
+		t.Errorf("got login output %q", out)
+	}
+
+	cfg, err := loadCLIConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Token == "" || cfg.Server != server.URL {
+		t.Fatalf("got config %+v, want the server and a token", cfg)
+	}
+
+	if _, code := runTestCLI(t, "", "orgs", "create", "-name", "Lovelace Labs", "-description", "Engines"); code != 0 {
+		t.Fatalf("orgs create exited with %d", code)
+	}
+
+	out, code = runTestCLI(t, "", "orgs", "list", "-o", "json")
+	if code != 0 {
+		t.Fatalf("orgs list exited with %d", code)
+	}
+	var orgs []*client.Org
+	if err := json.Unmarshal([]byte(out), &orgs); err != nil {
+		t.Fatalf("decoding %q: %v", out, err)
+	}
+	if len(orgs) != 2 {
+		t.Errorf("got %d orgs, want the default one and the created one", len(orgs))
+	}
+
+	out, code = runTestCLI(t, "", "orgs", "list")
+	if code != 0 || !strings.HasPrefix(out, "ID ") || !strings.Contains(out, "Lovelace Labs") {
+		t.Errorf("got table %q", out)
+	}
+
+	members, err := client.New(server.URL, client.WithToken(cfg.Token)).GetOrgUsers(context.Background(), orgs[0].OrgID)
+	if err != nil || len(members) != 1 {
+		t.Errorf("got members %v, %v", members, err)
+	}
+
+	if _, code := runTestCLI(t, "", "logout"); code != 0 {
+		t.Fatalf("logout exited with %d", code)
+	}
+	if _, code := runTestCLI(t, "", "orgs", "list"); code != 1 {
+		t.Errorf("orgs list after logging out exited with %d, want 1", code)
+	}
+}
+
+func TestCLIUsageErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"frobnicate"},
+		{"orgs"},
+		{"orgs", "delete"},
+		{"orgs", "create"},
+		{"orgs", "list", "-o", "yaml"},
+	} {
+		if _, code := runTestCLI(t, "", args...); code != 2 {
+			t.Errorf("uzorg %s exited with %d, want 2", strings.Join(args, " "), code)
+		}
+	}
+}
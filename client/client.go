@@ -0,0 +1,286 @@
+// Package client is a Go client for the uzorg API.
+//
+// A Client logs in once and sends the access token with every call. Tokens expire and sessions
+// can be revoked, so when a call is rejected as unauthorized the client logs in again with the
+// credentials it was last logged in with and retries the call once.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrNotLoggedIn is returned by calls that need a token on clients that have none
+var ErrNotLoggedIn = errors.New("uzorg: client is not logged in")
+
+// Client calls the uzorg API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	token string
+	// remembered to log in again when the token is rejected
+	email    string
+	password string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client requests are sent with
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithToken authenticates with an existing access token or API key instead of logging in.
+// Such clients can not log in again when the token is rejected.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New returns a client of the uzorg server at baseURL, e.g. https://uzorg.example.com
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Token returns the access token the client currently authenticates with
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// Register creates a user with their default organisation and logs the client in as them
+func (c *Client) Register(ctx context.Context, req RegisterRequest) (*User, error) {
+	var data userData
+	if err := c.do(ctx, http.MethodPost, "/api/v1/auth/register", req, &data, false); err != nil {
+		return nil, err
+	}
+	c.setCredentials(data.Token, req.Email, req.Password)
+	return data.User, nil
+}
+
+// Login logs the client in with email and password
+func (c *Client) Login(ctx context.Context, email, password string) (*User, error) {
+	var data userData
+	err := c.do(ctx, http.MethodPost, "/api/v1/auth/login", map[string]string{
+		"email":    email,
+		"password": password,
+	}, &data, false)
+	if err != nil {
+		return nil, err
+	}
+	c.setCredentials(data.Token, email, password)
+	return data.User, nil
+}
+
+// GetUser retrieves a user. Users other than the logged in one only have their ID and name filled in.
+func (c *Client) GetUser(ctx context.Context, userID string) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodGet, "/api/v1/users/"+url.PathEscape(userID), nil, &user, true); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateOrg creates an organisation owned by the logged in user
+func (c *Client) CreateOrg(ctx context.Context, req CreateOrgRequest) (*Org, error) {
+	var org Org
+	if err := c.do(ctx, http.MethodPost, "/api/v1/organisations", req, &org, true); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// GetOrgs lists the organisations of the logged in user
+func (c *Client) GetOrgs(ctx context.Context) ([]*Org, error) {
+	var data organisations
+	if err := c.do(ctx, http.MethodGet, "/api/v1/organisations", nil, &data, true); err != nil {
+		return nil, err
+	}
+	return data.Orgs, nil
+}
+
+// GetOrg retrieves an organisation of the logged in user
+func (c *Client) GetOrg(ctx context.Context, orgID string) (*Org, error) {
+	var org Org
+	if err := c.do(ctx, http.MethodGet, "/api/v1/organisations/"+url.PathEscape(orgID), nil, &org, true); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// GetOrgUsers lists the members of an organisation with their roles
+func (c *Client) GetOrgUsers(ctx context.Context, orgID string) ([]*User, error) {
+	var users []*User
+	if err := c.do(ctx, http.MethodGet, "/api/v1/organisations/"+url.PathEscape(orgID)+"/users", nil, &users, true); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// AddUserToOrg adds a user to an organisation of the logged in user
+func (c *Client) AddUserToOrg(ctx context.Context, orgID, userID string) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/organisations/"+url.PathEscape(orgID)+"/users", map[string]string{
+		"userId": userID,
+	}, nil, true)
+}
+
+// AddUsersToOrg adds the users named by ID or email to an organisation of the logged in user in
+// one request, and returns the outcome for each user: the user IDs first, then the emails. Only
+// owners and admins of the organisation can name users by email.
+func (c *Client) AddUsersToOrg(ctx context.Context, orgID string, userIDs, emails []string) ([]*MemberResult, error) {
+	return c.batchMembers(ctx, orgID, "users:batch", userIDs, emails)
+}
+
+// RemoveUsersFromOrg removes the members named by ID or email from an organisation in one
+// request, and returns the outcome for each user: the user IDs first, then the emails.
+func (c *Client) RemoveUsersFromOrg(ctx context.Context, orgID string, userIDs, emails []string) ([]*MemberResult, error) {
+	return c.batchMembers(ctx, orgID, "users:batchRemove", userIDs, emails)
+}
+
+func (c *Client) batchMembers(ctx context.Context, orgID, action string, userIDs, emails []string) ([]*MemberResult, error) {
+	var results []*MemberResult
+	err := c.do(ctx, http.MethodPost, "/api/v1/organisations/"+url.PathEscape(orgID)+"/"+action, map[string][]string{
+		"userIds": userIDs,
+		"emails":  emails,
+	}, &results, true)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (c *Client) setCredentials(token, email, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+	c.email = email
+	c.password = password
+}
+
+// relogin logs in again with the remembered credentials unless another call already replaced
+// the rejected token. It reports whether there is a new token to retry with.
+func (c *Client) relogin(ctx context.Context, rejected string) (bool, error) {
+	c.mu.Lock()
+	token, email, password := c.token, c.email, c.password
+	c.mu.Unlock()
+
+	if token != rejected {
+		return true, nil
+	}
+	if email == "" {
+		return false, nil
+	}
+	_, err := c.Login(ctx, email, password)
+	return err == nil, err
+}
+
+// do sends a request with body encoded as JSON and decodes the data of the response into out.
+// Calls with authed send the access token and log in again once if the server rejects the token.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}, authed bool) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	token := c.Token()
+	if authed && token == "" {
+		return ErrNotLoggedIn
+	}
+	err := c.send(ctx, method, path, payload, out, authed, token)
+	if !authed || !isTokenRejected(err) {
+		return err
+	}
+
+	retry, loginErr := c.relogin(ctx, token)
+	if loginErr != nil {
+		return fmt.Errorf("logging in again: %w", loginErr)
+	}
+	if !retry {
+		return err
+	}
+	return c.send(ctx, method, path, payload, out, authed, c.Token())
+}
+
+func (c *Client) send(ctx context.Context, method, path string, payload []byte, out interface{}, authed bool, token string) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if authed && token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		return decodeError(resp.StatusCode, raw)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, &envelope{Data: out}); err != nil {
+		return fmt.Errorf("uzorg: decoding response: %w", err)
+	}
+	return nil
+}
+
+// decodeError maps the error envelopes of the server to typed errors. Errors raised before
+// a request reaches its handler, like rejected tokens, have a plain text body.
+func decodeError(statusCode int, raw []byte) error {
+	if statusCode == http.StatusUnprocessableEntity {
+		var verr ValidationError
+		if err := json.Unmarshal(raw, &verr); err == nil && len(verr.Errors) > 0 {
+			return &verr
+		}
+	}
+
+	apiErr := &APIError{}
+	if err := json.Unmarshal(raw, apiErr); err != nil {
+		apiErr.Message = strings.TrimSpace(string(raw))
+	}
+	apiErr.StatusCode = statusCode
+	return apiErr
+}
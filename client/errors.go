@@ -0,0 +1,76 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIError is returned when the server answers with an error status. It carries the fields of
+// the server's ErrorResponse and, for 403 responses, the scopes the credential is missing.
+type APIError struct {
+	StatusCode    int      `json:"statusCode"`
+	Status        string   `json:"status"`
+	Message       string   `json:"message"`
+	MissingScopes []string `json:"missingScopes,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("uzorg: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("uzorg: %d %s", e.StatusCode, e.Message)
+}
+
+// FieldError is a field of a request that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when the server rejects the fields of a request with 422
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, f := range e.Errors {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "uzorg: validation failed: " + strings.Join(msgs, "; ")
+}
+
+// IsNotFound reports whether err is an API error with status 404
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsUnauthorized reports whether err is an API error with status 401
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+// IsForbidden reports whether err is an API error with status 403
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+// IsConflict reports whether err is an API error with status 409
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+// isTokenRejected reports whether err is the plain text 401 the server answers when it rejects the
+// access token itself. Handlers that deny the caller access to a resource answer 401 with a JSON
+// error instead, which logging in again would not change.
+func isTokenRejected(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized && apiErr.Status == ""
+}
+
+func hasStatus(err error, status int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
@@ -0,0 +1,70 @@
+package client
+
+// User is a user of uzorg. Other members of a user's organisations only see their
+// ID and name; Email and Phone are empty for them.
+type User struct {
+	UserID    string `json:"userId"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+	Version   int    `json:"version"`
+	// Role is the user's role in an organisation when listed as one of its members
+	Role string `json:"role,omitempty"`
+}
+
+// Org is an organisation users belong to
+type Org struct {
+	OrgID       string `json:"orgId"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Version     int    `json:"version"`
+}
+
+// Outcomes of the users of batch membership requests
+const (
+	MemberAdded         = "added"
+	MemberAlreadyMember = "already_member"
+	MemberNotFound      = "not_found"
+	MemberRemoved       = "removed"
+	MemberNotMember     = "not_member"
+	// owners are only removed by transferring ownership first
+	MemberOwner = "owner"
+)
+
+// MemberResult is the outcome for one user of a batch membership request. UserID is set for
+// users named by email when they were found.
+type MemberResult struct {
+	UserID string `json:"userId,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Status string `json:"status"`
+}
+
+type RegisterRequest struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	Phone     string `json:"phone"`
+}
+
+type CreateOrgRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// envelope is the body of successful responses
+type envelope struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+type userData struct {
+	Token string `json:"accessToken"`
+	User  *User  `json:"user"`
+}
+
+type organisations struct {
+	Orgs []*Org `json:"organisations"`
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+// memoryStore keeps the users, organisations and sessions the client tests need in memory.
+// Calls to the other methods of UzorgStorer panic on the nil embedded interface.
+type memoryStore struct {
+	UzorgStorer
+
+	mu       sync.Mutex
+	users    map[string]*User
+	orgs     map[string]*Org
+	members  map[string]map[string]string // orgID -> userID -> role
+	sessions map[string]*Session
+	// keyed by user ID and key
+	idempotencyKeys map[string]*IdempotencyKey
+	// keyed by token hash
+	scimTokens map[string]*SCIMToken
+	apiKeys    map[string]*APIKey
+	// appended to by the tests, not by the store methods
+	auditEvents []*AuditEvent
+	webhooks    map[string]*Webhook
+	// in the order they were queued
+	webhookDeliveries []*WebhookDelivery
+	outbox            []*queuedOutboxEvent
+	// keyed by state
+	oidcStates   map[string]*OIDCLoginState
+	oauthClients map[string]*OAuthClient
+	// granted scopes keyed by user and client ID
+	oauthConsents map[string][]string
+	// keyed by code hash
+	oauthCodes  map[string]*OAuthCode
+	dataExports map[string]*storedDataExport
+	// pending email changes keyed by token hash
+	emailChanges map[string]*EmailChange
+	// user IDs keyed by issuer and subject
+	identities map[string]string
+	// returned by GetUserByIdentity when set
+	identityErr error
+	// counts the calls of the batched loaders
+	batchLoads int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:    map[string]*User{},
+		orgs:     map[string]*Org{},
+		members:  map[string]map[string]string{},
+		sessions: map[string]*Session{},
+
+		idempotencyKeys: map[string]*IdempotencyKey{},
+		scimTokens:      map[string]*SCIMToken{},
+		apiKeys:         map[string]*APIKey{},
+		emailChanges:    map[string]*EmailChange{},
+		webhooks:        map[string]*Webhook{},
+		oidcStates:      map[string]*OIDCLoginState{},
+		oauthClients:    map[string]*OAuthClient{},
+		oauthConsents:   map[string][]string{},
+		oauthCodes:      map[string]*OAuthCode{},
+		dataExports:     map[string]*storedDataExport{},
+		identities:      map[string]string{},
+	}
+}
+
+func (s *memoryStore) addMember(orgID, userID, role string) {
+	if s.members[orgID] == nil {
+		s.members[orgID] = map[string]string{}
+	}
+	s.members[orgID][userID] = role
+}
+
+func (s *memoryStore) InsertUserAndDefaultOrg(u *User, o *Org, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u.Version, o.Version = 1, 1
+	user, org := *u, *o
+	s.users[u.UserID] = &user
+	s.orgs[o.OrgID] = &org
+	s.addMember(o.OrgID, u.UserID, RoleOwner)
+	return nil
+}
+
+func (s *memoryStore) InsertOrgAndAddUser(o *Org, userID string, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o.Version = 1
+	org := *o
+	s.orgs[o.OrgID] = &org
+	s.addMember(o.OrgID, userID, RoleOwner)
+	return nil
+}
+
+func (s *memoryStore) AddUserToOrg(userID, orgID string, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addMember(orgID, userID, RoleMember)
+	return nil
+}
+
+func (s *memoryStore) GetUserByEmail(email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			return *u, nil
+		}
+	}
+	return User{}, sql.ErrNoRows
+}
+
+func (s *memoryStore) GetUserByID(userID string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return *u, nil
+}
+
+func (s *memoryStore) UpdateUserPassword(userID, hashedPassword string, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[userID].Password = hashedPassword
+	return nil
+}
+
+func (s *memoryStore) GetOrg(orgID string) (Org, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orgs[orgID]
+	if !ok {
+		return Org{}, sql.ErrNoRows
+	}
+	return *o, nil
+}
+
+func (s *memoryStore) GetUserOrgs(userID string) ([]*Org, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var orgs []*Org
+	for orgID, members := range s.members {
+		if _, ok := members[userID]; ok {
+			org := *s.orgs[orgID]
+			orgs = append(orgs, &org)
+		}
+	}
+	return orgs, nil
+}
+
+func (s *memoryStore) GetOrgUsers(orgID string) ([]*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var users []*User
+	for userID, role := range s.members[orgID] {
+		user := *s.users[userID]
+		user.Role = role
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+func (s *memoryStore) UserBelongsToOrg(userID, orgID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.members[orgID][userID]
+	return ok, nil
+}
+
+func (s *memoryStore) UsersShareOrg(userID, otherUserID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, members := range s.members {
+		_, a := members[userID]
+		_, b := members[otherUserID]
+		if a && b {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) InsertSession(session *Session, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *session
+	stored.CreatedAt, stored.LastSeenAt = time.Now(), time.Now()
+	s.sessions[session.SessionID] = &stored
+	return nil
+}
+
+func (s *memoryStore) TouchSession(sessionID string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return Session{}, sql.ErrNoRows
+	}
+	session.LastSeenAt = time.Now()
+	return *session, nil
+}
+
+// revokeAll ends every session, like a user signing out everywhere
+func (s *memoryStore) revokeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]*Session{}
+}
+
+// newTestHandler returns a handler over an in-memory store for tests that configure it further
+func newTestHandler(t *testing.T) (*memoryStore, *ReqHandler) {
+	t.Helper()
+	t.Setenv("UZORG_JWT_SECRET", "client-test-secret")
+
+	store := newMemoryStore()
+	h := &ReqHandler{
+		uzorgStore: store,
+		passwords: &PasswordHashers{
+			// cheap parameters keep the tests fast
+			Preferred: &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		},
+		passwordPolicy: &PasswordPolicy{MinLength: 8},
+		mailer:         LogMailer{},
+	}
+	return store, h
+}
+
+func newClientTestServer(t *testing.T) (*memoryStore, *httptest.Server) {
+	t.Helper()
+	store, h := newTestHandler(t)
+	server := httptest.NewServer(newRouter(h))
+	t.Cleanup(server.Close)
+	return store, server
+}
+
+func registerTestUser(t *testing.T, c *client.Client, first, email string) *client.User {
+	t.Helper()
+	user, err := c.Register(context.Background(), client.RegisterRequest{
+		FirstName: first,
+		LastName:  "Tester",
+		Email:     email,
+		Password:  "correct horse battery",
+		Phone:     "+2348012345678",
+	})
+	if err != nil {
+		t.Fatalf("registering %s: %v", email, err)
+	}
+	return user
+}
+
+// doTestRequest sends a request with a bearer token and decodes its JSON response into out
+// when out is not nil
+func doTestRequest(t *testing.T, method, url, token, body string, out interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decoding %s %s: %v", method, url, err)
+		}
+	}
+	return resp
+}
+
+func TestClientOrganisations(t *testing.T) {
+	_, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	ada := client.New(server.URL)
+	adaUser := registerTestUser(t, ada, "Ada", "ada@example.com")
+
+	bob := client.New(server.URL)
+	bobUser := registerTestUser(t, bob, "Bob", "bob@example.com")
+
+	org, err := ada.CreateOrg(ctx, client.CreateOrgRequest{Name: "Analytical Engines", Description: "Difference and more"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ada.GetOrg(ctx, org.OrgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Analytical Engines" {
+		t.Errorf("got org name %q, want Analytical Engines", got.Name)
+	}
+
+	orgs, err := ada.GetOrgs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 2 {
+		t.Errorf("got %d orgs, want the default one and the created one", len(orgs))
+	}
+
+	if err := ada.AddUserToOrg(ctx, org.OrgID, bobUser.UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := ada.GetOrgUsers(ctx, org.OrgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := map[string]string{}
+	for _, m := range members {
+		roles[m.UserID] = m.Role
+	}
+	if roles[adaUser.UserID] != RoleOwner || roles[bobUser.UserID] != RoleMember {
+		t.Errorf("got member roles %v", roles)
+	}
+
+	// members see each other's public profile only
+	profile, err := bob.GetUser(ctx, adaUser.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.FirstName != "Ada" || profile.Email != "" {
+		t.Errorf("got profile %+v, want name without email", profile)
+	}
+
+	me, err := bob.GetUser(ctx, bobUser.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if me.Email != "bob@example.com" {
+		t.Errorf("got own email %q, want bob@example.com", me.Email)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	_, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	c := client.New(server.URL)
+
+	_, err := c.GetOrgs(ctx)
+	if !errors.Is(err, client.ErrNotLoggedIn) {
+		t.Errorf("got %v before logging in, want ErrNotLoggedIn", err)
+	}
+
+	_, err = c.Register(ctx, client.RegisterRequest{FirstName: "Eve", Email: "not-an-email"})
+	var verr *client.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got %v for an invalid registration, want a ValidationError", err)
+	}
+	fields := map[string]bool{}
+	for _, f := range verr.Errors {
+		fields[f.Field] = true
+	}
+	if !fields["RegisterUserRequest.Email"] {
+		t.Errorf("got validation errors %v, want one for the email", verr.Errors)
+	}
+
+	_, err = c.Login(ctx, "nobody@example.com", "whatever")
+	if !client.IsUnauthorized(err) {
+		t.Errorf("got %v for unknown credentials, want unauthorized", err)
+	}
+
+	registerTestUser(t, c, "Eve", "eve@example.com")
+
+	_, err = c.GetUser(ctx, "not-a-uuid")
+	if !client.IsNotFound(err) {
+		t.Errorf("got %v for an unknown user, want not found", err)
+	}
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) && apiErr.Message != "User not found" {
+		t.Errorf("got message %q, want the message of the server", apiErr.Message)
+	}
+
+	// rejected tokens of clients without credentials are reported as is
+	stale := client.New(server.URL, client.WithToken("not-a-jwt"))
+	_, err = stale.GetOrgs(ctx)
+	if !client.IsUnauthorized(err) {
+		t.Errorf("got %v for an invalid token, want unauthorized", err)
+	}
+}
+
+func TestClientLogsInAgainWhenSessionEnds(t *testing.T) {
+	store, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	c := client.New(server.URL)
+	registerTestUser(t, c, "Grace", "grace@example.com")
+	token := c.Token()
+
+	store.revokeAll()
+
+	orgs, err := c.GetOrgs(ctx)
+	if err != nil {
+		t.Fatalf("got %v after the session was revoked, want the call to succeed after logging in again", err)
+	}
+	if len(orgs) != 1 {
+		t.Errorf("got %d orgs, want the default one", len(orgs))
+	}
+	if c.Token() == token {
+		t.Error("the client kept the rejected token")
+	}
+}
+
+func TestClientKeepsSessionWhenAccessIsDenied(t *testing.T) {
+	store, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	owner := client.New(server.URL)
+	registerTestUser(t, owner, "Ada", "ada@example.com")
+	org, err := owner.CreateOrg(ctx, client.CreateOrgRequest{Name: "Private", Description: "Members only"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client.New(server.URL)
+	registerTestUser(t, c, "Mallory", "mallory@example.com")
+	token := c.Token()
+	sessions := func() int {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.sessions)
+	}
+	before := sessions()
+
+	// a non-member is denied with a JSON 401 that logging in again would not change
+	_, err = c.GetOrg(ctx, org.OrgID)
+	if !client.IsUnauthorized(err) {
+		t.Fatalf("got %v for the org of others, want unauthorized", err)
+	}
+	if got := sessions(); got != before {
+		t.Errorf("got %d sessions after being denied access, want %d", got, before)
+	}
+	if c.Token() != token {
+		t.Error("the client logged in again after being denied access")
+	}
+}
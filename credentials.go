@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// how long the link confirming an email change stays valid
+const emailChangeTTL = 24 * time.Hour
+
+// handler for POST /api/users/me/password that changes the logged in user's password.
+// The current password is required, and every other session is signed out.
+func (h *ReqHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	// retrieve userId and sessionId from context claim
+	userID := r.Context().Value("userId").(string)
+	sessionID, _ := r.Context().Value("sessionId").(string)
+
+	user, err := h.uzorgStore.GetUserByID(userID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+
+	errs := req.Validate()
+	if req.NewPassword != "" {
+		errs = append(errs, h.passwordPolicy.Check("ChangePasswordRequest.NewPassword", req.NewPassword, user.Email, user.FirstName, user.LastName)...)
+	}
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	ok, _, err := h.passwords.Verify(req.CurrentPassword, user.Password)
+	if err != nil || !ok {
+		log.Println("Error comparing password: ", err)
+		writeBadRequestResponse(w, http.StatusUnauthorized, "Current password is incorrect")
+		return
+	}
+
+	hashedPassword, err := h.passwords.Hash(req.NewPassword)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error hashing password: %v", err))
+		return
+	}
+
+	err = h.uzorgStore.UpdateUserPassword(userID, hashedPassword, newAuditEvent(r, AuditUserPasswordChanged, "user", userID))
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error updating password: %v", err))
+		return
+	}
+
+	err = h.uzorgStore.RevokeUserSessions(userID, sessionID)
+	if err != nil {
+		log.Println("Error revoking sessions after password change: ", err)
+	}
+
+	response := ResponseStatus{
+		Status:  SuccessStatus,
+		Message: "Password changed successfully",
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for POST /api/users/me/email that starts changing the logged in user's email.
+// A confirmation link is sent to the new address and a notice to the old one; the email
+// only changes once the link is followed.
+func (h *ReqHandler) RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ChangeEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	user, err := h.uzorgStore.GetUserByID(userID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+
+	ok, _, err := h.passwords.Verify(req.Password, user.Password)
+	if err != nil || !ok {
+		log.Println("Error comparing password: ", err)
+		writeBadRequestResponse(w, http.StatusUnauthorized, "Password is incorrect")
+		return
+	}
+
+	// the unique constraint is checked again when the change is confirmed
+	_, err = h.uzorgStore.GetUserByEmail(req.NewEmail)
+	if err == nil {
+		writeBadRequestResponse(w, http.StatusConflict, "User with email already exists")
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error generating token: %v", err))
+		return
+	}
+
+	err = h.uzorgStore.InsertEmailChange(&EmailChange{
+		TokenHash: hashAPIKey(token),
+		UserID:    userID,
+		NewEmail:  req.NewEmail,
+		ExpiresAt: time.Now().Add(emailChangeTTL),
+	})
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error saving email change: %v", err))
+		return
+	}
+
+	link := publicURL(apiV1Prefix + "/auth/email/confirm?token=" + url.QueryEscape(token))
+	err = h.mailer.Send(
+		req.NewEmail,
+		"Confirm your new email address",
+		fmt.Sprintf("Hi %s,\n\nFollow this link within 24 hours to confirm your new email address:\n\n%s\n", user.FirstName, link),
+	)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error sending confirmation email: %v", err))
+		return
+	}
+
+	err = h.mailer.Send(
+		user.Email,
+		"Your email address is being changed",
+		fmt.Sprintf("Hi %s,\n\nA request was made to change the email address of your account to %s. If this wasn't you, change your password now.\n", user.FirstName, req.NewEmail),
+	)
+	if err != nil {
+		log.Println("Error sending email change notice: ", err)
+	}
+
+	response := ResponseStatus{
+		Status:  SuccessStatus,
+		Message: "Confirmation email sent to the new address",
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for GET /auth/email/confirm that applies an email change once the link sent to the new address is followed
+func (h *ReqHandler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeBadRequestResponse(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	user, err := h.uzorgStore.ConfirmEmailChange(hashAPIKey(token), newAuditEvent(r, AuditUserEmailChanged, "user", ""))
+	if errors.Is(err, ErrEmailTaken) {
+		writeBadRequestResponse(w, http.StatusConflict, "User with email already exists")
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		writeBadRequestResponse(w, http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error changing email: %v", err))
+		return
+	}
+
+	response := GetUserResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Email changed successfully",
+		},
+		Data: &user,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
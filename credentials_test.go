@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) RevokeUserSessions(userID, exceptSessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.UserID == userID && id != exceptSessionID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) InsertEmailChange(c *EmailChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *c
+	s.emailChanges[c.TokenHash] = &stored
+	return nil
+}
+
+func (s *memoryStore) ConfirmEmailChange(tokenHash string, ev *AuditEvent) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.emailChanges[tokenHash]
+	if !ok || time.Now().After(c.ExpiresAt) {
+		return User{}, ErrNotFound
+	}
+	for _, u := range s.users {
+		if u.Email == c.NewEmail {
+			return User{}, ErrEmailTaken
+		}
+	}
+	delete(s.emailChanges, tokenHash)
+	user := s.users[c.UserID]
+	user.Email = c.NewEmail
+	user.EmailVerified = true
+	user.Version++
+	return *user, nil
+}
+
+type sentEmail struct {
+	to, subject, body string
+}
+
+// recordingMailer keeps the emails sent instead of sending them
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []sentEmail
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, sentEmail{to, subject, body})
+	return nil
+}
+
+// takeAll returns the emails sent since the last call
+func (m *recordingMailer) takeAll() []sentEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := m.sent
+	m.sent = nil
+	return sent
+}
+
+var confirmTokenPattern = regexp.MustCompile(`token=(\S+)`)
+
+func TestConfirmedEmailChange(t *testing.T) {
+	store, h := newTestHandler(t)
+	mailer := &recordingMailer{}
+	h.mailer = mailer
+	server := httptest.NewServer(newRouter(h))
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+
+	c := client.New(server.URL)
+	ada := registerTestUser(t, c, "Ada", "ada@example.com")
+	registerTestUser(t, client.New(server.URL), "Bob", "bob@example.com")
+	changeEmail := func(body string) *http.Response {
+		t.Helper()
+		return doTestRequest(t, http.MethodPost, server.URL+"/api/v1/users/me/email", c.Token(), body, nil)
+	}
+
+	if resp := changeEmail(`{"newEmail":"ada@new.example.com","password":"wrong horse battery"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d with a wrong password, want 401", resp.StatusCode)
+	}
+	if resp := changeEmail(`{"newEmail":"bob@example.com","password":"correct horse battery"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("got status %d for a taken email, want 409", resp.StatusCode)
+	}
+	if resp := changeEmail(`{"newEmail":"not-an-email","password":"correct horse battery"}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an invalid email, want 422", resp.StatusCode)
+	}
+	if sent := mailer.takeAll(); len(sent) != 0 {
+		t.Errorf("got %d emails for rejected changes, want none", len(sent))
+	}
+
+	requestChange := func(oldEmail, newEmail string) string {
+		t.Helper()
+		if resp := changeEmail(`{"newEmail":"` + newEmail + `","password":"correct horse battery"}`); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("got status %d requesting an email change, want 202", resp.StatusCode)
+		}
+		sent := mailer.takeAll()
+		if len(sent) != 2 || sent[0].to != newEmail || sent[1].to != oldEmail {
+			t.Fatalf("got emails %+v, want a confirmation to the new address and a notice to the old one", sent)
+		}
+		m := confirmTokenPattern.FindStringSubmatch(sent[0].body)
+		if m == nil {
+			t.Fatalf("got confirmation %q without a token", sent[0].body)
+		}
+		token, _ := url.QueryUnescape(m[1])
+		return token
+	}
+	confirm := func(token string) (*http.Response, GetUserResponse) {
+		t.Helper()
+		var body GetUserResponse
+		resp := doTestRequest(t, http.MethodGet, server.URL+"/api/v1/auth/email/confirm?token="+url.QueryEscape(token), "", "", &body)
+		return resp, body
+	}
+
+	token := requestChange("ada@example.com", "ada@new.example.com")
+	if u, _ := store.GetUserByID(ada.UserID); u.Email != "ada@example.com" {
+		t.Errorf("got email %q before confirming, want it unchanged", u.Email)
+	}
+	if resp, _ := confirm("not-the-token"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for an unknown token, want 400", resp.StatusCode)
+	}
+	resp, body := confirm(token)
+	if resp.StatusCode != http.StatusOK || body.Data == nil || body.Data.Email != "ada@new.example.com" {
+		t.Fatalf("got status %d, %+v confirming, want the new email", resp.StatusCode, body.Data)
+	}
+	if resp, _ := confirm(token); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d confirming twice, want 400", resp.StatusCode)
+	}
+	if _, err := client.New(server.URL).Login(ctx, "ada@new.example.com", "correct horse battery"); err != nil {
+		t.Errorf("got %v logging in with the new email", err)
+	}
+	if _, err := client.New(server.URL).Login(ctx, "ada@example.com", "correct horse battery"); !client.IsUnauthorized(err) {
+		t.Errorf("got %v logging in with the old email, want unauthorized", err)
+	}
+
+	// the address is checked again on confirmation since it may have been taken since
+	token = requestChange("ada@new.example.com", "ada@other.example.com")
+	registerTestUser(t, client.New(server.URL), "Other", "ada@other.example.com")
+	if resp, _ := confirm(token); resp.StatusCode != http.StatusConflict {
+		t.Errorf("got status %d confirming a taken email, want 409", resp.StatusCode)
+	}
+
+	token = requestChange("ada@new.example.com", "ada@late.example.com")
+	store.mu.Lock()
+	store.emailChanges[hashAPIKey(token)].ExpiresAt = time.Now().Add(-time.Minute)
+	store.mu.Unlock()
+	if resp, _ := confirm(token); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for an expired token, want 400", resp.StatusCode)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	_, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	c := client.New(server.URL)
+	registerTestUser(t, c, "Ada", "ada@example.com")
+	elsewhere := client.New(server.URL)
+	if _, err := elsewhere.Login(ctx, "ada@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	changePassword := func(body string) *http.Response {
+		t.Helper()
+		return doTestRequest(t, http.MethodPost, server.URL+"/api/v1/users/me/password", c.Token(), body, nil)
+	}
+
+	if resp := changePassword(`{"currentPassword":"wrong horse battery","newPassword":"a new passphrase"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d with a wrong current password, want 401", resp.StatusCode)
+	}
+	if resp := changePassword(`{"currentPassword":"correct horse battery","newPassword":"short"}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for a password breaking the policy, want 422", resp.StatusCode)
+	}
+	if resp := changePassword(`{"currentPassword":"correct horse battery","newPassword":"a new passphrase"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d changing the password, want 200", resp.StatusCode)
+	}
+
+	if _, err := c.GetOrgs(ctx); err != nil {
+		t.Errorf("got %v in the session that changed the password, want it kept", err)
+	}
+	if resp := doTestRequest(t, http.MethodGet, server.URL+"/api/v1/organisations", elsewhere.Token(), "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d in another session, want it revoked", resp.StatusCode)
+	}
+	if _, err := client.New(server.URL).Login(ctx, "ada@example.com", "a new passphrase"); err != nil {
+		t.Errorf("got %v logging in with the new password", err)
+	}
+}
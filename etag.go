@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// entityTag is the strong ETag of a resource at version. Resources served in several
+// representations, like the public and the private profile of a user, pass the name of the
+// one served as variant so each representation has its own tag.
+func entityTag(version int, variant string) string {
+	if variant != "" {
+		return fmt.Sprintf(`"v%d-%s"`, version, variant)
+	}
+	return fmt.Sprintf(`"v%d"`, version)
+}
+
+// etagListMatches reports whether the ETag list of an If-Match or If-None-Match header
+// holds etag. Weak comparison (RFC 9110 8.8.3.2) ignores the W/ prefix of weak tags, strong
+// comparison never matches them.
+func etagListMatches(list, etag string, weak bool) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag of a response and answers 304 Not Modified when the client
+// already holds that representation. It reports whether the response was written.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" || !etagListMatches(inm, etag, true) {
+		return false
+	}
+
+	// a 304 has no body to describe
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// requireIfMatch checks that a request changing a resource was made against its current
+// version. Requests without If-Match are answered with 428 Precondition Required so lost
+// updates cannot happen by omission, and those for another version with 412 Precondition
+// Failed. It reports whether the request may go ahead.
+func requireIfMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		writeBadRequestResponse(w, http.StatusPreconditionRequired, "If-Match header with the ETag of the resource is required")
+		return false
+	}
+	if !etagListMatches(im, etag, false) {
+		writeBadRequestResponse(w, http.StatusPreconditionFailed, "Resource was modified, fetch it again and retry")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) GetMemberRole(orgID, userID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	role, ok := s.members[orgID][userID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return role, nil
+}
+
+func (s *memoryStore) UpdateUser(u *User, expectedVersion int, ev *AuditEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users[u.UserID].Version != expectedVersion {
+		return false, nil
+	}
+	u.Version = expectedVersion + 1
+	user := *u
+	s.users[u.UserID] = &user
+	return true, nil
+}
+
+func (s *memoryStore) DeleteOrg(orgID string, expectedVersion int, ev *AuditEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.orgs[orgID].Version != expectedVersion {
+		return false, nil
+	}
+	delete(s.orgs, orgID)
+	delete(s.members, orgID)
+	return true, nil
+}
+
+func TestETagListMatches(t *testing.T) {
+	tests := []struct {
+		list  string
+		weak  bool
+		match bool
+	}{
+		{`"v2"`, false, true},
+		{`"v1", "v2"`, false, true},
+		{`*`, false, true},
+		{`"v1"`, true, false},
+		{`W/"v2"`, false, false},
+		{`W/"v2"`, true, true},
+		{`"v2-public"`, true, false},
+	}
+	for _, tt := range tests {
+		if got := etagListMatches(tt.list, `"v2"`, tt.weak); got != tt.match {
+			t.Errorf("etagListMatches(%s, weak %v) = %v, want %v", tt.list, tt.weak, got, tt.match)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	store, server := newClientTestServer(t)
+
+	c := client.New(server.URL)
+	user := registerTestUser(t, c, "Etta", "etta@example.com")
+
+	do := func(method, path, body string, header map[string]string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token())
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	userPath := "/api/v1/users/" + user.UserID
+	resp := do("GET", userPath, "", nil)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag != `"v1"` {
+		t.Fatalf("got %d with ETag %s, want 200 with \"v1\"", resp.StatusCode, etag)
+	}
+
+	resp = do("GET", userPath, "", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("got %d for a current ETag, want 304", resp.StatusCode)
+	}
+
+	update := `{"firstName": "Henrietta"}`
+	resp = do("PATCH", userPath, update, nil)
+	if resp.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("got %d for a PATCH without If-Match, want 428", resp.StatusCode)
+	}
+
+	resp = do("PATCH", userPath, update, map[string]string{"If-Match": etag})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"v2"` {
+		t.Errorf("got %d with ETag %s, want 200 with \"v2\"", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if store.users[user.UserID].FirstName != "Henrietta" {
+		t.Error("the user was not updated")
+	}
+
+	resp = do("PATCH", userPath, update, map[string]string{"If-Match": etag})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("got %d for a stale If-Match, want 412", resp.StatusCode)
+	}
+
+	// clients written before ETags send the version in the body instead
+	resp = do("PATCH", userPath, `{"firstName": "Hetty", "version": 1}`, nil)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("got %d for a stale version in the body, want 412", resp.StatusCode)
+	}
+	resp = do("PATCH", userPath, `{"firstName": "Hetty", "version": 2}`, map[string]string{"If-Match": `"v1"`})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("got %d for a current version in the body with a stale If-Match, want 412", resp.StatusCode)
+	}
+	resp = do("PATCH", userPath, `{"firstName": "Hetty", "version": 2}`, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"v3"` {
+		t.Errorf("got %d with ETag %s for the current version in the body, want 200 with \"v3\"", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if store.users[user.UserID].FirstName != "Hetty" {
+		t.Error("the user was not updated with the version in the body")
+	}
+
+	resp = do("GET", userPath, "", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d for a stale ETag, want 200", resp.StatusCode)
+	}
+
+	orgs, err := c.GetOrgs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgPath := "/api/v1/organisations/" + orgs[0].OrgID
+	resp = do("GET", orgPath, "", map[string]string{"If-None-Match": `"v1"`})
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != `"v1"` {
+		t.Errorf("got %d with ETag %s for a current org, want 304 with \"v1\"", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	resp = do("DELETE", orgPath, "", nil)
+	if resp.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("got %d for a DELETE without If-Match, want 428", resp.StatusCode)
+	}
+	resp = do("DELETE", orgPath, "", map[string]string{"If-Match": `"v2"`})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("got %d for a stale If-Match, want 412", resp.StatusCode)
+	}
+	resp = do("DELETE", orgPath, "", map[string]string{"If-Match": `"v1"`})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d for a current If-Match, want 200", resp.StatusCode)
+	}
+}
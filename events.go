@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// outboxChannel is the Postgres notification channel new outbox events are announced on
+const outboxChannel = "outbox_events"
+
+const (
+	// the first retry of an event some subscriber failed waits outboxRetryBase, each one after twice as long
+	outboxRetryBase = 10 * time.Second
+	outboxRetryMax  = time.Hour
+	// how long a claimed event is left to its dispatcher before another one retries it
+	outboxLease = time.Minute
+	// how long dispatched events are kept in the outbox before they are purged
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// EventMeta describes the occurrence of a domain event. It is stored in the columns of the
+// outbox rather than in the payload of the event.
+type EventMeta struct {
+	EventID    string    `json:"-"`
+	OrgID      string    `json:"-"`
+	ActorID    string    `json:"-"`
+	OccurredAt time.Time `json:"-"`
+}
+
+func (m *EventMeta) Meta() *EventMeta {
+	return m
+}
+
+// DomainEvent is something that happened to users or organisations that other parts of the
+// server react to after it is committed
+type DomainEvent interface {
+	EventType() string
+	Meta() *EventMeta
+}
+
+type UserRegistered struct {
+	EventMeta
+	UserID string `json:"userId"`
+	// the default organisation created for the user
+	OrgID string `json:"orgId"`
+}
+
+func (*UserRegistered) EventType() string { return AuditUserRegistered }
+
+type UserDeleted struct {
+	EventMeta
+	UserID string `json:"userId"`
+}
+
+func (*UserDeleted) EventType() string { return AuditUserDeleted }
+
+type OrgCreated struct {
+	EventMeta
+	OrgID     string `json:"orgId"`
+	CreatedBy string `json:"createdBy"`
+}
+
+func (*OrgCreated) EventType() string { return AuditOrgCreated }
+
+type OrgDeleted struct {
+	EventMeta
+	OrgID     string `json:"orgId"`
+	DeletedBy string `json:"deletedBy"`
+}
+
+func (*OrgDeleted) EventType() string { return AuditOrgDeleted }
+
+type OrgOwnershipTransferred struct {
+	EventMeta
+	OrgID      string `json:"orgId"`
+	FromUserID string `json:"fromUserId"`
+	ToUserID   string `json:"toUserId"`
+}
+
+func (*OrgOwnershipTransferred) EventType() string { return AuditOrgOwnerTransferred }
+
+type MemberAdded struct {
+	EventMeta
+	OrgID   string `json:"orgId"`
+	UserID  string `json:"userId"`
+	AddedBy string `json:"addedBy"`
+}
+
+func (*MemberAdded) EventType() string { return AuditMemberAdded }
+
+type MemberRemoved struct {
+	EventMeta
+	OrgID     string `json:"orgId"`
+	UserID    string `json:"userId"`
+	RemovedBy string `json:"removedBy"`
+}
+
+func (*MemberRemoved) EventType() string { return AuditMemberRemoved }
+
+// MemberRoleChanged is raised when the role of a member changes. Receivers look the new role up
+// in the members of the organisation.
+type MemberRoleChanged struct {
+	EventMeta
+	OrgID     string `json:"orgId"`
+	UserID    string `json:"userId"`
+	ChangedBy string `json:"changedBy,omitempty"`
+}
+
+func (*MemberRoleChanged) EventType() string { return AuditMemberRoleChanged }
+
+// domainEventTypes creates an empty event of each type, to decode the payloads of the outbox into
+var domainEventTypes = map[string]func() DomainEvent{
+	AuditUserRegistered:      func() DomainEvent { return &UserRegistered{} },
+	AuditUserDeleted:         func() DomainEvent { return &UserDeleted{} },
+	AuditOrgCreated:          func() DomainEvent { return &OrgCreated{} },
+	AuditOrgDeleted:          func() DomainEvent { return &OrgDeleted{} },
+	AuditOrgOwnerTransferred: func() DomainEvent { return &OrgOwnershipTransferred{} },
+	AuditMemberAdded:         func() DomainEvent { return &MemberAdded{} },
+	AuditMemberRemoved:       func() DomainEvent { return &MemberRemoved{} },
+	AuditMemberRoleChanged:   func() DomainEvent { return &MemberRoleChanged{} },
+}
+
+// domainEventFromAudit returns the domain event raised by an audited change, or nil when other
+// parts of the server have no interest in it
+func domainEventFromAudit(ev *AuditEvent) DomainEvent {
+	// the actors of domain events are users, changes made over SCIM have none
+	actorID := ev.ActorID
+	if ev.ActorType != "" {
+		actorID = ""
+	}
+
+	var e DomainEvent
+	switch ev.Action {
+	case AuditUserRegistered:
+		e = &UserRegistered{UserID: ev.TargetID, OrgID: ev.OrgID}
+	case AuditUserDeleted:
+		e = &UserDeleted{UserID: ev.TargetID}
+	case AuditOrgCreated:
+		e = &OrgCreated{OrgID: ev.OrgID, CreatedBy: actorID}
+	case AuditOrgDeleted:
+		e = &OrgDeleted{OrgID: ev.OrgID, DeletedBy: actorID}
+	case AuditOrgOwnerTransferred:
+		e = &OrgOwnershipTransferred{OrgID: ev.OrgID, FromUserID: actorID, ToUserID: ev.TargetID}
+	case AuditMemberAdded:
+		e = &MemberAdded{OrgID: ev.OrgID, UserID: ev.TargetID, AddedBy: actorID}
+	case AuditMemberRemoved:
+		e = &MemberRemoved{OrgID: ev.OrgID, UserID: ev.TargetID, RemovedBy: actorID}
+	case AuditMemberRoleChanged:
+		e = &MemberRoleChanged{OrgID: ev.OrgID, UserID: ev.TargetID, ChangedBy: actorID}
+	default:
+		return nil
+	}
+	*e.Meta() = EventMeta{
+		EventID:    ev.EventID,
+		OrgID:      ev.OrgID,
+		ActorID:    actorID,
+		OccurredAt: ev.CreatedAt,
+	}
+	return e
+}
+
+// OutboxEvent is a domain event as stored in the outbox
+type OutboxEvent struct {
+	EventID    string
+	Type       string
+	OrgID      string
+	ActorID    string
+	Payload    []byte
+	Attempts   int
+	OccurredAt time.Time
+	// the subscribers that already handled the event
+	Handled []string
+}
+
+// decode returns the typed domain event stored in the outbox
+func (o *OutboxEvent) decode() (DomainEvent, error) {
+	newEvent, ok := domainEventTypes[o.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown domain event type %s", o.Type)
+	}
+	e := newEvent()
+	if err := json.Unmarshal(o.Payload, e); err != nil {
+		return nil, err
+	}
+	*e.Meta() = EventMeta{
+		EventID:    o.EventID,
+		OrgID:      o.OrgID,
+		ActorID:    o.ActorID,
+		OccurredAt: o.OccurredAt,
+	}
+	return e, nil
+}
+
+// EventSubscriber reacts to a domain event. Events are delivered at least once, so
+// subscribers must tolerate receiving the same event again.
+type EventSubscriber func(e DomainEvent) error
+
+type subscription struct {
+	name      string
+	eventType string
+	handle    EventSubscriber
+}
+
+// EventBus delivers the domain events of the outbox to the subscribers registered in process
+type EventBus struct {
+	subscriptions []subscription
+}
+
+// Subscribe registers a subscriber for the events of one type. The name identifies the subscriber
+// in the outbox to avoid handing it an event again once it handled it, so it must not change.
+func (b *EventBus) Subscribe(name, eventType string, handle EventSubscriber) {
+	b.subscriptions = append(b.subscriptions, subscription{name: name, eventType: eventType, handle: handle})
+}
+
+// outboxRetryDelay is how long to wait before retrying an event after a failed attempt
+func outboxRetryDelay(attempts int) time.Duration {
+	delay := outboxRetryBase
+	for i := 1; i < attempts && delay < outboxRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > outboxRetryMax {
+		delay = outboxRetryMax
+	}
+	return delay
+}
+
+// outboxMaxAttempts is how many times an event is dispatched before it is dead lettered.
+// It is configured with UZORG_OUTBOX_MAX_ATTEMPTS.
+func outboxMaxAttempts() int {
+	return envInt("UZORG_OUTBOX_MAX_ATTEMPTS", 12)
+}
+
+// dispatch hands an event of the outbox to each of its subscribers that has not handled it yet,
+// and completes it once all have. Events that some subscriber failed are retried later, until
+// they have been attempted outboxMaxAttempts times.
+func (b *EventBus) dispatch(store UzorgStorer, o *OutboxEvent) error {
+	e, err := o.decode()
+	if err != nil {
+		// events the server no longer knows can never be handled
+		return store.CompleteOutboxEvent(o.EventID, err.Error())
+	}
+
+	handled := map[string]bool{}
+	for _, name := range o.Handled {
+		handled[name] = true
+	}
+
+	var failures []string
+	for _, s := range b.subscriptions {
+		if s.eventType != o.Type || handled[s.name] {
+			continue
+		}
+		if err := s.handle(e); err != nil {
+			log.Printf("Subscriber %s failed to handle event %s: %v", s.name, o.EventID, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", s.name, err))
+			continue
+		}
+		if err := store.MarkOutboxEventHandled(o.EventID, s.name); err != nil {
+			return err
+		}
+	}
+
+	if len(failures) > 0 {
+		msg, _ := json.Marshal(failures)
+		// a nil retry time dead letters the event
+		var retryAt *time.Time
+		if o.Attempts < outboxMaxAttempts() {
+			t := time.Now().Add(outboxRetryDelay(o.Attempts))
+			retryAt = &t
+		}
+		return store.FailOutboxEvent(o.EventID, string(msg), retryAt)
+	}
+	return store.CompleteOutboxEvent(o.EventID, "")
+}
+
+// runOutboxDispatcher delivers the events of the outbox to the subscribers of bus. It waits for
+// notifications from listener and polls every interval in case one was missed; a nil listener
+// only polls.
+func runOutboxDispatcher(store UzorgStorer, bus *EventBus, listener *pq.Listener, interval time.Duration) {
+	var notify <-chan *pq.Notification
+	if listener != nil {
+		notify = listener.Notify
+	}
+
+	for {
+		o, err := store.ClaimOutboxEvent(time.Now().Add(outboxLease))
+		if err == nil {
+			if err := bus.dispatch(store, &o); err != nil {
+				log.Printf("Error dispatching event %s: %v", o.EventID, err)
+			}
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("Error claiming outbox event: ", err)
+		}
+
+		select {
+		case <-notify:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// newOutboxListener listens for the notifications of new outbox events on the database at connectionURL
+func newOutboxListener(connectionURL string) (*pq.Listener, error) {
+	listener := pq.NewListener(connectionURL, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Outbox listener error: ", err)
+		}
+	})
+	if err := listener.Listen(outboxChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// subscribe registers the reactions of the server to domain events
+func (h *ReqHandler) subscribe(bus *EventBus) {
+	for _, eventType := range webhookEvents {
+		bus.Subscribe("webhooks", eventType, h.enqueueWebhooks)
+	}
+	bus.Subscribe("welcome-email", AuditUserRegistered, h.sendWelcomeEmail)
+	bus.Subscribe("member-added-email", AuditMemberAdded, h.sendMemberAddedEmail)
+}
+
+// sendWelcomeEmail welcomes newly registered users
+func (h *ReqHandler) sendWelcomeEmail(e DomainEvent) error {
+	registered := e.(*UserRegistered)
+
+	user, err := h.uzorgStore.GetUserByID(registered.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // purged since
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.mailer.Send(
+		user.Email,
+		"Welcome to Uzorg",
+		fmt.Sprintf("Hi %s,\n\nYour account is ready. Sign in at %s\n", user.FirstName, publicURL("/")),
+	)
+}
+
+// sendMemberAddedEmail tells users they were added to an organisation
+func (h *ReqHandler) sendMemberAddedEmail(e DomainEvent) error {
+	added := e.(*MemberAdded)
+
+	user, err := h.uzorgStore.GetUserByID(added.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // purged since
+	}
+	if err != nil {
+		return err
+	}
+
+	org, err := h.uzorgStore.GetOrg(added.OrgID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // deleted since
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.mailer.Send(
+		user.Email,
+		fmt.Sprintf("You were added to %s", org.Name),
+		fmt.Sprintf("Hi %s,\n\nYou are now a member of the organisation %s.\n", user.FirstName, org.Name),
+	)
+}
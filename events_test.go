@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// queuedOutboxEvent is an event of the outbox of memoryStore with the columns the dispatcher updates
+type queuedOutboxEvent struct {
+	OutboxEvent
+	nextAttemptAt time.Time
+	dispatched    bool
+	dispatchedAt  time.Time
+	dead          bool
+	lastError     string
+}
+
+// queueOutboxEvent adds e to the outbox like insertOutboxEvent
+func (s *memoryStore) queueOutboxEvent(t *testing.T, e DomainEvent) *queuedOutboxEvent {
+	t.Helper()
+	payload, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := e.Meta()
+	q := &queuedOutboxEvent{
+		OutboxEvent: OutboxEvent{
+			EventID:    meta.EventID,
+			Type:       e.EventType(),
+			OrgID:      meta.OrgID,
+			ActorID:    meta.ActorID,
+			Payload:    payload,
+			OccurredAt: meta.OccurredAt,
+		},
+		nextAttemptAt: time.Now(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outbox = append(s.outbox, q)
+	return q
+}
+
+func (s *memoryStore) outboxEvent(eventID string) *queuedOutboxEvent {
+	for _, q := range s.outbox {
+		if q.EventID == eventID {
+			return q
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ClaimOutboxEvent(leaseUntil time.Time) (OutboxEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due *queuedOutboxEvent
+	for _, q := range s.outbox {
+		if !q.dispatched && !q.dead && !q.nextAttemptAt.After(time.Now()) && (due == nil || q.nextAttemptAt.Before(due.nextAttemptAt)) {
+			due = q
+		}
+	}
+	if due == nil {
+		return OutboxEvent{}, sql.ErrNoRows
+	}
+	due.Attempts++
+	due.nextAttemptAt = leaseUntil
+	o := due.OutboxEvent
+	o.Handled = append([]string(nil), due.Handled...)
+	return o, nil
+}
+
+func (s *memoryStore) MarkOutboxEventHandled(eventID, subscriber string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.outboxEvent(eventID)
+	for _, name := range q.Handled {
+		if name == subscriber {
+			return nil
+		}
+	}
+	q.Handled = append(q.Handled, subscriber)
+	return nil
+}
+
+func (s *memoryStore) CompleteOutboxEvent(eventID, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.outboxEvent(eventID)
+	q.dispatched, q.dispatchedAt, q.lastError = true, time.Now(), message
+	return nil
+}
+
+func (s *memoryStore) FailOutboxEvent(eventID, message string, retryAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.outboxEvent(eventID)
+	q.lastError = message
+	if retryAt == nil {
+		q.dead = true
+	} else {
+		q.nextAttemptAt = *retryAt
+	}
+	return nil
+}
+
+func (s *memoryStore) PurgeDispatchedOutboxEvents(dispatchedBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []*queuedOutboxEvent
+	for _, q := range s.outbox {
+		if !q.dispatched || !q.dispatchedAt.Before(dispatchedBefore) {
+			kept = append(kept, q)
+		}
+	}
+	n := int64(len(s.outbox) - len(kept))
+	s.outbox = kept
+	return n, nil
+}
+
+func TestOutboxRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  outboxRetryBase,
+		2:  2 * outboxRetryBase,
+		4:  8 * outboxRetryBase,
+		50: outboxRetryMax,
+	} {
+		if got := outboxRetryDelay(attempts); got != want {
+			t.Errorf("got %v after %d attempts, want %v", got, attempts, want)
+		}
+	}
+}
+
+func TestOutboxDispatch(t *testing.T) {
+	store := newMemoryStore()
+	bus := &EventBus{}
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	failing := true
+	count := func(name string) EventSubscriber {
+		return func(e DomainEvent) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[name]++
+			if name == "flaky" && failing {
+				return errors.New("mail server down")
+			}
+			return nil
+		}
+	}
+	bus.Subscribe("steady", AuditMemberAdded, count("steady"))
+	bus.Subscribe("flaky", AuditMemberAdded, count("flaky"))
+	bus.Subscribe("other", AuditMemberRemoved, count("other"))
+	var got *MemberAdded
+	bus.Subscribe("decoded", AuditMemberAdded, func(e DomainEvent) error {
+		got = e.(*MemberAdded)
+		return nil
+	})
+
+	claimAndDispatch := func() OutboxEvent {
+		t.Helper()
+		o, err := store.ClaimOutboxEvent(time.Now().Add(outboxLease))
+		if err != nil {
+			t.Fatalf("got %v claiming an event, want one due", err)
+		}
+		if err := bus.dispatch(store, &o); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	assertNoneDue := func(when string) {
+		t.Helper()
+		if _, err := store.ClaimOutboxEvent(time.Now().Add(outboxLease)); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("got %v claiming an event %s, want none due", err, when)
+		}
+	}
+
+	added := &MemberAdded{
+		EventMeta: EventMeta{EventID: uuid.New().String(), OrgID: uuid.New().String(), ActorID: uuid.New().String(), OccurredAt: time.Now().Truncate(time.Second)},
+		OrgID:     uuid.New().String(),
+		UserID:    uuid.New().String(),
+		AddedBy:   uuid.New().String(),
+	}
+	queued := store.queueOutboxEvent(t, added)
+
+	claimAndDispatch()
+	if got == nil || got.UserID != added.UserID || got.EventMeta != added.EventMeta {
+		t.Errorf("got event %+v, want %+v", got, added)
+	}
+	if calls["steady"] != 1 || calls["flaky"] != 1 || calls["other"] != 0 {
+		t.Errorf("got calls %v, want the subscribers of member.added called once", calls)
+	}
+	if queued.dispatched || !strings.Contains(queued.lastError, "flaky: mail server down") {
+		t.Errorf("got dispatched %v with error %q after a failed subscriber, want the event kept", queued.dispatched, queued.lastError)
+	}
+	if delay := time.Until(queued.nextAttemptAt); delay < outboxRetryBase-5*time.Second || delay > outboxRetryBase {
+		t.Errorf("got the retry in %v, want it in %v", delay, outboxRetryBase)
+	}
+	assertNoneDue("before the retry is due")
+
+	// the retry only hands the event to the subscribers that did not handle it yet
+	for attempt := 2; attempt <= 3; attempt++ {
+		if attempt == 3 {
+			failing = false
+		}
+		store.mu.Lock()
+		queued.nextAttemptAt = time.Now().Add(-time.Second)
+		store.mu.Unlock()
+		o := claimAndDispatch()
+		if o.Attempts != attempt || len(o.Handled) != 2 {
+			t.Errorf("got attempt %d with handled %v, want attempt %d handled by steady and decoded", o.Attempts, o.Handled, attempt)
+		}
+		if queued.dispatched != (attempt == 3) {
+			t.Errorf("got dispatched %v after attempt %d", queued.dispatched, attempt)
+		}
+	}
+	if calls["steady"] != 1 || calls["flaky"] != 3 {
+		t.Errorf("got calls %v, want steady called once and flaky until it succeeded", calls)
+	}
+	if !queued.dispatched || queued.lastError != "" {
+		t.Errorf("got dispatched %v with error %q, want the event completed", queued.dispatched, queued.lastError)
+	}
+	assertNoneDue("after it was dispatched")
+
+	// events the server no longer knows are completed with the reason
+	unknown := store.queueOutboxEvent(t, added)
+	store.mu.Lock()
+	unknown.EventID, unknown.Type = uuid.New().String(), "member.promoted"
+	store.mu.Unlock()
+	claimAndDispatch()
+	if !unknown.dispatched || !strings.Contains(unknown.lastError, "unknown domain event type") {
+		t.Errorf("got dispatched %v with error %q for an unknown type, want it completed with the reason", unknown.dispatched, unknown.lastError)
+	}
+	if calls["steady"] != 1 {
+		t.Errorf("got calls %v, want no subscriber called for an unknown type", calls)
+	}
+
+	// events are dead lettered once a subscriber failed them on every attempt
+	t.Setenv("UZORG_OUTBOX_MAX_ATTEMPTS", "2")
+	failing = true
+	added.EventID = uuid.New().String()
+	doomed := store.queueOutboxEvent(t, added)
+	claimAndDispatch()
+	if doomed.dead {
+		t.Error("got the event dead lettered after its first attempt, want it retried")
+	}
+	store.mu.Lock()
+	doomed.nextAttemptAt = time.Now().Add(-time.Second)
+	store.mu.Unlock()
+	claimAndDispatch()
+	if !doomed.dead || doomed.dispatched || !strings.Contains(doomed.lastError, "flaky: mail server down") {
+		t.Errorf("got dead %v, dispatched %v with error %q after the last attempt, want it dead lettered", doomed.dead, doomed.dispatched, doomed.lastError)
+	}
+	store.mu.Lock()
+	doomed.nextAttemptAt = time.Now().Add(-time.Second)
+	store.mu.Unlock()
+	assertNoneDue("after it was dead lettered")
+}
+
+func TestOutboxDispatcherSendsEmails(t *testing.T) {
+	store, h := newTestHandler(t)
+	mailer := &recordingMailer{}
+	h.mailer = mailer
+	bus := &EventBus{}
+	h.subscribe(bus)
+
+	user := &User{UserID: uuid.New().String(), FirstName: "Ada", Email: "ada@example.com"}
+	org := &Org{OrgID: uuid.New().String(), Name: "Engines"}
+	if err := store.InsertUserAndDefaultOrg(user, org, nil); err != nil {
+		t.Fatal(err)
+	}
+	queued := store.queueOutboxEvent(t, domainEventFromAudit(&AuditEvent{
+		EventID:   uuid.New().String(),
+		OrgID:     org.OrgID,
+		ActorID:   user.UserID,
+		Action:    AuditUserRegistered,
+		TargetID:  user.UserID,
+		CreatedAt: time.Now(),
+	}))
+
+	go runOutboxDispatcher(store, bus, nil, 10*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.mu.Lock()
+		dispatched := queued.dispatched
+		store.mu.Unlock()
+		if dispatched {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the event was not dispatched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sent := mailer.takeAll()
+	if len(sent) != 1 || sent[0].to != user.Email || sent[0].subject != "Welcome to Uzorg" {
+		t.Errorf("got emails %+v, want the welcome email", sent)
+	}
+}
+
+func TestPurgeJobPurgesDispatchedEvents(t *testing.T) {
+	store := newMemoryStore()
+	longAgo := time.Now().Add(-outboxRetention - time.Hour)
+	queue := func(dispatchedAt time.Time, dispatched, dead bool) *queuedOutboxEvent {
+		q := store.queueOutboxEvent(t, &UserDeleted{EventMeta: EventMeta{EventID: uuid.New().String()}, UserID: uuid.New().String()})
+		q.dispatched, q.dispatchedAt, q.dead = dispatched, dispatchedAt, dead
+		return q
+	}
+	old := queue(longAgo, true, false)
+	recent := queue(time.Now(), true, false)
+	dead := queue(time.Time{}, false, true)
+
+	oldDelivery := time.Now().Add(-webhookDeliveryRetention - time.Hour)
+	store.webhookDeliveries = []*WebhookDelivery{
+		{DeliveryID: "old", Status: WebhookDeliveryDelivered, DeliveredAt: &oldDelivery},
+		{DeliveryID: "recent", Status: WebhookDeliveryDelivered, DeliveredAt: &recent.dispatchedAt},
+		{DeliveryID: "dead", Status: WebhookDeliveryDead},
+	}
+
+	go runPurgeJob(store, time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.mu.Lock()
+		purged := store.outboxEvent(old.EventID) == nil && store.webhookDelivery("old") == nil
+		store.mu.Unlock()
+		if purged {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the old event and delivery were not purged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, q := range []*queuedOutboxEvent{recent, dead} {
+		if store.outboxEvent(q.EventID) == nil {
+			t.Errorf("got event %+v purged, want it kept", q)
+		}
+	}
+	for _, id := range []string{"recent", "dead"} {
+		if store.webhookDelivery(id) == nil {
+			t.Errorf("got the %s delivery purged, want it kept", id)
+		}
+	}
+}
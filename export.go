@@ -0,0 +1,268 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// exports with more records than this are generated in the background
+	exportSyncLimit = 500
+	// how long a claimed export is left to its worker before another one generates it
+	exportLease = 10 * time.Minute
+	// how long the archive of a finished export can be downloaded before it is purged
+	exportRetention = 7 * 24 * time.Hour
+)
+
+const (
+	ExportPending   = "pending"
+	ExportRunning   = "running"
+	ExportCompleted = "completed"
+	ExportFailed    = "failed"
+)
+
+// exportFile is one JSON file of a data export archive
+type exportFile struct {
+	name string
+	data interface{}
+}
+
+// collectUserExport gathers everything stored about a user for a data export
+func (h *ReqHandler) collectUserExport(userID string) ([]exportFile, error) {
+	user, err := h.uzorgStore.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("getting user: %w", err)
+	}
+
+	orgs, err := h.uzorgStore.GetUserOrgs(userID)
+	if err != nil {
+		return nil, fmt.Errorf("getting orgs: %w", err)
+	}
+
+	sessions, err := h.uzorgStore.GetUserSessions(userID)
+	if err != nil {
+		return nil, fmt.Errorf("getting sessions: %w", err)
+	}
+
+	keys, err := h.uzorgStore.GetUserAPIKeys(userID)
+	if err != nil {
+		return nil, fmt.Errorf("getting api keys: %w", err)
+	}
+
+	events, err := h.uzorgStore.GetUserAuditEvents(userID)
+	if err != nil {
+		return nil, fmt.Errorf("getting audit events: %w", err)
+	}
+
+	return []exportFile{
+		{name: "profile.json", data: user},
+		{name: "organisations.json", data: orgs},
+		{name: "sessions.json", data: sessions},
+		{name: "api_keys.json", data: keys},
+		{name: "audit_events.json", data: events},
+	}, nil
+}
+
+// writeExportArchive writes the files of a data export as a zip archive
+func writeExportArchive(w io.Writer, files []exportFile) error {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeExportDownload(w http.ResponseWriter, archive []byte) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="uzorg-export-%s.zip"`, time.Now().UTC().Format("20060102")))
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive)
+}
+
+// runDataExportWorker generates the archives of pending exports, checking for new ones every interval
+func (h *ReqHandler) runDataExportWorker(interval time.Duration) {
+	for {
+		export, err := h.uzorgStore.ClaimDataExport(time.Now().Add(exportLease))
+		if errors.Is(err, sql.ErrNoRows) {
+			time.Sleep(interval)
+			continue
+		}
+		if err != nil {
+			log.Println("Error claiming data export: ", err)
+			time.Sleep(interval)
+			continue
+		}
+
+		var buf bytes.Buffer
+		files, err := h.collectUserExport(export.UserID)
+		if err == nil {
+			err = writeExportArchive(&buf, files)
+		}
+
+		if err != nil {
+			log.Printf("Error generating data export %s: %v", export.ExportID, err)
+			err = h.uzorgStore.FailDataExport(export.ExportID, err.Error())
+		} else {
+			err = h.uzorgStore.CompleteDataExport(export.ExportID, buf.Bytes())
+		}
+		if err != nil {
+			log.Printf("Error saving data export %s: %v", export.ExportID, err)
+		}
+	}
+}
+
+// handler for GET /api/users/me/export that exports the logged in user's data as a zip of JSON files.
+// Small accounts get the archive straight away; for large ones an export is queued and 202 returned
+// with the URL of its status. An export still pending or running is returned instead of queueing another.
+func (h *ReqHandler) ExportUserData(w http.ResponseWriter, r *http.Request) {
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	export, err := h.uzorgStore.GetActiveDataExport(userID)
+	if err == nil {
+		writeQueuedDataExport(w, &export, "Export already queued, poll its status until it is completed")
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		w.Header().Set("Content-Type", "application/json")
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting queued export: %v", err))
+		return
+	}
+
+	// count first so large accounts are never read in the request
+	records, err := h.uzorgStore.CountUserExportRecords(userID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeServerErrorResponse(w, fmt.Sprintf("Error counting user data: %v", err))
+		return
+	}
+
+	if records <= exportSyncLimit {
+		files, err := h.collectUserExport(userID)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeServerErrorResponse(w, fmt.Sprintf("Error collecting user data: %v", err))
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := writeExportArchive(&buf, files); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeServerErrorResponse(w, fmt.Sprintf("Error writing archive: %v", err))
+			return
+		}
+		writeExportDownload(w, buf.Bytes())
+		return
+	}
+
+	export = DataExport{
+		ExportID: uuid.New().String(),
+		UserID:   userID,
+		Status:   ExportPending,
+	}
+
+	err = h.uzorgStore.InsertDataExport(&export)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeServerErrorResponse(w, fmt.Sprintf("Error queueing export: %v", err))
+		return
+	}
+	writeQueuedDataExport(w, &export, "Export queued, poll its status until it is completed")
+}
+
+// writeQueuedDataExport answers 202 with a queued export and the URL of its status
+func writeQueuedDataExport(w http.ResponseWriter, export *DataExport, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	export.StatusURL = apiV1Prefix + "/users/me/export/" + export.ExportID
+
+	response := DataExportResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: message,
+		},
+		Data: export,
+	}
+
+	w.Header().Set("Location", export.StatusURL)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for GET /api/users/me/export/{id} that reports the status of a queued export
+func (h *ReqHandler) GetDataExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	exportID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	export, err := h.uzorgStore.GetDataExport(userID, exportID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeBadRequestResponse(w, http.StatusNotFound, "Export not found")
+		return
+	}
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting export: %v", err))
+		return
+	}
+
+	export.StatusURL = apiV1Prefix + "/users/me/export/" + export.ExportID
+	if export.Status == ExportCompleted {
+		export.DownloadURL = export.StatusURL + "/download"
+	}
+
+	response := DataExportResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Export retrieved successfully",
+		},
+		Data: &export,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for GET /api/users/me/export/{id}/download that downloads the archive of a completed export
+func (h *ReqHandler) DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	exportID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	archive, err := h.uzorgStore.GetDataExportArchive(userID, exportID)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.Header().Set("Content-Type", "application/json")
+		writeBadRequestResponse(w, http.StatusNotFound, "Export not found or not completed")
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting export: %v", err))
+		return
+	}
+
+	writeExportDownload(w, archive)
+}
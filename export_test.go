@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/utukj/user-org-crud/client"
+)
+
+// storedDataExport is a data export with the columns the API does not return
+type storedDataExport struct {
+	DataExport
+	archive    []byte
+	leaseUntil time.Time
+}
+
+func (s *memoryStore) GetUserAPIKeys(userID string) ([]*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []*APIKey
+	for _, k := range s.apiKeys {
+		if k.UserID == userID {
+			stored := *k
+			keys = append(keys, &stored)
+		}
+	}
+	return keys, nil
+}
+
+// GetUserAuditEvents blanks the IP address and request ID of other actors like the SQL of UzorgPgStorer
+func (s *memoryStore) GetUserAuditEvents(userID string) ([]*AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []*AuditEvent
+	for _, ev := range s.auditEvents {
+		if ev.ActorID != userID && (ev.TargetType != "user" || ev.TargetID != userID) {
+			continue
+		}
+		stored := *ev
+		if ev.ActorID != userID {
+			stored.IPAddress, stored.RequestID = "", ""
+		}
+		events = append(events, &stored)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].CreatedAt.Before(events[j].CreatedAt) })
+	return events, nil
+}
+
+func (s *memoryStore) CountUserExportRecords(userID string) (int, error) {
+	orgs, _ := s.GetUserOrgs(userID)
+	sessions, _ := s.GetUserSessions(userID)
+	keys, _ := s.GetUserAPIKeys(userID)
+	events, _ := s.GetUserAuditEvents(userID)
+	return 1 + len(orgs) + len(sessions) + len(keys) + len(events), nil
+}
+
+func (s *memoryStore) GetActiveDataExport(userID string) (DataExport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.dataExports {
+		if e.UserID == userID && (e.Status == ExportPending || e.Status == ExportRunning) {
+			return e.DataExport, nil
+		}
+	}
+	return DataExport{}, sql.ErrNoRows
+}
+
+func (s *memoryStore) InsertDataExport(e *DataExport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.CreatedAt = time.Now()
+	s.dataExports[e.ExportID] = &storedDataExport{DataExport: *e}
+	return nil
+}
+
+func (s *memoryStore) ClaimDataExport(leaseUntil time.Time) (DataExport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var claimed *storedDataExport
+	for _, e := range s.dataExports {
+		due := e.Status == ExportPending || (e.Status == ExportRunning && e.leaseUntil.Before(time.Now()))
+		if due && (claimed == nil || e.CreatedAt.Before(claimed.CreatedAt)) {
+			claimed = e
+		}
+	}
+	if claimed == nil {
+		return DataExport{}, sql.ErrNoRows
+	}
+	claimed.Status = ExportRunning
+	claimed.leaseUntil = leaseUntil
+	return claimed.DataExport, nil
+}
+
+func (s *memoryStore) CompleteDataExport(exportID string, archive []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e := s.dataExports[exportID]
+	e.Status, e.archive, e.CompletedAt = ExportCompleted, archive, &now
+	return nil
+}
+
+func (s *memoryStore) FailDataExport(exportID, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e := s.dataExports[exportID]
+	e.Status, e.Error, e.CompletedAt = ExportFailed, message, &now
+	return nil
+}
+
+func (s *memoryStore) GetDataExport(userID, exportID string) (DataExport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.dataExports[exportID]
+	if !ok || e.UserID != userID {
+		return DataExport{}, sql.ErrNoRows
+	}
+	return e.DataExport, nil
+}
+
+func (s *memoryStore) GetDataExportArchive(userID, exportID string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.dataExports[exportID]
+	if !ok || e.UserID != userID || e.Status != ExportCompleted {
+		return nil, sql.ErrNoRows
+	}
+	return e.archive, nil
+}
+
+func (s *memoryStore) PurgeFinishedDataExports(finishedBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for exportID, e := range s.dataExports {
+		if e.CompletedAt != nil && e.CompletedAt.Before(finishedBefore) {
+			delete(s.dataExports, exportID)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// downloadTestExport requests an export archive and decodes the JSON files in it
+func downloadTestExport(t *testing.T, url, token string) (*http.Response, map[string]json.RawMessage) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != "application/zip" {
+		return resp, nil
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("got %v reading the archive", err)
+	}
+	files := map[string]json.RawMessage{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name] = data
+	}
+	return resp, files
+}
+
+func TestDataExport(t *testing.T) {
+	store, h := newTestHandler(t)
+	server := httptest.NewServer(newRouter(h))
+	t.Cleanup(server.Close)
+	exportURL := server.URL + "/api/v1/users/me/export"
+
+	ada := client.New(server.URL)
+	adaUser := registerTestUser(t, ada, "Ada", "ada@example.com")
+	bob := client.New(server.URL)
+	bobUser := registerTestUser(t, bob, "Bob", "bob@example.com")
+
+	store.mu.Lock()
+	store.auditEvents = append(store.auditEvents,
+		&AuditEvent{EventID: uuid.New().String(), ActorID: adaUser.UserID, Action: AuditUserUpdated, TargetType: "user", TargetID: adaUser.UserID, IPAddress: "10.0.0.1", RequestID: "ada-request", CreatedAt: time.Now()},
+		&AuditEvent{EventID: uuid.New().String(), ActorID: bobUser.UserID, Action: AuditUserUpdated, TargetType: "user", TargetID: adaUser.UserID, IPAddress: "10.0.0.2", RequestID: "bob-request", CreatedAt: time.Now()},
+		&AuditEvent{EventID: uuid.New().String(), ActorID: bobUser.UserID, Action: AuditUserUpdated, TargetType: "user", TargetID: bobUser.UserID, IPAddress: "10.0.0.2", CreatedAt: time.Now()},
+	)
+	store.mu.Unlock()
+
+	// small accounts get their archive straight away
+	resp, files := downloadTestExport(t, exportURL, ada.Token())
+	if resp.StatusCode != http.StatusOK || files == nil {
+		t.Fatalf("got status %d, %s exporting a small account, want a zip archive", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for _, name := range []string{"profile.json", "organisations.json", "sessions.json", "api_keys.json", "audit_events.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("got no %s in the archive", name)
+		}
+	}
+	var profile User
+	json.Unmarshal(files["profile.json"], &profile)
+	if profile.Email != "ada@example.com" {
+		t.Errorf("got profile %+v, want the profile of Ada", profile)
+	}
+	var events []*AuditEvent
+	json.Unmarshal(files["audit_events.json"], &events)
+	if len(events) != 2 {
+		t.Fatalf("got %d audit events, want the 2 about Ada", len(events))
+	}
+	for _, ev := range events {
+		switch ev.ActorID {
+		case adaUser.UserID:
+			if ev.IPAddress != "10.0.0.1" || ev.RequestID != "ada-request" {
+				t.Errorf("got IP address %q and request ID %q on an event by Ada, want hers", ev.IPAddress, ev.RequestID)
+			}
+		default:
+			if ev.IPAddress != "" || ev.RequestID != "" {
+				t.Errorf("got IP address %q and request ID %q of another actor in the export", ev.IPAddress, ev.RequestID)
+			}
+		}
+	}
+	if len(store.dataExports) != 0 {
+		t.Errorf("got %d exports queued for a small account, want none", len(store.dataExports))
+	}
+
+	// large accounts are queued once, however often the export is requested
+	store.mu.Lock()
+	for i := 0; i < exportSyncLimit; i++ {
+		store.auditEvents = append(store.auditEvents, &AuditEvent{EventID: uuid.New().String(), ActorID: adaUser.UserID, Action: AuditUserUpdated, TargetType: "user", TargetID: adaUser.UserID, CreatedAt: time.Now()})
+	}
+	store.mu.Unlock()
+	var queued, again DataExportResponse
+	resp = doTestRequest(t, http.MethodGet, exportURL, ada.Token(), "", &queued)
+	if resp.StatusCode != http.StatusAccepted || queued.Data == nil || queued.Data.Status != ExportPending || resp.Header.Get("Location") != queued.Data.StatusURL {
+		t.Fatalf("got status %d, %+v exporting a large account, want 202 with a pending export", resp.StatusCode, queued.Data)
+	}
+	resp = doTestRequest(t, http.MethodGet, exportURL, ada.Token(), "", &again)
+	if resp.StatusCode != http.StatusAccepted || again.Data == nil || again.Data.ExportID != queued.Data.ExportID {
+		t.Errorf("got status %d, %+v requesting the export again, want the queued export", resp.StatusCode, again.Data)
+	}
+	if len(store.dataExports) != 1 {
+		t.Errorf("got %d exports queued, want 1", len(store.dataExports))
+	}
+
+	statusURL := server.URL + queued.Data.StatusURL
+	var status DataExportResponse
+	doTestRequest(t, http.MethodGet, statusURL, ada.Token(), "", &status)
+	if status.Data == nil || status.Data.Status != ExportPending || status.Data.DownloadURL != "" {
+		t.Errorf("got %+v, want a pending export without a download URL", status.Data)
+	}
+	if resp, _ := downloadTestExport(t, statusURL+"/download", ada.Token()); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d downloading a pending export, want 404", resp.StatusCode)
+	}
+	if resp := doTestRequest(t, http.MethodGet, statusURL, bob.Token(), "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for the export of another user, want 404", resp.StatusCode)
+	}
+
+	// the export of a dead worker is generated again once its lease runs out, a live worker's is left alone
+	store.mu.Lock()
+	stalled := &storedDataExport{DataExport: DataExport{ExportID: uuid.New().String(), UserID: bobUser.UserID, Status: ExportRunning, CreatedAt: time.Now()}, leaseUntil: time.Now().Add(-time.Second)}
+	working := &storedDataExport{DataExport: DataExport{ExportID: uuid.New().String(), UserID: bobUser.UserID, Status: ExportRunning, CreatedAt: time.Now()}, leaseUntil: time.Now().Add(time.Hour)}
+	store.dataExports[stalled.ExportID] = stalled
+	store.dataExports[working.ExportID] = working
+	store.mu.Unlock()
+
+	go h.runDataExportWorker(10 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e, _ := store.GetDataExport(bobUser.UserID, stalled.ExportID)
+		doTestRequest(t, http.MethodGet, statusURL, ada.Token(), "", &status)
+		if status.Data.Status == ExportCompleted && e.Status == ExportCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got exports %s and %s, want both completed", status.Data.Status, e.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if e, _ := store.GetDataExport(bobUser.UserID, working.ExportID); e.Status != ExportRunning {
+		t.Errorf("got status %s for an export leased to a live worker, want it left running", e.Status)
+	}
+
+	if status.Data.DownloadURL != queued.Data.StatusURL+"/download" {
+		t.Errorf("got download URL %q for a completed export", status.Data.DownloadURL)
+	}
+	resp, files = downloadTestExport(t, server.URL+status.Data.DownloadURL, ada.Token())
+	json.Unmarshal(files["audit_events.json"], &events)
+	if resp.StatusCode != http.StatusOK || len(events) != exportSyncLimit+2 {
+		t.Errorf("got status %d with %d audit events downloading the export, want 200 with %d", resp.StatusCode, len(events), exportSyncLimit+2)
+	}
+
+	// a new export can be queued once the last one finished, and finished archives are purged
+	var next DataExportResponse
+	doTestRequest(t, http.MethodGet, exportURL, ada.Token(), "", &next)
+	if next.Data == nil || next.Data.ExportID == queued.Data.ExportID {
+		t.Errorf("got %+v requesting an export after the last one completed, want a new export", next.Data)
+	}
+	store.mu.Lock()
+	longAgo := time.Now().Add(-exportRetention - time.Hour)
+	store.dataExports[queued.Data.ExportID].CompletedAt = &longAgo
+	store.mu.Unlock()
+
+	go runPurgeJob(store, time.Hour)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if _, err := store.GetDataExport(adaUser.UserID, queued.Data.ExportID); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the export was not purged after its retention")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := store.GetDataExport(bobUser.UserID, stalled.ExportID); err != nil {
+		t.Errorf("got %v for a recently completed export, want it kept", err)
+	}
+}
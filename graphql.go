@@ -0,0 +1,859 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vektah/gqlparser/v2/validator"
+)
+
+const (
+	// graphqlMaxDepth is how deeply a query may nest fields
+	graphqlMaxDepth = 8
+	// graphqlMaxComplexity bounds the fields a query may resolve, counting the fields beneath
+	// a list graphqlListFactor times
+	graphqlMaxComplexity = 5000
+	graphqlListFactor    = 10
+	graphqlMaxBytes      = 1 << 20
+	// introspection has limits of its own, high enough for the introspection query of tools
+	// loading the schema, as its types refer to each other without end
+	graphqlMaxIntrospectionDepth      = 13
+	graphqlMaxIntrospectionComplexity = 50000
+)
+
+//go:embed schema.graphql
+var graphqlSDL string
+
+var graphqlSchema = gqlparser.MustLoadSchema(&ast.Source{Name: "schema.graphql", Input: graphqlSDL})
+
+// handler for POST /graphql that answers GraphQL queries over users, organisations and their
+// members. The fields follow the authorisation rules of the REST handlers and need the scopes
+// of the matching routes, so a query can fetch a user, their organisations and each
+// organisation's members in one round trip.
+func (h *ReqHandler) GraphQL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req GraphQLRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, graphqlMaxBytes)).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	e := &graphqlExecutor{
+		h:           h,
+		r:           r,
+		userID:      userID,
+		orgsOfUsers: map[string][]*Org{},
+		usersOfOrgs: map[string][]*User{},
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(e.execute(&req))
+}
+
+// graphqlObject is an object of a GraphQL response, keeping its fields in the order of the query
+type graphqlObject []graphqlField
+
+type graphqlField struct {
+	key   string
+	value interface{}
+}
+
+func (o graphqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// graphqlUser is a user as the logged in user may see them. Contact details are shown to the
+// user themselves and to fellow members listing the members of an organisation, as in the REST API.
+type graphqlUser struct {
+	*User
+	contact bool
+}
+
+type graphqlMembership struct {
+	role string
+	user *graphqlUser
+	org  *Org
+}
+
+// graphqlExecutor executes a query breadth first: each field is resolved for all the objects
+// at its level at once, so the storer is called once per level rather than once per object.
+// Results of the batched storer calls are kept for the rest of the request.
+type graphqlExecutor struct {
+	h      *ReqHandler
+	r      *http.Request
+	userID string
+	doc    *ast.QueryDocument
+	vars   map[string]interface{}
+	errs   gqlerror.List
+
+	orgsOfUsers map[string][]*Org
+	usersOfOrgs map[string][]*User
+}
+
+func (e *graphqlExecutor) execute(req *GraphQLRequest) *GraphQLResponse {
+	doc, errs := gqlparser.LoadQuery(graphqlSchema, req.Query)
+	if len(errs) > 0 {
+		return &GraphQLResponse{Errors: errs}
+	}
+	e.doc = doc
+
+	op := doc.Operations.ForName(req.OperationName)
+	if op == nil {
+		return &GraphQLResponse{Errors: gqlerror.List{gqlerror.Errorf("Operation %q not found; operationName is required when the query has several", req.OperationName)}}
+	}
+
+	vars, err := validator.VariableValues(graphqlSchema, op, req.Variables)
+	if err != nil {
+		return &GraphQLResponse{Errors: gqlerror.List{gqlerror.WrapIfUnwrapped(err)}}
+	}
+	e.vars = vars
+
+	if depth, complexity := e.cost(op.SelectionSet, 1, false); depth > graphqlMaxDepth {
+		return &GraphQLResponse{Errors: gqlerror.List{gqlerror.Errorf("Query is %d fields deep, more than the limit of %d", depth, graphqlMaxDepth)}}
+	} else if complexity > graphqlMaxComplexity {
+		return &GraphQLResponse{Errors: gqlerror.List{gqlerror.Errorf("Query has a complexity of %d, more than the limit of %d", complexity, graphqlMaxComplexity)}}
+	}
+	if depth, complexity := e.cost(op.SelectionSet, 1, true); depth > graphqlMaxIntrospectionDepth {
+		return &GraphQLResponse{Errors: gqlerror.List{gqlerror.Errorf("Introspection is %d fields deep, more than the limit of %d", depth, graphqlMaxIntrospectionDepth)}}
+	} else if complexity > graphqlMaxIntrospectionComplexity {
+		return &GraphQLResponse{Errors: gqlerror.List{gqlerror.Errorf("Introspection has a complexity of %d, more than the limit of %d", complexity, graphqlMaxIntrospectionComplexity)}}
+	}
+
+	data := e.executeSelections(graphqlSchema.Query.Name, []interface{}{nil}, op.SelectionSet, nil)
+	return &GraphQLResponse{Data: data[0], Errors: e.errs}
+}
+
+// cost measures the depth and complexity of a selection set. Of the root fields it measures
+// __schema and __type when introspection is set and the others when it is not, as introspection
+// has limits of its own.
+func (e *graphqlExecutor) cost(set ast.SelectionSet, depth int, introspection bool) (maxDepth, complexity int) {
+	maxDepth = depth - 1
+	for _, sel := range set {
+		var d, c int
+		switch sel := sel.(type) {
+		case *ast.Field:
+			if depth == 1 && (sel.Name == "__schema" || sel.Name == "__type") != introspection {
+				continue
+			}
+			d, c = e.cost(sel.SelectionSet, depth+1, introspection)
+			if sel.Definition.Type.Elem != nil {
+				c *= graphqlListFactor
+			}
+			d, c = maxInt(d, depth), c+1
+		case *ast.FragmentSpread:
+			d, c = e.cost(e.doc.Fragments.ForName(sel.Name).SelectionSet, depth, introspection)
+		case *ast.InlineFragment:
+			d, c = e.cost(sel.SelectionSet, depth, introspection)
+		}
+		maxDepth, complexity = maxInt(maxDepth, d), complexity+c
+	}
+	return maxDepth, complexity
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// collectedField is the fields of a selection set sharing a response key
+type collectedField struct {
+	key    string
+	fields []*ast.Field
+}
+
+// collectFields lists the fields of a selection set selected on an object of the type,
+// expanding fragments and applying @skip and @include
+func (e *graphqlExecutor) collectFields(typeName string, set ast.SelectionSet, collected []*collectedField) []*collectedField {
+	for _, sel := range set {
+		switch sel := sel.(type) {
+		case *ast.Field:
+			if !e.included(sel.Directives) {
+				continue
+			}
+			key := sel.Alias
+			if key == "" {
+				key = sel.Name
+			}
+			found := false
+			for _, cf := range collected {
+				if cf.key == key {
+					cf.fields = append(cf.fields, sel)
+					found = true
+				}
+			}
+			if !found {
+				collected = append(collected, &collectedField{key: key, fields: []*ast.Field{sel}})
+			}
+		case *ast.FragmentSpread:
+			fragment := e.doc.Fragments.ForName(sel.Name)
+			if e.included(sel.Directives) && fragment.TypeCondition == typeName {
+				collected = e.collectFields(typeName, fragment.SelectionSet, collected)
+			}
+		case *ast.InlineFragment:
+			if e.included(sel.Directives) && (sel.TypeCondition == "" || sel.TypeCondition == typeName) {
+				collected = e.collectFields(typeName, sel.SelectionSet, collected)
+			}
+		}
+	}
+	return collected
+}
+
+func (e *graphqlExecutor) included(directives ast.DirectiveList) bool {
+	if skip := directives.ForName("skip"); skip != nil && skip.ArgumentMap(e.vars)["if"] == true {
+		return false
+	}
+	if include := directives.ForName("include"); include != nil && include.ArgumentMap(e.vars)["if"] == false {
+		return false
+	}
+	return true
+}
+
+// executeSelections resolves a selection set on objects of the type. An object whose non-null
+// field is null becomes null itself. Errors are reported with the path of their field without
+// list indexes, as a field is resolved for every item of the lists above it at once.
+func (e *graphqlExecutor) executeSelections(typeName string, parents []interface{}, set ast.SelectionSet, path ast.Path) []interface{} {
+	objects := make([]graphqlObject, len(parents))
+	null := make([]bool, len(parents))
+
+	for _, cf := range e.collectFields(typeName, set, nil) {
+		field := cf.fields[0]
+		fieldPath := append(path[:len(path):len(path)], ast.PathName(cf.key))
+
+		var values []interface{}
+		if field.Name == "__typename" {
+			values = make([]interface{}, len(parents))
+			for i := range values {
+				values[i] = typeName
+			}
+		} else {
+			var err error
+			values, err = e.resolve(typeName, field, parents)
+			if err != nil {
+				e.errs = append(e.errs, &gqlerror.Error{
+					Message:   err.Error(),
+					Path:      fieldPath,
+					Locations: []gqlerror.Location{{Line: field.Position.Line, Column: field.Position.Column}},
+				})
+				values = make([]interface{}, len(parents))
+			}
+
+			var sub ast.SelectionSet
+			for _, f := range cf.fields {
+				sub = append(sub, f.SelectionSet...)
+			}
+			values = e.complete(field.Definition.Type, values, sub, fieldPath)
+		}
+
+		for i, v := range values {
+			objects[i] = append(objects[i], graphqlField{key: cf.key, value: v})
+			if v == nil && field.Definition.Type.NonNull {
+				null[i] = true
+			}
+		}
+	}
+
+	results := make([]interface{}, len(parents))
+	for i, o := range objects {
+		if !null[i] {
+			results[i] = o
+		}
+	}
+	return results
+}
+
+// complete turns resolved values into response values of type t, executing the selection set
+// on objects. Lists with a null item that can't be null become null.
+func (e *graphqlExecutor) complete(t *ast.Type, values []interface{}, set ast.SelectionSet, path ast.Path) []interface{} {
+	completed := make([]interface{}, len(values))
+
+	if t.Elem != nil {
+		var items []interface{}
+		for _, v := range values {
+			list, _ := v.([]interface{})
+			items = append(items, list...)
+		}
+		items = e.complete(t.Elem, items, set, path)
+
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			n := len(v.([]interface{}))
+			list := append([]interface{}{}, items[:n]...)
+			items = items[n:]
+
+			completed[i] = list
+			for _, item := range list {
+				if item == nil && t.Elem.NonNull {
+					completed[i] = nil
+				}
+			}
+		}
+		return completed
+	}
+
+	def := graphqlSchema.Types[t.NamedType]
+	if def.IsLeafType() {
+		return values
+	}
+
+	var parents []interface{}
+	var at []int
+	for i, v := range values {
+		if v != nil {
+			parents = append(parents, v)
+			at = append(at, i)
+		}
+	}
+	for j, o := range e.executeSelections(def.Name, parents, set, path) {
+		completed[at[j]] = o
+	}
+	return completed
+}
+
+// each resolves a field of every parent separately, for fields that need no storer calls
+func each(parents []interface{}, fn func(parent interface{}) interface{}) []interface{} {
+	values := make([]interface{}, len(parents))
+	for i, p := range parents {
+		values[i] = fn(p)
+	}
+	return values
+}
+
+// nullable turns empty strings into null
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (e *graphqlExecutor) requireScope(scope string) error {
+	if len(missingScopes(scopesFromContext(e.r.Context()), []string{scope})) > 0 {
+		return fmt.Errorf("Insufficient scope, %s is required", scope)
+	}
+	return nil
+}
+
+// resolve returns the value of a field for every parent
+func (e *graphqlExecutor) resolve(typeName string, field *ast.Field, parents []interface{}) ([]interface{}, error) {
+	args := field.ArgumentMap(e.vars)
+
+	switch typeName {
+	case "Query":
+		v, err := e.resolveQuery(field.Name, args)
+		return []interface{}{v}, err
+	case "User":
+		return e.resolveUsers(field.Name, parents)
+	case "Organisation":
+		return e.resolveOrgs(field.Name, parents)
+	case "Membership":
+		return each(parents, func(p interface{}) interface{} {
+			m := p.(*graphqlMembership)
+			switch field.Name {
+			case "role":
+				return m.role
+			case "user":
+				return m.user
+			default:
+				return m.org
+			}
+		}), nil
+	}
+	return each(parents, func(p interface{}) interface{} {
+		return resolveIntrospection(typeName, field.Name, args, p)
+	}), nil
+}
+
+func (e *graphqlExecutor) resolveQuery(name string, args map[string]interface{}) (interface{}, error) {
+	switch name {
+	case "__schema":
+		return graphqlSchema, nil
+	case "__type":
+		if def := graphqlSchema.Types[args["name"].(string)]; def != nil {
+			return &graphqlTypeRef{def: def}, nil
+		}
+		return nil, nil
+
+	case "me":
+		if err := e.requireScope(ScopeUsersRead); err != nil {
+			return nil, err
+		}
+		user, err := e.h.uzorgStore.GetUserByID(e.userID)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting user: %v", err)
+		}
+		return &graphqlUser{User: &user, contact: true}, nil
+
+	case "user":
+		if err := e.requireScope(ScopeUsersRead); err != nil {
+			return nil, err
+		}
+		id := args["id"].(string)
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, nil
+		}
+		if id != e.userID {
+			shared, err := e.h.uzorgStore.UsersShareOrg(e.userID, id)
+			if err != nil {
+				return nil, fmt.Errorf("Error checking shared orgs: %v", err)
+			}
+			if !shared {
+				return nil, nil
+			}
+		}
+		user, err := e.h.uzorgStore.GetUserByID(id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error getting user: %v", err)
+		}
+		return &graphqlUser{User: &user, contact: id == e.userID}, nil
+
+	case "organisations":
+		if err := e.requireScope(ScopeOrgsRead); err != nil {
+			return nil, err
+		}
+		orgs, err := e.orgsOf([]string{e.userID})
+		if err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for _, o := range orgs[e.userID] {
+			list = append(list, o)
+		}
+		return list, nil
+
+	case "organisation":
+		if err := e.requireScope(ScopeOrgsRead); err != nil {
+			return nil, err
+		}
+		id := args["id"].(string)
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, fmt.Errorf("Unauthorized access")
+		}
+		belongs, err := e.h.uzorgStore.UserBelongsToOrg(e.userID, id)
+		if err != nil {
+			return nil, fmt.Errorf("Error checking if user belongs to org: %v", err)
+		}
+		if !belongs {
+			return nil, fmt.Errorf("Unauthorized access")
+		}
+		org, err := e.h.uzorgStore.GetOrg(id)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting org: %v", err)
+		}
+		return &org, nil
+	}
+	return nil, fmt.Errorf("Unknown field %s", name)
+}
+
+// orgsOf loads the organisations of users, fetching the users not loaded yet in one storer call
+func (e *graphqlExecutor) orgsOf(userIDs []string) (map[string][]*Org, error) {
+	var missing []string
+	for _, id := range userIDs {
+		if _, ok := e.orgsOfUsers[id]; !ok {
+			e.orgsOfUsers[id] = nil
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		orgs, err := e.h.uzorgStore.GetOrgsOfUsers(missing)
+		if err != nil {
+			for _, id := range missing {
+				delete(e.orgsOfUsers, id)
+			}
+			return nil, fmt.Errorf("Error getting user orgs: %v", err)
+		}
+		for _, id := range missing {
+			e.orgsOfUsers[id] = orgs[id]
+		}
+	}
+	return e.orgsOfUsers, nil
+}
+
+// usersOf loads the members of organisations, fetching the organisations not loaded yet in one storer call
+func (e *graphqlExecutor) usersOf(orgIDs []string) (map[string][]*User, error) {
+	var missing []string
+	for _, id := range orgIDs {
+		if _, ok := e.usersOfOrgs[id]; !ok {
+			e.usersOfOrgs[id] = nil
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		users, err := e.h.uzorgStore.GetUsersOfOrgs(missing)
+		if err != nil {
+			for _, id := range missing {
+				delete(e.usersOfOrgs, id)
+			}
+			return nil, fmt.Errorf("Error getting org users: %v", err)
+		}
+		for _, id := range missing {
+			e.usersOfOrgs[id] = users[id]
+		}
+	}
+	return e.usersOfOrgs, nil
+}
+
+func (e *graphqlExecutor) resolveUsers(name string, parents []interface{}) ([]interface{}, error) {
+	switch name {
+	case "organisations", "memberships":
+		if err := e.requireScope(ScopeOrgsRead); err != nil {
+			return nil, err
+		}
+		ids := []string{e.userID}
+		for _, p := range parents {
+			ids = append(ids, p.(*graphqlUser).UserID)
+		}
+		orgs, err := e.orgsOf(ids)
+		if err != nil {
+			return nil, err
+		}
+
+		// only organisations the logged in user belongs to are listed
+		mine := map[string]bool{}
+		for _, o := range orgs[e.userID] {
+			mine[o.OrgID] = true
+		}
+		return each(parents, func(p interface{}) interface{} {
+			u := p.(*graphqlUser)
+			list := []interface{}{}
+			for _, o := range orgs[u.UserID] {
+				if !mine[o.OrgID] {
+					continue
+				}
+				if name == "organisations" {
+					list = append(list, o)
+				} else {
+					list = append(list, &graphqlMembership{role: o.Role, user: u, org: o})
+				}
+			}
+			return list
+		}), nil
+	}
+
+	return each(parents, func(p interface{}) interface{} {
+		u := p.(*graphqlUser)
+		contact := u.contact || u.UserID == e.userID
+		switch name {
+		case "id":
+			return u.UserID
+		case "firstName":
+			return u.FirstName
+		case "lastName":
+			return u.LastName
+		case "email":
+			if contact {
+				return u.Email
+			}
+		case "phone":
+			if contact {
+				return nullable(u.Phone)
+			}
+		}
+		return nil
+	}), nil
+}
+
+func (e *graphqlExecutor) resolveOrgs(name string, parents []interface{}) ([]interface{}, error) {
+	if name == "members" {
+		if err := e.requireScope(ScopeMembersRead); err != nil {
+			return nil, err
+		}
+		var ids []string
+		for _, p := range parents {
+			ids = append(ids, p.(*Org).OrgID)
+		}
+		users, err := e.usersOf(ids)
+		if err != nil {
+			return nil, err
+		}
+		return each(parents, func(p interface{}) interface{} {
+			o := p.(*Org)
+			list := []interface{}{}
+			for _, u := range users[o.OrgID] {
+				list = append(list, &graphqlMembership{role: u.Role, user: &graphqlUser{User: u, contact: true}, org: o})
+			}
+			return list
+		}), nil
+	}
+
+	return each(parents, func(p interface{}) interface{} {
+		o := p.(*Org)
+		switch name {
+		case "id":
+			return o.OrgID
+		case "name":
+			return o.Name
+		default:
+			return o.Description
+		}
+	}), nil
+}
+
+// graphqlTypeRef is a type for introspection: a named type, or a list or non-null wrapper of ofType
+type graphqlTypeRef struct {
+	def    *ast.Definition
+	kind   string
+	ofType *ast.Type
+}
+
+func typeRef(t *ast.Type) *graphqlTypeRef {
+	switch {
+	case t.NonNull:
+		of := *t
+		of.NonNull = false
+		return &graphqlTypeRef{kind: "NON_NULL", ofType: &of}
+	case t.Elem != nil:
+		return &graphqlTypeRef{kind: "LIST", ofType: t.Elem}
+	}
+	return &graphqlTypeRef{def: graphqlSchema.Types[t.NamedType]}
+}
+
+// graphqlInputValue is an argument or input field for introspection
+type graphqlInputValue struct {
+	name         string
+	description  string
+	typ          *ast.Type
+	defaultValue *ast.Value
+}
+
+func inputValues(args ast.ArgumentDefinitionList) []interface{} {
+	list := []interface{}{}
+	for _, a := range args {
+		list = append(list, &graphqlInputValue{name: a.Name, description: a.Description, typ: a.Type, defaultValue: a.DefaultValue})
+	}
+	return list
+}
+
+func deprecation(directives ast.DirectiveList) (bool, interface{}) {
+	d := directives.ForName("deprecated")
+	if d == nil {
+		return false, nil
+	}
+	return true, d.ArgumentMap(nil)["reason"]
+}
+
+// resolveIntrospection resolves the fields of the introspection types of the schema
+func resolveIntrospection(typeName, name string, args map[string]interface{}, parent interface{}) interface{} {
+	switch typeName {
+	case "__Schema":
+		s := parent.(*ast.Schema)
+		switch name {
+		case "description":
+			return nullable(s.Description)
+		case "types":
+			var names []string
+			for n := range s.Types {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			list := []interface{}{}
+			for _, n := range names {
+				list = append(list, &graphqlTypeRef{def: s.Types[n]})
+			}
+			return list
+		case "queryType":
+			return &graphqlTypeRef{def: s.Query}
+		case "directives":
+			var names []string
+			for n := range s.Directives {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			list := []interface{}{}
+			for _, n := range names {
+				list = append(list, s.Directives[n])
+			}
+			return list
+		}
+		// there are no mutations or subscriptions
+		return nil
+
+	case "__Type":
+		t := parent.(*graphqlTypeRef)
+		if t.def == nil {
+			switch name {
+			case "kind":
+				return t.kind
+			case "ofType":
+				return typeRef(t.ofType)
+			}
+			return nil
+		}
+		switch name {
+		case "kind":
+			return string(t.def.Kind)
+		case "name":
+			return t.def.Name
+		case "description":
+			return nullable(t.def.Description)
+		case "fields":
+			if t.def.Kind != ast.Object && t.def.Kind != ast.Interface {
+				return nil
+			}
+			list := []interface{}{}
+			for _, f := range t.def.Fields {
+				deprecated, _ := deprecation(f.Directives)
+				if strings.HasPrefix(f.Name, "__") || deprecated && args["includeDeprecated"] != true {
+					continue
+				}
+				list = append(list, f)
+			}
+			return list
+		case "interfaces":
+			if t.def.Kind != ast.Object && t.def.Kind != ast.Interface {
+				return nil
+			}
+			list := []interface{}{}
+			for _, n := range t.def.Interfaces {
+				list = append(list, &graphqlTypeRef{def: graphqlSchema.Types[n]})
+			}
+			return list
+		case "possibleTypes":
+			if !t.def.IsAbstractType() {
+				return nil
+			}
+			list := []interface{}{}
+			for _, d := range graphqlSchema.GetPossibleTypes(t.def) {
+				list = append(list, &graphqlTypeRef{def: d})
+			}
+			return list
+		case "enumValues":
+			if t.def.Kind != ast.Enum {
+				return nil
+			}
+			list := []interface{}{}
+			for _, v := range t.def.EnumValues {
+				if deprecated, _ := deprecation(v.Directives); !deprecated || args["includeDeprecated"] == true {
+					list = append(list, v)
+				}
+			}
+			return list
+		case "inputFields":
+			if t.def.Kind != ast.InputObject {
+				return nil
+			}
+			list := []interface{}{}
+			for _, f := range t.def.Fields {
+				list = append(list, &graphqlInputValue{name: f.Name, description: f.Description, typ: f.Type, defaultValue: f.DefaultValue})
+			}
+			return list
+		}
+		return nil
+
+	case "__Field":
+		f := parent.(*ast.FieldDefinition)
+		deprecated, reason := deprecation(f.Directives)
+		switch name {
+		case "name":
+			return f.Name
+		case "description":
+			return nullable(f.Description)
+		case "args":
+			return inputValues(f.Arguments)
+		case "type":
+			return typeRef(f.Type)
+		case "isDeprecated":
+			return deprecated
+		case "deprecationReason":
+			return reason
+		}
+
+	case "__InputValue":
+		v := parent.(*graphqlInputValue)
+		switch name {
+		case "name":
+			return v.name
+		case "description":
+			return nullable(v.description)
+		case "type":
+			return typeRef(v.typ)
+		case "defaultValue":
+			if v.defaultValue != nil {
+				return v.defaultValue.String()
+			}
+		}
+
+	case "__EnumValue":
+		v := parent.(*ast.EnumValueDefinition)
+		deprecated, reason := deprecation(v.Directives)
+		switch name {
+		case "name":
+			return v.Name
+		case "description":
+			return nullable(v.Description)
+		case "isDeprecated":
+			return deprecated
+		case "deprecationReason":
+			return reason
+		}
+
+	case "__Directive":
+		d := parent.(*ast.DirectiveDefinition)
+		switch name {
+		case "name":
+			return d.Name
+		case "description":
+			return nullable(d.Description)
+		case "locations":
+			list := []interface{}{}
+			for _, l := range d.Locations {
+				list = append(list, string(l))
+			}
+			return list
+		case "args":
+			return inputValues(d.Arguments)
+		case "isRepeatable":
+			return d.IsRepeatable
+		}
+	}
+	return nil
+}
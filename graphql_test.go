@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) GetOrgsOfUsers(userIDs []string) (map[string][]*Org, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batchLoads++
+	orgs := map[string][]*Org{}
+	for _, userID := range userIDs {
+		for orgID, members := range s.members {
+			if role, ok := members[userID]; ok {
+				org := *s.orgs[orgID]
+				org.Role = role
+				orgs[userID] = append(orgs[userID], &org)
+			}
+		}
+		sort.Slice(orgs[userID], func(i, j int) bool { return orgs[userID][i].Name < orgs[userID][j].Name })
+	}
+	return orgs, nil
+}
+
+func (s *memoryStore) GetUsersOfOrgs(orgIDs []string) (map[string][]*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batchLoads++
+	users := map[string][]*User{}
+	for _, orgID := range orgIDs {
+		for userID, role := range s.members[orgID] {
+			user := *s.users[userID]
+			user.Role = role
+			users[orgID] = append(users[orgID], &user)
+		}
+		sort.Slice(users[orgID], func(i, j int) bool { return users[orgID][i].Email < users[orgID][j].Email })
+	}
+	return users, nil
+}
+
+func TestGraphQL(t *testing.T) {
+	store, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	ann := client.New(server.URL)
+	registerTestUser(t, ann, "Ann", "ann@example.com")
+	bola := client.New(server.URL)
+	bolaUser := registerTestUser(t, bola, "Bola", "bola@example.com")
+	chidi := client.New(server.URL)
+	chidiUser := registerTestUser(t, chidi, "Chidi", "chidi@example.com")
+
+	org, err := ann.CreateOrg(ctx, client.CreateOrgRequest{Name: "Shared", Description: "Ann and Bola"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ann.AddUserToOrg(ctx, org.OrgID, bolaUser.UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(c *client.Client, q string, vars map[string]interface{}) (string, []map[string]interface{}) {
+		t.Helper()
+		body, _ := json.Marshal(GraphQLRequest{Query: q, Variables: vars})
+		req, err := http.NewRequest("POST", server.URL+"/graphql", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d for %s", resp.StatusCode, q)
+		}
+		var res struct {
+			Data   json.RawMessage          `json:"data"`
+			Errors []map[string]interface{} `json:"errors"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return string(res.Data), res.Errors
+	}
+
+	store.batchLoads = 0
+	data, errs := query(ann, `{
+		me {
+			firstName
+			organisations { name members { role user { firstName email memberships { role } } } }
+		}
+	}`, nil)
+	if len(errs) > 0 {
+		t.Fatalf("got errors %v", errs)
+	}
+	want := `{"me":{"firstName":"Ann","organisations":[` +
+		`{"name":"Ann's Organisation","members":[{"role":"owner","user":{"firstName":"Ann","email":"ann@example.com","memberships":[{"role":"owner"},{"role":"owner"}]}}]},` +
+		`{"name":"Shared","members":[` +
+		`{"role":"owner","user":{"firstName":"Ann","email":"ann@example.com","memberships":[{"role":"owner"},{"role":"owner"}]}},` +
+		`{"role":"member","user":{"firstName":"Bola","email":"bola@example.com","memberships":[{"role":"member"}]}}]}]}}`
+	if data != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+	// the organisations of Ann, the members of both organisations and the organisations of Bola
+	if store.batchLoads != 3 {
+		t.Errorf("got %d batched loads, want 3", store.batchLoads)
+	}
+
+	data, _ = query(ann, `query($id: ID!) { user(id: $id) { firstName email phone } }`, map[string]interface{}{"id": bolaUser.UserID})
+	if data != `{"user":{"firstName":"Bola","email":null,"phone":null}}` {
+		t.Errorf("got %s, want Bola's public profile", data)
+	}
+	data, _ = query(ann, `query($id: ID!) { user(id: $id) { firstName } }`, map[string]interface{}{"id": chidiUser.UserID})
+	if data != `{"user":null}` {
+		t.Errorf("got %s for a user sharing no organisation, want null", data)
+	}
+
+	data, errs = query(chidi, `query($id: ID!) { organisation(id: $id) { name } me { firstName } }`, map[string]interface{}{"id": org.OrgID})
+	if len(errs) != 1 || errs[0]["message"] != "Unauthorized access" || data != `{"organisation":null,"me":{"firstName":"Chidi"}}` {
+		t.Errorf("got %s with errors %v for another organisation", data, errs)
+	}
+
+	_, errs = query(ann, `{ me { organisations { members { user { organisations { members { user { organisations { name } } } } } } } } }`, nil)
+	if len(errs) != 1 || !strings.Contains(errs[0]["message"].(string), "deep") {
+		t.Errorf("got errors %v for a deep query, want it rejected", errs)
+	}
+	_, errs = query(ann, `{ organisations { members { user { memberships { organisation { members { role } } } } } } }`, nil)
+	if len(errs) != 1 || !strings.Contains(errs[0]["message"].(string), "complexity") {
+		t.Errorf("got errors %v for a complex query, want it rejected", errs)
+	}
+	_, errs = query(ann, `{ me { password } }`, nil)
+	if len(errs) != 1 {
+		t.Errorf("got errors %v for an unknown field, want one", errs)
+	}
+
+	data, _ = query(ann, `{ __schema { queryType { name } } __type(name: "Membership") { fields { name type { kind ofType { name } } } } }`, nil)
+	if !strings.HasPrefix(data, `{"__schema":{"queryType":{"name":"Query"}},`) ||
+		!strings.Contains(data, `{"name":"role","type":{"kind":"NON_NULL","ofType":{"name":"String"}}}`) {
+		t.Errorf("got introspection %s", data)
+	}
+
+	// introspection types refer to each other, so introspection has limits too
+	data, errs = query(ann, introspectionQuery, nil)
+	if len(errs) != 0 || !strings.Contains(data, `"name":"Membership"`) {
+		t.Errorf("got errors %v for the introspection query of tools, want the schema", errs)
+	}
+	nested := "name"
+	for i := 0; i < 6; i++ {
+		nested = "fields { type { ofType { " + nested + " } } }"
+	}
+	_, errs = query(ann, "{ __schema { types { "+nested+" } } }", nil)
+	if len(errs) != 1 || !strings.Contains(errs[0]["message"].(string), "deep") {
+		t.Errorf("got errors %v for deeply nested introspection, want it rejected", errs)
+	}
+	_, errs = query(ann, `{ __schema { types { fields { type { ofType { fields { type { ofType { fields { type { ofType { fields { name } } } } } } } } } } } } }`, nil)
+	if len(errs) != 1 || !strings.Contains(errs[0]["message"].(string), "complexity") {
+		t.Errorf("got errors %v for complex introspection, want it rejected", errs)
+	}
+}
+
+// introspectionQuery is the query GraphQL tools send to load a schema
+const introspectionQuery = `
+query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types { ...FullType }
+    directives {
+      name
+      description
+      locations
+      args { ...InputValue }
+    }
+  }
+}
+
+fragment FullType on __Type {
+  kind
+  name
+  description
+  fields(includeDeprecated: true) {
+    name
+    description
+    args { ...InputValue }
+    type { ...TypeRef }
+    isDeprecated
+    deprecationReason
+  }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) {
+    name
+    description
+    isDeprecated
+    deprecationReason
+  }
+  possibleTypes { ...TypeRef }
+}
+
+fragment InputValue on __InputValue {
+  name
+  description
+  type { ...TypeRef }
+  defaultValue
+}
+
+fragment TypeRef on __Type {
+  kind
+  name
+  ofType {
+    kind
+    name
+    ofType {
+      kind
+      name
+      ofType {
+        kind
+        name
+        ofType {
+          kind
+          name
+          ofType {
+            kind
+            name
+            ofType {
+              kind
+              name
+              ofType {
+                kind
+                name
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
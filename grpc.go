@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	uzorgv1 "github.com/utukj/user-org-crud/proto/uzorg/v1"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// The code in proto/uzorg/v1 is generated from its .proto files by buf; see buf.gen.yaml.
+//go:generate buf generate
+
+// grpcForwardedMetadata lists the metadata of an RPC passed on to its REST route as headers
+var grpcForwardedMetadata = []string{"authorization", "idempotency-key", "if-match", "x-request-id", "user-agent"}
+
+// grpcReturnedHeaders lists the headers of a REST response sent back as header metadata
+var grpcReturnedHeaders = []string{"etag", "x-request-id", "idempotent-replayed"}
+
+// grpcGateway serves the gRPC API by calling the REST route each RPC is mapped to with the
+// google.api.http option in its .proto file, the way grpc-gateway maps REST onto gRPC the
+// other way round. Authentication, scopes, validation and authorisation are those of the REST
+// handlers, so the two APIs can't drift apart.
+type grpcGateway struct {
+	router http.Handler
+}
+
+// serveGRPC serves the gRPC API on UZORG_GRPC_ADDR, :9090 by default, answering every RPC
+// with the routes of router
+func serveGRPC(router http.Handler) {
+	addr := os.Getenv("UZORG_GRPC_ADDR")
+	if addr == "" {
+		addr = ":9090"
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("Could not listen for gRPC: ", err)
+	}
+
+	log.Println("Starting gRPC server on", addr)
+	log.Fatal(newGRPCServer(router).Serve(listener))
+}
+
+func newGRPCServer(router http.Handler) *grpc.Server {
+	gw := &grpcGateway{router: router}
+
+	s := grpc.NewServer()
+	uzorgv1.RegisterAuthServiceServer(s, &grpcAuthServer{gw: gw})
+	uzorgv1.RegisterUserServiceServer(s, &grpcUserServer{gw: gw})
+	uzorgv1.RegisterOrganisationServiceServer(s, &grpcOrganisationServer{gw: gw})
+	reflection.Register(s)
+	return s
+}
+
+type grpcAuthServer struct {
+	uzorgv1.UnimplementedAuthServiceServer
+	gw *grpcGateway
+}
+
+func (s *grpcAuthServer) Register(ctx context.Context, req *uzorgv1.RegisterRequest) (*uzorgv1.AuthResponse, error) {
+	res := &uzorgv1.AuthResponse{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+func (s *grpcAuthServer) Login(ctx context.Context, req *uzorgv1.LoginRequest) (*uzorgv1.AuthResponse, error) {
+	res := &uzorgv1.AuthResponse{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+type grpcUserServer struct {
+	uzorgv1.UnimplementedUserServiceServer
+	gw *grpcGateway
+}
+
+func (s *grpcUserServer) GetUser(ctx context.Context, req *uzorgv1.GetUserRequest) (*uzorgv1.User, error) {
+	res := &uzorgv1.User{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+func (s *grpcUserServer) UpdateUser(ctx context.Context, req *uzorgv1.UpdateUserRequest) (*uzorgv1.User, error) {
+	res := &uzorgv1.User{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+type grpcOrganisationServer struct {
+	uzorgv1.UnimplementedOrganisationServiceServer
+	gw *grpcGateway
+}
+
+func (s *grpcOrganisationServer) ListOrganisations(ctx context.Context, req *uzorgv1.ListOrganisationsRequest) (*uzorgv1.ListOrganisationsResponse, error) {
+	res := &uzorgv1.ListOrganisationsResponse{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+func (s *grpcOrganisationServer) GetOrganisation(ctx context.Context, req *uzorgv1.GetOrganisationRequest) (*uzorgv1.Organisation, error) {
+	res := &uzorgv1.Organisation{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+func (s *grpcOrganisationServer) CreateOrganisation(ctx context.Context, req *uzorgv1.CreateOrganisationRequest) (*uzorgv1.Organisation, error) {
+	res := &uzorgv1.Organisation{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+func (s *grpcOrganisationServer) DeleteOrganisation(ctx context.Context, req *uzorgv1.DeleteOrganisationRequest) (*emptypb.Empty, error) {
+	res := &emptypb.Empty{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+func (s *grpcOrganisationServer) ListMembers(ctx context.Context, req *uzorgv1.ListMembersRequest) (*uzorgv1.ListMembersResponse, error) {
+	res := &uzorgv1.ListMembersResponse{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+func (s *grpcOrganisationServer) AddMember(ctx context.Context, req *uzorgv1.AddMemberRequest) (*emptypb.Empty, error) {
+	res := &emptypb.Empty{}
+	return res, s.gw.forward(ctx, req, res)
+}
+
+// httpRule returns the REST route a gRPC method is mapped to
+func httpRule(method protoreflect.MethodDescriptor) (verb, path string, rule *annotations.HttpRule) {
+	rule, _ = proto.GetExtension(method.Options(), annotations.E_Http).(*annotations.HttpRule)
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		return http.MethodGet, p.Get, rule
+	case *annotations.HttpRule_Put:
+		return http.MethodPut, p.Put, rule
+	case *annotations.HttpRule_Post:
+		return http.MethodPost, p.Post, rule
+	case *annotations.HttpRule_Delete:
+		return http.MethodDelete, p.Delete, rule
+	case *annotations.HttpRule_Patch:
+		return http.MethodPatch, p.Patch, rule
+	}
+	return "", "", rule
+}
+
+// forward calls the REST route of the RPC in ctx with req and fills res with the data of its response
+func (gw *grpcGateway) forward(ctx context.Context, req, res proto.Message) error {
+	fullMethod, _ := grpc.Method(ctx)
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(strings.ReplaceAll(strings.TrimPrefix(fullMethod, "/"), "/", ".")))
+	if err != nil {
+		return status.Errorf(codes.Unimplemented, "Unknown method %s", fullMethod)
+	}
+	verb, template, rule := httpRule(desc.(protoreflect.MethodDescriptor))
+	if verb == "" {
+		return status.Errorf(codes.Unimplemented, "Method %s has no REST route", fullMethod)
+	}
+
+	// fields named in the path are taken out of the rest of the request
+	rest := proto.Clone(req)
+	fields := rest.ProtoReflect().Descriptor().Fields()
+	var pathErr error
+	path := pathParamPattern.ReplaceAllStringFunc(template, func(param string) string {
+		field := fields.ByName(protoreflect.Name(strings.Trim(param, "{}")))
+		if field == nil {
+			pathErr = status.Errorf(codes.Internal, "Route of %s names unknown field %s", fullMethod, param)
+			return param
+		}
+		value := rest.ProtoReflect().Get(field).String()
+		if value == "" {
+			pathErr = status.Errorf(codes.InvalidArgument, "%s is required", field.Name())
+		}
+		rest.ProtoReflect().Clear(field)
+		return url.PathEscape(value)
+	})
+	if pathErr != nil {
+		return pathErr
+	}
+
+	var body []byte
+	if rule.GetBody() == "*" {
+		body, err = protojson.Marshal(rest)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Error encoding request: %v", err)
+		}
+	} else {
+		// the rest of a request without a body is sent in the query
+		query := url.Values{}
+		rest.ProtoReflect().Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+			if !field.IsList() && !field.IsMap() && field.Message() == nil {
+				query.Set(field.JSONName(), value.String())
+			}
+			return true
+		})
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, verb, path, bytes.NewReader(body))
+	if err != nil {
+		return status.Errorf(codes.Internal, "Error creating request: %v", err)
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range grpcForwardedMetadata {
+		if values := md.Get(key); len(values) > 0 {
+			r.Header.Set(key, values[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	w := &grpcResponseWriter{header: http.Header{}}
+	gw.router.ServeHTTP(w, r)
+
+	var header metadata.MD
+	for _, key := range grpcReturnedHeaders {
+		if value := w.header.Get(key); value != "" {
+			header = metadata.Join(header, metadata.Pairs(key, value))
+		}
+	}
+	if header != nil {
+		grpc.SetHeader(ctx, header)
+	}
+
+	if w.status >= 400 {
+		return grpcError(w.status, w.body.Bytes())
+	}
+
+	var response struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.body.Bytes(), &response); err != nil || len(response.Data) == 0 || string(response.Data) == "null" {
+		return nil
+	}
+
+	// the data of the response fills one field of res when the route names it
+	data := response.Data
+	if rule.GetResponseBody() != "" {
+		field := res.ProtoReflect().Descriptor().Fields().ByName(protoreflect.Name(rule.GetResponseBody()))
+		if field == nil {
+			return status.Errorf(codes.Internal, "Route of %s names unknown field %s", fullMethod, rule.GetResponseBody())
+		}
+		data, _ = json.Marshal(map[string]json.RawMessage{field.JSONName(): data})
+	}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, res); err != nil {
+		return status.Errorf(codes.Internal, "Error decoding response: %v", err)
+	}
+	return nil
+}
+
+// grpcError turns an error response of the REST API into a gRPC status with the same message
+func grpcError(statusCode int, body []byte) error {
+	message := strings.TrimSpace(string(body))
+
+	var errResp ErrorResponse
+	var validationResp ValidationErrorResponse
+	if json.Unmarshal(body, &validationResp) == nil && len(validationResp.Errors) > 0 {
+		var fields []string
+		for _, e := range validationResp.Errors {
+			fields = append(fields, fmt.Sprintf("%s: %s", e.Field, e.Message))
+		}
+		message = strings.Join(fields, "; ")
+	} else if json.Unmarshal(body, &errResp) == nil && errResp.Message != "" {
+		message = errResp.Message
+	}
+
+	code := codes.Unknown
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusPreconditionFailed, http.StatusPreconditionRequired:
+		code = codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		code = codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	default:
+		if statusCode >= 500 {
+			code = codes.Internal
+		}
+	}
+	return status.Error(code, message)
+}
+
+// grpcResponseWriter keeps the response of a REST route called for an RPC
+type grpcResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *grpcResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *grpcResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *grpcResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	uzorgv1 "github.com/utukj/user-org-crud/proto/uzorg/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func newGRPCTestClient(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	_, server := newClientTestServer(t)
+
+	listener := bufconn.Listen(1 << 20)
+	s := newGRPCServer(server.Config.Handler)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPCRoutesExist(t *testing.T) {
+	_, server := newClientTestServer(t)
+	router := server.Config.Handler.(*mux.Router)
+
+	for _, file := range []protoreflect.FileDescriptor{
+		uzorgv1.File_uzorg_v1_auth_proto, uzorgv1.File_uzorg_v1_users_proto, uzorgv1.File_uzorg_v1_organisations_proto,
+	} {
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			methods := services.Get(i).Methods()
+			for j := 0; j < methods.Len(); j++ {
+				method := methods.Get(j)
+				verb, path, _ := httpRule(method)
+				if verb == "" {
+					t.Errorf("%s has no REST route", method.FullName())
+					continue
+				}
+				path = pathParamPattern.ReplaceAllString(path, "6f1c1fd0-8a7e-4d84-9b1b-2f4a3f9f6d0e")
+				req, _ := http.NewRequest(verb, path, nil)
+				var match mux.RouteMatch
+				if !router.Match(req, &match) || match.MatchErr != nil {
+					t.Errorf("%s is mapped to %s %s, which is not a route", method.FullName(), verb, path)
+				}
+			}
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	conn := newGRPCTestClient(t)
+	ctx := context.Background()
+	auth := uzorgv1.NewAuthServiceClient(conn)
+	users := uzorgv1.NewUserServiceClient(conn)
+	orgs := uzorgv1.NewOrganisationServiceClient(conn)
+
+	register := func(first, email string) *uzorgv1.AuthResponse {
+		t.Helper()
+		res, err := auth.Register(ctx, &uzorgv1.RegisterRequest{
+			FirstName: first,
+			LastName:  "Tester",
+			Email:     email,
+			Password:  "correct horse battery",
+			Phone:     "+2348012345678",
+		})
+		if err != nil {
+			t.Fatalf("registering %s: %v", email, err)
+		}
+		return res
+	}
+	ann := register("Ann", "ann@example.com")
+	bola := register("Bola", "bola@example.com")
+	if ann.AccessToken == "" || ann.User.GetFirstName() != "Ann" {
+		t.Fatalf("got %v registering", ann)
+	}
+	asAnn := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+ann.AccessToken)
+
+	_, err := auth.Register(ctx, &uzorgv1.RegisterRequest{FirstName: "No", Email: "not-an-email"})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "email") {
+		t.Errorf("got %v registering an invalid user, want InvalidArgument naming the email", err)
+	}
+	if _, err := orgs.ListOrganisations(ctx, &uzorgv1.ListOrganisationsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v without a token, want Unauthenticated", err)
+	}
+
+	org, err := orgs.CreateOrganisation(asAnn, &uzorgv1.CreateOrganisationRequest{Name: "Shared", Description: "Ann and Bola"})
+	if err != nil || org.OrgId == "" || org.Name != "Shared" {
+		t.Fatalf("got %v, %v creating an organisation", org, err)
+	}
+
+	if _, err := users.GetUser(asAnn, &uzorgv1.GetUserRequest{UserId: bola.User.UserId}); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for a user sharing no organisation, want NotFound", err)
+	}
+	if _, err := orgs.AddMember(asAnn, &uzorgv1.AddMemberRequest{OrgId: org.OrgId, UserId: bola.User.UserId}); err != nil {
+		t.Fatal(err)
+	}
+	other, err := users.GetUser(asAnn, &uzorgv1.GetUserRequest{UserId: bola.User.UserId})
+	if err != nil || other.FirstName != "Bola" || other.Email != "" {
+		t.Errorf("got %v, %v for a fellow member, want their public profile", other, err)
+	}
+
+	members, err := orgs.ListMembers(asAnn, &uzorgv1.ListMembersRequest{OrgId: org.OrgId})
+	if err != nil || len(members.Members) != 2 {
+		t.Fatalf("got %v, %v listing members, want 2", members, err)
+	}
+	for _, m := range members.Members {
+		if m.Email == "" || m.Role == "" {
+			t.Errorf("got member %v, want their email and role", m)
+		}
+	}
+	list, err := orgs.ListOrganisations(asAnn, &uzorgv1.ListOrganisationsRequest{})
+	if err != nil || len(list.Organisations) != 2 {
+		t.Errorf("got %v, %v listing organisations, want 2", list, err)
+	}
+
+	var header metadata.MD
+	if _, err := users.GetUser(asAnn, &uzorgv1.GetUserRequest{UserId: ann.User.UserId}, grpc.Header(&header)); err != nil {
+		t.Fatal(err)
+	}
+	name := "Annie"
+	update := &uzorgv1.UpdateUserRequest{UserId: ann.User.UserId, FirstName: &name}
+	if _, err := users.UpdateUser(asAnn, update); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v updating without if-match, want FailedPrecondition", err)
+	}
+	updated, err := users.UpdateUser(metadata.AppendToOutgoingContext(asAnn, "if-match", header.Get("etag")[0]), update)
+	if err != nil || updated.FirstName != "Annie" || updated.LastName != "Tester" {
+		t.Errorf("got %v, %v updating with if-match", updated, err)
+	}
+
+	if _, err := orgs.GetOrganisation(asAnn, &uzorgv1.GetOrganisationRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v without an org_id, want InvalidArgument", err)
+	}
+	asBola := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+bola.AccessToken)
+	if _, err := orgs.DeleteOrganisation(asBola, &uzorgv1.DeleteOrganisationRequest{OrgId: org.OrgId}); err == nil {
+		t.Error("got no error deleting an organisation as a member")
+	}
+}
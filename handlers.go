@@ -6,26 +6,41 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// ReqHandler contains the database connection
+// ReqHandler contains the database connection, the password hashers and policy, the mailer,
+// the configured identity providers and the issuer of tokens for client applications
 type ReqHandler struct {
-	uzorgStore UzorgStorer
+	uzorgStore     UzorgStorer
+	passwords      *PasswordHashers
+	passwordPolicy *PasswordPolicy
+	mailer         Mailer
+	oidcProviders  map[string]*OIDCProvider
+	issuer         *OIDCIssuer
 }
 
-// GenerateJWT generates a JWT token for a user
-func GenerateJWT(user User) (string, error) {
+// UzorgClaims are the claims carried by access tokens issued by the server
+type UzorgClaims struct {
+	jwt.StandardClaims
+	// Scopes granted to the token. Tokens issued before scopes were introduced carry none and
+	// are refused by every route that requires one, so their holders have to log in again.
+	Scopes []string `json:"scopes"`
+}
+
+// GenerateJWT generates a JWT token for a user bound to a login session and granting the given scopes
+func GenerateJWT(user User, session *Session, scopes []string) (string, error) {
 	var jwtKey = []byte(os.Getenv("UZORG_JWT_SECRET"))
-	expirationTime := time.Now().Add(24 * time.Hour) // Token is valid for 1 day
-	claims := &jwt.StandardClaims{
-		Subject:   user.UserID,
-		ExpiresAt: expirationTime.Unix(),
+	claims := &UzorgClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        session.SessionID,
+			Subject:   user.UserID,
+			ExpiresAt: session.ExpiresAt.Unix(),
+		},
+		Scopes: scopes,
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -49,6 +64,9 @@ func (h *ReqHandler) registerUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	errs := req.Validate()
+	if req.Password != "" {
+		errs = append(errs, h.passwordPolicy.Check("RegisterUserRequest.Password", req.Password, req.Email, req.FirstName, req.LastName)...)
+	}
 	if len(errs) > 0 {
 		writeValidationErrorResponse(w, errs)
 		return
@@ -56,7 +74,7 @@ func (h *ReqHandler) registerUser(w http.ResponseWriter, r *http.Request) {
 
 	userID := uuid.New().String()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := h.passwords.Hash(req.Password)
 	if err != nil {
 		writeServerErrorResponse(w, fmt.Sprintf("Error hashing password: %v", err))
 		return
@@ -68,7 +86,7 @@ func (h *ReqHandler) registerUser(w http.ResponseWriter, r *http.Request) {
 		LastName:  req.LastName,
 		Email:     req.Email,
 		Phone:     req.Phone,
-		Password:  string(hashedPassword),
+		Password:  hashedPassword,
 	}
 
 	// check that the user does not already exist by email
@@ -80,14 +98,17 @@ func (h *ReqHandler) registerUser(w http.ResponseWriter, r *http.Request) {
 
 	org := makeUserDefaultOrg(&user)
 
-	err = h.uzorgStore.InsertUserAndDefaultOrg(&user, &org)
+	ev := newAuditEvent(r, AuditUserRegistered, "user", user.UserID)
+	ev.OrgID = org.OrgID
+	ev.ActorID = user.UserID
+	err = h.uzorgStore.InsertUserAndDefaultOrg(&user, &org, ev)
 	if err != nil {
 		writeServerErrorResponse(w, fmt.Sprintf("Error inserting user into database: %v", err))
 		return
 	}
 
-	// generate token for user
-	token, err := GenerateJWT(user)
+	// start a session and generate token for user
+	token, err := h.startSession(&user, r)
 
 	if err != nil {
 		writeServerErrorResponse(w, fmt.Sprintf("Error while generating jwt: %s", err))
@@ -127,15 +148,30 @@ func (h *ReqHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
-	if err != nil {
+	ok, needsRehash, err := h.passwords.Verify(req.Password, user.Password)
+	if err != nil || !ok {
 		log.Println("Error comparing password: ", err)
-		log.Println("Hashed Password: ", user.Password)
 		writeBadRequestResponse(w, http.StatusUnauthorized, "Authentication failed")
 		return
 	}
 
-	token, err := GenerateJWT(user)
+	if user.DeletedAt != nil {
+		writeBadRequestResponse(w, http.StatusForbidden, "Account is scheduled for deletion, restore it to sign in")
+		return
+	}
+
+	// transparently upgrade hashes made with an outdated algorithm or parameters
+	if needsRehash {
+		hashedPassword, err := h.passwords.Hash(req.Password)
+		if err == nil {
+			err = h.uzorgStore.UpdateUserPassword(user.UserID, hashedPassword, nil)
+		}
+		if err != nil {
+			log.Println("Error rehashing password: ", err)
+		}
+	}
+
+	token, err := h.startSession(&user, r)
 	if err != nil {
 		log.Println("Error generating token: ", err)
 		writeServerErrorResponse(w, "Error generating token")
@@ -157,7 +193,8 @@ func (h *ReqHandler) Login(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-// Implement handler for /api/users/:id
+// Implement handler for /api/users/:id. Users get their own full profile, and the public
+// profile of users they share an organisation with. Anyone else is reported as not found.
 func (h *ReqHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -167,22 +204,147 @@ func (h *ReqHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 	// retrieve userId from context claim
 	userID := r.Context().Value("userId").(string)
 
+	if _, err := uuid.Parse(id); err != nil {
+		writeBadRequestResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	if id != userID {
+		shared, err := h.uzorgStore.UsersShareOrg(userID, id)
+		if err != nil {
+			writeServerErrorResponse(w, fmt.Sprintf("Error checking shared orgs: %v", err))
+			return
+		}
+
+		if !shared {
+			log.Printf("Requested user id [%s] shares no org with token user id [%s]", id, userID)
+			writeBadRequestResponse(w, http.StatusNotFound, "User not found")
+			return
+		}
+	}
+
+	user, err := h.uzorgStore.GetUserByID(id)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+
+	if id != userID {
+		if notModified(w, r, entityTag(user.Version, "public")) {
+			return
+		}
+
+		response := GetPublicUserResponse{
+			ResponseStatus: ResponseStatus{
+				Status:  SuccessStatus,
+				Message: "User retrieved successfully",
+			},
+			Data: &PublicUser{
+				UserID:    user.UserID,
+				FirstName: user.FirstName,
+				LastName:  user.LastName,
+			},
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if notModified(w, r, entityTag(user.Version, "")) {
+		return
+	}
+
+	response := GetUserResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "User retrieved successfully",
+		},
+		Data: &user,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for PATCH /api/users/{id} that updates the profile of the logged in user.
+// The request carries the ETag of the version it was based on in If-Match, or that version in
+// the body, so concurrent edits are rejected rather than lost.
+func (h *ReqHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
 	if id != userID {
 		log.Printf("Requested user id [%s] does not match token user id [%s]", id, userID)
 		writeBadRequestResponse(w, http.StatusUnauthorized, "Unauthorized access")
 		return
 	}
 
+	var req UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
 	user, err := h.uzorgStore.GetUserByID(id)
 	if err != nil {
 		writeServerErrorResponse(w, fmt.Sprintf("Error getting user: %v", err))
 		return
 	}
 
-	response := GetUserResponse{
+	// clients written before ETags send the version in the body instead of If-Match
+	if req.Version == 0 || r.Header.Get("If-Match") != "" {
+		if !requireIfMatch(w, r, entityTag(user.Version, "")) {
+			return
+		}
+	}
+	if req.Version != 0 && req.Version != user.Version {
+		writeBadRequestResponse(w, http.StatusPreconditionFailed, "User was modified by another request, fetch it again and retry")
+		return
+	}
+
+	if req.FirstName != nil {
+		user.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		user.LastName = *req.LastName
+	}
+	if req.Phone != nil {
+		user.Phone = *req.Phone
+	}
+
+	updated, err := h.uzorgStore.UpdateUser(&user, user.Version, newAuditEvent(r, AuditUserUpdated, "user", user.UserID))
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error updating user: %v", err))
+		return
+	}
+
+	if !updated {
+		writeBadRequestResponse(w, http.StatusPreconditionFailed, "User was modified by another request, fetch it again and retry")
+		return
+	}
+
+	w.Header().Set("ETag", entityTag(user.Version, ""))
+
+	response := UpdateUserResponse{
 		ResponseStatus: ResponseStatus{
 			Status:  SuccessStatus,
-			Message: "User retrieved successfully",
+			Message: "User updated successfully",
 		},
 		Data: &user,
 	}
@@ -247,7 +409,9 @@ func (h *ReqHandler) CreateOrg(w http.ResponseWriter, r *http.Request) {
 		Description: req.Description,
 	}
 
-	err := h.uzorgStore.InsertOrgAndAddUser(&org, userID)
+	ev := newAuditEvent(r, AuditOrgCreated, "org", org.OrgID)
+	ev.OrgID = org.OrgID
+	err := h.uzorgStore.InsertOrgAndAddUser(&org, userID, ev)
 	if err != nil {
 		writeServerErrorResponse(w, fmt.Sprintf("Error inserting org: %v", err))
 		return
@@ -293,6 +457,10 @@ func (h *ReqHandler) GetOrg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if notModified(w, r, entityTag(org.Version, "")) {
+		return
+	}
+
 	response := GetOrgResponse{
 		ResponseStatus: ResponseStatus{
 			Status:  SuccessStatus,
@@ -402,7 +570,9 @@ func (h *ReqHandler) AddUserToOrg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.uzorgStore.AddUserToOrg(user.UserID, orgID)
+	ev := newAuditEvent(r, AuditMemberAdded, "user", user.UserID)
+	ev.OrgID = orgID
+	err = h.uzorgStore.AddUserToOrg(user.UserID, orgID, ev)
 	if err != nil {
 		writeServerErrorResponse(w, fmt.Sprintf("Error adding user to org: %v", err))
 		return
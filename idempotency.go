@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotencyKeyMaxLength = 255
+	// how long a request holds its key before a retry may take it over, in case the server
+	// processing it stopped before recording its response
+	idempotencyLock = time.Minute
+)
+
+// replayedHeaders are the response headers recorded for idempotent requests
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// idempotencyTTL is how long the response to a request made with an Idempotency-Key is replayed.
+// It is configured in hours with UZORG_IDEMPOTENCY_TTL_HOURS.
+func idempotencyTTL() time.Duration {
+	return time.Duration(envInt("UZORG_IDEMPOTENCY_TTL_HOURS", 24)) * time.Hour
+}
+
+// requestFingerprint identifies a request by its method, path and body, to detect a key reused for another request
+func requestFingerprint(r *http.Request, body []byte) string {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s %s\n", r.Method, r.URL.Path)
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// IdempotencyMiddleware makes POST requests carrying an Idempotency-Key safe to retry. The response
+// to the first request with a key is recorded per user and replayed for retries until the key
+// expires. Reusing a key for a different request is rejected with 422, and retrying while the
+// first request is still being processed with 409. Responses with a server error are not
+// recorded so the request can be retried with the same key.
+func (h *ReqHandler) IdempotencyMiddleware(next http.Handler) http.Handler {
+	return h.idempotency(next, true)
+}
+
+// SecretIdempotencyMiddleware is IdempotencyMiddleware for requests whose response carries a
+// secret, which must not be kept in the database. Only the status of the response is recorded,
+// and retries of a completed request are rejected with 409 rather than replayed.
+func (h *ReqHandler) SecretIdempotencyMiddleware(next http.Handler) http.Handler {
+	return h.idempotency(next, false)
+}
+
+func (h *ReqHandler) idempotency(next http.Handler, replay bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > idempotencyKeyMaxLength {
+			w.Header().Set("Content-Type", "application/json")
+			writeBadRequestResponse(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", idempotencyKeyMaxLength))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeBadRequestResponse(w, http.StatusBadRequest, fmt.Sprintf("Error reading request: %v", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID := r.Context().Value("userId").(string)
+		now := time.Now()
+		record := IdempotencyKey{
+			UserID:      userID,
+			Key:         key,
+			Fingerprint: requestFingerprint(r, body),
+			ExpiresAt:   now.Add(idempotencyTTL()),
+		}
+
+		existing, reserved, err := h.uzorgStore.ReserveIdempotencyKey(&record, now.Add(idempotencyLock))
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeServerErrorResponse(w, fmt.Sprintf("Error reserving idempotency key: %v", err))
+			return
+		}
+
+		if !reserved {
+			if existing.Fingerprint != record.Fingerprint {
+				w.Header().Set("Content-Type", "application/json")
+				writeBadRequestResponse(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+				return
+			}
+			if !existing.Completed {
+				w.Header().Set("Content-Type", "application/json")
+				writeBadRequestResponse(w, http.StatusConflict, "A request with this Idempotency-Key is still being processed")
+				return
+			}
+			if !replay {
+				w.Header().Set("Content-Type", "application/json")
+				writeBadRequestResponse(w, http.StatusConflict, "A request with this Idempotency-Key was already processed and its response is not kept as it contains a secret")
+				return
+			}
+
+			for name, values := range existing.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(existing.StatusCode)
+			w.Write(existing.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		if rec.status >= 500 {
+			if err := h.uzorgStore.ReleaseIdempotencyKey(userID, key); err != nil {
+				log.Printf("Error releasing idempotency key %s: %v", key, err)
+			}
+			return
+		}
+
+		record.StatusCode = rec.status
+		record.Header = map[string][]string{}
+		if replay {
+			record.Body = rec.body.Bytes()
+			for _, name := range replayedHeaders {
+				if values := w.Header().Values(name); len(values) > 0 {
+					record.Header[name] = values
+				}
+			}
+		}
+		if err := h.uzorgStore.CompleteIdempotencyKey(&record); err != nil {
+			log.Printf("Error recording response for idempotency key %s: %v", key, err)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) ReserveIdempotencyKey(k *IdempotencyKey, lockedUntil time.Time) (IdempotencyKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := k.UserID + "|" + k.Key
+	if existing, ok := s.idempotencyKeys[id]; ok && existing.ExpiresAt.After(time.Now()) {
+		return *existing, false, nil
+	}
+	stored := *k
+	s.idempotencyKeys[id] = &stored
+	return *k, true, nil
+}
+
+func (s *memoryStore) CompleteIdempotencyKey(k *IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *k
+	stored.Completed = true
+	s.idempotencyKeys[k.UserID+"|"+k.Key] = &stored
+	return nil
+}
+
+func (s *memoryStore) ReleaseIdempotencyKey(userID, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.idempotencyKeys, userID+"|"+key)
+	return nil
+}
+
+func TestIdempotentCreateOrg(t *testing.T) {
+	_, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	c := client.New(server.URL)
+	registerTestUser(t, c, "Ida", "ida@example.com")
+
+	post := func(key, body string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/organisations", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token())
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(raw)
+	}
+
+	body := `{"name": "Retry Inc", "description": "Created once"}`
+	first, firstBody := post("create-retry-inc", body)
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", first.StatusCode, http.StatusCreated, firstBody)
+	}
+
+	retry, retryBody := post("create-retry-inc", body)
+	if retry.StatusCode != http.StatusCreated || retryBody != firstBody {
+		t.Errorf("retry got %d %s, want the first response replayed", retry.StatusCode, retryBody)
+	}
+	if retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("retry is missing the Idempotent-Replayed header")
+	}
+	if retry.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("retry got Content-Type %q", retry.Header.Get("Content-Type"))
+	}
+
+	orgs, err := c.GetOrgs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 2 {
+		t.Errorf("got %d orgs, want the default one and one created org", len(orgs))
+	}
+
+	reused, reusedBody := post("create-retry-inc", `{"name": "Other Inc", "description": "Different"}`)
+	if reused.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("key reuse got %d %s, want %d", reused.StatusCode, reusedBody, http.StatusUnprocessableEntity)
+	}
+
+	// keys are scoped to their user
+	other := client.New(server.URL)
+	registerTestUser(t, other, "Otto", "otto@example.com")
+	c = other
+	resp, respBody := post("create-retry-inc", body)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("another user's request got %d %s, want a new org", resp.StatusCode, respBody)
+	}
+	var created CreateOrgResponse
+	if err := json.Unmarshal([]byte(respBody), &created); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(firstBody, created.Data.OrgID) {
+		t.Error("another user's request was answered with the first user's org")
+	}
+}
+
+func TestIdempotentRequestsKeepNoSecrets(t *testing.T) {
+	store, server := newClientTestServer(t)
+
+	c := client.New(server.URL)
+	user := registerTestUser(t, c, "Ida", "ida@example.com")
+
+	post := func(key, body string, out interface{}) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/users/me/api-keys", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token())
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp
+	}
+
+	body := `{"name":"deploy","scopes":["orgs:read"]}`
+	var created CreateAPIKeyResponse
+	if resp := post("create-deploy-key", body, &created); resp.StatusCode != http.StatusCreated || created.Data == nil {
+		t.Fatalf("got status %d creating an API key, want 201", resp.StatusCode)
+	}
+
+	store.mu.Lock()
+	record := *store.idempotencyKeys[user.UserID+"|create-deploy-key"]
+	keys := len(store.apiKeys)
+	store.mu.Unlock()
+	if !record.Completed || record.StatusCode != http.StatusCreated || len(record.Body) != 0 || len(record.Header) != 0 {
+		t.Errorf("got recorded response %d %q %v, want the status only", record.StatusCode, record.Body, record.Header)
+	}
+
+	// retries are rejected rather than creating another key or replaying the secret
+	var retried ErrorResponse
+	if resp := post("create-deploy-key", body, &retried); resp.StatusCode != http.StatusConflict || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("got status %d retrying, want 409 without a replay", resp.StatusCode)
+	}
+	if strings.Contains(retried.Message, created.Data.Key) {
+		t.Error("the retry was answered with the secret")
+	}
+	store.mu.Lock()
+	if len(store.apiKeys) != keys {
+		t.Errorf("got %d API keys after the retry, want %d", len(store.apiKeys), keys)
+	}
+	store.mu.Unlock()
+
+	if resp := post("create-deploy-key", `{"name":"other","scopes":["orgs:read"]}`, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d reusing the key for another request, want 422", resp.StatusCode)
+	}
+}
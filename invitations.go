@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// how long an invitation to join an organisation can be accepted
+const invitationTTL = 7 * 24 * time.Hour
+
+// sendInvitation emails the token accepting an invitation to the invited address
+func (h *ReqHandler) sendInvitation(inv *Invitation, org *Org, token string) error {
+	name := org.Name
+	if name == "" {
+		name = "an organisation"
+	}
+	return h.mailer.Send(
+		inv.Email,
+		fmt.Sprintf("You are invited to join %s", name),
+		fmt.Sprintf(
+			"Hi,\n\nYou are invited to join %s as %s. Register at %s with this email address, then accept the invitation within %d days with this code:\n\n%s\n",
+			name, inv.Role, publicURL(apiV1Prefix+"/auth/register"), int(invitationTTL/(24*time.Hour)), token,
+		),
+	)
+}
+
+// handler for POST /api/invitations/accept that adds the logged in user to the organisation
+// they were invited to, with the role of the invitation. The token emailed with the
+// invitation proves it reached them, so they may have registered with another email.
+func (h *ReqHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req AcceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	inv, err := h.uzorgStore.AcceptInvitation(hashAPIKey(req.Token), userID, newAuditEvent(r, AuditMemberAdded, "user", userID))
+	if errors.Is(err, ErrNotFound) {
+		writeBadRequestResponse(w, http.StatusBadRequest, "Invalid or expired invitation")
+		return
+	}
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error accepting invitation: %v", err))
+		return
+	}
+
+	org, err := h.uzorgStore.GetOrg(inv.OrgID)
+	if err != nil {
+		log.Println("Error getting org of accepted invitation: ", err)
+		org = Org{OrgID: inv.OrgID}
+	}
+
+	response := AcceptInvitationResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Invitation accepted successfully",
+		},
+		Data: &org,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Mailer sends plain text emails to users
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// LogMailer writes emails to the log instead of sending them. It is used when no SMTP server is configured.
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	msg := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+// loadMailer configures email delivery from the environment. UZORG_SMTP_ADDR is the host:port
+// of the SMTP server, UZORG_SMTP_FROM the sender address and UZORG_SMTP_USERNAME and
+// UZORG_SMTP_PASSWORD optional credentials. Without a server emails are only logged.
+func loadMailer() Mailer {
+	addr := os.Getenv("UZORG_SMTP_ADDR")
+	if addr == "" {
+		log.Println("UZORG_SMTP_ADDR is not set, emails will be logged instead of sent")
+		return LogMailer{}
+	}
+
+	m := &SMTPMailer{
+		Addr: addr,
+		From: os.Getenv("UZORG_SMTP_FROM"),
+	}
+	if username := os.Getenv("UZORG_SMTP_USERNAME"); username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.Auth = smtp.PlainAuth("", username, os.Getenv("UZORG_SMTP_PASSWORD"), host)
+	}
+	return m
+}
+
+// publicURL returns the base URL users reach the server at, for links in emails
+func publicURL(path string) string {
+	base := strings.TrimSuffix(os.Getenv("UZORG_PUBLIC_URL"), "/")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return fmt.Sprintf("%s%s", base, path)
+}
@@ -5,32 +5,43 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	serve()
+}
+
+// openDB connects to the database at UZORG_DB_URL
+func openDB() *sql.DB {
 
 	// err := godotenv.Load()
 	// if err != nil {
 	// 	log.Fatal("Error loading .env file")
 	// }
 
-	connectionURL := os.Getenv("UZORG_DB_URL")
-
-	db, err := sql.Open("postgres", connectionURL)
+	db, err := sql.Open("postgres", os.Getenv("UZORG_DB_URL"))
 	if err != nil {
 		log.Fatal("Could not open postgress connection: ", err)
 	}
-	defer db.Close()
 
 	err = db.Ping()
 	if err != nil {
 		log.Fatal("Could not ping postgress: ", err)
 	}
+	return db
+}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
+// migrate creates the tables of the server and brings existing ones up to date. Every
+// statement can run again on an up to date database.
+func migrate(db *sql.DB) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS users (
 		user_id UUID PRIMARY KEY,
 		first_name TEXT,
 		last_name TEXT,
@@ -42,6 +53,24 @@ func main() {
 		log.Fatal("Could not create users table: ", err)
 	}
 
+	// version is bumped on every profile update for optimistic concurrency
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1`)
+	if err != nil {
+		log.Fatal("Could not add version to users table: ", err)
+	}
+
+	// deleted_at marks accounts in their deletion grace period
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`)
+	if err != nil {
+		log.Fatal("Could not add deleted_at to users table: ", err)
+	}
+
+	// email_verified is released as a claim by the OpenID Connect provider
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE`)
+	if err != nil {
+		log.Fatal("Could not add email_verified to users table: ", err)
+	}
+
 	// Updated org table without user_id
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS orgs (
 		org_id UUID PRIMARY KEY,
@@ -52,6 +81,12 @@ func main() {
 		log.Fatal("Could not create orgs table: ", err)
 	}
 
+	// version is bumped on every change of an organisation and backs its ETag
+	_, err = db.Exec(`ALTER TABLE orgs ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1`)
+	if err != nil {
+		log.Fatal("Could not add version to orgs table: ", err)
+	}
+
 	// New org_users join table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS org_users (
 		org_id UUID,
@@ -64,25 +99,500 @@ func main() {
 		log.Fatal("Could not create org_users table: ", err)
 	}
 
+	_, err = db.Exec(`ALTER TABLE org_users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'member'`)
+	if err != nil {
+		log.Fatal("Could not add role to org_users table: ", err)
+	}
+
+	// memberships created before roles existed were all equal, so every member of an
+	// organisation without an owner becomes an owner
+	_, err = db.Exec(`UPDATE org_users SET role = 'owner' WHERE org_id IN (
+		SELECT org_id FROM org_users GROUP BY org_id HAVING bool_and(role <> 'owner')
+	)`)
+	if err != nil {
+		log.Fatal("Could not backfill org owners: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_keys (
+		key_id UUID PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		name TEXT,
+		prefix TEXT,
+		key_hash TEXT UNIQUE NOT NULL,
+		scopes TEXT[] NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_used_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ
+	)`)
+	if err != nil {
+		log.Fatal("Could not create api_keys table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_identities (
+		issuer TEXT,
+		subject TEXT,
+		user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (issuer, subject)
+	)`)
+	if err != nil {
+		log.Fatal("Could not create user_identities table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS oidc_login_states (
+		state TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		log.Fatal("Could not create oidc_login_states table: ", err)
+	}
+
+	// restore lets users without a password restore their deleted account by logging in
+	_, err = db.Exec(`ALTER TABLE oidc_login_states ADD COLUMN IF NOT EXISTS restore BOOLEAN NOT NULL DEFAULT FALSE`)
+	if err != nil {
+		log.Fatal("Could not add restore to oidc_login_states table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS oauth_clients (
+		client_id TEXT PRIMARY KEY,
+		client_secret_hash TEXT NOT NULL,
+		name TEXT,
+		redirect_uris TEXT[] NOT NULL,
+		owner_user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		log.Fatal("Could not create oauth_clients table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS oauth_consents (
+		user_id UUID REFERENCES users(user_id) ON DELETE CASCADE,
+		client_id TEXT REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+		scopes TEXT[] NOT NULL,
+		granted_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (user_id, client_id)
+	)`)
+	if err != nil {
+		log.Fatal("Could not create oauth_consents table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS oauth_codes (
+		code_hash TEXT PRIMARY KEY,
+		client_id TEXT NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+		user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		redirect_uri TEXT NOT NULL,
+		scopes TEXT[] NOT NULL,
+		nonce TEXT,
+		code_challenge TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		log.Fatal("Could not create oauth_codes table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		session_id UUID PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		user_agent TEXT,
+		ip_address TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		revoked_at TIMESTAMPTZ
+	)`)
+	if err != nil {
+		log.Fatal("Could not create sessions table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS email_changes (
+		token_hash TEXT PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		new_email TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		used_at TIMESTAMPTZ
+	)`)
+	if err != nil {
+		log.Fatal("Could not create email_changes table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS data_exports (
+		export_id UUID PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		status TEXT NOT NULL,
+		archive BYTEA,
+		error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		completed_at TIMESTAMPTZ
+	)`)
+	if err != nil {
+		log.Fatal("Could not create data_exports table: ", err)
+	}
+
+	// lease_until hides a running export from other workers until its worker is presumed dead
+	_, err = db.Exec(`ALTER TABLE data_exports ADD COLUMN IF NOT EXISTS lease_until TIMESTAMPTZ`)
+	if err != nil {
+		log.Fatal("Could not add lease_until to data_exports table: ", err)
+	}
+
+	// audit events have no foreign keys so they outlive the users and organisations they describe
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS audit_events (
+		event_id UUID PRIMARY KEY,
+		org_id UUID,
+		actor_id UUID,
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id TEXT NOT NULL,
+		ip_address TEXT,
+		request_id TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		log.Fatal("Could not create audit_events table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS audit_events_org_idx ON audit_events (org_id, created_at DESC, event_id DESC)`)
+	if err != nil {
+		log.Fatal("Could not create audit_events index: ", err)
+	}
+
+	// actor_type tells SCIM tokens acting on an organisation apart from users
+	_, err = db.Exec(`ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS actor_type TEXT`)
+	if err != nil {
+		log.Fatal("Could not add actor_type to audit_events table: ", err)
+	}
+
+	// the audit log is append-only
+	_, err = db.Exec(`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	END;
+	$$ LANGUAGE plpgsql`)
+	if err != nil {
+		log.Fatal("Could not create audit_events trigger function: ", err)
+	}
+
+	_, err = db.Exec(`DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+	CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+		FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only()`)
+	if err != nil {
+		log.Fatal("Could not create audit_events trigger: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS webhooks (
+		webhook_id UUID PRIMARY KEY,
+		org_id UUID NOT NULL REFERENCES orgs(org_id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		log.Fatal("Could not create webhooks table: ", err)
+	}
+
+	// deliveries keep the url and secret of their webhook so that the org.deleted event can still be
+	// delivered once the organisation and its webhooks are gone. Deleting a webhook deletes its deliveries.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		delivery_id UUID PRIMARY KEY,
+		webhook_id UUID NOT NULL,
+		event_id UUID NOT NULL,
+		event_type TEXT NOT NULL,
+		payload BYTEA NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ DEFAULT NOW(),
+		last_status_code INTEGER,
+		last_error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMPTZ
+	)`)
+	if err != nil {
+		log.Fatal("Could not create webhook_deliveries table: ", err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE webhook_deliveries DROP CONSTRAINT IF EXISTS webhook_deliveries_webhook_id_fkey`)
+	if err != nil {
+		log.Fatal("Could not drop webhook_deliveries foreign key: ", err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS url TEXT`)
+	if err != nil {
+		log.Fatal("Could not add url to webhook_deliveries table: ", err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS secret TEXT`)
+	if err != nil {
+		log.Fatal("Could not add secret to webhook_deliveries table: ", err)
+	}
+
+	_, err = db.Exec(`UPDATE webhook_deliveries d SET url = wh.url, secret = wh.secret FROM webhooks wh WHERE d.webhook_id = wh.webhook_id AND d.url IS NULL`)
+	if err != nil {
+		log.Fatal("Could not backfill webhook_deliveries table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`)
+	if err != nil {
+		log.Fatal("Could not create webhook_deliveries index: ", err)
+	}
+
+	// an event is queued at most once per webhook even if it is dispatched again
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event_idx ON webhook_deliveries (webhook_id, event_id)`)
+	if err != nil {
+		log.Fatal("Could not create webhook_deliveries index: ", err)
+	}
+
+	// domain events are written to the outbox with the change that raised them and dispatched after it commits
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS outbox_events (
+		event_id UUID PRIMARY KEY,
+		type TEXT NOT NULL,
+		org_id UUID,
+		actor_id UUID,
+		payload BYTEA NOT NULL,
+		occurred_at TIMESTAMPTZ NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_error TEXT,
+		dispatched_at TIMESTAMPTZ
+	)`)
+	if err != nil {
+		log.Fatal("Could not create outbox_events table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS outbox_events_due_idx ON outbox_events (next_attempt_at) WHERE dispatched_at IS NULL`)
+	if err != nil {
+		log.Fatal("Could not create outbox_events index: ", err)
+	}
+
+	// dead_at marks events given up on after their last attempt, kept for inspection
+	_, err = db.Exec(`ALTER TABLE outbox_events ADD COLUMN IF NOT EXISTS dead_at TIMESTAMPTZ`)
+	if err != nil {
+		log.Fatal("Could not add dead_at to outbox_events table: ", err)
+	}
+
+	// the subscribers that handled each event, so retries only go to the ones that failed
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS outbox_handled (
+		event_id UUID REFERENCES outbox_events(event_id) ON DELETE CASCADE,
+		subscriber TEXT,
+		handled_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (event_id, subscriber)
+	)`)
+	if err != nil {
+		log.Fatal("Could not create outbox_handled table: ", err)
+	}
+
+	// responses to requests made with an Idempotency-Key, replayed when the request is retried
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id UUID REFERENCES users(user_id) ON DELETE CASCADE,
+		key TEXT,
+		fingerprint TEXT NOT NULL,
+		status_code INTEGER,
+		header JSONB,
+		body BYTEA,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		locked_until TIMESTAMPTZ NOT NULL,
+		completed_at TIMESTAMPTZ,
+		expires_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (user_id, key)
+	)`)
+	if err != nil {
+		log.Fatal("Could not create idempotency_keys table: ", err)
+	}
+
+	// an organisation has at most one pending invitation per email; inviting again replaces it
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS invitations (
+		invitation_id UUID PRIMARY KEY,
+		org_id UUID NOT NULL REFERENCES orgs(org_id) ON DELETE CASCADE,
+		email TEXT NOT NULL,
+		role TEXT NOT NULL,
+		invited_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		UNIQUE (org_id, email)
+	)`)
+	if err != nil {
+		log.Fatal("Could not create invitations table: ", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS scim_tokens (
+		token_id UUID PRIMARY KEY,
+		org_id UUID NOT NULL REFERENCES orgs(org_id) ON DELETE CASCADE,
+		name TEXT,
+		prefix TEXT,
+		token_hash TEXT UNIQUE NOT NULL,
+		created_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_used_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ
+	)`)
+	if err != nil {
+		log.Fatal("Could not create scim_tokens table: ", err)
+	}
+}
+
+// serve runs the API server on :8080 with its background workers
+func serve() {
+	db := openDB()
+	defer db.Close()
+
+	migrate(db)
+
+	issuer, err := loadOIDCIssuer()
+	if err != nil {
+		log.Fatal("Could not configure OIDC provider: ", err)
+	}
+
 	upgs := UzorgPgStorer{db: db}
-	reqHandler := ReqHandler{uzorgStore: &upgs}
+	reqHandler := ReqHandler{
+		uzorgStore:     &upgs,
+		passwords:      loadPasswordHashers(),
+		passwordPolicy: loadPasswordPolicy(),
+		mailer:         loadMailer(),
+		oidcProviders:  loadOIDCProviders(),
+		issuer:         issuer,
+	}
+
+	r := newRouter(&reqHandler)
+
+	go runPurgeJob(&upgs, time.Hour)
+	go reqHandler.runDataExportWorker(5 * time.Second)
+	go runWebhookWorker(&upgs, newWebhookClient(10*time.Second), 5*time.Second)
+
+	bus := &EventBus{}
+	reqHandler.subscribe(bus)
+	listener, err := newOutboxListener(os.Getenv("UZORG_DB_URL"))
+	if err != nil {
+		log.Println("Could not listen for outbox events, falling back to polling: ", err)
+		listener = nil
+	}
+	go runOutboxDispatcher(&upgs, bus, listener, 5*time.Second)
+
+	go serveGRPC(r)
+
+	log.Println("Starting server on :8080")
+	log.Fatal(http.ListenAndServe(":8080", r))
+}
 
+// newRouter registers the routes of the server. Each version of the API has its own router
+// mounted under /api/<version>, and the unversioned paths the API was first served at remain
+// aliases of v1 until legacySunset. The OpenID Connect provider keeps the paths its protocols define.
+func newRouter(reqHandler *ReqHandler) *mux.Router {
 	r := mux.NewRouter()
+	r.Use(RequestIDMiddleware)
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Welcome to the UZORG Web Server!"))
 	})
 
-	r.Handle("/auth/register", CMW(http.HandlerFunc(reqHandler.registerUser), LoggingMiddleware)).Methods("POST")
-	r.Handle("/auth/login", CMW(http.HandlerFunc(reqHandler.Login), LoggingMiddleware)).Methods("POST")
+	r.Handle("/openapi.json", CMW(http.HandlerFunc(reqHandler.OpenAPI), LoggingMiddleware)).Methods("GET")
+	r.Handle("/docs", CMW(http.HandlerFunc(reqHandler.Docs), LoggingMiddleware)).Methods("GET")
 
-	r.Handle("/api/users/{id}", CMW(http.HandlerFunc(reqHandler.GetUser), LoggingMiddleware, AuthMiddleware)).Methods("GET")
-	// add the new handlers
-	r.Handle("/api/organisations", CMW(http.HandlerFunc(reqHandler.CreateOrg), LoggingMiddleware, AuthMiddleware)).Methods("POST")
-	r.Handle("/api/organisations", CMW(http.HandlerFunc(reqHandler.GetOrgs), LoggingMiddleware, AuthMiddleware)).Methods("GET")
-	r.Handle("/api/organisations/{id}", CMW(http.HandlerFunc(reqHandler.GetOrg), LoggingMiddleware, AuthMiddleware)).Methods("GET")
-	r.Handle("/api/organisations/{id}/users", CMW(http.HandlerFunc(reqHandler.GetOrgUsers), LoggingMiddleware, AuthMiddleware)).Methods("GET")
-	r.Handle("/api/organisations/{id}/users", CMW(http.HandlerFunc(reqHandler.AddUserToOrg), LoggingMiddleware, AuthMiddleware)).Methods("POST")
+	r.Handle("/.well-known/openid-configuration", CMW(http.HandlerFunc(reqHandler.OIDCDiscovery), LoggingMiddleware)).Methods("GET")
+	r.Handle("/oauth2/jwks", CMW(http.HandlerFunc(reqHandler.OIDCJWKS), LoggingMiddleware)).Methods("GET")
+	r.Handle("/oauth2/authorize", reqHandler.authedSecret(reqHandler.OIDCAuthorize, ScopeOAuthAuthorize)).Methods("GET", "POST")
+	r.Handle("/oauth2/token", CMW(http.HandlerFunc(reqHandler.OIDCToken), LoggingMiddleware)).Methods("POST")
+	r.Handle("/oauth2/userinfo", CMW(http.HandlerFunc(reqHandler.OIDCUserinfo), LoggingMiddleware)).Methods("GET", "POST")
 
-	log.Println("Starting server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	r.Handle(scimPrefix+"/ServiceProviderConfig", CMW(http.HandlerFunc(reqHandler.SCIMServiceProviderConfig), LoggingMiddleware)).Methods("GET")
+	r.Handle(scimPrefix+"/Schemas", CMW(http.HandlerFunc(reqHandler.SCIMSchemas), LoggingMiddleware)).Methods("GET")
+	r.Handle(scimPrefix+"/ResourceTypes", CMW(http.HandlerFunc(reqHandler.SCIMResourceTypes), LoggingMiddleware)).Methods("GET")
+	r.Handle(scimPrefix+"/Users", reqHandler.scim(reqHandler.SCIMGetUsers)).Methods("GET")
+	r.Handle(scimPrefix+"/Users", reqHandler.scim(reqHandler.SCIMCreateUser)).Methods("POST")
+	r.Handle(scimPrefix+"/Users/{id}", reqHandler.scim(reqHandler.SCIMGetUser)).Methods("GET")
+	r.Handle(scimPrefix+"/Users/{id}", reqHandler.scim(reqHandler.SCIMReplaceUser)).Methods("PUT")
+	r.Handle(scimPrefix+"/Users/{id}", reqHandler.scim(reqHandler.SCIMPatchUser)).Methods("PATCH")
+	r.Handle(scimPrefix+"/Users/{id}", reqHandler.scim(reqHandler.SCIMDeleteUser)).Methods("DELETE")
+	r.Handle(scimPrefix+"/Groups", reqHandler.scim(reqHandler.SCIMGetGroups)).Methods("GET")
+	r.Handle(scimPrefix+"/Groups/{id}", reqHandler.scim(reqHandler.SCIMGetGroup)).Methods("GET")
+	r.Handle(scimPrefix+"/Groups/{id}", reqHandler.scim(reqHandler.SCIMReplaceGroup)).Methods("PUT")
+	r.Handle(scimPrefix+"/Groups/{id}", reqHandler.scim(reqHandler.SCIMPatchGroup)).Methods("PATCH")
+
+	// the fields of a query check their own scopes
+	r.Handle("/graphql", reqHandler.authed(reqHandler.GraphQL)).Methods("POST")
+
+	v1 := newV1Router(reqHandler)
+	r.PathPrefix(apiV1Prefix + "/").Handler(v1)
+
+	legacy := legacyAlias(v1, apiV1Prefix)
+	r.PathPrefix("/auth/").Handler(legacy)
+	r.PathPrefix("/api/").MatcherFunc(isUnversioned).Handler(legacy)
+
+	return r
+}
+
+// authed wraps a handler with authentication, the scope check and support for Idempotency-Key
+func (h *ReqHandler) authed(handler http.HandlerFunc, scopes ...string) http.Handler {
+	return CMW(handler, LoggingMiddleware, h.IdempotencyMiddleware, RequireScopes(scopes...), h.AuthMiddleware)
+}
+
+// authedSecret is authed for handlers whose response carries a secret, such as a new API key,
+// so that it is never recorded for Idempotency-Key
+func (h *ReqHandler) authedSecret(handler http.HandlerFunc, scopes ...string) http.Handler {
+	return CMW(handler, LoggingMiddleware, h.SecretIdempotencyMiddleware, RequireScopes(scopes...), h.AuthMiddleware)
+}
+
+// scim wraps a handler of the SCIM server with authentication by SCIM token
+func (h *ReqHandler) scim(handler http.HandlerFunc) http.Handler {
+	return CMW(handler, LoggingMiddleware, h.SCIMAuthMiddleware)
+}
+
+// newV1Router registers the routes of v1 of the API. Routes declare the scopes a token or API
+// key must hold to call them. A later version gets its own router that reuses the handlers of
+// v1 whose requests and responses it keeps. Versions are separate routers rather than
+// subrouters, which answer requests with a known path but the wrong method with 404.
+func newV1Router(h *ReqHandler) *mux.Router {
+	api := mux.NewRouter()
+
+	api.Handle("/api/v1/auth/register", CMW(http.HandlerFunc(h.registerUser), LoggingMiddleware)).Methods("POST")
+	api.Handle("/api/v1/auth/login", CMW(http.HandlerFunc(h.Login), LoggingMiddleware)).Methods("POST")
+	api.Handle("/api/v1/auth/restore", CMW(http.HandlerFunc(h.RestoreAccount), LoggingMiddleware)).Methods("POST")
+	api.Handle("/api/v1/auth/email/confirm", CMW(http.HandlerFunc(h.ConfirmEmailChange), LoggingMiddleware)).Methods("GET")
+	api.Handle("/api/v1/auth/oidc/{provider}/login", CMW(http.HandlerFunc(h.OIDCLogin), LoggingMiddleware)).Methods("GET")
+	api.Handle("/api/v1/auth/oidc/{provider}/callback", CMW(http.HandlerFunc(h.OIDCCallback), LoggingMiddleware)).Methods("GET")
+
+	api.Handle("/api/v1/oauth/clients", h.authedSecret(h.CreateOAuthClient, ScopeClientsWrite)).Methods("POST")
+	api.Handle("/api/v1/oauth/clients", h.authed(h.GetOAuthClients, ScopeClientsRead)).Methods("GET")
+	api.Handle("/api/v1/oauth/clients/{id}", h.authed(h.DeleteOAuthClient, ScopeClientsWrite)).Methods("DELETE")
+
+	api.Handle("/api/v1/users/me", h.authed(h.DeleteAccount, ScopeUsersWrite)).Methods("DELETE")
+	api.Handle("/api/v1/users/me/password", h.authed(h.ChangePassword, ScopeUsersWrite)).Methods("POST")
+	api.Handle("/api/v1/users/me/email", h.authed(h.RequestEmailChange, ScopeUsersWrite)).Methods("POST")
+	api.Handle("/api/v1/users/me/export", h.authed(h.ExportUserData, ScopeUsersRead)).Methods("GET")
+	api.Handle("/api/v1/users/me/export/{id}", h.authed(h.GetDataExport, ScopeUsersRead)).Methods("GET")
+	api.Handle("/api/v1/users/me/export/{id}/download", h.authed(h.DownloadDataExport, ScopeUsersRead)).Methods("GET")
+	api.Handle("/api/v1/users/me/sessions", h.authed(h.GetSessions, ScopeUsersRead)).Methods("GET")
+	api.Handle("/api/v1/users/me/sessions/{id}", h.authed(h.RevokeSession, ScopeUsersWrite)).Methods("DELETE")
+	api.Handle("/api/v1/users/me/api-keys", h.authedSecret(h.CreateAPIKey, ScopeAPIKeysWrite)).Methods("POST")
+	api.Handle("/api/v1/users/me/api-keys", h.authed(h.GetAPIKeys, ScopeAPIKeysRead)).Methods("GET")
+	api.Handle("/api/v1/users/me/api-keys/{id}", h.authed(h.RevokeAPIKey, ScopeAPIKeysWrite)).Methods("DELETE")
+
+	api.Handle("/api/v1/users/{id}", h.authed(h.GetUser, ScopeUsersRead)).Methods("GET")
+	api.Handle("/api/v1/users/{id}", h.authed(h.UpdateUser, ScopeUsersWrite)).Methods("PATCH")
+	api.Handle("/api/v1/organisations", h.authed(h.CreateOrg, ScopeOrgsWrite)).Methods("POST")
+	api.Handle("/api/v1/organisations", h.authed(h.GetOrgs, ScopeOrgsRead)).Methods("GET")
+	api.Handle("/api/v1/organisations/{id}", h.authed(h.GetOrg, ScopeOrgsRead)).Methods("GET")
+	api.Handle("/api/v1/organisations/{id}", h.authed(h.DeleteOrg, ScopeOrgsWrite)).Methods("DELETE")
+	api.Handle("/api/v1/organisations/{id}/audit", h.authed(h.GetOrgAuditEvents, ScopeOrgsRead)).Methods("GET")
+	api.Handle("/api/v1/organisations/{id}/webhooks", h.authedSecret(h.CreateWebhook, ScopeWebhooksWrite)).Methods("POST")
+	api.Handle("/api/v1/organisations/{id}/webhooks", h.authed(h.GetWebhooks, ScopeWebhooksRead)).Methods("GET")
+	api.Handle("/api/v1/organisations/{id}/webhooks/{webhookId}", h.authed(h.DeleteWebhook, ScopeWebhooksWrite)).Methods("DELETE")
+	api.Handle("/api/v1/organisations/{id}/webhooks/{webhookId}/deliveries", h.authed(h.GetWebhookDeliveries, ScopeWebhooksRead)).Methods("GET")
+	api.Handle("/api/v1/organisations/{id}/owner", h.authed(h.TransferOrgOwnership, ScopeOrgsWrite)).Methods("POST")
+	api.Handle("/api/v1/organisations/{id}/users", h.authed(h.GetOrgUsers, ScopeMembersRead)).Methods("GET")
+	api.Handle("/api/v1/organisations/{id}/users", h.authed(h.AddUserToOrg, ScopeMembersWrite)).Methods("POST")
+	api.Handle("/api/v1/organisations/{id}/users:batch", h.authed(h.AddUsersToOrg, ScopeMembersWrite)).Methods("POST")
+	api.Handle("/api/v1/organisations/{id}/users:batchRemove", h.authed(h.RemoveUsersFromOrg, ScopeMembersWrite)).Methods("POST")
+	api.Handle("/api/v1/organisations/{id}/users.csv", h.authed(h.ExportOrgMembersCSV, ScopeMembersRead)).Methods("GET")
+	api.Handle("/api/v1/organisations/{id}/users.csv", h.authed(h.ImportOrgMembersCSV, ScopeMembersWrite)).Methods("POST")
+	api.Handle("/api/v1/invitations/accept", h.authed(h.AcceptInvitation, ScopeOrgsWrite)).Methods("POST")
+	api.Handle("/api/v1/organisations/{id}/scim-tokens", h.authedSecret(h.CreateSCIMToken, ScopeOrgsWrite)).Methods("POST")
+	api.Handle("/api/v1/organisations/{id}/scim-tokens", h.authed(h.GetSCIMTokens, ScopeOrgsRead)).Methods("GET")
+	api.Handle("/api/v1/organisations/{id}/scim-tokens/{tokenId}", h.authed(h.RevokeSCIMToken, ScopeOrgsWrite)).Methods("DELETE")
+
+	return api
 }
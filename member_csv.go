@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// memberImportMaxRows is how many members an imported CSV may list
+	memberImportMaxRows  = 1000
+	memberImportMaxBytes = 1 << 20
+)
+
+// memberCSVHeader is the header of exported member CSVs. Exports can be imported again: the
+// import reads the email and role columns and ignores the others.
+var memberCSVHeader = []string{"userId", "email", "firstName", "lastName", "role"}
+
+// csvSafe keeps spreadsheets from evaluating a value as a formula
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// csvUnsafe undoes csvSafe so values of exported CSVs read back as they were exported
+func csvUnsafe(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(value[1])) {
+		return value[1:]
+	}
+	return value
+}
+
+// handler for GET /api/organisations/{id}/users.csv that streams the members of an organisation
+// as CSV. Like the JSON listing, any member can download it.
+func (h *ReqHandler) ExportOrgMembersCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	belongs, err := h.uzorgStore.UserBelongsToOrg(userID, orgID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error checking if user belongs to org: %v", err))
+		return
+	}
+
+	if !belongs {
+		writeBadRequestResponse(w, http.StatusUnauthorized, "Unauthorized access")
+		return
+	}
+
+	// the response starts with the first member so errors before it can still be reported
+	var cw *csv.Writer
+	start := func() error {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="members-%s.csv"`, orgID))
+		w.WriteHeader(http.StatusOK)
+		cw = csv.NewWriter(w)
+		return cw.Write(memberCSVHeader)
+	}
+	err = h.uzorgStore.StreamOrgUsers(orgID, func(u *User) error {
+		if cw == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return cw.Write([]string{u.UserID, csvSafe(u.Email), csvSafe(u.FirstName), csvSafe(u.LastName), u.Role})
+	})
+	if cw == nil {
+		if err != nil {
+			writeServerErrorResponse(w, fmt.Sprintf("Error getting org users: %v", err))
+			return
+		}
+		err = start()
+	}
+
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		log.Printf("Error streaming members of org %s: %v", orgID, err)
+	}
+}
+
+// parseMemberCSV reads the rows of an imported member CSV. The header names an email column
+// and optionally a role column, in any order. Problems with single rows are recorded in their
+// Errors; an error is returned when the file as a whole can't be read.
+func parseMemberCSV(body io.Reader) ([]*MemberImportRow, error) {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	emailCol, roleCol := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))) {
+		case "email":
+			emailCol = i
+		case "role":
+			roleCol = i
+		}
+	}
+	if emailCol < 0 {
+		return nil, errors.New("CSV header has no email column")
+	}
+
+	validate := validator.New()
+	seen := map[string]int{}
+	var rows []*MemberImportRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == memberImportMaxRows {
+			return nil, fmt.Errorf("CSV has more than %d rows", memberImportMaxRows)
+		}
+
+		line, _ := cr.FieldPos(0)
+		row := &MemberImportRow{Row: line, Role: RoleMember}
+		if emailCol < len(record) {
+			row.Email = csvUnsafe(strings.TrimSpace(record[emailCol]))
+		}
+		if roleCol >= 0 && roleCol < len(record) && strings.TrimSpace(record[roleCol]) != "" {
+			row.Role = strings.ToLower(strings.TrimSpace(record[roleCol]))
+		}
+
+		if validate.Var(row.Email, "required,email") != nil {
+			row.Errors = append(row.Errors, "email is not a valid email address")
+		} else if first, ok := seen[row.Email]; ok {
+			row.Errors = append(row.Errors, fmt.Sprintf("email is also listed on row %d", first))
+		} else {
+			seen[row.Email] = row.Row
+		}
+		if row.Role != RoleOwner && row.Role != RoleAdmin && row.Role != RoleMember {
+			row.Errors = append(row.Errors, fmt.Sprintf("role must be one of %s, %s or %s", RoleMember, RoleAdmin, RoleOwner))
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// planMemberImport works out what importing each row does, given the users with the emails
+// of the rows. Owners can be listed but their role only changes by transferring ownership.
+// It returns the number of rows with each outcome.
+func planMemberImport(rows []*MemberImportRow, users map[string]*User) map[string]int {
+	counts := map[string]int{}
+	for _, row := range rows {
+		user := users[row.Email]
+		switch {
+		case len(row.Errors) > 0:
+		case user == nil && row.Role == RoleOwner:
+			row.Errors = append(row.Errors, "only members can become owners, by transferring ownership")
+		case user == nil:
+			row.Status = MemberImportInvited
+		case user.Role == RoleOwner && row.Role != RoleOwner:
+			row.Errors = append(row.Errors, "owners keep their role until they transfer ownership")
+		case user.Role != RoleOwner && row.Role == RoleOwner:
+			row.Errors = append(row.Errors, "members become owners by transferring ownership")
+		case user.Role == "":
+			row.Status = MemberImportAdded
+		case user.Role == row.Role:
+			row.Status = MemberImportUnchanged
+		default:
+			row.Status = MemberImportRoleChanged
+			row.PreviousRole = user.Role
+		}
+		if user != nil {
+			row.UserID = user.UserID
+		}
+		if len(row.Errors) > 0 {
+			row.Status = MemberImportInvalid
+		}
+		counts[row.Status]++
+	}
+	return counts
+}
+
+// handler for POST /api/organisations/{id}/users.csv that imports members from a CSV of emails
+// and roles. Existing users are added or get the listed role, and unknown emails are invited.
+// With dryRun=true the changes are only reported. Nothing is changed when any row is invalid.
+// Members not listed are left as they are. Only owners and admins can import members.
+func (h *ReqHandler) ImportOrgMembersCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	dryRun := false
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			writeBadRequestResponse(w, http.StatusBadRequest, "dryRun must be true or false")
+			return
+		}
+	}
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	rows, err := parseMemberCSV(http.MaxBytesReader(w, r.Body, memberImportMaxBytes))
+	if err != nil {
+		writeBadRequestResponse(w, http.StatusBadRequest, fmt.Sprintf("Error reading CSV: %v", err))
+		return
+	}
+
+	emails := make([]string, 0, len(rows))
+	for _, row := range rows {
+		emails = append(emails, row.Email)
+	}
+	users, err := h.uzorgStore.GetOrgMembersByEmail(orgID, emails)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting users: %v", err))
+		return
+	}
+
+	result := &MemberImportResult{
+		DryRun: dryRun,
+		Counts: planMemberImport(rows, users),
+		Rows:   rows,
+	}
+
+	if result.Counts[MemberImportInvalid] > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(MemberImportResponse{
+			ResponseStatus: ResponseStatus{
+				Status:  BadRequestStatus,
+				Message: "CSV has invalid rows, nothing was changed",
+			},
+			Data: result,
+		})
+		return
+	}
+
+	if dryRun {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(MemberImportResponse{
+			ResponseStatus: ResponseStatus{
+				Status:  SuccessStatus,
+				Message: "Dry run, nothing was changed",
+			},
+			Data: result,
+		})
+		return
+	}
+
+	var invitations []*Invitation
+	tokens := map[*Invitation]string{}
+	for _, row := range rows {
+		if row.Status != MemberImportInvited {
+			continue
+		}
+		token, err := randomToken(32)
+		if err != nil {
+			writeServerErrorResponse(w, fmt.Sprintf("Error generating token: %v", err))
+			return
+		}
+		inv := &Invitation{
+			InvitationID: uuid.New().String(),
+			OrgID:        orgID,
+			Email:        row.Email,
+			Role:         row.Role,
+			InvitedBy:    userID,
+			TokenHash:    hashAPIKey(token),
+			ExpiresAt:    time.Now().Add(invitationTTL),
+		}
+		invitations = append(invitations, inv)
+		tokens[inv] = token
+	}
+
+	ev := newAuditEvent(r, "", "", "")
+	ev.OrgID = orgID
+	err = h.uzorgStore.ApplyMemberImport(orgID, rows, invitations, ev)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error importing members: %v", err))
+		return
+	}
+	result.Applied = true
+
+	if len(invitations) > 0 {
+		org, err := h.uzorgStore.GetOrg(orgID)
+		if err != nil {
+			log.Println("Error getting org for invitation emails: ", err)
+		}
+		for _, inv := range invitations {
+			if err := h.sendInvitation(inv, &org, tokens[inv]); err != nil {
+				log.Printf("Error sending invitation to %s: %v", inv.Email, err)
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(MemberImportResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Members imported successfully",
+		},
+		Data: result,
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) StreamOrgUsers(orgID string, fn func(*User) error) error {
+	users, _ := s.GetOrgUsers(orgID)
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	for _, u := range users {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetOrgMembersByEmail(orgID string, emails []string) (map[string]*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := map[string]*User{}
+	for _, email := range emails {
+		for _, u := range s.users {
+			if u.Email == email {
+				user := *u
+				user.Role = s.members[orgID][u.UserID]
+				users[email] = &user
+			}
+		}
+	}
+	return users, nil
+}
+
+func (s *memoryStore) ApplyMemberImport(orgID string, rows []*MemberImportRow, invitations []*Invitation, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, row := range rows {
+		if row.Status == MemberImportAdded || row.Status == MemberImportRoleChanged {
+			s.addMember(orgID, row.UserID, row.Role)
+		}
+	}
+	return nil
+}
+
+func TestParseMemberCSV(t *testing.T) {
+	rows, err := parseMemberCSV(strings.NewReader("\ufeffRole, Email\nadmin,ann@example.com\n,'+bo@example.com\nchief,not-an-email\nmember,ann@example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 4 {
+		t.Fatalf("got %d rows, want 4", len(rows))
+	}
+	if rows[0].Row != 2 || rows[0].Email != "ann@example.com" || rows[0].Role != RoleAdmin || rows[0].Errors != nil {
+		t.Errorf("got first row %+v", rows[0])
+	}
+	if rows[1].Role != RoleMember || rows[1].Email != "+bo@example.com" {
+		t.Errorf("got row %+v for a row without a role and an escaped email, want a member with the escape removed", rows[1])
+	}
+	if len(rows[2].Errors) != 2 {
+		t.Errorf("got errors %v for a row with a bad email and role, want 2", rows[2].Errors)
+	}
+	if !reflect.DeepEqual(rows[3].Errors, []string{"email is also listed on row 2"}) {
+		t.Errorf("got errors %v for a repeated email", rows[3].Errors)
+	}
+
+	for _, body := range []string{"", "name,role\nAnn,admin\n", "email\n\"unterminated\n"} {
+		if _, err := parseMemberCSV(strings.NewReader(body)); err == nil {
+			t.Errorf("got no error for CSV %q", body)
+		}
+	}
+}
+
+func TestPlanMemberImport(t *testing.T) {
+	users := map[string]*User{
+		"owner@example.com":  {UserID: "1", Email: "owner@example.com", Role: RoleOwner},
+		"member@example.com": {UserID: "2", Email: "member@example.com", Role: RoleMember},
+		"admin@example.com":  {UserID: "3", Email: "admin@example.com", Role: RoleAdmin},
+		"other@example.com":  {UserID: "4", Email: "other@example.com"},
+	}
+	rows := []*MemberImportRow{
+		{Email: "owner@example.com", Role: RoleOwner},
+		{Email: "member@example.com", Role: RoleAdmin},
+		{Email: "admin@example.com", Role: RoleAdmin},
+		{Email: "other@example.com", Role: RoleMember},
+		{Email: "new@example.com", Role: RoleMember},
+		{Email: "owner@example.com", Role: RoleMember},
+		{Email: "new-owner@example.com", Role: RoleOwner},
+	}
+
+	counts := planMemberImport(rows, users)
+
+	var statuses []string
+	for _, row := range rows {
+		statuses = append(statuses, row.Status)
+	}
+	want := []string{
+		MemberImportUnchanged, MemberImportRoleChanged, MemberImportUnchanged, MemberImportAdded,
+		MemberImportInvited, MemberImportInvalid, MemberImportInvalid,
+	}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("got outcomes %v, want %v", statuses, want)
+	}
+	if rows[1].PreviousRole != RoleMember || rows[3].UserID != "4" {
+		t.Errorf("got rows %+v and %+v", rows[1], rows[3])
+	}
+	if counts[MemberImportUnchanged] != 2 || counts[MemberImportInvalid] != 2 {
+		t.Errorf("got counts %v", counts)
+	}
+}
+
+func TestMemberCSVExportAndImport(t *testing.T) {
+	_, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	owner := client.New(server.URL)
+	registerTestUser(t, owner, "Ore", "ore@example.com")
+	registerTestUser(t, client.New(server.URL), "Kemi", "=kemi@example.com")
+
+	org, err := owner.CreateOrg(ctx, client.CreateOrgRequest{Name: "Spreadsheets", Description: "Kept in sync"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvPath := server.URL + "/api/v1/organisations/" + org.OrgID + "/users.csv"
+
+	do := func(method, url, body string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+owner.Token())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(raw)
+	}
+	importCSV := func(url, body string) (int, *MemberImportResult) {
+		t.Helper()
+		resp, raw := do("POST", url, body)
+		var decoded MemberImportResponse
+		if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+			t.Fatalf("decoding %s: %v", raw, err)
+		}
+		return resp.StatusCode, decoded.Data
+	}
+
+	body := "email,role\n=kemi@example.com,admin\nnew@example.com,member\n"
+	status, result := importCSV(csvPath+"?dryRun=true", body)
+	if status != http.StatusOK || !result.DryRun || result.Applied {
+		t.Fatalf("got %d %+v for a dry run", status, result)
+	}
+	if result.Counts[MemberImportAdded] != 1 || result.Counts[MemberImportInvited] != 1 {
+		t.Errorf("got counts %v for a dry run", result.Counts)
+	}
+
+	resp, export := do("GET", csvPath, "")
+	if resp.Header.Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Errorf("got Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	if strings.Contains(export, "kemi") {
+		t.Error("the dry run changed the members")
+	}
+
+	status, result = importCSV(csvPath, "email,role\n=kemi@example.com,chief\n")
+	if status != http.StatusUnprocessableEntity || result.Applied {
+		t.Errorf("got %d %+v for an invalid row, want 422 without changes", status, result)
+	}
+
+	status, result = importCSV(csvPath, body)
+	if status != http.StatusOK || !result.Applied {
+		t.Fatalf("got %d %+v for an import", status, result)
+	}
+
+	_, export = do("GET", csvPath, "")
+	lines := strings.Split(strings.TrimSpace(export), "\n")
+	if len(lines) != 3 || lines[0] != "userId,email,firstName,lastName,role" {
+		t.Fatalf("got export %q", export)
+	}
+	if !strings.HasSuffix(lines[1], ",'=kemi@example.com,Kemi,Tester,admin") {
+		t.Errorf("got row %q, want the imported admin with the formula escaped", lines[1])
+	}
+
+	// the export imports again without changes
+	status, result = importCSV(csvPath+"?dryRun=true", export)
+	if status != http.StatusOK || result.Counts[MemberImportUnchanged] != 2 {
+		t.Errorf("got %d %+v importing the export, want every row unchanged", status, result)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// decodeBatchMembersRequest reads the users named by a batch membership request, writing the
+// error response and returning nil when the request is invalid
+func decodeBatchMembersRequest(w http.ResponseWriter, r *http.Request) []MemberRef {
+	var req BatchMembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return nil
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return nil
+	}
+
+	refs := make([]MemberRef, 0, len(req.UserIDs)+len(req.Emails))
+	for _, id := range req.UserIDs {
+		refs = append(refs, MemberRef{UserID: id})
+	}
+	for _, email := range req.Emails {
+		refs = append(refs, MemberRef{Email: email})
+	}
+	return refs
+}
+
+// handler for POST /api/organisations/{id}/users:batch that adds up to membersBatchMax users,
+// named by ID or email, to an organisation in one transaction. Like adding a single user, any
+// member of the organisation can add users by ID. Naming users by email takes an owner or admin,
+// as the outcome tells which emails have an account. The response holds the outcome for each user.
+func (h *ReqHandler) AddUsersToOrg(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	refs := decodeBatchMembersRequest(w, r)
+	if refs == nil {
+		return
+	}
+
+	roles := []string{RoleOwner, RoleAdmin, RoleMember}
+	for _, ref := range refs {
+		if ref.Email != "" {
+			roles = []string{RoleOwner, RoleAdmin}
+		}
+	}
+	if !h.requireOrgRole(w, orgID, userID, roles...) {
+		return
+	}
+
+	ev := newAuditEvent(r, AuditMemberAdded, "user", "")
+	ev.OrgID = orgID
+	results, err := h.uzorgStore.AddUsersToOrg(orgID, refs, ev)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error adding users to org: %v", err))
+		return
+	}
+
+	response := BatchMembersResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Users processed successfully",
+		},
+		Data: results,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for POST /api/organisations/{id}/users:batchRemove that removes up to membersBatchMax
+// members, named by ID or email, from an organisation in one transaction. Only owners and
+// admins can remove members, and owners are only removed after transferring ownership.
+func (h *ReqHandler) RemoveUsersFromOrg(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	refs := decodeBatchMembersRequest(w, r)
+	if refs == nil {
+		return
+	}
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	ev := newAuditEvent(r, AuditMemberRemoved, "user", "")
+	ev.OrgID = orgID
+	results, err := h.uzorgStore.RemoveUsersFromOrg(orgID, refs, ev)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error removing users from org: %v", err))
+		return
+	}
+
+	response := BatchMembersResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Users processed successfully",
+		},
+		Data: results,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+// resolveMemberRefs looks up the users refs name, like the resolver of the Postgres store
+func (s *memoryStore) resolveMemberRefs(refs []MemberRef) []string {
+	userIDs := make([]string, len(refs))
+	for i, ref := range refs {
+		for _, u := range s.users {
+			if u.UserID == ref.UserID || ref.UserID == "" && u.Email == ref.Email {
+				userIDs[i] = u.UserID
+			}
+		}
+	}
+	return userIDs
+}
+
+func (s *memoryStore) AddUsersToOrg(orgID string, refs []MemberRef, ev *AuditEvent) ([]*BatchMemberResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]*BatchMemberResult, len(refs))
+	for i, id := range s.resolveMemberRefs(refs) {
+		results[i] = &BatchMemberResult{UserID: id, Email: refs[i].Email, Status: BatchMemberNotFound}
+		if id == "" {
+			continue
+		}
+		results[i].Status = BatchMemberAlreadyMember
+		if _, ok := s.members[orgID][id]; !ok {
+			s.addMember(orgID, id, RoleMember)
+			results[i].Status = BatchMemberAdded
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) RemoveUsersFromOrg(orgID string, refs []MemberRef, ev *AuditEvent) ([]*BatchMemberResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]*BatchMemberResult, len(refs))
+	for i, id := range s.resolveMemberRefs(refs) {
+		results[i] = &BatchMemberResult{UserID: id, Email: refs[i].Email, Status: BatchMemberNotFound}
+		if id == "" {
+			continue
+		}
+		switch role, ok := s.members[orgID][id]; {
+		case !ok:
+			results[i].Status = BatchMemberNotMember
+		case role == RoleOwner:
+			results[i].Status = BatchMemberOwner
+		default:
+			delete(s.members[orgID], id)
+			results[i].Status = BatchMemberRemoved
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) UpdateOrgMembers(orgID string, add, remove []MemberRef, addEv, removeEv *AuditEvent) error {
+	if _, err := s.AddUsersToOrg(orgID, add, addEv); err != nil {
+		return err
+	}
+	_, err := s.RemoveUsersFromOrg(orgID, remove, removeEv)
+	return err
+}
+
+func memberStatuses(results []*client.MemberResult) []string {
+	var statuses []string
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	return statuses
+}
+
+func TestBatchMembership(t *testing.T) {
+	_, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	owner := client.New(server.URL)
+	ownerUser := registerTestUser(t, owner, "Olu", "olu@example.com")
+	ana := registerTestUser(t, client.New(server.URL), "Ana", "ana@example.com")
+	registerTestUser(t, client.New(server.URL), "Ben", "ben@example.com")
+
+	org, err := owner.CreateOrg(ctx, client.CreateOrgRequest{Name: "Onboarding", Description: "New team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknownID := "7b0e9e9a-4f7e-4c1e-9a5e-1f2d3c4b5a69"
+	results, err := owner.AddUsersToOrg(ctx, org.OrgID,
+		[]string{ana.UserID, unknownID, ownerUser.UserID},
+		[]string{"ben@example.com", "nobody@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{client.MemberAdded, client.MemberNotFound, client.MemberAlreadyMember, client.MemberAdded, client.MemberNotFound}
+	if got := memberStatuses(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("got add outcomes %v, want %v", got, want)
+	}
+	if results[3].UserID == "" {
+		t.Error("the user added by email has no user ID in the result")
+	}
+
+	members, err := owner.GetOrgUsers(ctx, org.OrgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Errorf("got %d members, want 3", len(members))
+	}
+
+	results, err = owner.RemoveUsersFromOrg(ctx, org.OrgID, []string{ana.UserID, ownerUser.UserID}, []string{"ben@example.com", "nobody@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{client.MemberRemoved, client.MemberOwner, client.MemberRemoved, client.MemberNotFound}
+	if got := memberStatuses(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("got remove outcomes %v, want %v", got, want)
+	}
+
+	// plain members add users by ID only, so they cannot learn which emails have an account
+	member := client.New(server.URL)
+	mo := registerTestUser(t, member, "Mo", "mo@example.com")
+	if err := owner.AddUserToOrg(ctx, org.OrgID, mo.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := member.AddUsersToOrg(ctx, org.OrgID, nil, []string{"ben@example.com", "nobody@example.com"}); !client.IsForbidden(err) {
+		t.Errorf("got %v adding users by email as a member, want forbidden", err)
+	}
+	results, err = member.AddUsersToOrg(ctx, org.OrgID, []string{ana.UserID}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := memberStatuses(results); !reflect.DeepEqual(got, []string{client.MemberAdded}) {
+		t.Errorf("got add outcomes %v adding by ID as a member, want the user added", got)
+	}
+
+	_, err = owner.AddUsersToOrg(ctx, org.OrgID, nil, nil)
+	var verr *client.ValidationError
+	if !errors.As(err, &verr) {
+		t.Errorf("got %v for an empty batch, want a ValidationError", err)
+	}
+
+	tooMany := make([]string, membersBatchMax+1)
+	for i := range tooMany {
+		tooMany[i] = unknownID
+	}
+	_, err = owner.AddUsersToOrg(ctx, org.OrgID, tooMany, nil)
+	if !errors.As(err, &verr) {
+		t.Errorf("got %v for a batch of %d users, want a ValidationError", err, len(tooMany))
+	}
+}
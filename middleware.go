@@ -3,15 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
 )
 
 // LoggingMiddleware logs the details of incoming requests and their processing time
@@ -29,8 +32,8 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 				return
 			}
 
-			// Log the body
-			log.Printf("Request Body: %s", string(bodyBytes))
+			// Log the body, without the passwords, tokens and client secrets it may carry
+			log.Printf("Request Body: %s", redactBody(r.Header.Get("Content-Type"), bodyBytes))
 
 			// Since the body has been read, we need to recreate the io.Reader for further processing
 			r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
@@ -47,7 +50,91 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func AuthMiddleware(next http.Handler) http.Handler {
+// redactedFields are the body fields never written to the log: the substrings match
+// password, currentPassword, client_secret, token and the like
+var redactedFields = []string{"password", "secret", "token", "verifier"}
+
+// redactBody returns a JSON or form body for the log with the values of secret fields
+// replaced. Bodies that cannot be parsed are logged by size only.
+func redactBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return fmt.Sprintf("(%d bytes)", len(body))
+		}
+		for key := range form {
+			if isRedactedField(key) {
+				form[key] = []string{"REDACTED"}
+			}
+		}
+		return form.Encode()
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("(%d bytes)", len(body))
+	}
+	redacted, err := json.Marshal(redactJSON(v))
+	if err != nil {
+		return fmt.Sprintf("(%d bytes)", len(body))
+	}
+	return string(redacted)
+}
+
+// redactJSON replaces the values of secret fields anywhere in a decoded JSON value
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isRedactedField(key) {
+				v[key] = "REDACTED"
+			} else {
+				v[key] = redactJSON(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactJSON(value)
+		}
+	}
+	return v
+}
+
+func isRedactedField(key string) bool {
+	key = strings.ToLower(key)
+	if key == "code" {
+		// authorization codes redeemed at the token endpoint
+		return true
+	}
+	for _, field := range redactedFields {
+		if strings.Contains(key, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestIDMiddleware gives every request an ID, taken from the X-Request-ID header when the
+// client or a proxy sent one, stores it in the request context and echoes it in the response
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 {
+			requestID = uuid.New().String()
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+		ctx := context.WithValue(r.Context(), "requestId", requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// AuthMiddleware authenticates requests bearing either a JWT access token or an API key
+// and stores the user id and granted scopes in the request context
+func (h *ReqHandler) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -61,7 +148,21 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if strings.HasPrefix(tokenString, apiKeyPrefix) {
+			key, err := h.uzorgStore.UseAPIKey(hashAPIKey(tokenString))
+			if err != nil {
+				log.Printf("API key lookup error: %v", err)
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "userId", key.UserID)
+			ctx = context.WithValue(ctx, "scopes", key.Scopes)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		token, err := jwt.ParseWithClaims(tokenString, &UzorgClaims{}, func(token *jwt.Token) (interface{}, error) {
 			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 			}
@@ -74,17 +175,26 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		if claims, ok := token.Claims.(*jwt.StandardClaims); ok && token.Valid {
+		if claims, ok := token.Claims.(*UzorgClaims); ok && token.Valid {
 			// Check for token expiry
 			if err := claims.Valid(); err != nil {
 				http.Error(w, "Expired token", http.StatusUnauthorized)
 				return
 			}
 
-			// Token is valid and not expired. You can access claims like claims.Subject
+			// Token is valid and not expired. Reject it if its session was revoked
+			session, err := h.uzorgStore.TouchSession(claims.Id)
+			if err != nil || session.UserID != claims.Subject {
+				log.Printf("Session lookup error: %v", err)
+				http.Error(w, "Session is no longer active", http.StatusUnauthorized)
+				return
+			}
+
 			userID := claims.Subject
 
 			ctx := context.WithValue(r.Context(), "userId", userID)
+			ctx = context.WithValue(ctx, "sessionId", session.SessionID)
+			ctx = context.WithValue(ctx, "scopes", claims.Scopes)
 			r = r.WithContext(ctx)
 			// Proceed with the next handler
 			next.ServeHTTP(w, r)
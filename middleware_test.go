@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoggingMiddlewareRedactsSecrets(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	var received string
+	handler := LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		received = buf.String()
+	}))
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		secrets     []string
+		kept        []string
+	}{
+		{
+			name:        "token request",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "grant_type=authorization_code&code=c0de&client_id=app&client_secret=s3cret&code_verifier=v3rifier",
+			secrets:     []string{"c0de", "s3cret", "v3rifier"},
+			kept:        []string{"grant_type=authorization_code", "client_id=app"},
+		},
+		{
+			name:        "password change",
+			contentType: "application/json",
+			body:        `{"currentPassword":"old horse","newPassword":"new horse"}`,
+			secrets:     []string{"old horse", "new horse"},
+		},
+		{
+			name:        "SCIM user",
+			contentType: "application/scim+json",
+			body:        `{"userName":"ada@example.com","password":"scim horse","emails":[{"value":"ada@example.com"}]}`,
+			secrets:     []string{"scim horse"},
+			kept:        []string{"ada@example.com"},
+		},
+		{
+			name:        "unparseable body",
+			contentType: "application/json",
+			body:        `{"password":"broken horse"`,
+			secrets:     []string{"broken horse"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logged.Reset()
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if received != tt.body {
+				t.Errorf("got body %q in the handler, want %q", received, tt.body)
+			}
+			for _, secret := range tt.secrets {
+				if strings.Contains(logged.String(), secret) {
+					t.Errorf("got %q in the log: %s", secret, logged.String())
+				}
+			}
+			for _, kept := range tt.kept {
+				if !strings.Contains(logged.String(), kept) {
+					t.Errorf("got no %q in the log: %s", kept, logged.String())
+				}
+			}
+		})
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 )
 
 type User struct {
@@ -13,18 +15,38 @@ type User struct {
 	Email     string `json:"email"`
 	Password  string `json:"-"`
 	Phone     string `json:"phone"`
+	Version   int    `json:"version"`
+	// Role is the user's role in an organisation when listed as one of its members
+	Role      string     `json:"role,omitempty"`
+	DeletedAt *time.Time `json:"-"`
+	// EmailVerified is set once the user proved they receive mail at Email, by confirming an
+	// email change or signing in with an identity provider that verified it
+	EmailVerified bool `json:"-"`
 }
 
+// Roles a user can have in an organisation. Owners can delete the organisation and
+// transfer ownership; every organisation keeps at least one owner.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
 type RegisterUserRequest struct {
 	FirstName string `json:"firstName" validate:"required"`
 	LastName  string `json:"lastName"  validate:"required"`
 	Email     string `json:"email"     validate:"required,email"`
-	Password  string `json:"password"  validate:"required,min=8"`
+	Password  string `json:"password"  validate:"required"`
 	Phone     string `json:"phone"     validate:"required,e164"`
 }
 
 // Validate is a method of RegisterUserRequest that validates its fields.
 func (r *RegisterUserRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+// validateStruct runs the validate tags of a request struct and converts failures into ValidationErrors.
+func validateStruct(r interface{}) []*ValidationError {
 	validate := validator.New()
 	err := validate.Struct(r)
 	if err != nil {
@@ -49,6 +71,26 @@ func (r *RegisterUserRequest) Validate() []*ValidationError {
 	return nil
 }
 
+// UpdateUserRequest holds the profile fields to change. Omitted fields are left as they are.
+// The version the changes were made against is sent as the ETag of the user in If-Match.
+// Clients written before ETags may send it as Version instead; it is checked when given.
+type UpdateUserRequest struct {
+	FirstName *string `json:"firstName" validate:"omitnil,min=1"`
+	LastName  *string `json:"lastName"  validate:"omitnil,min=1"`
+	Phone     *string `json:"phone"     validate:"omitnil,e164"`
+	Version   int     `json:"version,omitempty"`
+}
+
+// Validate is a method of UpdateUserRequest that validates its fields.
+func (r *UpdateUserRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+type UpdateUserResponse struct {
+	ResponseStatus
+	Data *User `json:"data"`
+}
+
 type ValidationError struct {
 	Field   string `json:"field"`
 	Message string `json:"message"`
@@ -76,6 +118,12 @@ type ErrorResponse struct {
 const SuccessStatus = "success"
 const BadRequestStatus = "Bad Request"
 const ServverErrorStatus = "Server Error"
+const ForbiddenStatus = "Forbidden"
+
+type ForbiddenResponse struct {
+	ErrorResponse
+	MissingScopes []string `json:"missingScopes"`
+}
 
 type RegisterUserResponse struct {
 	ResponseStatus
@@ -86,6 +134,9 @@ type Org struct {
 	OrgID       string `json:"orgId"`
 	Name        string `json:"name"`
 	Description string `json:"description"`
+	Version     int    `json:"version"`
+	// Role is a user's role in the organisation when listed as one of their organisations
+	Role string `json:"role,omitempty"`
 }
 
 type LoginRequest struct {
@@ -103,6 +154,18 @@ type GetUserResponse struct {
 	Data *User `json:"data"`
 }
 
+// PublicUser is the profile of a user that members of their organisations can see
+type PublicUser struct {
+	UserID    string `json:"userId"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
+type GetPublicUserResponse struct {
+	ResponseStatus
+	Data *PublicUser `json:"data"`
+}
+
 type Organisations struct {
 	Orgs []*Org `json:"organisations"`
 }
@@ -119,28 +182,7 @@ type CreateOrgRequest struct {
 
 // validate is a method of CreateOrgRequest that validates its fields.
 func (r *CreateOrgRequest) Validate() []*ValidationError {
-	validate := validator.New()
-	err := validate.Struct(r)
-	if err != nil {
-		if _, ok := err.(*validator.InvalidValidationError); ok {
-			return nil // or handle the error
-		}
-
-		var errors []*ValidationError
-		for _, err := range err.(validator.ValidationErrors) {
-			var element ValidationError
-			element.Field = err.StructNamespace()
-			// Construct a descriptive message for the validation error
-			element.Message = fmt.Sprintf(
-				"Field '%s' failed validation for '%s' condition",
-				err.StructNamespace(),
-				err.Tag(),
-			)
-			errors = append(errors, &element)
-		}
-		return errors
-	}
-	return nil
+	return validateStruct(r)
 }
 
 type CreateOrgResponse struct {
@@ -164,30 +206,696 @@ type AddUserToOrgRequest struct {
 
 // validate is a method of AddUserToOrgRequest that validates its fields.
 func (r *AddUserToOrgRequest) Validate() []*ValidationError {
-	validate := validator.New()
-	err := validate.Struct(r)
-	if err != nil {
-		if _, ok := err.(*validator.InvalidValidationError); ok {
-			return nil // or handle the error
+	return validateStruct(r)
+}
+
+type AddUserToOrgResponse struct {
+	ResponseStatus
+}
+
+// membersBatchMax is how many users a batch membership request may name
+const membersBatchMax = 100
+
+// BatchMembersRequest names the users to add to or remove from an organisation by ID or email
+type BatchMembersRequest struct {
+	UserIDs []string `json:"userIds" validate:"dive,uuid"`
+	Emails  []string `json:"emails"  validate:"dive,email"`
+}
+
+// Validate is a method of BatchMembersRequest that validates its fields.
+func (r *BatchMembersRequest) Validate() []*ValidationError {
+	errs := validateStruct(r)
+	if n := len(r.UserIDs) + len(r.Emails); n == 0 || n > membersBatchMax {
+		errs = append(errs, &ValidationError{
+			Field:   "BatchMembersRequest",
+			Message: fmt.Sprintf("Between 1 and %d user IDs and emails are required", membersBatchMax),
+		})
+	}
+	return errs
+}
+
+// MemberRef names a user of a batch membership request by ID or, when UserID is empty, by email
+type MemberRef struct {
+	UserID string
+	Email  string
+}
+
+// Outcomes of the items of batch membership requests
+const (
+	BatchMemberAdded         = "added"
+	BatchMemberAlreadyMember = "already_member"
+	BatchMemberNotFound      = "not_found"
+	BatchMemberRemoved       = "removed"
+	BatchMemberNotMember     = "not_member"
+	// owners are only removed by transferring ownership first
+	BatchMemberOwner = "owner"
+)
+
+// BatchMemberResult is the outcome for one user of a batch membership request. UserID is
+// set for users named by email when they were found.
+type BatchMemberResult struct {
+	UserID string `json:"userId,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Status string `json:"status"`
+}
+
+type BatchMembersResponse struct {
+	ResponseStatus
+	Data []*BatchMemberResult `json:"data"`
+}
+
+// Outcomes of the rows of an imported member CSV
+const (
+	MemberImportAdded       = "added"
+	MemberImportRoleChanged = "role_changed"
+	MemberImportUnchanged   = "unchanged"
+	MemberImportInvited     = "invited"
+	MemberImportInvalid     = "invalid"
+)
+
+// MemberImportRow is a row of an imported member CSV and what importing it does. Row is the
+// line of the row in the file, the header being line 1.
+type MemberImportRow struct {
+	Row    int    `json:"row"`
+	Email  string `json:"email"`
+	Role   string `json:"role"`
+	UserID string `json:"userId,omitempty"`
+	Status string `json:"status"`
+	// the role of a member whose role changes
+	PreviousRole string   `json:"previousRole,omitempty"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+// MemberImportResult reports an import of members. Nothing is applied for dry runs or when
+// any row is invalid.
+type MemberImportResult struct {
+	DryRun  bool               `json:"dryRun"`
+	Applied bool               `json:"applied"`
+	Counts  map[string]int     `json:"counts"`
+	Rows    []*MemberImportRow `json:"rows"`
+}
+
+type MemberImportResponse struct {
+	ResponseStatus
+	Data *MemberImportResult `json:"data"`
+}
+
+// Invitation invites someone without an account to join an organisation with Role. It is
+// accepted with the token emailed to them once they have registered.
+type Invitation struct {
+	InvitationID string    `json:"invitationId"`
+	OrgID        string    `json:"orgId"`
+	Email        string    `json:"email"`
+	Role         string    `json:"role"`
+	InvitedBy    string    `json:"invitedBy"`
+	TokenHash    string    `json:"-"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+type AcceptInvitationRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// Validate is a method of AcceptInvitationRequest that validates its fields.
+func (r *AcceptInvitationRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+type AcceptInvitationResponse struct {
+	ResponseStatus
+	Data *Org `json:"data"`
+}
+
+// SCIMToken lets the identity provider of an organisation provision its members over SCIM
+type SCIMToken struct {
+	TokenID    string     `json:"tokenId"`
+	OrgID      string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	TokenHash  string     `json:"-"`
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type CreateSCIMTokenRequest struct {
+	Name string `json:"name" validate:"required"`
+}
+
+// Validate is a method of CreateSCIMTokenRequest that validates its fields.
+func (r *CreateSCIMTokenRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+// CreatedSCIMToken is a new SCIM token with its secret, which is only returned once
+type CreatedSCIMToken struct {
+	SCIMToken
+	Token string `json:"token"`
+}
+
+type CreateSCIMTokenResponse struct {
+	ResponseStatus
+	Data *CreatedSCIMToken `json:"data"`
+}
+
+type GetSCIMTokensResponse struct {
+	ResponseStatus
+	Data []*SCIMToken `json:"data"`
+}
+
+type APIKey struct {
+	KeyID      string     `json:"keyId"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"   validate:"required"`
+	Scopes []string `json:"scopes" validate:"required,min=1"`
+}
+
+// Validate is a method of CreateAPIKeyRequest that validates its fields.
+func (r *CreateAPIKeyRequest) Validate() []*ValidationError {
+	errors := validateStruct(r)
+	for i, scope := range r.Scopes {
+		if !isKnownScope(scope) {
+			errors = append(errors, &ValidationError{
+				Field:   fmt.Sprintf("CreateAPIKeyRequest.Scopes[%d]", i),
+				Message: fmt.Sprintf("Unknown scope '%s'", scope),
+			})
 		}
+	}
+	return errors
+}
 
-		var errors []*ValidationError
-		for _, err := range err.(validator.ValidationErrors) {
-			var element ValidationError
-			element.Field = err.StructNamespace()
-			// Construct a descriptive message for the validation error
-			element.Message = fmt.Sprintf(
-				"Field '%s' failed validation for '%s' condition",
-				err.StructNamespace(),
-				err.Tag(),
-			)
-			errors = append(errors, &element)
+type CreatedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type CreateAPIKeyResponse struct {
+	ResponseStatus
+	Data *CreatedAPIKey `json:"data"`
+}
+
+type GetAPIKeysResponse struct {
+	ResponseStatus
+	Data []*APIKey `json:"data"`
+}
+
+type OIDCLoginState struct {
+	State        string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	// Restore asks to restore the account if it is scheduled for deletion
+	Restore   bool
+	CreatedAt time.Time
+}
+
+type OAuthClient struct {
+	ClientID     string    `json:"clientId"`
+	SecretHash   string    `json:"-"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirectUris"`
+	OwnerUserID  string    `json:"-"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// allowsRedirectURI reports whether uri exactly matches one of the client's registered redirect URIs
+func (c *OAuthClient) allowsRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
 		}
-		return errors
 	}
-	return nil
+	return false
 }
 
-type AddUserToOrgResponse struct {
+type CreateOAuthClientRequest struct {
+	Name         string   `json:"name"         validate:"required"`
+	RedirectURIs []string `json:"redirectUris" validate:"required,min=1,dive,url"`
+}
+
+// Validate is a method of CreateOAuthClientRequest that validates its fields.
+func (r *CreateOAuthClientRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+type CreatedOAuthClient struct {
+	OAuthClient
+	ClientSecret string `json:"clientSecret"`
+}
+
+type CreateOAuthClientResponse struct {
+	ResponseStatus
+	Data *CreatedOAuthClient `json:"data"`
+}
+
+type GetOAuthClientsResponse struct {
+	ResponseStatus
+	Data []*OAuthClient `json:"data"`
+}
+
+type OAuthCode struct {
+	CodeHash      string
+	ClientID      string
+	UserID        string
+	RedirectURI   string
+	Scopes        []string
+	Nonce         string
+	CodeChallenge string
+	CreatedAt     time.Time
+}
+
+// AuthorizeRequest holds the parameters of an OpenID Connect authorization request.
+// CodeChallenge is required, with the S256 method. Consent is only set when the user
+// answers a consent prompt.
+type AuthorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Consent             string `json:"consent"`
+}
+
+type AuthorizeResult struct {
+	ConsentRequired bool         `json:"consentRequired"`
+	Client          *OAuthClient `json:"client,omitempty"`
+	Scopes          []string     `json:"scopes,omitempty"`
+	RedirectTo      string       `json:"redirectTo,omitempty"`
+}
+
+type AuthorizeResponse struct {
+	ResponseStatus
+	Data *AuthorizeResult `json:"data"`
+}
+
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type OIDCDiscoveryDocument struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// SCIM 2.0 resources and messages (RFC 7643 and RFC 7644)
+
+type SCIMMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+	Version      string `json:"version,omitempty"`
+}
+
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName"`
+	FamilyName string `json:"familyName"`
+}
+
+// SCIMMultiValue is an item of a multi-valued attribute, like an email of a user or a member of a group
+type SCIMMultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type SCIMUser struct {
+	Schemas      []string         `json:"schemas"`
+	ID           string           `json:"id,omitempty"`
+	ExternalID   string           `json:"externalId,omitempty"`
+	UserName     string           `json:"userName"`
+	Name         *SCIMName        `json:"name,omitempty"`
+	DisplayName  string           `json:"displayName,omitempty"`
+	Emails       []SCIMMultiValue `json:"emails,omitempty"`
+	PhoneNumbers []SCIMMultiValue `json:"phoneNumbers,omitempty"`
+	Active       *bool            `json:"active,omitempty"`
+	Meta         *SCIMMeta        `json:"meta,omitempty"`
+}
+
+type SCIMGroup struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []SCIMMultiValue `json:"members,omitempty"`
+	Meta        *SCIMMeta        `json:"meta,omitempty"`
+}
+
+type SCIMListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type SCIMPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	SCIMType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+type SCIMSupported struct {
+	Supported bool `json:"supported"`
+}
+
+type SCIMBulkSupport struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type SCIMFilterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type SCIMAuthenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary"`
+}
+
+type SCIMServiceProviderConfig struct {
+	Schemas               []string                   `json:"schemas"`
+	Patch                 SCIMSupported              `json:"patch"`
+	Bulk                  SCIMBulkSupport            `json:"bulk"`
+	Filter                SCIMFilterSupport          `json:"filter"`
+	ChangePassword        SCIMSupported              `json:"changePassword"`
+	Sort                  SCIMSupported              `json:"sort"`
+	ETag                  SCIMSupported              `json:"etag"`
+	AuthenticationSchemes []SCIMAuthenticationScheme `json:"authenticationSchemes"`
+	Meta                  *SCIMMeta                  `json:"meta"`
+}
+
+type SCIMAttribute struct {
+	Name          string          `json:"name"`
+	Type          string          `json:"type"`
+	MultiValued   bool            `json:"multiValued"`
+	Required      bool            `json:"required"`
+	CaseExact     bool            `json:"caseExact"`
+	Mutability    string          `json:"mutability"`
+	Returned      string          `json:"returned"`
+	Uniqueness    string          `json:"uniqueness"`
+	SubAttributes []SCIMAttribute `json:"subAttributes,omitempty"`
+}
+
+type SCIMSchema struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Attributes  []SCIMAttribute `json:"attributes"`
+	Meta        *SCIMMeta       `json:"meta"`
+}
+
+type SCIMResourceType struct {
+	Schemas     []string  `json:"schemas"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Endpoint    string    `json:"endpoint"`
+	Description string    `json:"description"`
+	Schema      string    `json:"schema"`
+	Meta        *SCIMMeta `json:"meta"`
+}
+
+type GraphQLRequest struct {
+	Query         string                 `json:"query" validate:"required"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func (r *GraphQLRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+// GraphQLResponse holds the data of a query and the errors of the fields that couldn't be
+// resolved. A query that can't be executed at all has errors and no data.
+type GraphQLResponse struct {
+	Data   interface{}   `json:"data,omitempty"`
+	Errors gqlerror.List `json:"errors,omitempty"`
+}
+
+type Session struct {
+	SessionID  string    `json:"sessionId"`
+	UserID     string    `json:"-"`
+	UserAgent  string    `json:"userAgent"`
+	IPAddress  string    `json:"ipAddress"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+type GetSessionsResponse struct {
 	ResponseStatus
+	Data []*Session `json:"data"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	NewPassword     string `json:"newPassword"     validate:"required"`
+}
+
+// Validate is a method of ChangePasswordRequest that validates its fields.
+func (r *ChangePasswordRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+type ChangeEmailRequest struct {
+	NewEmail string `json:"newEmail" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+// Validate is a method of ChangeEmailRequest that validates its fields.
+func (r *ChangeEmailRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+type EmailChange struct {
+	TokenHash string
+	UserID    string
+	NewEmail  string
+	ExpiresAt time.Time
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type DeleteAccountResult struct {
+	PurgeAfter time.Time `json:"purgeAfter"`
+}
+
+type DeleteAccountResponse struct {
+	ResponseStatus
+	Data *DeleteAccountResult `json:"data"`
+}
+
+// DeleteAccountBlockedResponse lists the organisations whose ownership must be transferred
+// or that must be deleted before the account can be deleted
+type DeleteAccountBlockedResponse struct {
+	ErrorResponse
+	Orgs []*Org `json:"organisations"`
+}
+
+type TransferOwnershipRequest struct {
+	UserID string `json:"userId" validate:"required"`
+}
+
+// Validate is a method of TransferOwnershipRequest that validates its fields.
+func (r *TransferOwnershipRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+type RestoreAccountRequest struct {
+	Email    string `json:"email"    validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+// Validate is a method of RestoreAccountRequest that validates its fields.
+func (r *RestoreAccountRequest) Validate() []*ValidationError {
+	return validateStruct(r)
+}
+
+type DataExport struct {
+	ExportID    string     `json:"exportId"`
+	UserID      string     `json:"-"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt"`
+	StatusURL   string     `json:"statusUrl"`
+	DownloadURL string     `json:"downloadUrl,omitempty"`
+}
+
+type DataExportResponse struct {
+	ResponseStatus
+	Data *DataExport `json:"data"`
+}
+
+// AuditEvent records who did what to which record. Events of organisations are kept
+// after the organisation is deleted.
+type AuditEvent struct {
+	EventID string `json:"eventId"`
+	OrgID   string `json:"orgId,omitempty"`
+	ActorID string `json:"actorId,omitempty"`
+	// ActorType is AuditActorSCIMToken when ActorID is a SCIM token, and empty for users
+	ActorType  string    `json:"actorType,omitempty"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"targetType"`
+	TargetID   string    `json:"targetId"`
+	IPAddress  string    `json:"ipAddress,omitempty"`
+	RequestID  string    `json:"requestId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// AuditEventFilter narrows down a listing of audit events. Zero fields don't filter.
+type AuditEventFilter struct {
+	Action   string
+	ActorID  string
+	TargetID string
+	Since    *time.Time
+	Until    *time.Time
+	// position of the last event of the previous page
+	AfterCreatedAt *time.Time
+	AfterEventID   string
+	Limit          int
+}
+
+type AuditEventPage struct {
+	Events     []*AuditEvent `json:"events"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+type GetAuditEventsResponse struct {
+	ResponseStatus
+	Data *AuditEventPage `json:"data"`
+}
+
+// Webhook subscribes a URL to events of an organisation. Deliveries are signed with Secret.
+type Webhook struct {
+	WebhookID string    `json:"webhookId"`
+	OrgID     string    `json:"orgId"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"    validate:"required,url,startswith=http"`
+	Events []string `json:"events" validate:"required,min=1"`
+}
+
+// Validate is a method of CreateWebhookRequest that validates its fields.
+func (r *CreateWebhookRequest) Validate() []*ValidationError {
+	errors := validateStruct(r)
+	for i, event := range r.Events {
+		if !isWebhookEvent(event) {
+			errors = append(errors, &ValidationError{
+				Field:   fmt.Sprintf("CreateWebhookRequest.Events[%d]", i),
+				Message: fmt.Sprintf("Unknown event type '%s'", event),
+			})
+		}
+	}
+	return errors
+}
+
+type CreatedWebhook struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+type CreateWebhookResponse struct {
+	ResponseStatus
+	Data *CreatedWebhook `json:"data"`
+}
+
+type GetWebhooksResponse struct {
+	ResponseStatus
+	Data []*Webhook `json:"data"`
+}
+
+// WebhookDelivery is one event queued for delivery to a webhook
+type WebhookDelivery struct {
+	DeliveryID     string     `json:"deliveryId"`
+	WebhookID      string     `json:"webhookId"`
+	EventID        string     `json:"eventId"`
+	EventType      string     `json:"eventType"`
+	Payload        []byte     `json:"-"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"nextAttemptAt"`
+	LastStatusCode *int       `json:"lastStatusCode"`
+	LastError      string     `json:"lastError,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	DeliveredAt    *time.Time `json:"deliveredAt"`
+	// of the webhook, filled in when the delivery is claimed
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+type GetWebhookDeliveriesResponse struct {
+	ResponseStatus
+	Data []*WebhookDelivery `json:"data"`
+}
+
+// IdempotencyKey is a request a user made with an Idempotency-Key header and, once it
+// completed, the response recorded for it
+type IdempotencyKey struct {
+	UserID string
+	Key    string
+	// hash of the method, path and body of the request
+	Fingerprint string
+	StatusCode  int
+	Header      map[string][]string
+	Body        []byte
+	Completed   bool
+	ExpiresAt   time.Time
 }
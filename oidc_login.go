@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// how long a user has to complete a login at the identity provider
+const oidcLoginStateTTL = 10 * time.Minute
+
+var errOIDCEmailNotVerified = errors.New("Identity provider did not return a verified email")
+
+// OIDCProvider is an external OpenID Connect issuer users can sign in with.
+// Its endpoints and signing keys are fetched from the discovery URL on first use.
+type OIDCProvider struct {
+	Name         string
+	DiscoveryURL string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *oidcProviderMetadata
+	keys     map[string]*rsa.PublicKey
+}
+
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// loadOIDCProviders reads the configured identity providers from the environment.
+// UZORG_OIDC_PROVIDERS is a comma separated list of provider names, and each provider
+// is configured with UZORG_OIDC_<NAME>_DISCOVERY_URL, _CLIENT_ID, _CLIENT_SECRET and _REDIRECT_URL.
+func loadOIDCProviders() map[string]*OIDCProvider {
+	providers := map[string]*OIDCProvider{}
+	for _, name := range strings.Split(os.Getenv("UZORG_OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		prefix := "UZORG_OIDC_" + strings.ToUpper(name) + "_"
+		p := &OIDCProvider{
+			Name:         name,
+			DiscoveryURL: os.Getenv(prefix + "DISCOVERY_URL"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		}
+		if p.DiscoveryURL == "" || p.ClientID == "" || p.RedirectURL == "" {
+			log.Printf("Skipping OIDC provider %s: discovery url, client id and redirect url are required", name)
+			continue
+		}
+		providers[name] = p
+	}
+	return providers
+}
+
+func (p *OIDCProvider) httpClient() *http.Client {
+	if p.client != nil {
+		return p.client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (p *OIDCProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.httpClient().Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches and caches the provider metadata
+func (p *OIDCProvider) discover() (*oidcProviderMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var md oidcProviderMetadata
+	if err := p.getJSON(p.DiscoveryURL, &md); err != nil {
+		return nil, fmt.Errorf("fetching discovery document: %w", err)
+	}
+	if md.Issuer == "" || md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing required endpoints")
+	}
+	p.metadata = &md
+	return p.metadata, nil
+}
+
+// signingKey returns the provider key with the given id, refreshing the key set
+// when the id is unknown so that key rotation is picked up
+func (p *OIDCProvider) signingKey(kid string) (*rsa.PublicKey, error) {
+	md, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set jsonWebKeySet
+	if err := p.getJSON(md.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching jwks: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		key, err := parseRSAJWK(k)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = key
+	}
+	p.keys = keys
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no signing key with id %q", kid)
+	}
+	return key, nil
+}
+
+func parseRSAJWK(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("decoding modulus of key %q: %w", k.Kid, err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("decoding exponent of key %q: %w", k.Kid, err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// authCodeURL builds the authorization request URL for the authorization code flow with PKCE
+func (p *OIDCProvider) authCodeURL(state, nonce, codeVerifier string) (string, error) {
+	md, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", "openid email profile")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return md.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// exchange redeems an authorization code at the token endpoint
+func (p *OIDCProvider) exchange(code, codeVerifier string) (*oidcTokenResponse, error) {
+	md, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	resp, err := p.httpClient().PostForm(md.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("decoding token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	return &tokens, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func (p *OIDCProvider) verifyIDToken(rawIDToken, nonce string) (jwt.MapClaims, error) {
+	md, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.Parse(rawIDToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid id token")
+	}
+	if !claims.VerifyIssuer(md.Issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, fmt.Errorf("id token was not issued for client %s", p.ClientID)
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("id token has expired")
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+	return claims, nil
+}
+
+// handler for GET /auth/oidc/{provider}/login that starts a login at an external identity provider.
+// With restore=true an account scheduled for deletion is restored when the login completes.
+func (h *ReqHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	provider, ok := h.oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		writeBadRequestResponse(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	state, err := randomToken(32)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error generating state: %v", err))
+		return
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error generating nonce: %v", err))
+		return
+	}
+	codeVerifier, err := randomToken(32)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error generating code verifier: %v", err))
+		return
+	}
+
+	authURL, err := provider.authCodeURL(state, nonce, codeVerifier)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error contacting identity provider: %v", err))
+		return
+	}
+
+	err = h.uzorgStore.InsertOIDCLoginState(&OIDCLoginState{
+		State:        state,
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		Restore:      r.URL.Query().Get("restore") == "true",
+	})
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error saving login state: %v", err))
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handler for GET /auth/oidc/{provider}/callback that completes a login at an external identity provider.
+// The external identity is linked to the user with the same verified email, or a new user is created.
+func (h *ReqHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	provider, ok := h.oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		writeBadRequestResponse(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	q := r.URL.Query()
+	if errCode := q.Get("error"); errCode != "" {
+		writeBadRequestResponse(w, http.StatusUnauthorized, fmt.Sprintf("Identity provider returned error: %s", errCode))
+		return
+	}
+
+	loginState, err := h.uzorgStore.ConsumeOIDCLoginState(q.Get("state"))
+	if err != nil || loginState.Provider != provider.Name || time.Since(loginState.CreatedAt) > oidcLoginStateTTL {
+		writeBadRequestResponse(w, http.StatusBadRequest, "Invalid or expired login state")
+		return
+	}
+
+	tokens, err := provider.exchange(q.Get("code"), loginState.CodeVerifier)
+	if err != nil {
+		log.Println("Error exchanging authorization code: ", err)
+		writeBadRequestResponse(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	claims, err := provider.verifyIDToken(tokens.IDToken, loginState.Nonce)
+	if err != nil {
+		log.Println("Error verifying id token: ", err)
+		writeBadRequestResponse(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		writeBadRequestResponse(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	user, err := h.uzorgStore.GetUserByIdentity(issuer, subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = h.linkOIDCIdentity(r, issuer, subject, claims)
+		if err != nil {
+			log.Println("Error linking external identity: ", err)
+			if errors.Is(err, errOIDCEmailNotVerified) {
+				writeBadRequestResponse(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			writeServerErrorResponse(w, "Error linking external identity")
+			return
+		}
+	} else if err != nil {
+		log.Println("Error getting user by identity: ", err)
+		writeServerErrorResponse(w, "Error getting user by identity")
+		return
+	}
+
+	// users without a password restore their account by logging in with restore=true
+	if user.DeletedAt != nil {
+		if !loginState.Restore {
+			writeBadRequestResponse(w, http.StatusForbidden, "Account is scheduled for deletion, log in with restore=true to restore it")
+			return
+		}
+		if !h.restoreDeletedUser(w, r, &user) {
+			return
+		}
+	}
+
+	token, err := h.startSession(&user, r)
+	if err != nil {
+		log.Println("Error generating token: ", err)
+		writeServerErrorResponse(w, "Error generating token")
+		return
+	}
+
+	resp := LoginResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Login successful",
+		},
+		Data: &UserData{
+			Token: token,
+			User:  &user,
+		},
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// linkOIDCIdentity links an external identity seen for the first time to the user owning its
+// verified email, creating the user and their default org if there is none
+func (h *ReqHandler) linkOIDCIdentity(r *http.Request, issuer, subject string, claims jwt.MapClaims) (User, error) {
+	email, _ := claims["email"].(string)
+	verified, _ := claims["email_verified"].(bool)
+	if email == "" || !verified {
+		return User{}, errOIDCEmailNotVerified
+	}
+
+	user, err := h.uzorgStore.GetUserByEmail(email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return User{}, fmt.Errorf("getting user by email: %w", err)
+	}
+	if err != nil {
+		firstName, _ := claims["given_name"].(string)
+		lastName, _ := claims["family_name"].(string)
+		phone, _ := claims["phone_number"].(string)
+		if firstName == "" {
+			firstName, _ = claims["name"].(string)
+		}
+
+		// users created from an external identity have no password and can only sign in through it
+		user = User{
+			UserID:        uuid.New().String(),
+			FirstName:     firstName,
+			LastName:      lastName,
+			Email:         email,
+			Phone:         phone,
+			EmailVerified: true,
+		}
+		org := makeUserDefaultOrg(&user)
+
+		ev := newAuditEvent(r, AuditUserRegistered, "user", user.UserID)
+		ev.OrgID = org.OrgID
+		ev.ActorID = user.UserID
+		if err := h.uzorgStore.InsertUserAndDefaultOrg(&user, &org, ev); err != nil {
+			return User{}, fmt.Errorf("inserting user: %w", err)
+		}
+	}
+
+	if err := h.uzorgStore.InsertUserIdentity(user.UserID, issuer, subject); err != nil {
+		return User{}, fmt.Errorf("inserting identity: %w", err)
+	}
+	return user, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) InsertOIDCLoginState(state *OIDCLoginState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *state
+	stored.CreatedAt = time.Now()
+	s.oidcStates[state.State] = &stored
+	return nil
+}
+
+func (s *memoryStore) ConsumeOIDCLoginState(state string) (OIDCLoginState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.oidcStates[state]
+	if !ok {
+		return OIDCLoginState{}, sql.ErrNoRows
+	}
+	delete(s.oidcStates, state)
+	return *stored, nil
+}
+
+func (s *memoryStore) GetUserByIdentity(issuer, subject string) (User, error) {
+	s.mu.Lock()
+	if s.identityErr != nil {
+		s.mu.Unlock()
+		return User{}, s.identityErr
+	}
+	userID, ok := s.identities[issuer+" "+subject]
+	s.mu.Unlock()
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return s.GetUserByID(userID)
+}
+
+func (s *memoryStore) InsertUserIdentity(userID, issuer, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identities[issuer+" "+subject] = userID
+	s.users[userID].EmailVerified = true
+	return nil
+}
+
+// mockOIDCIssuer is an identity provider serving discovery, its key set and a token endpoint.
+// The ID token and PKCE challenge of each code are set up by the test before the callback.
+type mockOIDCIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockOIDCCode
+}
+
+type mockOIDCCode struct {
+	challenge string
+	idToken   string
+}
+
+func newMockOIDCIssuer(t *testing.T) *mockOIDCIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockOIDCIssuer{key: key, codes: map[string]mockOIDCCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProviderMetadata{
+			Issuer:                issuer.URL,
+			AuthorizationEndpoint: issuer.URL + "/authorize",
+			TokenEndpoint:         issuer.URL + "/token",
+			JWKSURI:               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{{
+			Kid: "k1",
+			Kty: "RSA",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		code, ok := issuer.codes[r.PostFormValue("code")]
+		delete(issuer.codes, r.PostFormValue("code"))
+		issuer.mu.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || r.PostFormValue("grant_type") != "authorization_code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(oidcTokenResponse{AccessToken: "at", TokenType: "Bearer", IDToken: code.idToken})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// sign returns an ID token for the claims signed with key under the issuer's key id
+func (i *mockOIDCIssuer) sign(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestOIDCLogin(t *testing.T) {
+	store, h := newTestHandler(t)
+	server := httptest.NewServer(newRouter(h))
+	t.Cleanup(server.Close)
+	issuer := newMockOIDCIssuer(t)
+	h.oidcProviders = map[string]*OIDCProvider{"mock": {
+		Name:         "mock",
+		DiscoveryURL: issuer.URL + "/.well-known/openid-configuration",
+		ClientID:     "uzorg-test",
+		RedirectURL:  server.URL + "/api/v1/auth/oidc/mock/callback",
+	}}
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// login starts a login, lets the issuer answer the code with the ID token built from
+	// the nonce of the authorization request, and completes it at the callback
+	login := func(restore bool, idToken func(nonce string) string) (*http.Response, LoginResponse) {
+		t.Helper()
+		loginURL := server.URL + "/api/v1/auth/oidc/mock/login"
+		if restore {
+			loginURL += "?restore=true"
+		}
+		resp, err := noRedirects.Get(loginURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("got status %d starting a login, want 302", resp.StatusCode)
+		}
+		authURL, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := authURL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			t.Fatalf("got authorization request %s, want a S256 code challenge", authURL)
+		}
+
+		issuer.mu.Lock()
+		issuer.codes["code-"+q.Get("state")] = mockOIDCCode{challenge: q.Get("code_challenge"), idToken: idToken(q.Get("nonce"))}
+		issuer.mu.Unlock()
+
+		var body LoginResponse
+		resp = doTestRequest(t, http.MethodGet, server.URL+"/api/v1/auth/oidc/mock/callback?"+url.Values{
+			"state": {q.Get("state")},
+			"code":  {"code-" + q.Get("state")},
+		}.Encode(), "", "", &body)
+		return resp, body
+	}
+	claims := func(nonce, subject, email string, verified bool) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":            issuer.URL,
+			"aud":            "uzorg-test",
+			"sub":            subject,
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          nonce,
+			"email":          email,
+			"email_verified": verified,
+			"given_name":     "Nia",
+		}
+	}
+	userCount := func() int {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.users)
+	}
+
+	resp, body := login(false, func(nonce string) string {
+		return issuer.sign(t, issuer.key, claims(nonce, "sub-nia", "nia@example.com", true))
+	})
+	if resp.StatusCode != http.StatusOK || body.Data == nil || body.Data.Token == "" {
+		t.Fatalf("got status %d, %+v for a new user, want 200 with a token", resp.StatusCode, body)
+	}
+	nia := body.Data.User
+	orgs, _ := store.GetUserOrgs(nia.UserID)
+	if nia.Email != "nia@example.com" || nia.FirstName != "Nia" || len(orgs) != 1 {
+		t.Errorf("got user %+v with %d orgs, want Nia with a default org", nia, len(orgs))
+	}
+
+	users := userCount()
+	resp, body = login(false, func(nonce string) string {
+		return issuer.sign(t, issuer.key, claims(nonce, "sub-nia", "nia@example.com", true))
+	})
+	if resp.StatusCode != http.StatusOK || body.Data.User.UserID != nia.UserID || userCount() != users {
+		t.Errorf("got status %d, %+v signing in again, want the linked user", resp.StatusCode, body.Data)
+	}
+
+	ctx := context.Background()
+	c := client.New(server.URL)
+	oba := registerTestUser(t, c, "Oba", "oba@example.com")
+	resp, body = login(false, func(nonce string) string {
+		return issuer.sign(t, issuer.key, claims(nonce, "sub-oba", "oba@example.com", true))
+	})
+	if resp.StatusCode != http.StatusOK || body.Data.User.UserID != oba.UserID {
+		t.Errorf("got status %d, %+v for a verified email, want the user owning it", resp.StatusCode, body.Data)
+	}
+	if _, err := c.GetOrgs(ctx); err != nil {
+		t.Errorf("got %v using the password session after linking", err)
+	}
+
+	registerTestUser(t, client.New(server.URL), "Pere", "pere@example.com")
+	users = userCount()
+	resp, _ = login(false, func(nonce string) string {
+		return issuer.sign(t, issuer.key, claims(nonce, "sub-pere", "pere@example.com", false))
+	})
+	if resp.StatusCode != http.StatusUnauthorized || userCount() != users {
+		t.Errorf("got status %d for an unverified email, want 401", resp.StatusCode)
+	}
+	if _, err := store.GetUserByIdentity(issuer.URL, "sub-pere"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("got %v, the unverified identity was linked", err)
+	}
+
+	for name, idToken := range map[string]func(nonce string) string{
+		"bad signature": func(nonce string) string {
+			return issuer.sign(t, otherKey, claims(nonce, "sub-nia", "nia@example.com", true))
+		},
+		"wrong nonce": func(nonce string) string {
+			return issuer.sign(t, issuer.key, claims("not-"+nonce, "sub-nia", "nia@example.com", true))
+		},
+		"wrong audience": func(nonce string) string {
+			c := claims(nonce, "sub-nia", "nia@example.com", true)
+			c["aud"] = "another-client"
+			return issuer.sign(t, issuer.key, c)
+		},
+	} {
+		if resp, _ := login(false, idToken); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("got status %d for an ID token with a %s, want 401", resp.StatusCode, name)
+		}
+	}
+
+	// the issuer refuses the code when the verifier does not match the challenge
+	resp, err = noRedirects.Get(server.URL + "/api/v1/auth/oidc/mock/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	authURL, _ := url.Parse(resp.Header.Get("Location"))
+	state := authURL.Query().Get("state")
+	issuer.mu.Lock()
+	issuer.codes["stolen"] = mockOIDCCode{
+		challenge: base64.RawURLEncoding.EncodeToString(make([]byte, 32)),
+		idToken:   issuer.sign(t, issuer.key, claims(authURL.Query().Get("nonce"), "sub-nia", "nia@example.com", true)),
+	}
+	issuer.mu.Unlock()
+	resp = doTestRequest(t, http.MethodGet, server.URL+"/api/v1/auth/oidc/mock/callback?state="+state+"&code=stolen", "", "", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for a code with another challenge, want 401", resp.StatusCode)
+	}
+
+	// users without a password restore their deleted account by logging in, during its grace period only
+	niaLogin := func(restore bool) (*http.Response, LoginResponse) {
+		return login(restore, func(nonce string) string {
+			return issuer.sign(t, issuer.key, claims(nonce, "sub-nia", "nia@example.com", true))
+		})
+	}
+	store.mu.Lock()
+	deletedAt := time.Now().Add(-time.Hour)
+	store.users[nia.UserID].DeletedAt = &deletedAt
+	store.mu.Unlock()
+	if resp, _ := niaLogin(false); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d signing in to a deleted account, want 403", resp.StatusCode)
+	}
+	if resp, body := niaLogin(true); resp.StatusCode != http.StatusOK || body.Data == nil || body.Data.User.UserID != nia.UserID {
+		t.Errorf("got status %d restoring a deleted account by logging in, want 200", resp.StatusCode)
+	}
+	if u, _ := store.GetUserByID(nia.UserID); u.DeletedAt != nil {
+		t.Error("the account is still deleted after logging in with restore=true")
+	}
+	store.mu.Lock()
+	deletedAt = time.Now().Add(-accountDeletionGrace() - time.Hour)
+	store.users[nia.UserID].DeletedAt = &deletedAt
+	store.mu.Unlock()
+	if resp, _ := niaLogin(true); resp.StatusCode != http.StatusGone {
+		t.Errorf("got status %d restoring an account after its grace period, want 410", resp.StatusCode)
+	}
+
+	store.mu.Lock()
+	store.identityErr = errors.New("connection refused")
+	store.mu.Unlock()
+	users = userCount()
+	resp, _ = login(false, func(nonce string) string {
+		return issuer.sign(t, issuer.key, claims(nonce, "sub-quin", "quin@example.com", true))
+	})
+	if resp.StatusCode != http.StatusInternalServerError || userCount() != users {
+		t.Errorf("got status %d when the identity lookup fails, want 500 without creating a user", resp.StatusCode)
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Scopes client applications can request from the OpenID Connect provider
+const (
+	OIDCScopeOpenID  = "openid"
+	OIDCScopeProfile = "profile"
+	OIDCScopeEmail   = "email"
+	OIDCScopePhone   = "phone"
+	OIDCScopeOrgs    = "orgs"
+)
+
+var oidcSupportedScopes = []string{OIDCScopeOpenID, OIDCScopeProfile, OIDCScopeEmail, OIDCScopePhone, OIDCScopeOrgs}
+
+const (
+	oauthCodeTTL = 5 * time.Minute
+	oidcTokenTTL = time.Hour
+)
+
+// OIDCIssuer signs the ID and access tokens handed to client applications
+type OIDCIssuer struct {
+	IssuerURL string
+	key       *rsa.PrivateKey
+	keyID     string
+}
+
+// loadOIDCIssuer configures the OpenID Connect provider from the environment.
+// UZORG_ISSUER_URL defaults to the public URL of the server and UZORG_OIDC_SIGNING_KEY_FILE
+// a PEM encoded RSA private key. Without a key file an ephemeral key is generated,
+// which invalidates issued tokens on every restart.
+func loadOIDCIssuer() (*OIDCIssuer, error) {
+	issuerURL := strings.TrimSuffix(os.Getenv("UZORG_ISSUER_URL"), "/")
+	if issuerURL == "" {
+		issuerURL = publicURL("")
+	}
+
+	var key *rsa.PrivateKey
+	if keyFile := os.Getenv("UZORG_OIDC_SIGNING_KEY_FILE"); keyFile != "" {
+		pemBytes, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading signing key: %w", err)
+		}
+		key, err = parseRSAPrivateKey(pemBytes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Println("UZORG_OIDC_SIGNING_KEY_FILE is not set, generating an ephemeral OIDC signing key")
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("generating signing key: %w", err)
+		}
+	}
+
+	kid := sha256.Sum256(key.PublicKey.N.Bytes())
+	return &OIDCIssuer{
+		IssuerURL: issuerURL,
+		key:       key,
+		keyID:     base64.RawURLEncoding.EncodeToString(kid[:8]),
+	}, nil
+}
+
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("signing key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an RSA key")
+	}
+	return key, nil
+}
+
+func (iss *OIDCIssuer) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = iss.keyID
+	return token.SignedString(iss.key)
+}
+
+// verifyAccessToken parses an access token issued by the token endpoint
+func (iss *OIDCIssuer) verifyAccessToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return &iss.key.PublicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid access token")
+	}
+	if !claims.VerifyIssuer(iss.IssuerURL, true) || claims["token_use"] != "access" {
+		return nil, errors.New("not an access token issued by this server")
+	}
+	return claims, nil
+}
+
+// hasScope reports whether scope is in scopes
+func hasScope(scopes []string, scope string) bool {
+	return len(missingScopes(scopes, []string{scope})) == 0
+}
+
+// userClaims returns the claims describing a user that the given OIDC scopes release
+func (h *ReqHandler) userClaims(user *User, scopes []string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{"sub": user.UserID}
+
+	if hasScope(scopes, OIDCScopeProfile) {
+		claims["name"] = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims["given_name"] = user.FirstName
+		claims["family_name"] = user.LastName
+	}
+	if hasScope(scopes, OIDCScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+	if hasScope(scopes, OIDCScopePhone) && user.Phone != "" {
+		claims["phone_number"] = user.Phone
+	}
+	if hasScope(scopes, OIDCScopeOrgs) {
+		orgs, err := h.uzorgStore.GetUserOrgs(user.UserID)
+		if err != nil {
+			return nil, err
+		}
+		orgClaims := []map[string]string{}
+		for _, org := range orgs {
+			orgClaims = append(orgClaims, map[string]string{"id": org.OrgID, "name": org.Name})
+		}
+		claims["orgs"] = orgClaims
+	}
+	return claims, nil
+}
+
+// writeOAuthError writes an error response in the format defined by RFC 6749
+func writeOAuthError(w http.ResponseWriter, statusCode int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(OAuthError{
+		Error:            code,
+		ErrorDescription: description,
+	})
+}
+
+// redirectWithParams adds query parameters to a client redirect URI
+func redirectWithParams(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	q := u.Query()
+	for k, vs := range params {
+		for _, v := range vs {
+			q.Add(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// handler for GET /.well-known/openid-configuration
+func (h *ReqHandler) OIDCDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	base := h.issuer.IssuerURL
+	json.NewEncoder(w).Encode(OIDCDiscoveryDocument{
+		Issuer:                            base,
+		AuthorizationEndpoint:             base + "/oauth2/authorize",
+		TokenEndpoint:                     base + "/oauth2/token",
+		UserinfoEndpoint:                  base + "/oauth2/userinfo",
+		JWKSURI:                           base + "/oauth2/jwks",
+		ScopesSupported:                   oidcSupportedScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "name", "given_name", "family_name", "email", "email_verified", "phone_number", "orgs"},
+	})
+}
+
+// handler for GET /oauth2/jwks that publishes the key ID tokens are signed with
+func (h *ReqHandler) OIDCJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	pub := h.issuer.key.PublicKey
+	json.NewEncoder(w).Encode(jsonWebKeySet{
+		Keys: []jsonWebKey{{
+			Kid: h.issuer.keyID,
+			Kty: "RSA",
+			Alg: "RS256",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// handler for /oauth2/authorize. The logged in user's frontend calls it with the client's
+// authorization request. A GET issues a code straight away when the user has already consented
+// to the requested scopes, and otherwise describes the consent to ask for. A POST records the
+// user's decision. Either way the response tells the frontend where to send the browser.
+func (h *ReqHandler) OIDCAuthorize(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req AuthorizeRequest
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBadRequestResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Error decoding request: %v", err),
+			)
+			return
+		}
+	} else {
+		q := r.URL.Query()
+		req = AuthorizeRequest{
+			ResponseType:        q.Get("response_type"),
+			ClientID:            q.Get("client_id"),
+			RedirectURI:         q.Get("redirect_uri"),
+			Scope:               q.Get("scope"),
+			State:               q.Get("state"),
+			Nonce:               q.Get("nonce"),
+			CodeChallenge:       q.Get("code_challenge"),
+			CodeChallengeMethod: q.Get("code_challenge_method"),
+		}
+	}
+
+	// errors about the client or redirect uri must not be sent to the redirect uri
+	client, err := h.uzorgStore.GetOAuthClient(req.ClientID)
+	if err != nil {
+		writeBadRequestResponse(w, http.StatusBadRequest, "Unknown client")
+		return
+	}
+	if !client.allowsRedirectURI(req.RedirectURI) {
+		writeBadRequestResponse(w, http.StatusBadRequest, "Redirect URI is not registered for client")
+		return
+	}
+
+	redirectError := func(code, description string) {
+		params := url.Values{"error": {code}, "error_description": {description}}
+		if req.State != "" {
+			params.Set("state", req.State)
+		}
+		writeAuthorizeResponse(w, &AuthorizeResult{RedirectTo: redirectWithParams(req.RedirectURI, params)})
+	}
+
+	if req.ResponseType != "code" {
+		redirectError("unsupported_response_type", "Only the code response type is supported")
+		return
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if !hasScope(scopes, OIDCScopeOpenID) {
+		redirectError("invalid_scope", "The openid scope is required")
+		return
+	}
+	if unsupported := missingScopes(oidcSupportedScopes, scopes); len(unsupported) > 0 {
+		redirectError("invalid_scope", fmt.Sprintf("Unsupported scopes: %s", strings.Join(unsupported, " ")))
+		return
+	}
+	// every client uses PKCE so an intercepted code cannot be redeemed
+	if req.CodeChallenge == "" {
+		redirectError("invalid_request", "A code_challenge is required")
+		return
+	}
+	if req.CodeChallengeMethod != "S256" {
+		redirectError("invalid_request", "Only the S256 code challenge method is supported")
+		return
+	}
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	if r.Method == "POST" {
+		if req.Consent != "approve" {
+			redirectError("access_denied", "The user denied the request")
+			return
+		}
+		if err := h.uzorgStore.UpsertOAuthConsent(userID, client.ClientID, scopes); err != nil {
+			writeServerErrorResponse(w, fmt.Sprintf("Error saving consent: %v", err))
+			return
+		}
+	} else {
+		granted, err := h.uzorgStore.GetOAuthConsent(userID, client.ClientID)
+		if err != nil || len(missingScopes(granted, scopes)) > 0 {
+			writeAuthorizeResponse(w, &AuthorizeResult{
+				ConsentRequired: true,
+				Client:          &client,
+				Scopes:          scopes,
+			})
+			return
+		}
+	}
+
+	code, err := randomToken(32)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error generating code: %v", err))
+		return
+	}
+
+	err = h.uzorgStore.InsertOAuthCode(&OAuthCode{
+		CodeHash:      hashAPIKey(code),
+		ClientID:      client.ClientID,
+		UserID:        userID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        scopes,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+	})
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error saving code: %v", err))
+		return
+	}
+
+	params := url.Values{"code": {code}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	writeAuthorizeResponse(w, &AuthorizeResult{RedirectTo: redirectWithParams(req.RedirectURI, params)})
+}
+
+func writeAuthorizeResponse(w http.ResponseWriter, result *AuthorizeResult) {
+	message := "Authorization complete"
+	if result.ConsentRequired {
+		message = "User consent is required"
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AuthorizeResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: message,
+		},
+		Data: result,
+	})
+}
+
+// handler for POST /oauth2/token that redeems authorization codes for ID and access tokens
+func (h *ReqHandler) OIDCToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := h.uzorgStore.GetOAuthClient(clientID)
+	if err != nil || subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashAPIKey(clientSecret))) != 1 {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code grant is supported")
+		return
+	}
+
+	code, err := h.uzorgStore.ConsumeOAuthCode(hashAPIKey(r.PostForm.Get("code")))
+	if err != nil ||
+		code.ClientID != client.ClientID ||
+		code.RedirectURI != r.PostForm.Get("redirect_uri") ||
+		time.Since(code.CreatedAt) > oauthCodeTTL {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(verifier[:]) != code.CodeChallenge {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Code verifier does not match")
+		return
+	}
+
+	user, err := h.uzorgStore.GetUserByID(code.UserID)
+	if err != nil || user.DeletedAt != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "User no longer exists")
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(oidcTokenTTL)
+
+	idClaims, err := h.userClaims(&user, code.Scopes)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error building claims")
+		return
+	}
+	idClaims["iss"] = h.issuer.IssuerURL
+	idClaims["aud"] = client.ClientID
+	idClaims["iat"] = now.Unix()
+	idClaims["exp"] = expiresAt.Unix()
+	if code.Nonce != "" {
+		idClaims["nonce"] = code.Nonce
+	}
+
+	idToken, err := h.issuer.sign(idClaims)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error signing id token")
+		return
+	}
+
+	accessToken, err := h.issuer.sign(jwt.MapClaims{
+		"iss":       h.issuer.IssuerURL,
+		"sub":       user.UserID,
+		"aud":       client.ClientID,
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+		"scope":     strings.Join(code.Scopes, " "),
+		"token_use": "access",
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error signing access token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(oidcTokenTTL.Seconds()),
+		IDToken:     idToken,
+		Scope:       strings.Join(code.Scopes, " "),
+	})
+}
+
+// handler for /oauth2/userinfo that returns the claims of the user an access token was issued for
+func (h *ReqHandler) OIDCUserinfo(w http.ResponseWriter, r *http.Request) {
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims, err := h.issuer.verifyAccessToken(tokenString)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+		return
+	}
+
+	sub, _ := claims["sub"].(string)
+	scope, _ := claims["scope"].(string)
+
+	user, err := h.uzorgStore.GetUserByID(sub)
+	if err != nil || user.DeletedAt != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "User no longer exists")
+		return
+	}
+
+	userClaims, err := h.userClaims(&user, strings.Fields(scope))
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error building claims")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userClaims)
+}
+
+// handler for POST /api/oauth/clients that registers a client application owned by the logged in user.
+// The client secret is returned only once.
+func (h *ReqHandler) CreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req CreateOAuthClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	secret, err := randomToken(32)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error generating client secret: %v", err))
+		return
+	}
+
+	client := OAuthClient{
+		ClientID:     uuid.New().String(),
+		SecretHash:   hashAPIKey(secret),
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		OwnerUserID:  userID,
+	}
+
+	err = h.uzorgStore.InsertOAuthClient(&client)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error inserting client: %v", err))
+		return
+	}
+
+	response := CreateOAuthClientResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Client registered successfully",
+		},
+		Data: &CreatedOAuthClient{
+			OAuthClient:  client,
+			ClientSecret: secret,
+		},
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for GET /api/oauth/clients that lists the client applications owned by the logged in user
+func (h *ReqHandler) GetOAuthClients(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	clients, err := h.uzorgStore.GetUserOAuthClients(userID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting clients: %v", err))
+		return
+	}
+
+	response := GetOAuthClientsResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Clients retrieved successfully",
+		},
+		Data: clients,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for DELETE /api/oauth/clients/{id} that deletes a client application owned by the logged in user
+func (h *ReqHandler) DeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	clientID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	deleted, err := h.uzorgStore.DeleteOAuthClient(userID, clientID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error deleting client: %v", err))
+		return
+	}
+
+	if !deleted {
+		writeBadRequestResponse(w, http.StatusNotFound, "Client not found")
+		return
+	}
+
+	response := ResponseStatus{
+		Status:  SuccessStatus,
+		Message: "Client deleted successfully",
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
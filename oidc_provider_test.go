@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) InsertOAuthClient(c *OAuthClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.CreatedAt = time.Now()
+	stored := *c
+	s.oauthClients[c.ClientID] = &stored
+	return nil
+}
+
+func (s *memoryStore) GetOAuthClient(clientID string) (OAuthClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.oauthClients[clientID]
+	if !ok {
+		return OAuthClient{}, sql.ErrNoRows
+	}
+	return *c, nil
+}
+
+func (s *memoryStore) GetUserOAuthClients(userID string) ([]*OAuthClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var clients []*OAuthClient
+	for _, c := range s.oauthClients {
+		if c.OwnerUserID == userID {
+			stored := *c
+			clients = append(clients, &stored)
+		}
+	}
+	return clients, nil
+}
+
+func (s *memoryStore) DeleteOAuthClient(userID, clientID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.oauthClients[clientID]
+	if !ok || c.OwnerUserID != userID {
+		return false, nil
+	}
+	delete(s.oauthClients, clientID)
+	return true, nil
+}
+
+func (s *memoryStore) GetOAuthConsent(userID, clientID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scopes, ok := s.oauthConsents[userID+" "+clientID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return scopes, nil
+}
+
+func (s *memoryStore) UpsertOAuthConsent(userID, clientID string, scopes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.oauthConsents[userID+" "+clientID] = scopes
+	return nil
+}
+
+func (s *memoryStore) InsertOAuthCode(c *OAuthCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *c
+	stored.CreatedAt = time.Now()
+	s.oauthCodes[c.CodeHash] = &stored
+	return nil
+}
+
+func (s *memoryStore) ConsumeOAuthCode(codeHash string) (OAuthCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.oauthCodes[codeHash]
+	if !ok {
+		return OAuthCode{}, sql.ErrNoRows
+	}
+	delete(s.oauthCodes, codeHash)
+	return *c, nil
+}
+
+func TestOIDCProvider(t *testing.T) {
+	store, h := newTestHandler(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.issuer = &OIDCIssuer{key: key, keyID: "k1"}
+	server := httptest.NewServer(newRouter(h))
+	t.Cleanup(server.Close)
+	h.issuer.IssuerURL = server.URL
+
+	ada := client.New(server.URL)
+	adaUser := registerTestUser(t, ada, "Ada", "ada@example.com")
+	bob := client.New(server.URL)
+	registerTestUser(t, bob, "Bob", "bob@example.com")
+
+	// discovery and the key set let client applications verify ID tokens
+	var discovery OIDCDiscoveryDocument
+	if resp := doTestRequest(t, http.MethodGet, server.URL+"/.well-known/openid-configuration", "", "", &discovery); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d for discovery, want 200", resp.StatusCode)
+	}
+	if discovery.Issuer != server.URL || discovery.TokenEndpoint != server.URL+"/oauth2/token" || discovery.JWKSURI != server.URL+"/oauth2/jwks" {
+		t.Errorf("got discovery %+v", discovery)
+	}
+	var jwks jsonWebKeySet
+	doTestRequest(t, http.MethodGet, discovery.JWKSURI, "", "", &jwks)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "k1" {
+		t.Fatalf("got key set %+v, want the signing key", jwks)
+	}
+	publicKey, err := parseRSAJWK(jwks.Keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// client registration
+	clientsURL := server.URL + "/api/v1/oauth/clients"
+	redirectURI := "https://app.example.com/callback"
+	var created CreateOAuthClientResponse
+	resp := doTestRequest(t, http.MethodPost, clientsURL, ada.Token(), `{"name":"App","redirectUris":["`+redirectURI+`"]}`, &created)
+	if resp.StatusCode != http.StatusCreated || created.Data == nil || created.Data.ClientSecret == "" {
+		t.Fatalf("got status %d registering a client, want 201 with a secret", resp.StatusCode)
+	}
+	app := created.Data
+	if resp := doTestRequest(t, http.MethodPost, clientsURL, ada.Token(), `{"name":"App","redirectUris":["not a url"]}`, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an invalid redirect URI, want 422", resp.StatusCode)
+	}
+
+	verifier := "a-code-verifier-long-enough-to-be-unguessable-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	authorizeParams := func(c *client.Client) url.Values {
+		return url.Values{
+			"response_type":         {"code"},
+			"client_id":             {app.ClientID},
+			"redirect_uri":          {redirectURI},
+			"scope":                 {"openid profile email orgs"},
+			"state":                 {"st4te"},
+			"nonce":                 {"n0nce"},
+			"code_challenge":        {challenge},
+			"code_challenge_method": {"S256"},
+		}
+	}
+	authorize := func(c *client.Client, q url.Values) (*http.Response, *AuthorizeResult) {
+		t.Helper()
+		var body AuthorizeResponse
+		resp := doTestRequest(t, http.MethodGet, server.URL+"/oauth2/authorize?"+q.Encode(), c.Token(), "", &body)
+		return resp, body.Data
+	}
+	redirectParams := func(result *AuthorizeResult) url.Values {
+		t.Helper()
+		if result == nil || result.RedirectTo == "" {
+			t.Fatalf("got %+v, want a redirect", result)
+		}
+		u, err := url.Parse(result.RedirectTo)
+		if err != nil || !strings.HasPrefix(result.RedirectTo, redirectURI+"?") {
+			t.Fatalf("got redirect to %s, want the redirect URI of the client", result.RedirectTo)
+		}
+		return u.Query()
+	}
+	// code runs the authorization request of Ada, who already consented, and returns the code
+	code := func(q url.Values) string {
+		t.Helper()
+		_, result := authorize(ada, q)
+		params := redirectParams(result)
+		if params.Get("code") == "" || params.Get("state") != "st4te" {
+			t.Fatalf("got redirect params %v, want a code and the state", params)
+		}
+		return params.Get("code")
+	}
+	redeem := func(form url.Values, secret string) (*http.Response, OAuthTokenResponse, OAuthError) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/oauth2/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(app.ClientID, secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var tokens OAuthTokenResponse
+		var oauthErr OAuthError
+		if resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&tokens)
+		} else {
+			json.NewDecoder(resp.Body).Decode(&oauthErr)
+		}
+		return resp, tokens, oauthErr
+	}
+	grant := func(code string) url.Values {
+		return url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}, "code_verifier": {verifier}}
+	}
+	assertRejected := func(form url.Values, secret string, wantStatus int, wantErr, what string) {
+		t.Helper()
+		resp, _, oauthErr := redeem(form, secret)
+		if resp.StatusCode != wantStatus || oauthErr.Error != wantErr {
+			t.Errorf("got status %d, %q for %s, want %d, %q", resp.StatusCode, oauthErr.Error, what, wantStatus, wantErr)
+		}
+	}
+
+	// the user is asked to consent once, then codes are issued straight away
+	_, result := authorize(ada, authorizeParams(ada))
+	if result == nil || !result.ConsentRequired || result.Client == nil || result.Client.ClientID != app.ClientID {
+		t.Fatalf("got %+v, want consent required", result)
+	}
+	deny := `{"response_type":"code","client_id":"` + app.ClientID + `","redirect_uri":"` + redirectURI + `","scope":"openid","state":"st4te","code_challenge":"` + challenge + `","code_challenge_method":"S256","consent":"deny"}`
+	var denied AuthorizeResponse
+	doTestRequest(t, http.MethodPost, server.URL+"/oauth2/authorize", ada.Token(), deny, &denied)
+	if params := redirectParams(denied.Data); params.Get("error") != "access_denied" || params.Get("code") != "" {
+		t.Errorf("got redirect params %v when the user denied, want access_denied", params)
+	}
+	var approved AuthorizeResponse
+	approve := strings.Replace(strings.Replace(deny, `"deny"`, `"approve"`, 1), `"openid"`, `"openid profile email orgs"`, 1)
+	doTestRequest(t, http.MethodPost, server.URL+"/oauth2/authorize", ada.Token(), approve, &approved)
+	if params := redirectParams(approved.Data); params.Get("code") == "" {
+		t.Errorf("got redirect params %v when the user approved, want a code", params)
+	}
+
+	// code flow with PKCE
+	resp, tokens, _ := redeem(grant(code(authorizeParams(ada))), created.Data.ClientSecret)
+	if resp.StatusCode != http.StatusOK || tokens.TokenType != "Bearer" || tokens.Scope != "openid profile email orgs" {
+		t.Fatalf("got status %d, %+v redeeming a code, want tokens", resp.StatusCode, tokens)
+	}
+	idClaims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokens.IDToken, idClaims, func(*jwt.Token) (interface{}, error) { return publicKey, nil }); err != nil {
+		t.Fatalf("got %v verifying the ID token with the published key", err)
+	}
+	orgs, _ := idClaims["orgs"].([]interface{})
+	if idClaims["iss"] != server.URL || idClaims["aud"] != app.ClientID || idClaims["sub"] != adaUser.UserID ||
+		idClaims["nonce"] != "n0nce" || idClaims["email"] != "ada@example.com" || idClaims["email_verified"] != false ||
+		idClaims["given_name"] != "Ada" || len(orgs) != 1 {
+		t.Errorf("got ID token claims %v", idClaims)
+	}
+
+	var userinfo map[string]interface{}
+	if resp := doTestRequest(t, http.MethodGet, server.URL+"/oauth2/userinfo", tokens.AccessToken, "", &userinfo); resp.StatusCode != http.StatusOK ||
+		userinfo["sub"] != adaUser.UserID || userinfo["email"] != "ada@example.com" {
+		t.Errorf("got status %d, %v for userinfo, want the claims of Ada", resp.StatusCode, userinfo)
+	}
+	if resp := doTestRequest(t, http.MethodGet, server.URL+"/oauth2/userinfo", tokens.IDToken, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for userinfo with an ID token, want 401", resp.StatusCode)
+	}
+
+	// a confirmed email is released as verified
+	store.mu.Lock()
+	store.users[adaUser.UserID].EmailVerified = true
+	store.mu.Unlock()
+	doTestRequest(t, http.MethodGet, server.URL+"/oauth2/userinfo", tokens.AccessToken, "", &userinfo)
+	if userinfo["email_verified"] != true {
+		t.Errorf("got email_verified %v for a verified email, want true", userinfo["email_verified"])
+	}
+
+	// code flow without PKCE
+	withoutPKCE := authorizeParams(ada)
+	withoutPKCE.Del("code_challenge")
+	withoutPKCE.Del("code_challenge_method")
+	_, result = authorize(ada, withoutPKCE)
+	if params := redirectParams(result); params.Get("error") != "invalid_request" || params.Get("code") != "" {
+		t.Errorf("got redirect params %v without a code challenge, want invalid_request", params)
+	}
+	plain := authorizeParams(ada)
+	plain.Set("code_challenge_method", "plain")
+	_, result = authorize(ada, plain)
+	if params := redirectParams(result); params.Get("error") != "invalid_request" {
+		t.Errorf("got redirect params %v for the plain method, want invalid_request", params)
+	}
+	form := grant(code(authorizeParams(ada)))
+	form.Del("code_verifier")
+	assertRejected(form, app.ClientSecret, http.StatusBadRequest, "invalid_grant", "a code redeemed without its verifier")
+	form = grant(code(authorizeParams(ada)))
+	form.Set("code_verifier", "another-verifier")
+	assertRejected(form, app.ClientSecret, http.StatusBadRequest, "invalid_grant", "a wrong verifier")
+
+	// reused and expired codes
+	form = grant(code(authorizeParams(ada)))
+	if resp, _, _ := redeem(form, app.ClientSecret); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d redeeming a code, want 200", resp.StatusCode)
+	}
+	assertRejected(form, app.ClientSecret, http.StatusBadRequest, "invalid_grant", "a reused code")
+	expired := code(authorizeParams(ada))
+	store.mu.Lock()
+	store.oauthCodes[hashAPIKey(expired)].CreatedAt = time.Now().Add(-oauthCodeTTL - time.Second)
+	store.mu.Unlock()
+	assertRejected(grant(expired), app.ClientSecret, http.StatusBadRequest, "invalid_grant", "an expired code")
+
+	// redirect URI mismatches
+	unregistered := authorizeParams(ada)
+	unregistered.Set("redirect_uri", "https://evil.example.com/callback")
+	if resp, result := authorize(ada, unregistered); resp.StatusCode != http.StatusBadRequest || result != nil {
+		t.Errorf("got status %d, %+v for an unregistered redirect URI, want 400 without a redirect", resp.StatusCode, result)
+	}
+	form = grant(code(authorizeParams(ada)))
+	form.Set("redirect_uri", "https://app.example.com/other")
+	assertRejected(form, app.ClientSecret, http.StatusBadRequest, "invalid_grant", "a redirect URI other than the authorized one")
+
+	// client authentication
+	assertRejected(grant(code(authorizeParams(ada))), "wrong-secret", http.StatusUnauthorized, "invalid_client", "a wrong client secret")
+	form = grant(code(authorizeParams(ada)))
+	form.Set("grant_type", "password")
+	assertRejected(form, app.ClientSecret, http.StatusBadRequest, "unsupported_grant_type", "the password grant")
+
+	// accounts scheduled for deletion get no tokens or claims
+	pending := code(authorizeParams(ada))
+	store.mu.Lock()
+	deletedAt := time.Now()
+	store.users[adaUser.UserID].DeletedAt = &deletedAt
+	store.mu.Unlock()
+	assertRejected(grant(pending), app.ClientSecret, http.StatusBadRequest, "invalid_grant", "a deleted user")
+	if resp := doTestRequest(t, http.MethodGet, server.URL+"/oauth2/userinfo", tokens.AccessToken, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for userinfo of a deleted user, want 401", resp.StatusCode)
+	}
+	store.mu.Lock()
+	store.users[adaUser.UserID].DeletedAt = nil
+	store.mu.Unlock()
+
+	// clients are listed and deleted by their owner only
+	var listed GetOAuthClientsResponse
+	doTestRequest(t, http.MethodGet, clientsURL, bob.Token(), "", &listed)
+	if len(listed.Data) != 0 {
+		t.Errorf("got %d clients for another user, want none", len(listed.Data))
+	}
+	doTestRequest(t, http.MethodGet, clientsURL, ada.Token(), "", &listed)
+	if len(listed.Data) != 1 || listed.Data[0].ClientID != app.ClientID {
+		t.Errorf("got clients %+v, want the registered one", listed.Data)
+	}
+	if resp := doTestRequest(t, http.MethodDelete, clientsURL+"/"+app.ClientID, bob.Token(), "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d deleting the client of another user, want 404", resp.StatusCode)
+	}
+	if resp := doTestRequest(t, http.MethodDelete, clientsURL+"/"+app.ClientID, ada.Token(), "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d deleting the client, want 200", resp.StatusCode)
+	}
+	if resp, _ := authorize(ada, authorizeParams(ada)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d authorizing a deleted client, want 400", resp.StatusCode)
+	}
+}
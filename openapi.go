@@ -0,0 +1,611 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonObject is a node of the OpenAPI document
+type jsonObject = map[string]interface{}
+
+// apiParam is a query parameter of an operation. Path parameters are taken from the path.
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// apiOperation documents a route of the server. Request and the values of Responses are
+// zero values of the body types; a nil response has no JSON body.
+type apiOperation struct {
+	Method  string
+	Path    string
+	Tag     string
+	Summary string
+	// scopes the caller must hold, nil for routes that take no bearer credential
+	Scopes      []string
+	Query       []apiParam
+	Request     interface{}
+	FormRequest bool
+	CSVRequest  bool
+	// Conditional operations take the ETag of their resource, in If-None-Match for GET and
+	// in the required If-Match for changes
+	Conditional bool
+	// VersionInBody changes may send the version of their resource in the body instead of If-Match
+	VersionInBody bool
+	// SCIM operations authenticate with a SCIM token and exchange application/scim+json
+	SCIM bool
+	// Secret operations answer with a secret, so retries with the same Idempotency-Key are
+	// rejected rather than replayed
+	Secret    bool
+	Responses map[int]interface{}
+}
+
+// apiOperations lists every route registered in newRouter. The test of the OpenAPI
+// document fails when a route is missing from it.
+var apiOperations = []apiOperation{
+	{Method: "POST", Path: "/api/v1/auth/register", Tag: "auth", Summary: "Register a user and their default organisation",
+		Request: RegisterUserRequest{}, Responses: map[int]interface{}{201: RegisterUserResponse{}, 400: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/auth/login", Tag: "auth", Summary: "Log in with email and password",
+		Request: LoginRequest{}, Responses: map[int]interface{}{200: LoginResponse{}, 401: ErrorResponse{}, 403: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/auth/restore", Tag: "auth", Summary: "Restore a deleted account during its grace period and log in",
+		Request: RestoreAccountRequest{}, Responses: map[int]interface{}{200: LoginResponse{}, 400: ErrorResponse{}, 401: ErrorResponse{}, 410: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/auth/email/confirm", Tag: "auth", Summary: "Confirm an email change with the emailed token",
+		Query:     []apiParam{{Name: "token", Type: "string", Description: "token from the confirmation link"}},
+		Responses: map[int]interface{}{200: GetUserResponse{}, 400: ErrorResponse{}, 409: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/auth/oidc/{provider}/login", Tag: "auth", Summary: "Start logging in with an external identity provider",
+		Query:     []apiParam{{Name: "restore", Type: "boolean", Description: "restore the account if it is scheduled for deletion"}},
+		Responses: map[int]interface{}{302: nil, 404: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/auth/oidc/{provider}/callback", Tag: "auth", Summary: "Finish logging in with an external identity provider",
+		Query: []apiParam{
+			{Name: "code", Type: "string", Description: "authorization code issued by the provider"},
+			{Name: "state", Type: "string", Description: "state of the login"},
+		},
+		Responses: map[int]interface{}{200: LoginResponse{}, 400: ErrorResponse{}, 401: ErrorResponse{}, 403: ErrorResponse{}, 410: ErrorResponse{}}},
+
+	{Method: "GET", Path: "/.well-known/openid-configuration", Tag: "oidc", Summary: "OpenID Connect discovery document",
+		Responses: map[int]interface{}{200: OIDCDiscoveryDocument{}}},
+	{Method: "GET", Path: "/oauth2/jwks", Tag: "oidc", Summary: "Keys ID tokens are signed with",
+		Responses: map[int]interface{}{200: jsonWebKeySet{}}},
+	{Method: "GET", Path: "/oauth2/authorize", Tag: "oidc", Summary: "Describe an authorization request for the user to consent to",
+		Scopes: []string{ScopeOAuthAuthorize},
+		Query: []apiParam{
+			{Name: "response_type", Type: "string"}, {Name: "client_id", Type: "string"}, {Name: "redirect_uri", Type: "string"},
+			{Name: "scope", Type: "string"}, {Name: "state", Type: "string"}, {Name: "nonce", Type: "string"},
+			{Name: "code_challenge", Type: "string"}, {Name: "code_challenge_method", Type: "string"},
+		},
+		Responses: map[int]interface{}{200: AuthorizeResponse{}, 400: OAuthError{}}},
+	{Method: "POST", Path: "/oauth2/authorize", Tag: "oidc", Summary: "Approve or deny an authorization request",
+		Scopes: []string{ScopeOAuthAuthorize}, Request: AuthorizeRequest{}, Secret: true,
+		Responses: map[int]interface{}{200: AuthorizeResponse{}, 400: OAuthError{}}},
+	{Method: "POST", Path: "/oauth2/token", Tag: "oidc", Summary: "Redeem an authorization code",
+		FormRequest: true, Responses: map[int]interface{}{200: OAuthTokenResponse{}, 400: OAuthError{}, 401: OAuthError{}}},
+	{Method: "GET", Path: "/oauth2/userinfo", Tag: "oidc", Summary: "Claims about the user an access token was issued for",
+		Responses: map[int]interface{}{200: jsonObject{}, 401: OAuthError{}}},
+	{Method: "POST", Path: "/oauth2/userinfo", Tag: "oidc", Summary: "Claims about the user an access token was issued for",
+		Responses: map[int]interface{}{200: jsonObject{}, 401: OAuthError{}}},
+
+	{Method: "POST", Path: "/api/v1/oauth/clients", Tag: "oauth clients", Summary: "Register a client application",
+		Scopes: []string{ScopeClientsWrite}, Request: CreateOAuthClientRequest{}, Secret: true,
+		Responses: map[int]interface{}{201: CreateOAuthClientResponse{}}},
+	{Method: "GET", Path: "/api/v1/oauth/clients", Tag: "oauth clients", Summary: "List the client applications of the logged in user",
+		Scopes: []string{ScopeClientsRead}, Responses: map[int]interface{}{200: GetOAuthClientsResponse{}}},
+	{Method: "DELETE", Path: "/api/v1/oauth/clients/{id}", Tag: "oauth clients", Summary: "Delete a client application",
+		Scopes: []string{ScopeClientsWrite}, Responses: map[int]interface{}{200: ResponseStatus{}, 404: ErrorResponse{}}},
+
+	{Method: "DELETE", Path: "/api/v1/users/me", Tag: "users", Summary: "Delete the account of the logged in user",
+		Scopes: []string{ScopeUsersWrite}, Request: DeleteAccountRequest{},
+		Responses: map[int]interface{}{200: DeleteAccountResponse{}, 401: ErrorResponse{}, 409: DeleteAccountBlockedResponse{}}},
+	{Method: "POST", Path: "/api/v1/users/me/password", Tag: "users", Summary: "Change the password of the logged in user",
+		Scopes: []string{ScopeUsersWrite}, Request: ChangePasswordRequest{},
+		Responses: map[int]interface{}{200: ResponseStatus{}, 401: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/users/me/email", Tag: "users", Summary: "Start changing the email of the logged in user",
+		Scopes: []string{ScopeUsersWrite}, Request: ChangeEmailRequest{},
+		Responses: map[int]interface{}{202: ResponseStatus{}, 401: ErrorResponse{}, 409: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/users/me/export", Tag: "users", Summary: "Export the data of the logged in user as a zip archive",
+		Scopes: []string{ScopeUsersRead}, Responses: map[int]interface{}{200: nil, 202: DataExportResponse{}}},
+	{Method: "GET", Path: "/api/v1/users/me/export/{id}", Tag: "users", Summary: "Status of a queued data export",
+		Scopes: []string{ScopeUsersRead}, Responses: map[int]interface{}{200: DataExportResponse{}, 404: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/users/me/export/{id}/download", Tag: "users", Summary: "Download the archive of a completed data export",
+		Scopes: []string{ScopeUsersRead}, Responses: map[int]interface{}{200: nil, 404: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/users/me/sessions", Tag: "users", Summary: "List the active sessions of the logged in user",
+		Scopes: []string{ScopeUsersRead}, Responses: map[int]interface{}{200: GetSessionsResponse{}}},
+	{Method: "DELETE", Path: "/api/v1/users/me/sessions/{id}", Tag: "users", Summary: "Revoke a session",
+		Scopes: []string{ScopeUsersWrite}, Responses: map[int]interface{}{200: ResponseStatus{}, 404: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/users/me/api-keys", Tag: "users", Summary: "Create an API key",
+		Scopes: []string{ScopeAPIKeysWrite}, Request: CreateAPIKeyRequest{}, Secret: true,
+		Responses: map[int]interface{}{201: CreateAPIKeyResponse{}}},
+	{Method: "GET", Path: "/api/v1/users/me/api-keys", Tag: "users", Summary: "List the API keys of the logged in user",
+		Scopes: []string{ScopeAPIKeysRead}, Responses: map[int]interface{}{200: GetAPIKeysResponse{}}},
+	{Method: "DELETE", Path: "/api/v1/users/me/api-keys/{id}", Tag: "users", Summary: "Revoke an API key",
+		Scopes: []string{ScopeAPIKeysWrite}, Responses: map[int]interface{}{200: ResponseStatus{}, 404: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/users/{id}", Tag: "users", Summary: "Get a user. Other members of the user's organisations see their public profile.",
+		Scopes: []string{ScopeUsersRead}, Conditional: true, Responses: map[int]interface{}{200: GetUserResponse{}, 404: ErrorResponse{}}},
+	{Method: "PATCH", Path: "/api/v1/users/{id}", Tag: "users", Summary: "Update the profile of the logged in user",
+		Scopes: []string{ScopeUsersWrite}, Request: UpdateUserRequest{}, Conditional: true, VersionInBody: true,
+		Responses: map[int]interface{}{200: UpdateUserResponse{}}},
+
+	{Method: "POST", Path: "/api/v1/organisations", Tag: "organisations", Summary: "Create an organisation owned by the logged in user",
+		Scopes: []string{ScopeOrgsWrite}, Request: CreateOrgRequest{},
+		Responses: map[int]interface{}{201: CreateOrgResponse{}}},
+	{Method: "GET", Path: "/api/v1/organisations", Tag: "organisations", Summary: "List the organisations of the logged in user",
+		Scopes: []string{ScopeOrgsRead}, Responses: map[int]interface{}{200: GetOrgsResponse{}}},
+	{Method: "GET", Path: "/api/v1/organisations/{id}", Tag: "organisations", Summary: "Get an organisation",
+		Scopes: []string{ScopeOrgsRead}, Conditional: true, Responses: map[int]interface{}{200: GetOrgResponse{}, 401: ErrorResponse{}}},
+	{Method: "DELETE", Path: "/api/v1/organisations/{id}", Tag: "organisations", Summary: "Delete an organisation",
+		Scopes: []string{ScopeOrgsWrite}, Conditional: true, Responses: map[int]interface{}{200: ResponseStatus{}, 401: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/organisations/{id}/audit", Tag: "organisations", Summary: "List the audit events of an organisation, newest first",
+		Scopes: []string{ScopeOrgsRead},
+		Query: []apiParam{
+			{Name: "action", Type: "string"},
+			{Name: "actorId", Type: "string"},
+			{Name: "targetId", Type: "string"},
+			{Name: "since", Type: "string", Description: "RFC 3339 timestamp"},
+			{Name: "until", Type: "string", Description: "RFC 3339 timestamp"},
+			{Name: "cursor", Type: "string", Description: "nextCursor of the previous page"},
+			{Name: "limit", Type: "integer"},
+		},
+		Responses: map[int]interface{}{200: GetAuditEventsResponse{}, 401: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/organisations/{id}/webhooks", Tag: "webhooks", Summary: "Subscribe a URL to events of an organisation",
+		Scopes: []string{ScopeWebhooksWrite}, Request: CreateWebhookRequest{}, Secret: true,
+		Responses: map[int]interface{}{201: CreateWebhookResponse{}, 401: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/organisations/{id}/webhooks", Tag: "webhooks", Summary: "List the webhooks of an organisation",
+		Scopes: []string{ScopeWebhooksRead}, Responses: map[int]interface{}{200: GetWebhooksResponse{}, 401: ErrorResponse{}}},
+	{Method: "DELETE", Path: "/api/v1/organisations/{id}/webhooks/{webhookId}", Tag: "webhooks", Summary: "Delete a webhook",
+		Scopes: []string{ScopeWebhooksWrite}, Responses: map[int]interface{}{200: ResponseStatus{}, 404: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/organisations/{id}/webhooks/{webhookId}/deliveries", Tag: "webhooks", Summary: "List the most recent deliveries of a webhook",
+		Scopes: []string{ScopeWebhooksRead}, Query: []apiParam{{Name: "limit", Type: "integer"}},
+		Responses: map[int]interface{}{200: GetWebhookDeliveriesResponse{}}},
+	{Method: "POST", Path: "/api/v1/organisations/{id}/owner", Tag: "organisations", Summary: "Transfer ownership of an organisation to another member",
+		Scopes: []string{ScopeOrgsWrite}, Request: TransferOwnershipRequest{},
+		Responses: map[int]interface{}{200: ResponseStatus{}, 400: ErrorResponse{}, 401: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/organisations/{id}/users", Tag: "organisations", Summary: "List the members of an organisation",
+		Scopes: []string{ScopeMembersRead}, Responses: map[int]interface{}{200: GetOrgUsersResponse{}, 401: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/organisations/{id}/users", Tag: "organisations", Summary: "Add a user to an organisation",
+		Scopes: []string{ScopeMembersWrite}, Request: AddUserToOrgRequest{},
+		Responses: map[int]interface{}{201: AddUserToOrgResponse{}, 400: ErrorResponse{}, 401: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/organisations/{id}/users:batch", Tag: "organisations", Summary: "Add users named by ID or email to an organisation in one transaction. Naming users by email requires an owner or admin.",
+		Scopes: []string{ScopeMembersWrite}, Request: BatchMembersRequest{},
+		Responses: map[int]interface{}{200: BatchMembersResponse{}, 401: ErrorResponse{}, 403: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/organisations/{id}/users:batchRemove", Tag: "organisations", Summary: "Remove members named by ID or email from an organisation in one transaction",
+		Scopes: []string{ScopeMembersWrite}, Request: BatchMembersRequest{},
+		Responses: map[int]interface{}{200: BatchMembersResponse{}, 401: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/organisations/{id}/users.csv", Tag: "organisations", Summary: "Download the members of an organisation as CSV",
+		Scopes: []string{ScopeMembersRead}, Responses: map[int]interface{}{200: nil, 401: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/organisations/{id}/users.csv", Tag: "organisations", Summary: "Import members from a CSV of emails and roles, inviting unknown emails",
+		Scopes: []string{ScopeMembersWrite}, CSVRequest: true,
+		Query:     []apiParam{{Name: "dryRun", Type: "boolean", Description: "report the changes without applying them"}},
+		Responses: map[int]interface{}{200: MemberImportResponse{}, 400: ErrorResponse{}, 422: MemberImportResponse{}}},
+	{Method: "POST", Path: "/api/v1/invitations/accept", Tag: "organisations", Summary: "Join the organisation of an invitation",
+		Scopes: []string{ScopeOrgsWrite}, Request: AcceptInvitationRequest{},
+		Responses: map[int]interface{}{200: AcceptInvitationResponse{}, 400: ErrorResponse{}}},
+	{Method: "POST", Path: "/api/v1/organisations/{id}/scim-tokens", Tag: "organisations", Summary: "Create a token for provisioning the members of an organisation over SCIM",
+		Scopes: []string{ScopeOrgsWrite}, Request: CreateSCIMTokenRequest{}, Secret: true,
+		Responses: map[int]interface{}{201: CreateSCIMTokenResponse{}, 401: ErrorResponse{}}},
+	{Method: "GET", Path: "/api/v1/organisations/{id}/scim-tokens", Tag: "organisations", Summary: "List the SCIM tokens of an organisation",
+		Scopes: []string{ScopeOrgsRead}, Responses: map[int]interface{}{200: GetSCIMTokensResponse{}, 401: ErrorResponse{}}},
+	{Method: "DELETE", Path: "/api/v1/organisations/{id}/scim-tokens/{tokenId}", Tag: "organisations", Summary: "Revoke a SCIM token",
+		Scopes: []string{ScopeOrgsWrite}, Responses: map[int]interface{}{200: ResponseStatus{}, 401: ErrorResponse{}, 404: ErrorResponse{}}},
+
+	{Method: "GET", Path: "/scim/v2/ServiceProviderConfig", Tag: "scim", Summary: "SCIM features the server supports",
+		Responses: map[int]interface{}{200: SCIMServiceProviderConfig{}}},
+	{Method: "GET", Path: "/scim/v2/Schemas", Tag: "scim", Summary: "Schemas of SCIM users and groups",
+		Responses: map[int]interface{}{200: SCIMListResponse{}}},
+	{Method: "GET", Path: "/scim/v2/ResourceTypes", Tag: "scim", Summary: "Kinds of SCIM resources",
+		Responses: map[int]interface{}{200: SCIMListResponse{}}},
+	{Method: "GET", Path: "/scim/v2/Users", Tag: "scim", Summary: "List the members of the organisation of the SCIM token",
+		SCIM: true,
+		Query: []apiParam{
+			{Name: "filter", Type: "string", Description: `filter like userName eq "ann@example.com"`},
+			{Name: "startIndex", Type: "integer", Description: "1-based index of the first result"},
+			{Name: "count", Type: "integer", Description: "most results to return"},
+		},
+		Responses: map[int]interface{}{200: SCIMListResponse{}, 400: SCIMError{}}},
+	{Method: "POST", Path: "/scim/v2/Users", Tag: "scim", Summary: "Provision a member, creating their account when needed",
+		SCIM: true, Request: SCIMUser{},
+		Responses: map[int]interface{}{201: SCIMUser{}, 400: SCIMError{}, 409: SCIMError{}}},
+	{Method: "GET", Path: "/scim/v2/Users/{id}", Tag: "scim", Summary: "Retrieve a member",
+		SCIM: true, Responses: map[int]interface{}{200: SCIMUser{}, 404: SCIMError{}}},
+	{Method: "PUT", Path: "/scim/v2/Users/{id}", Tag: "scim", Summary: "Replace a member; active false removes them from the organisation",
+		SCIM: true, Request: SCIMUser{},
+		Responses: map[int]interface{}{200: SCIMUser{}, 400: SCIMError{}, 404: SCIMError{}, 409: SCIMError{}}},
+	{Method: "PATCH", Path: "/scim/v2/Users/{id}", Tag: "scim", Summary: "Change attributes of a member; active false removes them from the organisation",
+		SCIM: true, Request: SCIMPatchRequest{},
+		Responses: map[int]interface{}{200: SCIMUser{}, 400: SCIMError{}, 404: SCIMError{}, 409: SCIMError{}}},
+	{Method: "DELETE", Path: "/scim/v2/Users/{id}", Tag: "scim", Summary: "Remove a member from the organisation",
+		SCIM: true, Responses: map[int]interface{}{204: nil, 404: SCIMError{}, 409: SCIMError{}}},
+	{Method: "GET", Path: "/scim/v2/Groups", Tag: "scim", Summary: "List the organisation of the SCIM token as a group",
+		SCIM: true,
+		Query: []apiParam{
+			{Name: "filter", Type: "string", Description: `filter like displayName eq "Acme"`},
+			{Name: "excludedAttributes", Type: "string", Description: "members leaves out the members"},
+			{Name: "startIndex", Type: "integer", Description: "1-based index of the first result"},
+			{Name: "count", Type: "integer", Description: "most results to return"},
+		},
+		Responses: map[int]interface{}{200: SCIMListResponse{}, 400: SCIMError{}}},
+	{Method: "GET", Path: "/scim/v2/Groups/{id}", Tag: "scim", Summary: "Retrieve the organisation of the SCIM token as a group",
+		SCIM:      true,
+		Query:     []apiParam{{Name: "excludedAttributes", Type: "string", Description: "members leaves out the members"}},
+		Responses: map[int]interface{}{200: SCIMGroup{}, 404: SCIMError{}}},
+	{Method: "PUT", Path: "/scim/v2/Groups/{id}", Tag: "scim", Summary: "Replace the members of the organisation",
+		SCIM: true, Request: SCIMGroup{},
+		Responses: map[int]interface{}{200: SCIMGroup{}, 400: SCIMError{}, 404: SCIMError{}, 409: SCIMError{}}},
+	{Method: "PATCH", Path: "/scim/v2/Groups/{id}", Tag: "scim", Summary: "Add and remove members of the organisation",
+		SCIM: true, Request: SCIMPatchRequest{},
+		Responses: map[int]interface{}{200: SCIMGroup{}, 400: SCIMError{}, 404: SCIMError{}, 409: SCIMError{}}},
+
+	{Method: "POST", Path: "/graphql", Tag: "graphql", Summary: "Query users, organisations and members with GraphQL; each field needs the scope of its REST route",
+		Scopes: []string{}, Request: GraphQLRequest{},
+		Responses: map[int]interface{}{200: GraphQLResponse{}, 400: ErrorResponse{}}},
+
+	{Method: "GET", Path: "/openapi.json", Tag: "docs", Summary: "This document",
+		Responses: map[int]interface{}{200: jsonObject{}}},
+	{Method: "GET", Path: "/docs", Tag: "docs", Summary: "Interactive documentation of the API",
+		Responses: map[int]interface{}{200: nil}},
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// schemaBuilder generates JSON schemas of Go types, collecting named struct types as components
+type schemaBuilder struct {
+	components jsonObject
+}
+
+func (b *schemaBuilder) ref(t reflect.Type) jsonObject {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t.Name() == "" || t == reflect.TypeOf(time.Time{}) {
+		return b.schema(t)
+	}
+	if _, ok := b.components[t.Name()]; !ok {
+		b.components[t.Name()] = jsonObject{} // placeholder for recursive types
+		b.components[t.Name()] = b.schema(t)
+	}
+	return jsonObject{"$ref": "#/components/schemas/" + t.Name()}
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) jsonObject {
+	if t == reflect.TypeOf(time.Time{}) {
+		return jsonObject{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.ref(t.Elem())
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonObject{"type": "string", "contentEncoding": "base64"}
+		}
+		return jsonObject{"type": "array", "items": b.ref(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": b.ref(t.Elem())}
+	case reflect.Struct:
+		return b.structSchema(t)
+	}
+	// interfaces hold any value
+	return jsonObject{}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) jsonObject {
+	properties := jsonObject{}
+	var required []string
+	b.addFields(t, properties, &required)
+
+	s := jsonObject{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// addFields adds the JSON fields of a struct to properties, flattening embedded structs the way encoding/json does
+func (b *schemaBuilder) addFields(t reflect.Type, properties jsonObject, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				b.addFields(ft, properties, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		s := b.ref(f.Type)
+		if f.Type.Kind() == reflect.Ptr && f.Type.Elem().Kind() != reflect.Struct {
+			s = jsonObject{"anyOf": []interface{}{s, jsonObject{"type": "null"}}}
+		}
+		if applyValidateTag(s, f.Tag.Get("validate")) {
+			*required = append(*required, name)
+		}
+		properties[name] = s
+	}
+}
+
+// applyValidateTag documents the rules of a validate tag on the schema of a field, and
+// reports whether the field is required
+func applyValidateTag(s jsonObject, tag string) bool {
+	if tag == "" {
+		return false
+	}
+
+	required := false
+	target := s
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		// the rules of nullable fields apply when they are present
+		target = anyOf[0].(jsonObject)
+	}
+	for _, rule := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			required = true
+		case "dive":
+			// the rules after dive apply to the items
+			if items, ok := target["items"].(jsonObject); ok {
+				target = items
+			}
+		case "email":
+			target["format"] = "email"
+		case "url":
+			target["format"] = "uri"
+		case "e164":
+			target["pattern"] = `^\+[1-9]\d{1,14}$`
+		case "startswith":
+			target["pattern"] = "^" + regexp.QuoteMeta(param)
+		case "min", "max":
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				continue
+			}
+			key := map[string]string{"min": "minLength", "max": "maxLength"}[name]
+			if target["type"] == "array" {
+				key = map[string]string{"min": "minItems", "max": "maxItems"}[name]
+			} else if target["type"] == "integer" {
+				key = map[string]string{"min": "minimum", "max": "maximum"}[name]
+			}
+			target[key] = n
+		case "oneof":
+			var values []interface{}
+			for _, v := range strings.Fields(param) {
+				values = append(values, v)
+			}
+			target["enum"] = values
+		}
+	}
+	return required
+}
+
+// buildOpenAPIDocument generates the OpenAPI document of apiOperations
+func buildOpenAPIDocument() jsonObject {
+	b := &schemaBuilder{components: jsonObject{}}
+	paths := jsonObject{}
+
+	for _, op := range apiOperations {
+		var params []interface{}
+		for _, m := range pathParamPattern.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, jsonObject{"name": m[1], "in": "path", "required": true, "schema": jsonObject{"type": "string"}})
+		}
+		for _, q := range op.Query {
+			param := jsonObject{"name": q.Name, "in": "query", "schema": jsonObject{"type": q.Type}}
+			if q.Description != "" {
+				param["description"] = q.Description
+			}
+			params = append(params, param)
+		}
+
+		contentType := "application/json"
+		if op.SCIM {
+			contentType = scimContentType
+		}
+
+		responses := jsonObject{}
+		for status, body := range op.Responses {
+			r := jsonObject{"description": http.StatusText(status)}
+			if body != nil {
+				r["content"] = jsonObject{contentType: jsonObject{"schema": b.ref(reflect.TypeOf(body))}}
+			}
+			responses[strconv.Itoa(status)] = r
+		}
+
+		operation := jsonObject{
+			"operationId": operationID(op),
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"responses":   responses,
+		}
+		if op.Request != nil {
+			operation["requestBody"] = jsonObject{
+				"required": true,
+				"content":  jsonObject{contentType: jsonObject{"schema": b.ref(reflect.TypeOf(op.Request))}},
+			}
+		}
+		if op.Request != nil && !op.SCIM {
+			responses["422"] = jsonObject{
+				"description": "Validation failed",
+				"content":     jsonObject{"application/json": jsonObject{"schema": b.ref(reflect.TypeOf(ValidationErrorResponse{}))}},
+			}
+		}
+		if op.FormRequest {
+			operation["requestBody"] = jsonObject{
+				"required": true,
+				"content":  jsonObject{"application/x-www-form-urlencoded": jsonObject{"schema": jsonObject{"type": "object"}}},
+			}
+		}
+		if op.CSVRequest {
+			operation["requestBody"] = jsonObject{
+				"required": true,
+				"content":  jsonObject{"text/csv": jsonObject{"schema": jsonObject{"type": "string"}}},
+			}
+		}
+		if op.Scopes != nil && op.Method == http.MethodPost {
+			keyDescription := "makes the request safe to retry; retries with the same key replay the recorded response"
+			conflictDescription := "A request with the same Idempotency-Key is still being processed"
+			if op.Secret {
+				keyDescription = "makes the request safe to retry; retries with the same key are rejected with 409 since the response carries a secret that is not recorded"
+				conflictDescription = "A request with the same Idempotency-Key is still being processed or was already processed"
+			}
+			params = append(params, jsonObject{
+				"name":        idempotencyKeyHeader,
+				"in":          "header",
+				"description": keyDescription,
+				"schema":      jsonObject{"type": "string", "maxLength": idempotencyKeyMaxLength},
+			})
+			if responses["409"] == nil {
+				responses["409"] = jsonObject{
+					"description": conflictDescription,
+					"content":     jsonObject{"application/json": jsonObject{"schema": b.ref(reflect.TypeOf(ErrorResponse{}))}},
+				}
+			}
+		}
+		if op.Conditional && op.Method == http.MethodGet {
+			params = append(params, jsonObject{
+				"name":        "If-None-Match",
+				"in":          "header",
+				"description": "ETag of a representation the client holds; it is not sent again while current",
+				"schema":      jsonObject{"type": "string"},
+			})
+			responses["304"] = jsonObject{"description": "The representation the client holds is current"}
+			if success, _ := responses["200"].(jsonObject); success != nil {
+				success["headers"] = jsonObject{"ETag": jsonObject{"schema": jsonObject{"type": "string"}}}
+			}
+		}
+		if op.Conditional && op.Method != http.MethodGet {
+			description := "ETag of the version of the resource the request was made against"
+			if op.VersionInBody {
+				description += "; required unless the version is sent in the body"
+			}
+			params = append(params, jsonObject{
+				"name":        "If-Match",
+				"in":          "header",
+				"required":    !op.VersionInBody,
+				"description": description,
+				"schema":      jsonObject{"type": "string"},
+			})
+			responses["412"] = jsonObject{
+				"description": "The resource was modified since the client fetched it",
+				"content":     jsonObject{"application/json": jsonObject{"schema": b.ref(reflect.TypeOf(ErrorResponse{}))}},
+			}
+			responses["428"] = jsonObject{
+				"description": "If-Match is missing",
+				"content":     jsonObject{"application/json": jsonObject{"schema": b.ref(reflect.TypeOf(ErrorResponse{}))}},
+			}
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.SCIM {
+			operation["security"] = []interface{}{jsonObject{"scimToken": []string{}}}
+			responses["401"] = jsonObject{
+				"description": "Missing, invalid or revoked SCIM token",
+				"content":     jsonObject{scimContentType: jsonObject{"schema": b.ref(reflect.TypeOf(SCIMError{}))}},
+			}
+		}
+		if op.Scopes != nil {
+			operation["security"] = []interface{}{
+				jsonObject{"bearerAuth": op.Scopes},
+				jsonObject{"apiKey": op.Scopes},
+			}
+			if responses["401"] == nil {
+				responses["401"] = jsonObject{"description": "Missing, invalid or revoked credential"}
+			}
+			if responses["403"] == nil {
+				responses["403"] = jsonObject{
+					"description": "Credential lacks a required scope or role",
+					"content":     jsonObject{"application/json": jsonObject{"schema": b.ref(reflect.TypeOf(ForbiddenResponse{}))}},
+				}
+			}
+		}
+
+		path := pathParamPattern.ReplaceAllString(op.Path, "{$1}")
+		item, ok := paths[path].(jsonObject)
+		if !ok {
+			item = jsonObject{}
+			paths[path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return jsonObject{
+		"openapi": "3.1.0",
+		"info": jsonObject{
+			"title":       "Uzorg API",
+			"version":     "1.0.0",
+			"description": "Users, organisations and their members. The unversioned paths /auth/... and /api/... of earlier releases are deprecated aliases of v1 until " + legacySunset.Format("2 January 2006") + ".",
+		},
+		"servers": []interface{}{jsonObject{"url": publicURL("")}},
+		"paths":   paths,
+		"components": jsonObject{
+			"schemas": b.components,
+			"securitySchemes": jsonObject{
+				"bearerAuth": jsonObject{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey":     jsonObject{"type": "http", "scheme": "bearer", "description": "API key starting with " + apiKeyPrefix},
+				"scimToken":  jsonObject{"type": "http", "scheme": "bearer", "description": "SCIM token of an organisation, starting with " + scimTokenPrefix},
+			},
+		},
+	}
+}
+
+// operationID names an operation after its method and path, e.g. getApiOrganisationsIdUsers
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool { return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+var (
+	openAPIOnce     sync.Once
+	openAPIDocument []byte
+)
+
+// handler for GET /openapi.json that serves the OpenAPI document of the API
+func (h *ReqHandler) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIDocument, _ = json.MarshalIndent(buildOpenAPIDocument(), "", "  ")
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPIDocument)
+}
+
+//go:embed docs.html
+var docsPage []byte
+
+// handler for GET /docs that serves interactive documentation of the OpenAPI document
+func (h *ReqHandler) Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(docsPage)
+}
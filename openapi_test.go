@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	h := &ReqHandler{}
+	paths := buildOpenAPIDocument()["paths"].(jsonObject)
+
+	walk := func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// routes without methods, like the welcome page, are not part of the API
+			return nil
+		}
+
+		item, ok := paths[pathParamPattern.ReplaceAllString(path, "{$1}")].(jsonObject)
+		for _, method := range methods {
+			if !ok || item[strings.ToLower(method)] == nil {
+				t.Errorf("%s %s is registered in newRouter but missing from apiOperations", method, path)
+			}
+		}
+		return nil
+	}
+	// versions of the API are mounted routers the walk of the root router does not enter
+	for _, router := range []*mux.Router{newRouter(h), newV1Router(h)} {
+		if err := router.Walk(walk); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenAPIDocumentReferencesResolve(t *testing.T) {
+	doc := buildOpenAPIDocument()
+	schemas := doc["components"].(jsonObject)["schemas"].(jsonObject)
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				name := strings.TrimPrefix(ref, "#/components/schemas/")
+				if _, ok := schemas[name]; !ok {
+					t.Errorf("reference %s does not resolve", ref)
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	walk(decoded)
+}
+
+func TestOpenAPIDocumentsValidateTags(t *testing.T) {
+	schemas := buildOpenAPIDocument()["components"].(jsonObject)["schemas"].(jsonObject)
+
+	register, ok := schemas["RegisterUserRequest"].(jsonObject)
+	if !ok {
+		t.Fatal("RegisterUserRequest is missing from the components")
+	}
+
+	required := map[string]bool{}
+	for _, name := range register["required"].([]string) {
+		required[name] = true
+	}
+	for _, name := range []string{"firstName", "lastName", "email", "password", "phone"} {
+		if !required[name] {
+			t.Errorf("RegisterUserRequest.%s should be required", name)
+		}
+	}
+
+	email := register["properties"].(jsonObject)["email"].(jsonObject)
+	if email["format"] != "email" {
+		t.Errorf("RegisterUserRequest.email has format %v, want email", email["format"])
+	}
+}
+
+func TestServeOpenAPIDocument(t *testing.T) {
+	router := newRouter(&ReqHandler{})
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.1.0" {
+		t.Errorf("got openapi version %q, want 3.1.0", doc.OpenAPI)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy holds the rules passwords must satisfy on registration, change and reset
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// DisallowPersonalInfo rejects passwords containing the user's email or name
+	DisallowPersonalInfo bool
+	// Breached is consulted for known breached passwords when set
+	Breached *BreachedPasswords
+}
+
+// loadPasswordPolicy configures the password policy from the environment
+func loadPasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{
+		MinLength:            envInt("UZORG_PASSWORD_MIN_LENGTH", 8),
+		MaxLength:            envInt("UZORG_PASSWORD_MAX_LENGTH", 128),
+		RequireUpper:         envBool("UZORG_PASSWORD_REQUIRE_UPPER", false),
+		RequireLower:         envBool("UZORG_PASSWORD_REQUIRE_LOWER", false),
+		RequireDigit:         envBool("UZORG_PASSWORD_REQUIRE_DIGIT", false),
+		RequireSymbol:        envBool("UZORG_PASSWORD_REQUIRE_SYMBOL", false),
+		DisallowPersonalInfo: envBool("UZORG_PASSWORD_DISALLOW_PERSONAL_INFO", true),
+	}
+	if dir := os.Getenv("UZORG_BREACHED_PASSWORDS_DIR"); dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			log.Println("Breached password checking is disabled: ", err)
+		} else {
+			policy.Breached = &BreachedPasswords{Dir: dir}
+		}
+	}
+	return policy
+}
+
+// Check returns a validation error for every rule the password breaks. field names the
+// request field holding the password and personal is the user's email and names.
+func (p *PasswordPolicy) Check(field, password string, personal ...string) []*ValidationError {
+	var errors []*ValidationError
+	fail := func(format string, args ...interface{}) {
+		errors = append(errors, &ValidationError{
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		fail("Password must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		fail("Password must be at most %d characters long", p.MaxLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		fail("Password must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		fail("Password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		fail("Password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		fail("Password must contain a symbol")
+	}
+
+	if p.DisallowPersonalInfo {
+		lowered := strings.ToLower(password)
+		for _, info := range personalInfoFragments(personal) {
+			if strings.Contains(lowered, info) {
+				fail("Password must not contain your email or name")
+				break
+			}
+		}
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			// a missing or unreadable dump should not block sign ups
+			log.Println("Error checking breached passwords: ", err)
+		} else if breached {
+			fail("Password has appeared in a data breach and cannot be used")
+		}
+	}
+
+	return errors
+}
+
+// personalInfoFragments returns the lowercased email, its local part and names
+// that are long enough to be meaningful in a password
+func personalInfoFragments(personal []string) []string {
+	var fragments []string
+	for _, info := range personal {
+		info = strings.ToLower(strings.TrimSpace(info))
+		candidates := []string{info}
+		if at := strings.Index(info, "@"); at > 0 {
+			candidates = append(candidates, info[:at])
+		}
+		for _, c := range candidates {
+			if len(c) >= 3 {
+				fragments = append(fragments, c)
+			}
+		}
+	}
+	return fragments
+}
+
+// BreachedPasswords checks passwords against an offline copy of the Have I Been Pwned
+// Pwned Passwords dump in its k-anonymity layout: Dir holds one file per 5 character SHA-1
+// prefix, named after the uppercase prefix with an optional .txt extension, whose lines
+// are the remaining 35 hash characters and a count separated by a colon.
+type BreachedPasswords struct {
+	Dir string
+}
+
+// Contains reports whether password appears in the dump
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(b.Dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(b.Dir, prefix+".txt"))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		// no range file means no breached password shares the prefix
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		candidate := line
+		if i := strings.Index(line, ":"); i >= 0 {
+			candidate = line[:i]
+		}
+		if strings.EqualFold(candidate, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
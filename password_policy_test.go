@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+// writeBreachedRange adds password to a range file of an offline breached password dump in dir
+func writeBreachedRange(t *testing.T, dir, ext, password string) {
+	t.Helper()
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	content := "0000000000000000000000000000000000A:3\r\n" + hash[5:] + ":42\r\n"
+	if err := os.WriteFile(filepath.Join(dir, hash[:5]+ext), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := &PasswordPolicy{
+		MinLength:            8,
+		MaxLength:            16,
+		RequireUpper:         true,
+		RequireLower:         true,
+		RequireDigit:         true,
+		RequireSymbol:        true,
+		DisallowPersonalInfo: true,
+	}
+
+	for _, tt := range []struct {
+		password string
+		want     []string
+	}{
+		{"Str0ng pass!", nil},
+		{"Sh0rt!", []string{"at least 8"}},
+		{"Much t00 long for it!", []string{"at most 16"}},
+		{"all lower 123", []string{"uppercase"}},
+		{"ALL UPPER 123", []string{"lowercase"}},
+		{"No digits here", []string{"digit"}},
+		{"NoSymbols123", []string{"symbol"}},
+		{"Hi ada.l0velace", []string{"email or name"}},
+		{"Hi Lovelace 1!", []string{"email or name"}},
+		{"ab", []string{"at least 8", "uppercase", "digit", "symbol"}},
+	} {
+		errs := policy.Check("Password", tt.password, "ada.lovelace@example.com", "Ada", "Lovelace")
+		var got []string
+		for _, e := range errs {
+			if e.Field != "Password" {
+				t.Errorf("got field %q, want Password", e.Field)
+			}
+			got = append(got, e.Message)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("got %q for %q, want errors about %q", got, tt.password, tt.want)
+			continue
+		}
+		for i, want := range tt.want {
+			if !strings.Contains(got[i], want) {
+				t.Errorf("got %q for %q, want an error about %q", got[i], tt.password, want)
+			}
+		}
+	}
+
+	// names shorter than three characters are too common to reject
+	if errs := (&PasswordPolicy{DisallowPersonalInfo: true}).Check("Password", "jo-and-friends", "jo@example.com", "Jo"); len(errs) != 0 {
+		t.Errorf("got %v for a short name, want none", errs)
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	dir := t.TempDir()
+	writeBreachedRange(t, dir, "", "password123")
+	writeBreachedRange(t, dir, ".txt", "letmein2024")
+	breached := &BreachedPasswords{Dir: dir}
+
+	for password, want := range map[string]bool{
+		"password123":             true,
+		"letmein2024":             true,
+		"correct horse battery":   false,
+		"an unlisted passphrase!": false,
+	} {
+		got, err := breached.Contains(password)
+		if err != nil || got != want {
+			t.Errorf("got %v, %v for %q, want %v", got, err, password, want)
+		}
+	}
+
+	policy := &PasswordPolicy{MinLength: 8, Breached: breached}
+	errs := policy.Check("Password", "password123")
+	if len(errs) != 1 || !strings.Contains(errs[0].Message, "data breach") {
+		t.Errorf("got %v for a breached password, want it rejected", errs)
+	}
+
+	// an unreadable dump is logged and does not block the password
+	policy.Breached = &BreachedPasswords{Dir: filepath.Join(dir, "missing", "\x00")}
+	if errs := policy.Check("Password", "password123"); len(errs) != 0 {
+		t.Errorf("got %v with an unreadable dump, want none", errs)
+	}
+}
+
+func TestRegisterEnforcesPasswordPolicy(t *testing.T) {
+	_, h := newTestHandler(t)
+	dir := t.TempDir()
+	writeBreachedRange(t, dir, "", "password123")
+	h.passwordPolicy = &PasswordPolicy{MinLength: 8, DisallowPersonalInfo: true, Breached: &BreachedPasswords{Dir: dir}}
+	server := httptest.NewServer(newRouter(h))
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+
+	for _, password := range []string{"short", "password123", "kemi-rocks-2024"} {
+		_, err := client.New(server.URL).Register(ctx, client.RegisterRequest{
+			FirstName: "Kemi",
+			LastName:  "Tester",
+			Email:     "kemi@example.com",
+			Password:  password,
+			Phone:     "+2348012345678",
+		})
+		var verr *client.ValidationError
+		if !errors.As(err, &verr) || len(verr.Errors) == 0 || verr.Errors[0].Field != "RegisterUserRequest.Password" {
+			t.Errorf("got %v registering with %q, want a validation error for the password", err, password)
+		}
+	}
+
+	registerTestUser(t, client.New(server.URL), "Kemi", "kemi@example.com")
+}
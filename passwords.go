@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errUnknownPasswordHash = errors.New("password hash was not produced by a known algorithm")
+
+// PasswordHasher hashes passwords with one algorithm. Encoded hashes carry the algorithm
+// and its parameters so they can be verified after the parameters change.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password
+	Hash(password string) (string, error)
+	// Verify reports whether password matches an encoded hash produced by this algorithm
+	Verify(password, encoded string) (bool, error)
+	// Recognizes reports whether encoded was produced by this algorithm
+	Recognizes(encoded string) bool
+	// NeedsRehash reports whether encoded was produced with weaker parameters than the current ones
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2idHasher hashes passwords with Argon2id, encoded in the PHC string format
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+type Argon2idHasher struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (a *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		a.Memory,
+		a.Iterations,
+		a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	p, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+}
+
+func (a *Argon2idHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a *Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return p.memory < a.Memory ||
+		p.iterations < a.Iterations ||
+		p.parallelism != a.Parallelism ||
+		len(p.salt) < int(a.SaltLength) ||
+		len(p.key) < int(a.KeyLength)
+}
+
+func decodeArgon2id(encoded string) (*argon2idParams, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, fmt.Errorf("parsing argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	var p argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return nil, fmt.Errorf("parsing argon2id parameters: %w", err)
+	}
+
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("decoding argon2id salt: %w", err)
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("decoding argon2id hash: %w", err)
+	}
+	return &p, nil
+}
+
+// BcryptHasher hashes passwords with bcrypt. It is kept to verify hashes created before Argon2id was adopted.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (b *BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(hashed), err
+}
+
+func (b *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *BcryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < b.Cost
+}
+
+// PasswordHashers hashes new passwords with the preferred algorithm and verifies
+// hashes produced by any of the configured algorithms
+type PasswordHashers struct {
+	Preferred PasswordHasher
+	Legacy    []PasswordHasher
+}
+
+// Hash hashes password with the preferred algorithm
+func (p *PasswordHashers) Hash(password string) (string, error) {
+	return p.Preferred.Hash(password)
+}
+
+// Verify reports whether password matches encoded, and whether encoded should be
+// replaced by a hash from the preferred algorithm with its current parameters
+func (p *PasswordHashers) Verify(password, encoded string) (ok bool, needsRehash bool, err error) {
+	if p.Preferred.Recognizes(encoded) {
+		ok, err = p.Preferred.Verify(password, encoded)
+		return ok, ok && p.Preferred.NeedsRehash(encoded), err
+	}
+	for _, hasher := range p.Legacy {
+		if hasher.Recognizes(encoded) {
+			ok, err = hasher.Verify(password, encoded)
+			return ok, ok, err
+		}
+	}
+	return false, false, errUnknownPasswordHash
+}
+
+// loadPasswordHashers configures password hashing from the environment. Argon2id parameters
+// default to the second recommended option of RFC 9106 and can be raised with
+// UZORG_ARGON2_MEMORY_KIB, UZORG_ARGON2_ITERATIONS and UZORG_ARGON2_PARALLELISM.
+// UZORG_BCRYPT_COST sets the cost legacy bcrypt hashes are expected to have.
+func loadPasswordHashers() *PasswordHashers {
+	return &PasswordHashers{
+		Preferred: &Argon2idHasher{
+			Memory:      uint32(envInt("UZORG_ARGON2_MEMORY_KIB", 64*1024)),
+			Iterations:  uint32(envInt("UZORG_ARGON2_ITERATIONS", 3)),
+			Parallelism: uint8(envInt("UZORG_ARGON2_PARALLELISM", 4)),
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+		Legacy: []PasswordHasher{
+			&BcryptHasher{Cost: envInt("UZORG_BCRYPT_COST", bcrypt.DefaultCost)},
+		},
+	}
+}
+
+// envInt reads an integer from the environment, falling back to def when it is unset or invalid
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envBool reads a boolean from the environment, falling back to def when it is unset or invalid
+func envBool(name string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/utukj/user-org-crud/client"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher := &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+	encoded, err := hasher.Hash("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") || !hasher.Recognizes(encoded) {
+		t.Errorf("got hash %q, want the PHC string format", encoded)
+	}
+	if again, _ := hasher.Hash("correct horse battery"); again == encoded {
+		t.Error("got the same hash twice, want a random salt")
+	}
+
+	if ok, err := hasher.Verify("correct horse battery", encoded); !ok || err != nil {
+		t.Errorf("got %v, %v verifying the password, want true", ok, err)
+	}
+	if ok, err := hasher.Verify("wrong horse battery", encoded); ok || err != nil {
+		t.Errorf("got %v, %v verifying a wrong password, want false", ok, err)
+	}
+	if _, err := hasher.Verify("correct horse battery", "$argon2id$v=19$garbage"); err == nil {
+		t.Error("got no error verifying a malformed hash")
+	}
+
+	if hasher.NeedsRehash(encoded) {
+		t.Error("got a rehash for the current parameters")
+	}
+	stronger := *hasher
+	stronger.Iterations = 2
+	if !stronger.NeedsRehash(encoded) {
+		t.Error("got no rehash after raising the iterations")
+	}
+}
+
+func TestPasswordHashersVerify(t *testing.T) {
+	hashers := &PasswordHashers{
+		Preferred: &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		Legacy:    []PasswordHasher{&BcryptHasher{Cost: bcrypt.MinCost}},
+	}
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse battery"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, rehash, err := hashers.Verify("correct horse battery", string(legacy)); !ok || !rehash || err != nil {
+		t.Errorf("got %v, %v, %v for a bcrypt hash, want it verified and rehashed", ok, rehash, err)
+	}
+	if ok, rehash, err := hashers.Verify("wrong horse battery", string(legacy)); ok || rehash || err != nil {
+		t.Errorf("got %v, %v, %v for a wrong password, want neither verified nor rehashed", ok, rehash, err)
+	}
+
+	current, _ := hashers.Hash("correct horse battery")
+	if ok, rehash, err := hashers.Verify("correct horse battery", current); !ok || rehash || err != nil {
+		t.Errorf("got %v, %v, %v for a current hash, want it verified as is", ok, rehash, err)
+	}
+	if _, _, err := hashers.Verify("correct horse battery", "plaintext"); !errors.Is(err, errUnknownPasswordHash) {
+		t.Errorf("got %v for an unknown hash, want errUnknownPasswordHash", err)
+	}
+}
+
+func TestLoginRehashesBcryptPasswords(t *testing.T) {
+	store, h := newTestHandler(t)
+	h.passwords.Legacy = []PasswordHasher{&BcryptHasher{Cost: bcrypt.MinCost}}
+	server := httptest.NewServer(newRouter(h))
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse battery"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{UserID: uuid.New().String(), FirstName: "Lin", Email: "lin@example.com", Password: string(legacy)}
+	org := makeUserDefaultOrg(&user)
+	if err := store.InsertUserAndDefaultOrg(&user, &org, nil); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() string {
+		u, _ := store.GetUserByID(user.UserID)
+		return u.Password
+	}
+
+	c := client.New(server.URL)
+	if _, err := c.Login(ctx, "lin@example.com", "wrong horse battery"); !client.IsUnauthorized(err) {
+		t.Errorf("got %v for a wrong password, want unauthorized", err)
+	}
+	if stored() != string(legacy) {
+		t.Error("the hash was replaced after a failed login")
+	}
+
+	if _, err := c.Login(ctx, "lin@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	rehashed := stored()
+	if !strings.HasPrefix(rehashed, "$argon2id$") {
+		t.Fatalf("got hash %q after logging in, want an argon2id hash", rehashed)
+	}
+
+	if _, err := c.Login(ctx, "lin@example.com", "correct horse battery"); err != nil {
+		t.Errorf("got %v logging in with the rehashed password", err)
+	}
+	if stored() != rehashed {
+		t.Error("a current hash was replaced again")
+	}
+}
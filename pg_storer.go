@@ -1,12 +1,20 @@
 package main
 
-import "database/sql"
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
 
 type UzorgPgStorer struct {
 	db *sql.DB
 }
 
-func (ups *UzorgPgStorer) InsertUserAndDefaultOrg(u *User, o *Org) error {
+func (ups *UzorgPgStorer) InsertUserAndDefaultOrg(u *User, o *Org, ev *AuditEvent) error {
 	// Begin a transaction
 	tx, err := ups.db.Begin()
 	if err != nil {
@@ -14,43 +22,50 @@ func (ups *UzorgPgStorer) InsertUserAndDefaultOrg(u *User, o *Org) error {
 	}
 
 	// Insert user
-	_, err = tx.Exec(
-		"INSERT INTO users (user_id, first_name, last_name, email, phone, password) VALUES ($1, $2, $3, $4, $5, $6)",
+	err = tx.QueryRow(
+		"INSERT INTO users (user_id, first_name, last_name, email, phone, password, email_verified) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING version",
 		u.UserID,
 		u.FirstName,
 		u.LastName,
 		u.Email,
 		u.Phone,
 		u.Password,
-	)
+		u.EmailVerified,
+	).Scan(&u.Version)
 	if err != nil {
 		tx.Rollback() // Rollback in case of error
 		return err
 	}
 
 	// Insert default org
-	_, err = tx.Exec(
-		"INSERT INTO orgs (org_id, name, description) VALUES ($1, $2, $3)",
+	err = tx.QueryRow(
+		"INSERT INTO orgs (org_id, name, description) VALUES ($1, $2, $3) RETURNING version",
 		o.OrgID,
 		o.Name,
 		o.Description,
-	)
+	).Scan(&o.Version)
 	if err != nil {
 		tx.Rollback() // Rollback in case of error
 		return err
 	}
 
-	// Insert into org_users to link the user with the default org
+	// Insert into org_users to make the user the owner of the default org
 	_, err = tx.Exec(
-		"INSERT INTO org_users (user_id, org_id) VALUES ($1, $2)",
+		"INSERT INTO org_users (user_id, org_id, role) VALUES ($1, $2, $3)",
 		u.UserID,
 		o.OrgID,
+		RoleOwner,
 	)
 	if err != nil {
 		tx.Rollback() // Rollback in case of error
 		return err
 	}
 
+	if err = insertAuditEvent(tx, ev); err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
 	// Commit the transaction
 	err = tx.Commit()
 	return err
@@ -59,31 +74,484 @@ func (ups *UzorgPgStorer) InsertUserAndDefaultOrg(u *User, o *Org) error {
 // InsertUser inserts a user into the database
 func (ups *UzorgPgStorer) InsertUser(u *User) error {
 	// Insert user into the database
-	_, err := ups.db.Exec(
-		"INSERT INTO users (user_id, first_name, last_name, email, phone, password) VALUES ($1, $2, $3, $4, $5, $6)",
+	return ups.db.QueryRow(
+		"INSERT INTO users (user_id, first_name, last_name, email, phone, password, email_verified) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING version",
 		u.UserID,
 		u.FirstName,
 		u.LastName,
 		u.Email,
 		u.Phone,
 		u.Password,
-	)
-	return err
+		u.EmailVerified,
+	).Scan(&u.Version)
 }
 
 // AddUserToOrg adds a user to an organisation
-func (ups *UzorgPgStorer) AddUserToOrg(userID, orgID string) error {
-	_, err := ups.db.Exec(
-		"INSERT INTO org_users (user_id, org_id) VALUES ($1, $2)",
-		userID, orgID,
+func (ups *UzorgPgStorer) AddUserToOrg(userID, orgID string, ev *AuditEvent) error {
+	_, err := ups.execAudited(
+		ev,
+		"INSERT INTO org_users (user_id, org_id, role) VALUES ($1, $2, $3)",
+		userID, orgID, RoleMember,
 	)
 	return err
 }
 
+// AddUsersToOrg adds the users refs name to an organisation as members in one transaction and
+// reports the outcome for each ref in order. ev is recorded for every added member with its
+// TargetID set to the member.
+func (ups *UzorgPgStorer) AddUsersToOrg(orgID string, refs []MemberRef, ev *AuditEvent) ([]*BatchMemberResult, error) {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := addUsersToOrg(tx, orgID, refs, ev)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return nil, err
+	}
+
+	// Commit the transaction
+	return results, tx.Commit()
+}
+
+// addUsersToOrg adds members to an organisation in the transaction of the caller, which
+// rolls it back on error
+func addUsersToOrg(tx *sql.Tx, orgID string, refs []MemberRef, ev *AuditEvent) ([]*BatchMemberResult, error) {
+	userIDs, found, err := resolveMemberRefs(tx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	// existing members are left as they are
+	added, err := queryUserIDs(
+		tx,
+		"INSERT INTO org_users (user_id, org_id, role) SELECT unnest($1::uuid[]), $2::uuid, $3 ON CONFLICT DO NOTHING RETURNING user_id",
+		pq.Array(found), orgID, RoleMember,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*BatchMemberResult, len(refs))
+	for i, ref := range refs {
+		result := &BatchMemberResult{UserID: userIDs[i], Email: ref.Email}
+		switch {
+		case userIDs[i] == "":
+			result.Status = BatchMemberNotFound
+		case added[userIDs[i]]:
+			result.Status = BatchMemberAdded
+			// users named twice are added once
+			delete(added, userIDs[i])
+
+			memberEv := *ev
+			memberEv.TargetID = userIDs[i]
+			if err := insertAuditEvent(tx, &memberEv); err != nil {
+				return nil, err
+			}
+		default:
+			result.Status = BatchMemberAlreadyMember
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// RemoveUsersFromOrg removes the members refs name from an organisation in one transaction and
+// reports the outcome for each ref in order. Owners are not removed. ev is recorded for every
+// removed member with its TargetID set to the member.
+func (ups *UzorgPgStorer) RemoveUsersFromOrg(orgID string, refs []MemberRef, ev *AuditEvent) ([]*BatchMemberResult, error) {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := removeUsersFromOrg(tx, orgID, refs, ev)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return nil, err
+	}
+
+	// Commit the transaction
+	return results, tx.Commit()
+}
+
+// removeUsersFromOrg removes members from an organisation in the transaction of the caller,
+// which rolls it back on error
+func removeUsersFromOrg(tx *sql.Tx, orgID string, refs []MemberRef, ev *AuditEvent) ([]*BatchMemberResult, error) {
+	userIDs, found, err := resolveMemberRefs(tx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	// owners are checked and other members removed in one statement so an owner made in the
+	// meantime is not removed
+	removed, err := queryUserIDs(
+		tx,
+		"DELETE FROM org_users WHERE org_id = $1 AND user_id = ANY($2::uuid[]) AND role <> $3 RETURNING user_id",
+		orgID, pq.Array(found), RoleOwner,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	owners, err := queryUserIDs(
+		tx,
+		"SELECT user_id FROM org_users WHERE org_id = $1 AND user_id = ANY($2::uuid[]) AND role = $3",
+		orgID, pq.Array(found), RoleOwner,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*BatchMemberResult, len(refs))
+	for i, ref := range refs {
+		result := &BatchMemberResult{UserID: userIDs[i], Email: ref.Email}
+		switch {
+		case userIDs[i] == "":
+			result.Status = BatchMemberNotFound
+		case owners[userIDs[i]]:
+			result.Status = BatchMemberOwner
+		case removed[userIDs[i]]:
+			result.Status = BatchMemberRemoved
+			// users named twice are removed once
+			delete(removed, userIDs[i])
+
+			memberEv := *ev
+			memberEv.TargetID = userIDs[i]
+			if err := insertAuditEvent(tx, &memberEv); err != nil {
+				return nil, err
+			}
+		default:
+			result.Status = BatchMemberNotMember
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// UpdateOrgMembers adds and removes members of an organisation in one transaction, recording
+// addEv and removeEv like AddUsersToOrg and RemoveUsersFromOrg. Owners are not removed.
+func (ups *UzorgPgStorer) UpdateOrgMembers(orgID string, add, remove []MemberRef, addEv, removeEv *AuditEvent) error {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if len(add) > 0 {
+		_, err = addUsersToOrg(tx, orgID, add, addEv)
+	}
+	if err == nil && len(remove) > 0 {
+		_, err = removeUsersFromOrg(tx, orgID, remove, removeEv)
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// StreamOrgUsers calls fn with each member of an organisation, ordered by email, without
+// loading them all at once. It stops at the first error fn returns.
+func (ups *UzorgPgStorer) StreamOrgUsers(orgID string, fn func(*User) error) error {
+	rows, err := ups.db.Query(
+		"SELECT u.user_id, u.first_name, u.last_name, u.email, u.phone, u.version, ou.role FROM users u INNER JOIN org_users ou ON u.user_id = ou.user_id WHERE ou.org_id = $1 AND u.deleted_at IS NULL ORDER BY u.email",
+		orgID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Version, &user.Role); err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetOrgMembersByEmail retrieves the users with the given emails, keyed by email. Role is their
+// role in the organisation, or empty when they are not members.
+func (ups *UzorgPgStorer) GetOrgMembersByEmail(orgID string, emails []string) (map[string]*User, error) {
+	rows, err := ups.db.Query(
+		"SELECT u.user_id, u.first_name, u.last_name, u.email, COALESCE(ou.role, '') FROM users u LEFT JOIN org_users ou ON u.user_id = ou.user_id AND ou.org_id = $1 WHERE u.email = ANY($2) AND u.deleted_at IS NULL",
+		orgID, pq.Array(emails),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := map[string]*User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Role); err != nil {
+			return nil, err
+		}
+		users[user.Email] = &user
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ApplyMemberImport applies the added and role_changed rows of a member import and saves its
+// invitations in one transaction. Owners keep their role. ev is recorded for every change,
+// with its action and target set to the change.
+func (ups *UzorgPgStorer) ApplyMemberImport(orgID string, rows []*MemberImportRow, invitations []*Invitation, ev *AuditEvent) error {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		var res sql.Result
+		changeEv := *ev
+		changeEv.TargetType = "user"
+		changeEv.TargetID = row.UserID
+		switch row.Status {
+		case MemberImportAdded:
+			changeEv.Action = AuditMemberAdded
+			res, err = tx.Exec(
+				"INSERT INTO org_users (user_id, org_id, role) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+				row.UserID, orgID, row.Role,
+			)
+		case MemberImportRoleChanged:
+			changeEv.Action = AuditMemberRoleChanged
+			res, err = tx.Exec(
+				"UPDATE org_users SET role = $1 WHERE org_id = $2 AND user_id = $3 AND role <> $4",
+				row.Role, orgID, row.UserID, RoleOwner,
+			)
+		default:
+			continue
+		}
+		if err != nil {
+			tx.Rollback() // Rollback in case of error
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback() // Rollback in case of error
+			return err
+		}
+		// rows changed by another request in the meantime are left as they are
+		if n == 0 {
+			continue
+		}
+		if err = insertAuditEvent(tx, &changeEv); err != nil {
+			tx.Rollback() // Rollback in case of error
+			return err
+		}
+	}
+
+	for _, inv := range invitations {
+		err = tx.QueryRow(
+			`INSERT INTO invitations (invitation_id, org_id, email, role, invited_by, token_hash, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (org_id, email) DO UPDATE SET role = EXCLUDED.role, invited_by = EXCLUDED.invited_by, token_hash = EXCLUDED.token_hash, created_at = NOW(), expires_at = EXCLUDED.expires_at
+			RETURNING invitation_id`,
+			inv.InvitationID, orgID, inv.Email, inv.Role, inv.InvitedBy, inv.TokenHash, inv.ExpiresAt,
+		).Scan(&inv.InvitationID)
+		if err != nil {
+			tx.Rollback() // Rollback in case of error
+			return err
+		}
+
+		invitationEv := *ev
+		invitationEv.Action = AuditInvitationCreated
+		invitationEv.TargetType = "invitation"
+		invitationEv.TargetID = inv.InvitationID
+		if err = insertAuditEvent(tx, &invitationEv); err != nil {
+			tx.Rollback() // Rollback in case of error
+			return err
+		}
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// AcceptInvitation adds a user to the organisation of an unexpired invitation with its role
+// and deletes the invitation. It returns ErrNotFound for unknown, used or expired tokens.
+// ev is recorded when the user was not a member yet.
+func (ups *UzorgPgStorer) AcceptInvitation(tokenHash, userID string, ev *AuditEvent) (Invitation, error) {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return Invitation{}, err
+	}
+
+	var inv Invitation
+	err = tx.QueryRow(
+		"DELETE FROM invitations WHERE token_hash = $1 AND expires_at > NOW() RETURNING invitation_id, org_id, email, role, COALESCE(invited_by::text, ''), expires_at",
+		tokenHash,
+	).Scan(&inv.InvitationID, &inv.OrgID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.ExpiresAt)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return Invitation{}, ErrNotFound
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return Invitation{}, err
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO org_users (user_id, org_id, role) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		userID, inv.OrgID, inv.Role,
+	)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return Invitation{}, err
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 && ev != nil {
+		ev.OrgID = inv.OrgID
+		ev.TargetID = userID
+		if err = insertAuditEvent(tx, ev); err != nil {
+			tx.Rollback() // Rollback in case of error
+			return Invitation{}, err
+		}
+	}
+
+	// Commit the transaction
+	return inv, tx.Commit()
+}
+
+// PurgeExpiredInvitations deletes the invitations that can no longer be accepted
+func (ups *UzorgPgStorer) PurgeExpiredInvitations() (int64, error) {
+	res, err := ups.db.Exec("DELETE FROM invitations WHERE expires_at <= NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// InsertUserIntoOrg creates a user as a member of an existing organisation, for users
+// provisioned by the organisation rather than registering themselves
+func (ups *UzorgPgStorer) InsertUserIntoOrg(u *User, orgID string, ev *AuditEvent) error {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO users (user_id, first_name, last_name, email, phone, password, email_verified) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING version",
+		u.UserID,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		u.Phone,
+		u.Password,
+		u.EmailVerified,
+	).Scan(&u.Version)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO org_users (user_id, org_id, role) VALUES ($1, $2, $3)",
+		u.UserID,
+		orgID,
+		RoleMember,
+	)
+	if err == nil {
+		err = insertAuditEvent(tx, ev)
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// resolveMemberRefs looks up the IDs of the users refs name, in the order of refs. Refs to
+// unknown or deleted users resolve to "". found holds the IDs of the users that exist.
+func resolveMemberRefs(tx *sql.Tx, refs []MemberRef) (userIDs, found []string, err error) {
+	var ids, emails []string
+	for _, ref := range refs {
+		if ref.UserID != "" {
+			ids = append(ids, ref.UserID)
+		} else {
+			emails = append(emails, ref.Email)
+		}
+	}
+
+	rows, err := tx.Query(
+		"SELECT user_id, email FROM users WHERE (user_id = ANY($1::uuid[]) OR email = ANY($2)) AND deleted_at IS NULL",
+		pq.Array(ids), pq.Array(emails),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	byID := map[string]bool{}
+	byEmail := map[string]string{}
+	for rows.Next() {
+		var id, email string
+		if err := rows.Scan(&id, &email); err != nil {
+			return nil, nil, err
+		}
+		byID[id] = true
+		byEmail[email] = id
+		found = append(found, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	userIDs = make([]string, len(refs))
+	for i, ref := range refs {
+		if ref.UserID != "" {
+			if byID[ref.UserID] {
+				userIDs[i] = ref.UserID
+			}
+		} else {
+			userIDs[i] = byEmail[ref.Email]
+		}
+	}
+	return userIDs, found, nil
+}
+
+// queryUserIDs runs a query returning user IDs and collects them into a set
+func queryUserIDs(tx *sql.Tx, query string, args ...interface{}) (map[string]bool, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
 // GetUsersByOrgID retrieves all users belonging to a specific organisation
 func (ups *UzorgPgStorer) GetOrgUsers(orgID string) ([]*User, error) {
 	rows, err := ups.db.Query(
-		"SELECT u.user_id, u.first_name, u.last_name, u.email, u.phone, u.password FROM users u INNER JOIN org_users ou ON u.user_id = ou.user_id WHERE ou.org_id = $1",
+		"SELECT u.user_id, u.first_name, u.last_name, u.email, u.phone, u.password, u.version, u.deleted_at, ou.role FROM users u INNER JOIN org_users ou ON u.user_id = ou.user_id WHERE ou.org_id = $1 AND u.deleted_at IS NULL",
 		orgID,
 	)
 	if err != nil {
@@ -94,7 +562,7 @@ func (ups *UzorgPgStorer) GetOrgUsers(orgID string) ([]*User, error) {
 	var users []*User
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Password); err != nil {
+		if err := rows.Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Password, &user.Version, &user.DeletedAt, &user.Role); err != nil {
 			return nil, err
 		}
 		users = append(users, &user)
@@ -108,35 +576,78 @@ func (ups *UzorgPgStorer) GetOrgUsers(orgID string) ([]*User, error) {
 func (ups *UzorgPgStorer) GetUserByEmail(email string) (User, error) {
 	var user User
 	err := ups.db.QueryRow(
-		"SELECT user_id, first_name, last_name, email, phone, password FROM users WHERE email = $1",
+		"SELECT user_id, first_name, last_name, email, phone, password, version, deleted_at, email_verified FROM users WHERE email = $1",
 		email,
-	).Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Password)
+	).Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Password, &user.Version, &user.DeletedAt, &user.EmailVerified)
 	return user, err
 }
 
 func (ups *UzorgPgStorer) GetUserByID(userID string) (User, error) {
 	var user User
 	err := ups.db.QueryRow(
-		"SELECT user_id, first_name, last_name, email, phone, password FROM users WHERE user_id = $1",
+		"SELECT user_id, first_name, last_name, email, phone, password, version, deleted_at, email_verified FROM users WHERE user_id = $1",
 		userID,
-	).Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Password)
+	).Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Password, &user.Version, &user.DeletedAt, &user.EmailVerified)
 	return user, err
 }
 
+// UpdateUser saves the profile fields of a user if it is still at expectedVersion, and bumps its version.
+// It reports whether the user was updated; false means a concurrent edit got there first.
+func (ups *UzorgPgStorer) UpdateUser(u *User, expectedVersion int, ev *AuditEvent) (bool, error) {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.QueryRow(
+		"UPDATE users SET first_name = $1, last_name = $2, phone = $3, version = version + 1 WHERE user_id = $4 AND version = $5 RETURNING version",
+		u.FirstName,
+		u.LastName,
+		u.Phone,
+		u.UserID,
+		expectedVersion,
+	).Scan(&u.Version)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return false, nil
+	}
+	if err == nil {
+		err = insertAuditEvent(tx, ev)
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return false, err
+	}
+
+	// Commit the transaction
+	err = tx.Commit()
+	return err == nil, err
+}
+
+// UpdateUserPassword replaces the password hash of a user
+func (ups *UzorgPgStorer) UpdateUserPassword(userID, hashedPassword string, ev *AuditEvent) error {
+	_, err := ups.execAudited(
+		ev,
+		"UPDATE users SET password = $1 WHERE user_id = $2",
+		hashedPassword, userID,
+	)
+	return err
+}
+
 func (ups *UzorgPgStorer) InsertOrg(o *Org) error {
-	_, err := ups.db.Exec(
-		"INSERT INTO orgs (org_id, name, description) VALUES ($1, $2, $3)",
+	return ups.db.QueryRow(
+		"INSERT INTO orgs (org_id, name, description) VALUES ($1, $2, $3) RETURNING version",
 		o.OrgID,
 		o.Name,
 		o.Description,
-	)
-	return err
+	).Scan(&o.Version)
 }
 
 // GetUserOrgs retrieves all organisations that a user belongs to
 func (ups *UzorgPgStorer) GetUserOrgs(userID string) ([]*Org, error) {
 	rows, err := ups.db.Query(
-		"SELECT o.org_id, o.name, o.description FROM orgs o INNER JOIN org_users ou ON o.org_id = ou.org_id WHERE ou.user_id = $1",
+		"SELECT o.org_id, o.name, o.description, o.version FROM orgs o INNER JOIN org_users ou ON o.org_id = ou.org_id WHERE ou.user_id = $1",
 		userID,
 	)
 	if err != nil {
@@ -147,7 +658,7 @@ func (ups *UzorgPgStorer) GetUserOrgs(userID string) ([]*Org, error) {
 	var orgs []*Org
 	for rows.Next() {
 		var org Org
-		if err := rows.Scan(&org.OrgID, &org.Name, &org.Description); err != nil {
+		if err := rows.Scan(&org.OrgID, &org.Name, &org.Description, &org.Version); err != nil {
 			return nil, err
 		}
 		orgs = append(orgs, &org)
@@ -158,13 +669,66 @@ func (ups *UzorgPgStorer) GetUserOrgs(userID string) ([]*Org, error) {
 	return orgs, nil
 }
 
+// GetOrgsOfUsers retrieves the organisations of several users in one query, keyed by user ID.
+// Org.Role holds the role of the user.
+func (ups *UzorgPgStorer) GetOrgsOfUsers(userIDs []string) (map[string][]*Org, error) {
+	rows, err := ups.db.Query(
+		"SELECT ou.user_id, o.org_id, o.name, o.description, o.version, ou.role FROM orgs o INNER JOIN org_users ou ON o.org_id = ou.org_id WHERE ou.user_id = ANY($1::uuid[]) ORDER BY o.name, o.org_id",
+		pq.Array(userIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := map[string][]*Org{}
+	for rows.Next() {
+		var userID string
+		var org Org
+		if err := rows.Scan(&userID, &org.OrgID, &org.Name, &org.Description, &org.Version, &org.Role); err != nil {
+			return nil, err
+		}
+		orgs[userID] = append(orgs[userID], &org)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// GetUsersOfOrgs retrieves the members of several organisations in one query, keyed by organisation ID
+func (ups *UzorgPgStorer) GetUsersOfOrgs(orgIDs []string) (map[string][]*User, error) {
+	rows, err := ups.db.Query(
+		"SELECT ou.org_id, u.user_id, u.first_name, u.last_name, u.email, u.phone, u.password, u.version, u.deleted_at, ou.role FROM users u INNER JOIN org_users ou ON u.user_id = ou.user_id WHERE ou.org_id = ANY($1::uuid[]) AND u.deleted_at IS NULL ORDER BY u.email",
+		pq.Array(orgIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := map[string][]*User{}
+	for rows.Next() {
+		var orgID string
+		var user User
+		if err := rows.Scan(&orgID, &user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Password, &user.Version, &user.DeletedAt, &user.Role); err != nil {
+			return nil, err
+		}
+		users[orgID] = append(users[orgID], &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 // getorg retrieves an org by ID
 func (ups *UzorgPgStorer) GetOrg(orgID string) (Org, error) {
 	var org Org
 	err := ups.db.QueryRow(
-		"SELECT org_id, name, description FROM orgs WHERE org_id = $1",
+		"SELECT org_id, name, description, version FROM orgs WHERE org_id = $1",
 		orgID,
-	).Scan(&org.OrgID, &org.Name, &org.Description)
+	).Scan(&org.OrgID, &org.Name, &org.Description, &org.Version)
 	return org, err
 }
 
@@ -178,8 +742,21 @@ func (ups *UzorgPgStorer) UserBelongsToOrg(userID, orgID string) (bool, error) {
 	return count > 0, err
 }
 
+// UsersShareOrg checks if two users belong to a common organisation. Deleted users share no organisations.
+func (ups *UzorgPgStorer) UsersShareOrg(userID, otherUserID string) (bool, error) {
+	var count int
+	err := ups.db.QueryRow(
+		`SELECT COUNT(*) FROM org_users a
+		INNER JOIN org_users b ON a.org_id = b.org_id
+		INNER JOIN users u ON b.user_id = u.user_id
+		WHERE a.user_id = $1 AND b.user_id = $2 AND u.deleted_at IS NULL`,
+		userID, otherUserID,
+	).Scan(&count)
+	return count > 0, err
+}
+
 // InsertOrgAndAddUser inserts an organisation and adds a user to it
-func (ups *UzorgPgStorer) InsertOrgAndAddUser(o *Org, userID string) error {
+func (ups *UzorgPgStorer) InsertOrgAndAddUser(o *Org, userID string, ev *AuditEvent) error {
 	// Begin a transaction
 	tx, err := ups.db.Begin()
 	if err != nil {
@@ -187,29 +764,1283 @@ func (ups *UzorgPgStorer) InsertOrgAndAddUser(o *Org, userID string) error {
 	}
 
 	// Insert org
-	_, err = tx.Exec(
-		"INSERT INTO orgs (org_id, name, description) VALUES ($1, $2, $3)",
+	err = tx.QueryRow(
+		"INSERT INTO orgs (org_id, name, description) VALUES ($1, $2, $3) RETURNING version",
 		o.OrgID,
 		o.Name,
 		o.Description,
-	)
+	).Scan(&o.Version)
 	if err != nil {
 		tx.Rollback() // Rollback in case of error
 		return err
 	}
 
-	// Insert into org_users to link the user with the org
+	// Insert into org_users to make the user the owner of the org
 	_, err = tx.Exec(
-		"INSERT INTO org_users (user_id, org_id) VALUES ($1, $2)",
+		"INSERT INTO org_users (user_id, org_id, role) VALUES ($1, $2, $3)",
 		userID,
 		o.OrgID,
+		RoleOwner,
 	)
 	if err != nil {
 		tx.Rollback() // Rollback in case of error
 		return err
 	}
 
+	if err = insertAuditEvent(tx, ev); err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
 	// Commit the transaction
 	err = tx.Commit()
 	return err
 }
+
+// InsertAPIKey stores a new API key. Only the hash of the key is persisted.
+func (ups *UzorgPgStorer) InsertAPIKey(k *APIKey, ev *AuditEvent) error {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO api_keys (key_id, user_id, name, prefix, key_hash, scopes) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at",
+		k.KeyID,
+		k.UserID,
+		k.Name,
+		k.Prefix,
+		k.KeyHash,
+		pq.Array(k.Scopes),
+	).Scan(&k.CreatedAt)
+	if err == nil {
+		err = insertAuditEvent(tx, ev)
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// UseAPIKey looks up an unrevoked API key by its hash and records that it was used
+func (ups *UzorgPgStorer) UseAPIKey(keyHash string) (APIKey, error) {
+	var k APIKey
+	err := ups.db.QueryRow(
+		"UPDATE api_keys SET last_used_at = NOW() WHERE key_hash = $1 AND revoked_at IS NULL AND user_id IN (SELECT user_id FROM users WHERE deleted_at IS NULL) RETURNING key_id, user_id, name, prefix, key_hash, scopes, created_at, last_used_at",
+		keyHash,
+	).Scan(&k.KeyID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, pq.Array(&k.Scopes), &k.CreatedAt, &k.LastUsedAt)
+	return k, err
+}
+
+// GetUserAPIKeys retrieves the unrevoked API keys of a user
+func (ups *UzorgPgStorer) GetUserAPIKeys(userID string) ([]*APIKey, error) {
+	rows, err := ups.db.Query(
+		"SELECT key_id, user_id, name, prefix, key_hash, scopes, created_at, last_used_at FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.KeyID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, pq.Array(&k.Scopes), &k.CreatedAt, &k.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// InsertSCIMToken stores a new SCIM token. Only the hash of the token is persisted.
+func (ups *UzorgPgStorer) InsertSCIMToken(t *SCIMToken, ev *AuditEvent) error {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO scim_tokens (token_id, org_id, name, prefix, token_hash, created_by) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at",
+		t.TokenID,
+		t.OrgID,
+		t.Name,
+		t.Prefix,
+		t.TokenHash,
+		t.CreatedBy,
+	).Scan(&t.CreatedAt)
+	if err == nil {
+		err = insertAuditEvent(tx, ev)
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// UseSCIMToken looks up an unrevoked SCIM token by hash and records that it was used
+func (ups *UzorgPgStorer) UseSCIMToken(tokenHash string) (SCIMToken, error) {
+	var t SCIMToken
+	err := ups.db.QueryRow(
+		"UPDATE scim_tokens SET last_used_at = NOW() WHERE token_hash = $1 AND revoked_at IS NULL RETURNING token_id, org_id, name, prefix, token_hash, COALESCE(created_by::text, ''), created_at, last_used_at",
+		tokenHash,
+	).Scan(&t.TokenID, &t.OrgID, &t.Name, &t.Prefix, &t.TokenHash, &t.CreatedBy, &t.CreatedAt, &t.LastUsedAt)
+	return t, err
+}
+
+// GetOrgSCIMTokens retrieves the unrevoked SCIM tokens of an organisation
+func (ups *UzorgPgStorer) GetOrgSCIMTokens(orgID string) ([]*SCIMToken, error) {
+	rows, err := ups.db.Query(
+		"SELECT token_id, org_id, name, prefix, token_hash, COALESCE(created_by::text, ''), created_at, last_used_at FROM scim_tokens WHERE org_id = $1 AND revoked_at IS NULL ORDER BY created_at",
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*SCIMToken
+	for rows.Next() {
+		var t SCIMToken
+		if err := rows.Scan(&t.TokenID, &t.OrgID, &t.Name, &t.Prefix, &t.TokenHash, &t.CreatedBy, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokeSCIMToken revokes one of an organisation's SCIM tokens. It reports whether a token was revoked.
+func (ups *UzorgPgStorer) RevokeSCIMToken(orgID, tokenID string, ev *AuditEvent) (bool, error) {
+	res, err := ups.execAudited(
+		ev,
+		"UPDATE scim_tokens SET revoked_at = NOW() WHERE token_id = $1 AND org_id = $2 AND revoked_at IS NULL",
+		tokenID, orgID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RevokeAPIKey revokes one of a user's API keys. It reports whether a key was revoked.
+func (ups *UzorgPgStorer) RevokeAPIKey(userID, keyID string, ev *AuditEvent) (bool, error) {
+	res, err := ups.execAudited(
+		ev,
+		"UPDATE api_keys SET revoked_at = NOW() WHERE key_id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		keyID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// InsertOIDCLoginState saves the state of a login started at an external identity provider
+func (ups *UzorgPgStorer) InsertOIDCLoginState(s *OIDCLoginState) error {
+	return ups.db.QueryRow(
+		"INSERT INTO oidc_login_states (state, provider, nonce, code_verifier, restore) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		s.State,
+		s.Provider,
+		s.Nonce,
+		s.CodeVerifier,
+		s.Restore,
+	).Scan(&s.CreatedAt)
+}
+
+// ConsumeOIDCLoginState retrieves and deletes a login state so that it can only be used once
+func (ups *UzorgPgStorer) ConsumeOIDCLoginState(state string) (OIDCLoginState, error) {
+	var s OIDCLoginState
+	err := ups.db.QueryRow(
+		"DELETE FROM oidc_login_states WHERE state = $1 RETURNING state, provider, nonce, code_verifier, restore, created_at",
+		state,
+	).Scan(&s.State, &s.Provider, &s.Nonce, &s.CodeVerifier, &s.Restore, &s.CreatedAt)
+	return s, err
+}
+
+// GetUserByIdentity retrieves the user linked to an external identity
+func (ups *UzorgPgStorer) GetUserByIdentity(issuer, subject string) (User, error) {
+	var user User
+	err := ups.db.QueryRow(
+		"SELECT u.user_id, u.first_name, u.last_name, u.email, u.phone, u.password, u.version, u.deleted_at, u.email_verified FROM users u INNER JOIN user_identities ui ON u.user_id = ui.user_id WHERE ui.issuer = $1 AND ui.subject = $2",
+		issuer, subject,
+	).Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email, &user.Phone, &user.Password, &user.Version, &user.DeletedAt, &user.EmailVerified)
+	return user, err
+}
+
+// InsertUserIdentity links an external identity to a user. Identities are linked by the email
+// the identity provider verified, so the email of the user is marked verified.
+func (ups *UzorgPgStorer) InsertUserIdentity(userID, issuer, subject string) error {
+	_, err := ups.db.Exec(
+		`WITH linked AS (
+			INSERT INTO user_identities (issuer, subject, user_id) VALUES ($1, $2, $3) RETURNING user_id
+		) UPDATE users SET email_verified = TRUE WHERE user_id = (SELECT user_id FROM linked)`,
+		issuer, subject, userID,
+	)
+	return err
+}
+
+// InsertOAuthClient registers a client application of the OpenID Connect provider
+func (ups *UzorgPgStorer) InsertOAuthClient(c *OAuthClient) error {
+	return ups.db.QueryRow(
+		"INSERT INTO oauth_clients (client_id, client_secret_hash, name, redirect_uris, owner_user_id) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		c.ClientID,
+		c.SecretHash,
+		c.Name,
+		pq.Array(c.RedirectURIs),
+		c.OwnerUserID,
+	).Scan(&c.CreatedAt)
+}
+
+// GetOAuthClient retrieves a client application by ID
+func (ups *UzorgPgStorer) GetOAuthClient(clientID string) (OAuthClient, error) {
+	var c OAuthClient
+	err := ups.db.QueryRow(
+		"SELECT client_id, client_secret_hash, name, redirect_uris, owner_user_id, created_at FROM oauth_clients WHERE client_id = $1",
+		clientID,
+	).Scan(&c.ClientID, &c.SecretHash, &c.Name, pq.Array(&c.RedirectURIs), &c.OwnerUserID, &c.CreatedAt)
+	return c, err
+}
+
+// GetUserOAuthClients retrieves the client applications owned by a user
+func (ups *UzorgPgStorer) GetUserOAuthClients(userID string) ([]*OAuthClient, error) {
+	rows, err := ups.db.Query(
+		"SELECT client_id, client_secret_hash, name, redirect_uris, owner_user_id, created_at FROM oauth_clients WHERE owner_user_id = $1 ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []*OAuthClient
+	for rows.Next() {
+		var c OAuthClient
+		if err := rows.Scan(&c.ClientID, &c.SecretHash, &c.Name, pq.Array(&c.RedirectURIs), &c.OwnerUserID, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		clients = append(clients, &c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// DeleteOAuthClient deletes a client application owned by a user. It reports whether a client was deleted.
+func (ups *UzorgPgStorer) DeleteOAuthClient(userID, clientID string) (bool, error) {
+	res, err := ups.db.Exec(
+		"DELETE FROM oauth_clients WHERE client_id = $1 AND owner_user_id = $2",
+		clientID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetOAuthConsent retrieves the scopes a user has consented to share with a client application
+func (ups *UzorgPgStorer) GetOAuthConsent(userID, clientID string) ([]string, error) {
+	var scopes []string
+	err := ups.db.QueryRow(
+		"SELECT scopes FROM oauth_consents WHERE user_id = $1 AND client_id = $2",
+		userID, clientID,
+	).Scan(pq.Array(&scopes))
+	return scopes, err
+}
+
+// UpsertOAuthConsent records the scopes a user has consented to share with a client application
+func (ups *UzorgPgStorer) UpsertOAuthConsent(userID, clientID string, scopes []string) error {
+	_, err := ups.db.Exec(
+		"INSERT INTO oauth_consents (user_id, client_id, scopes) VALUES ($1, $2, $3) ON CONFLICT (user_id, client_id) DO UPDATE SET scopes = EXCLUDED.scopes, granted_at = NOW()",
+		userID, clientID, pq.Array(scopes),
+	)
+	return err
+}
+
+// InsertOAuthCode saves an issued authorization code. Only the hash of the code is persisted.
+func (ups *UzorgPgStorer) InsertOAuthCode(c *OAuthCode) error {
+	return ups.db.QueryRow(
+		"INSERT INTO oauth_codes (code_hash, client_id, user_id, redirect_uri, scopes, nonce, code_challenge) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at",
+		c.CodeHash,
+		c.ClientID,
+		c.UserID,
+		c.RedirectURI,
+		pq.Array(c.Scopes),
+		c.Nonce,
+		c.CodeChallenge,
+	).Scan(&c.CreatedAt)
+}
+
+// ConsumeOAuthCode retrieves and deletes an authorization code so that it can only be redeemed once
+func (ups *UzorgPgStorer) ConsumeOAuthCode(codeHash string) (OAuthCode, error) {
+	var c OAuthCode
+	err := ups.db.QueryRow(
+		"DELETE FROM oauth_codes WHERE code_hash = $1 RETURNING code_hash, client_id, user_id, redirect_uri, scopes, nonce, code_challenge, created_at",
+		codeHash,
+	).Scan(&c.CodeHash, &c.ClientID, &c.UserID, &c.RedirectURI, pq.Array(&c.Scopes), &c.Nonce, &c.CodeChallenge, &c.CreatedAt)
+	return c, err
+}
+
+// InsertSession records a new login session
+func (ups *UzorgPgStorer) InsertSession(s *Session, ev *AuditEvent) error {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO sessions (session_id, user_id, user_agent, ip_address, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, last_seen_at",
+		s.SessionID,
+		s.UserID,
+		s.UserAgent,
+		s.IPAddress,
+		s.ExpiresAt,
+	).Scan(&s.CreatedAt, &s.LastSeenAt)
+	if err == nil {
+		err = insertAuditEvent(tx, ev)
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// TouchSession retrieves an active session and records that it was used
+func (ups *UzorgPgStorer) TouchSession(sessionID string) (Session, error) {
+	var s Session
+	err := ups.db.QueryRow(
+		"UPDATE sessions SET last_seen_at = NOW() WHERE session_id = $1 AND revoked_at IS NULL AND expires_at > NOW() RETURNING session_id, user_id, user_agent, ip_address, created_at, last_seen_at, expires_at",
+		sessionID,
+	).Scan(&s.SessionID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+	return s, err
+}
+
+// GetUserSessions retrieves the active sessions of a user, most recently used first
+func (ups *UzorgPgStorer) GetUserSessions(userID string) ([]*Session, error) {
+	rows, err := ups.db.Query(
+		"SELECT session_id, user_id, user_agent, ip_address, created_at, last_seen_at, expires_at FROM sessions WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW() ORDER BY last_seen_at DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.SessionID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes one of a user's sessions. It reports whether a session was revoked.
+func (ups *UzorgPgStorer) RevokeSession(userID, sessionID string, ev *AuditEvent) (bool, error) {
+	res, err := ups.execAudited(
+		ev,
+		"UPDATE sessions SET revoked_at = NOW() WHERE session_id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		sessionID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RevokeUserSessions revokes every session of a user except the given one
+func (ups *UzorgPgStorer) RevokeUserSessions(userID, exceptSessionID string) error {
+	_, err := ups.db.Exec(
+		"UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND session_id::text <> $2 AND revoked_at IS NULL",
+		userID, exceptSessionID,
+	)
+	return err
+}
+
+// InsertEmailChange saves a pending email change. Only the hash of the confirmation token is persisted.
+func (ups *UzorgPgStorer) InsertEmailChange(c *EmailChange) error {
+	_, err := ups.db.Exec(
+		"INSERT INTO email_changes (token_hash, user_id, new_email, expires_at) VALUES ($1, $2, $3, $4)",
+		c.TokenHash,
+		c.UserID,
+		c.NewEmail,
+		c.ExpiresAt,
+	)
+	return err
+}
+
+// ConfirmEmailChange applies the pending email change with the given token hash and returns the updated user.
+// It returns ErrNotFound for unknown, used or expired tokens and ErrEmailTaken when another user has the email.
+// The actor and target of ev are set to the user whose email changed.
+func (ups *UzorgPgStorer) ConfirmEmailChange(tokenHash string, ev *AuditEvent) (User, error) {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+
+	var c EmailChange
+	err = tx.QueryRow(
+		"SELECT user_id, new_email FROM email_changes WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() FOR UPDATE",
+		tokenHash,
+	).Scan(&c.UserID, &c.NewEmail)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return User{}, err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE users SET email = $1, email_verified = TRUE, version = version + 1 WHERE user_id = $2",
+		c.NewEmail, c.UserID,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" { // unique_violation
+		tx.Rollback()
+		return User{}, ErrEmailTaken
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return User{}, err
+	}
+
+	// mark this and any other pending change of the user as used
+	_, err = tx.Exec(
+		"UPDATE email_changes SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL",
+		c.UserID,
+	)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return User{}, err
+	}
+
+	if ev != nil {
+		ev.ActorID = c.UserID
+		ev.TargetID = c.UserID
+	}
+	if err = insertAuditEvent(tx, ev); err != nil {
+		tx.Rollback() // Rollback in case of error
+		return User{}, err
+	}
+
+	// Commit the transaction
+	if err = tx.Commit(); err != nil {
+		return User{}, err
+	}
+	return ups.GetUserByID(c.UserID)
+}
+
+// GetMemberRole retrieves the role of a user in an organisation. It returns sql.ErrNoRows if the user is not a member.
+func (ups *UzorgPgStorer) GetMemberRole(orgID, userID string) (string, error) {
+	var role string
+	err := ups.db.QueryRow(
+		"SELECT role FROM org_users WHERE org_id = $1 AND user_id = $2",
+		orgID, userID,
+	).Scan(&role)
+	return role, err
+}
+
+// SetMemberRole changes the role of a member of an organisation. It reports false if the user is not a member.
+func (ups *UzorgPgStorer) SetMemberRole(orgID, userID, role string, ev *AuditEvent) (bool, error) {
+	res, err := ups.execAudited(
+		ev,
+		"UPDATE org_users SET role = $1 WHERE org_id = $2 AND user_id = $3",
+		role, orgID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetAllOrgs retrieves every organisation, for operators
+func (ups *UzorgPgStorer) GetAllOrgs() ([]*Org, error) {
+	rows, err := ups.db.Query("SELECT org_id, name, description, version FROM orgs ORDER BY name, org_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []*Org
+	for rows.Next() {
+		var org Org
+		if err := rows.Scan(&org.OrgID, &org.Name, &org.Description, &org.Version); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, &org)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// querySoleOwnedOrgs retrieves the organisations where the user is the only owner that has not deleted their account
+func querySoleOwnedOrgs(tx *sql.Tx, userID string) ([]*Org, error) {
+	rows, err := tx.Query(
+		`SELECT o.org_id, o.name, o.description, o.version FROM orgs o
+		INNER JOIN org_users ou ON o.org_id = ou.org_id
+		WHERE ou.user_id = $1 AND ou.role = $2 AND NOT EXISTS (
+			SELECT 1 FROM org_users other INNER JOIN users u ON other.user_id = u.user_id
+			WHERE other.org_id = o.org_id AND other.user_id <> $1 AND other.role = $2 AND u.deleted_at IS NULL
+		)`,
+		userID, RoleOwner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []*Org
+	for rows.Next() {
+		var org Org
+		if err := rows.Scan(&org.OrgID, &org.Name, &org.Description, &org.Version); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, &org)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// TransferOrgOwnership makes toUserID an owner of an organisation and demotes fromUserID to admin.
+// It returns ErrNotFound when toUserID is not a member or their account is scheduled for deletion.
+func (ups *UzorgPgStorer) TransferOrgOwnership(orgID, fromUserID, toUserID string, ev *AuditEvent) error {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// lock the organisation like SoftDeleteUser, so the new owner cannot delete their account meanwhile
+	_, err = tx.Exec("SELECT 1 FROM orgs WHERE org_id = $1 FOR UPDATE", orgID)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	res, err := tx.Exec(
+		`UPDATE org_users SET role = $1 WHERE org_id = $2 AND user_id = $3
+		AND EXISTS (SELECT 1 FROM users WHERE user_id = $3 AND deleted_at IS NULL)`,
+		RoleOwner, orgID, toUserID,
+	)
+	if err == nil {
+		var n int64
+		if n, err = res.RowsAffected(); err == nil && n == 0 {
+			err = ErrNotFound
+		}
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE org_users SET role = $1 WHERE org_id = $2 AND user_id = $3",
+		RoleAdmin, orgID, fromUserID,
+	)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	if err = insertAuditEvent(tx, ev); err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// DeleteOrg deletes an organisation and its memberships if it is still at expectedVersion.
+// It reports whether the organisation was deleted; false means it was changed in the meantime.
+func (ups *UzorgPgStorer) DeleteOrg(orgID string, expectedVersion int, ev *AuditEvent) (bool, error) {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	var version int
+	err = tx.QueryRow("SELECT version FROM orgs WHERE org_id = $1 FOR UPDATE", orgID).Scan(&version)
+	if err == sql.ErrNoRows || (err == nil && version != expectedVersion) {
+		tx.Rollback()
+		return false, nil
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return false, err
+	}
+
+	if err = insertAuditEvent(tx, ev); err != nil {
+		tx.Rollback() // Rollback in case of error
+		return false, err
+	}
+
+	// the webhooks of the organisation are deleted with it, so org.deleted is queued for them
+	// now rather than when the outbox dispatches the event
+	if e := domainEventFromAudit(ev); e != nil {
+		payload, err := webhookPayload(e)
+		if err == nil {
+			_, err = tx.Exec(enqueueWebhookDeliveriesQuery, ev.EventID, e.EventType(), payload, orgID)
+		}
+		if err != nil {
+			tx.Rollback() // Rollback in case of error
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM orgs WHERE org_id = $1", orgID)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return false, err
+	}
+
+	// Commit the transaction
+	return true, tx.Commit()
+}
+
+// SoftDeleteUser marks a user as deleted and signs them out everywhere. The user is kept
+// until purged so the deletion can be undone during the grace period. Users who are the sole
+// owner of organisations are not deleted; the organisations are returned instead.
+func (ups *UzorgPgStorer) SoftDeleteUser(userID string, ev *AuditEvent) ([]*Org, error) {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// lock the organisations the user owns, so co-owners deleting their accounts at
+	// the same time wait for each other and cannot leave an organisation without owner
+	_, err = tx.Exec(
+		"SELECT 1 FROM orgs WHERE org_id IN (SELECT org_id FROM org_users WHERE user_id = $1 AND role = $2) ORDER BY org_id FOR UPDATE",
+		userID, RoleOwner,
+	)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return nil, err
+	}
+
+	orgs, err := querySoleOwnedOrgs(tx, userID)
+	if err != nil || len(orgs) > 0 {
+		tx.Rollback()
+		return orgs, err
+	}
+
+	_, err = tx.Exec("UPDATE users SET deleted_at = NOW() WHERE user_id = $1 AND deleted_at IS NULL", userID)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return nil, err
+	}
+
+	if err = insertAuditEvent(tx, ev); err != nil {
+		tx.Rollback() // Rollback in case of error
+		return nil, err
+	}
+
+	// Commit the transaction
+	return nil, tx.Commit()
+}
+
+// RestoreUser undoes the soft deletion of a user deleted after deletedAfter, the start of the
+// grace period. It reports whether the user was restored; false means the grace period has ended.
+func (ups *UzorgPgStorer) RestoreUser(userID string, deletedAfter time.Time, ev *AuditEvent) (bool, error) {
+	res, err := ups.execAudited(ev, "UPDATE users SET deleted_at = NULL WHERE user_id = $1 AND deleted_at >= $2", userID, deletedAfter)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// PurgeDeletedUsers permanently deletes users that were soft deleted before the given time
+// and returns how many were purged
+func (ups *UzorgPgStorer) PurgeDeletedUsers(deletedBefore time.Time) (int64, error) {
+	res, err := ups.db.Exec("DELETE FROM users WHERE deleted_at < $1", deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CountUserExportRecords counts the records a data export of a user would contain, without reading them
+func (ups *UzorgPgStorer) CountUserExportRecords(userID string) (int, error) {
+	var records int
+	err := ups.db.QueryRow(
+		`SELECT 1
+			+ (SELECT COUNT(*) FROM org_users WHERE user_id = $1)
+			+ (SELECT COUNT(*) FROM sessions WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW())
+			+ (SELECT COUNT(*) FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL)
+			+ (SELECT COUNT(*) FROM audit_events WHERE actor_id = $1 OR (target_type = 'user' AND target_id = $1::text))`,
+		userID,
+	).Scan(&records)
+	return records, err
+}
+
+// GetActiveDataExport retrieves the latest data export of a user that is pending or running.
+// It returns sql.ErrNoRows when the user has none.
+func (ups *UzorgPgStorer) GetActiveDataExport(userID string) (DataExport, error) {
+	var e DataExport
+	err := ups.db.QueryRow(
+		"SELECT export_id, user_id, status, created_at FROM data_exports WHERE user_id = $1 AND status IN ('pending', 'running') ORDER BY created_at DESC LIMIT 1",
+		userID,
+	).Scan(&e.ExportID, &e.UserID, &e.Status, &e.CreatedAt)
+	return e, err
+}
+
+// InsertDataExport queues a data export
+func (ups *UzorgPgStorer) InsertDataExport(e *DataExport) error {
+	return ups.db.QueryRow(
+		"INSERT INTO data_exports (export_id, user_id, status) VALUES ($1, $2, $3) RETURNING created_at",
+		e.ExportID,
+		e.UserID,
+		e.Status,
+	).Scan(&e.CreatedAt)
+}
+
+// ClaimDataExport marks the oldest pending data export as running, hides it from other workers
+// until leaseUntil and returns it. Running exports whose lease ran out, because their worker died,
+// are claimed again. It returns sql.ErrNoRows when no export is pending.
+func (ups *UzorgPgStorer) ClaimDataExport(leaseUntil time.Time) (DataExport, error) {
+	var e DataExport
+	err := ups.db.QueryRow(
+		`UPDATE data_exports SET status = 'running', lease_until = $1 WHERE export_id = (
+			SELECT export_id FROM data_exports
+			WHERE status = 'pending' OR (status = 'running' AND (lease_until IS NULL OR lease_until < NOW()))
+			ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED
+		) RETURNING export_id, user_id, status, created_at`,
+		leaseUntil,
+	).Scan(&e.ExportID, &e.UserID, &e.Status, &e.CreatedAt)
+	return e, err
+}
+
+// CompleteDataExport stores the archive of a finished data export
+func (ups *UzorgPgStorer) CompleteDataExport(exportID string, archive []byte) error {
+	_, err := ups.db.Exec(
+		"UPDATE data_exports SET status = 'completed', archive = $1, completed_at = NOW(), lease_until = NULL WHERE export_id = $2",
+		archive, exportID,
+	)
+	return err
+}
+
+// FailDataExport records why a data export could not be generated
+func (ups *UzorgPgStorer) FailDataExport(exportID, message string) error {
+	_, err := ups.db.Exec(
+		"UPDATE data_exports SET status = 'failed', error = $1, completed_at = NOW(), lease_until = NULL WHERE export_id = $2",
+		message, exportID,
+	)
+	return err
+}
+
+// GetDataExport retrieves the status of one of a user's data exports
+func (ups *UzorgPgStorer) GetDataExport(userID, exportID string) (DataExport, error) {
+	var e DataExport
+	err := ups.db.QueryRow(
+		"SELECT export_id, user_id, status, COALESCE(error, ''), created_at, completed_at FROM data_exports WHERE export_id = $1 AND user_id = $2",
+		exportID, userID,
+	).Scan(&e.ExportID, &e.UserID, &e.Status, &e.Error, &e.CreatedAt, &e.CompletedAt)
+	return e, err
+}
+
+// GetDataExportArchive retrieves the archive of one of a user's completed data exports
+func (ups *UzorgPgStorer) GetDataExportArchive(userID, exportID string) ([]byte, error) {
+	var archive []byte
+	err := ups.db.QueryRow(
+		"SELECT archive FROM data_exports WHERE export_id = $1 AND user_id = $2 AND status = 'completed'",
+		exportID, userID,
+	).Scan(&archive)
+	return archive, err
+}
+
+// PurgeFinishedDataExports deletes the data exports, and their archives, that completed or failed
+// before the given time and returns how many were purged
+func (ups *UzorgPgStorer) PurgeFinishedDataExports(finishedBefore time.Time) (int64, error) {
+	res, err := ups.db.Exec("DELETE FROM data_exports WHERE status IN ('completed', 'failed') AND completed_at < $1", finishedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// insertAuditEvent records an audit event in the transaction of the change it describes, along
+// with the domain event it raises in the outbox. A nil event records nothing.
+func insertAuditEvent(tx *sql.Tx, ev *AuditEvent) error {
+	if ev == nil {
+		return nil
+	}
+	if ev.EventID == "" {
+		ev.EventID = uuid.New().String()
+	}
+	err := tx.QueryRow(
+		"INSERT INTO audit_events (event_id, org_id, actor_id, actor_type, action, target_type, target_id, ip_address, request_id) VALUES ($1, NULLIF($2, '')::uuid, NULLIF($3, '')::uuid, NULLIF($4, ''), $5, $6, $7, $8, $9) RETURNING created_at",
+		ev.EventID,
+		ev.OrgID,
+		ev.ActorID,
+		ev.ActorType,
+		ev.Action,
+		ev.TargetType,
+		ev.TargetID,
+		ev.IPAddress,
+		ev.RequestID,
+	).Scan(&ev.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	e := domainEventFromAudit(ev)
+	if e == nil {
+		return nil
+	}
+	return insertOutboxEvent(tx, e)
+}
+
+// insertOutboxEvent adds a domain event to the outbox in the transaction of the change that raised it.
+// Dispatchers are notified of it once the transaction commits.
+func insertOutboxEvent(tx *sql.Tx, e DomainEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	meta := e.Meta()
+	_, err = tx.Exec(
+		"INSERT INTO outbox_events (event_id, type, org_id, actor_id, payload, occurred_at) VALUES ($1, $2, NULLIF($3, '')::uuid, NULLIF($4, '')::uuid, $5, $6)",
+		meta.EventID,
+		e.EventType(),
+		meta.OrgID,
+		meta.ActorID,
+		payload,
+		meta.OccurredAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("SELECT pg_notify($1, $2)", outboxChannel, meta.EventID)
+	return err
+}
+
+// execAudited runs a single statement and, if it changed any rows, records ev in the same transaction
+func (ups *UzorgPgStorer) execAudited(ev *AuditEvent, query string, args ...interface{}) (sql.Result, error) {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n > 0 {
+		err = insertAuditEvent(tx, ev)
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return nil, err
+	}
+
+	// Commit the transaction
+	return res, tx.Commit()
+}
+
+// GetOrgAuditEvents retrieves the audit events of an organisation matching filter, newest first
+func (ups *UzorgPgStorer) GetOrgAuditEvents(orgID string, filter AuditEventFilter) ([]*AuditEvent, error) {
+	query := "SELECT event_id, COALESCE(org_id::text, ''), COALESCE(actor_id::text, ''), COALESCE(actor_type, ''), action, target_type, target_id, COALESCE(ip_address, ''), COALESCE(request_id, ''), created_at FROM audit_events WHERE org_id = $1"
+	args := []interface{}{orgID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.Action != "" {
+		query += " AND action = " + arg(filter.Action)
+	}
+	if filter.ActorID != "" {
+		query += " AND actor_id::text = " + arg(filter.ActorID)
+	}
+	if filter.TargetID != "" {
+		query += " AND target_id = " + arg(filter.TargetID)
+	}
+	if filter.Since != nil {
+		query += " AND created_at >= " + arg(*filter.Since)
+	}
+	if filter.Until != nil {
+		query += " AND created_at < " + arg(*filter.Until)
+	}
+	if filter.AfterCreatedAt != nil {
+		query += fmt.Sprintf(" AND (created_at, event_id) < (%s, %s::uuid)", arg(*filter.AfterCreatedAt), arg(filter.AfterEventID))
+	}
+	query += " ORDER BY created_at DESC, event_id DESC LIMIT " + arg(filter.Limit)
+
+	return ups.queryAuditEvents(query, args...)
+}
+
+// GetUserAuditEvents retrieves the audit events where a user is the actor or the target, oldest first.
+// The IP address and request ID belong to the actor, so they are blank on events of other actors.
+func (ups *UzorgPgStorer) GetUserAuditEvents(userID string) ([]*AuditEvent, error) {
+	return ups.queryAuditEvents(
+		`SELECT event_id, COALESCE(org_id::text, ''), COALESCE(actor_id::text, ''), COALESCE(actor_type, ''), action, target_type, target_id,
+			CASE WHEN actor_id = $1 THEN COALESCE(ip_address, '') ELSE '' END,
+			CASE WHEN actor_id = $1 THEN COALESCE(request_id, '') ELSE '' END,
+			created_at
+		FROM audit_events WHERE actor_id = $1 OR (target_type = 'user' AND target_id = $1::text) ORDER BY created_at`,
+		userID,
+	)
+}
+
+func (ups *UzorgPgStorer) queryAuditEvents(query string, args ...interface{}) ([]*AuditEvent, error) {
+	rows, err := ups.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		var ev AuditEvent
+		if err := rows.Scan(&ev.EventID, &ev.OrgID, &ev.ActorID, &ev.ActorType, &ev.Action, &ev.TargetType, &ev.TargetID, &ev.IPAddress, &ev.RequestID, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, &ev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// InsertWebhook subscribes a webhook to events of an organisation
+func (ups *UzorgPgStorer) InsertWebhook(wh *Webhook, ev *AuditEvent) error {
+	// Begin a transaction
+	tx, err := ups.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO webhooks (webhook_id, org_id, url, secret, events) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		wh.WebhookID,
+		wh.OrgID,
+		wh.URL,
+		wh.Secret,
+		pq.Array(wh.Events),
+	).Scan(&wh.CreatedAt)
+	if err == nil {
+		err = insertAuditEvent(tx, ev)
+	}
+	if err != nil {
+		tx.Rollback() // Rollback in case of error
+		return err
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// GetOrgWebhooks retrieves the webhooks of an organisation
+func (ups *UzorgPgStorer) GetOrgWebhooks(orgID string) ([]*Webhook, error) {
+	rows, err := ups.db.Query(
+		"SELECT webhook_id, org_id, url, secret, events, created_at FROM webhooks WHERE org_id = $1 ORDER BY created_at",
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []*Webhook
+	for rows.Next() {
+		var wh Webhook
+		if err := rows.Scan(&wh.WebhookID, &wh.OrgID, &wh.URL, &wh.Secret, pq.Array(&wh.Events), &wh.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &wh)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook of an organisation and its deliveries. It reports whether a webhook was deleted.
+func (ups *UzorgPgStorer) DeleteWebhook(orgID, webhookID string, ev *AuditEvent) (bool, error) {
+	res, err := ups.execAudited(
+		ev,
+		`WITH deliveries AS (
+			DELETE FROM webhook_deliveries WHERE webhook_id = $1 AND EXISTS (SELECT 1 FROM webhooks WHERE webhook_id = $1 AND org_id = $2)
+		) DELETE FROM webhooks WHERE webhook_id = $1 AND org_id = $2`,
+		webhookID, orgID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClaimWebhookDelivery takes the pending delivery that has been due the longest, counts an attempt
+// and hides it from other workers until leaseUntil. It returns sql.ErrNoRows when no delivery is due.
+func (ups *UzorgPgStorer) ClaimWebhookDelivery(leaseUntil time.Time) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := ups.db.QueryRow(
+		`UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = $1 WHERE delivery_id = (
+			SELECT delivery_id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at LIMIT 1 FOR UPDATE SKIP LOCKED
+		) RETURNING delivery_id, webhook_id, event_id, event_type, payload, status, attempts, created_at, url, secret`,
+		leaseUntil,
+	).Scan(&d.DeliveryID, &d.WebhookID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.CreatedAt, &d.URL, &d.Secret)
+	return d, err
+}
+
+// CompleteWebhookDelivery records that a delivery was accepted by its webhook
+func (ups *UzorgPgStorer) CompleteWebhookDelivery(deliveryID string, statusCode int) error {
+	_, err := ups.db.Exec(
+		"UPDATE webhook_deliveries SET status = 'delivered', last_status_code = $1, last_error = NULL, next_attempt_at = NULL, delivered_at = NOW() WHERE delivery_id = $2",
+		statusCode, deliveryID,
+	)
+	return err
+}
+
+// FailWebhookDelivery records a failed attempt of a delivery and when to retry it. A nil
+// retryAt moves the delivery to the dead letter state. A zero statusCode means no response was received.
+func (ups *UzorgPgStorer) FailWebhookDelivery(deliveryID string, statusCode int, message string, retryAt *time.Time) error {
+	status := WebhookDeliveryPending
+	if retryAt == nil {
+		status = WebhookDeliveryDead
+	}
+	_, err := ups.db.Exec(
+		"UPDATE webhook_deliveries SET status = $1, last_status_code = NULLIF($2, 0), last_error = $3, next_attempt_at = $4 WHERE delivery_id = $5",
+		status, statusCode, message, retryAt, deliveryID,
+	)
+	return err
+}
+
+// GetWebhookDeliveries retrieves the most recent deliveries of a webhook of an organisation, newest first
+func (ups *UzorgPgStorer) GetWebhookDeliveries(orgID, webhookID string, limit int) ([]*WebhookDelivery, error) {
+	rows, err := ups.db.Query(
+		`SELECT d.delivery_id, d.webhook_id, d.event_id, d.event_type, d.status, d.attempts, d.next_attempt_at, d.last_status_code, COALESCE(d.last_error, ''), d.created_at, d.delivered_at
+		FROM webhook_deliveries d INNER JOIN webhooks wh ON d.webhook_id = wh.webhook_id
+		WHERE d.webhook_id = $1 AND wh.org_id = $2 ORDER BY d.created_at DESC LIMIT $3`,
+		webhookID, orgID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.DeliveryID, &d.WebhookID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// EnqueueWebhookDeliveries queues an event for delivery to the webhooks of an organisation subscribed to
+// its type. Webhooks the event is already queued for are skipped.
+func (ups *UzorgPgStorer) EnqueueWebhookDeliveries(orgID, eventID, eventType string, payload []byte) error {
+	_, err := ups.db.Exec(enqueueWebhookDeliveriesQuery, eventID, eventType, payload, orgID)
+	return err
+}
+
+const enqueueWebhookDeliveriesQuery = `INSERT INTO webhook_deliveries (delivery_id, webhook_id, event_id, event_type, payload, url, secret)
+	SELECT gen_random_uuid(), webhook_id, $1, $2, $3, url, secret FROM webhooks WHERE org_id = $4 AND $2 = ANY(events)
+	ON CONFLICT (webhook_id, event_id) DO NOTHING`
+
+// PurgeOrphanedWebhookDeliveries deletes the finished deliveries of webhooks deleted with their organisation
+func (ups *UzorgPgStorer) PurgeOrphanedWebhookDeliveries() (int64, error) {
+	res, err := ups.db.Exec(
+		"DELETE FROM webhook_deliveries d WHERE status <> 'pending' AND NOT EXISTS (SELECT 1 FROM webhooks wh WHERE wh.webhook_id = d.webhook_id)",
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PurgeDeliveredWebhookDeliveries deletes the deliveries that were delivered before the given time
+// and returns how many were purged. Dead deliveries are kept for inspection.
+func (ups *UzorgPgStorer) PurgeDeliveredWebhookDeliveries(deliveredBefore time.Time) (int64, error) {
+	res, err := ups.db.Exec("DELETE FROM webhook_deliveries WHERE status = 'delivered' AND delivered_at < $1", deliveredBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ClaimOutboxEvent takes the undispatched event of the outbox that has been due the longest, counts an
+// attempt and hides it from other dispatchers until leaseUntil. It returns sql.ErrNoRows when no event is due.
+func (ups *UzorgPgStorer) ClaimOutboxEvent(leaseUntil time.Time) (OutboxEvent, error) {
+	var o OutboxEvent
+	err := ups.db.QueryRow(
+		`UPDATE outbox_events SET attempts = attempts + 1, next_attempt_at = $1 WHERE event_id = (
+			SELECT event_id FROM outbox_events WHERE dispatched_at IS NULL AND dead_at IS NULL AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at LIMIT 1 FOR UPDATE SKIP LOCKED
+		) RETURNING event_id, type, COALESCE(org_id::text, ''), COALESCE(actor_id::text, ''), payload, attempts, occurred_at,
+			ARRAY(SELECT subscriber FROM outbox_handled WHERE outbox_handled.event_id = outbox_events.event_id)`,
+		leaseUntil,
+	).Scan(&o.EventID, &o.Type, &o.OrgID, &o.ActorID, &o.Payload, &o.Attempts, &o.OccurredAt, pq.Array(&o.Handled))
+	return o, err
+}
+
+// MarkOutboxEventHandled records that a subscriber handled an event so it is not handed the event again
+func (ups *UzorgPgStorer) MarkOutboxEventHandled(eventID, subscriber string) error {
+	_, err := ups.db.Exec(
+		"INSERT INTO outbox_handled (event_id, subscriber) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		eventID, subscriber,
+	)
+	return err
+}
+
+// CompleteOutboxEvent records that an event was dispatched to all its subscribers, or could not be
+// dispatched at all for the reason in message
+func (ups *UzorgPgStorer) CompleteOutboxEvent(eventID, message string) error {
+	_, err := ups.db.Exec(
+		"UPDATE outbox_events SET dispatched_at = NOW(), last_error = NULLIF($1, '') WHERE event_id = $2",
+		message, eventID,
+	)
+	return err
+}
+
+// FailOutboxEvent records why some subscribers failed to handle an event and when to retry it.
+// A nil retryAt moves the event to the dead letter state, where it is no longer claimed.
+func (ups *UzorgPgStorer) FailOutboxEvent(eventID, message string, retryAt *time.Time) error {
+	_, err := ups.db.Exec(
+		`UPDATE outbox_events SET last_error = $1, next_attempt_at = COALESCE($2::timestamptz, next_attempt_at),
+			dead_at = CASE WHEN $2::timestamptz IS NULL THEN NOW() END
+		WHERE event_id = $3`,
+		message, retryAt, eventID,
+	)
+	return err
+}
+
+// PurgeDispatchedOutboxEvents deletes the events of the outbox that were dispatched before the given
+// time and returns how many were purged. Dead lettered events are kept for inspection.
+func (ups *UzorgPgStorer) PurgeDispatchedOutboxEvents(dispatchedBefore time.Time) (int64, error) {
+	res, err := ups.db.Exec("DELETE FROM outbox_events WHERE dispatched_at < $1", dispatchedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ReserveIdempotencyKey records that a request with an idempotency key is being processed. When the
+// user already used the key it returns the request recorded for it instead and false, unless that
+// one expired or was abandoned past lockedUntil by a server that stopped processing it.
+func (ups *UzorgPgStorer) ReserveIdempotencyKey(k *IdempotencyKey, lockedUntil time.Time) (IdempotencyKey, bool, error) {
+	var userID string
+	err := ups.db.QueryRow(
+		`INSERT INTO idempotency_keys (user_id, key, fingerprint, locked_until, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, key) DO UPDATE SET
+			fingerprint = EXCLUDED.fingerprint, locked_until = EXCLUDED.locked_until, expires_at = EXCLUDED.expires_at,
+			status_code = NULL, header = NULL, body = NULL, completed_at = NULL
+		WHERE idempotency_keys.expires_at < NOW()
+			OR (idempotency_keys.completed_at IS NULL AND idempotency_keys.locked_until < NOW())
+		RETURNING user_id`,
+		k.UserID, k.Key, k.Fingerprint, lockedUntil, k.ExpiresAt,
+	).Scan(&userID)
+	if err == nil {
+		return *k, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return IdempotencyKey{}, false, err
+	}
+
+	existing := IdempotencyKey{UserID: k.UserID, Key: k.Key}
+	var header []byte
+	err = ups.db.QueryRow(
+		"SELECT fingerprint, COALESCE(status_code, 0), header, body, completed_at IS NOT NULL, expires_at FROM idempotency_keys WHERE user_id = $1 AND key = $2",
+		k.UserID, k.Key,
+	).Scan(&existing.Fingerprint, &existing.StatusCode, &header, &existing.Body, &existing.Completed, &existing.ExpiresAt)
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+	if header != nil {
+		if err := json.Unmarshal(header, &existing.Header); err != nil {
+			return IdempotencyKey{}, false, err
+		}
+	}
+	return existing, false, nil
+}
+
+// CompleteIdempotencyKey records the response to a reserved request
+func (ups *UzorgPgStorer) CompleteIdempotencyKey(k *IdempotencyKey) error {
+	header, err := json.Marshal(k.Header)
+	if err != nil {
+		return err
+	}
+	_, err = ups.db.Exec(
+		"UPDATE idempotency_keys SET status_code = $1, header = $2, body = $3, completed_at = NOW() WHERE user_id = $4 AND key = $5",
+		k.StatusCode, header, k.Body, k.UserID, k.Key,
+	)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a reserved request that failed so it can be retried with the same key
+func (ups *UzorgPgStorer) ReleaseIdempotencyKey(userID, key string) error {
+	_, err := ups.db.Exec(
+		"DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND completed_at IS NULL",
+		userID, key,
+	)
+	return err
+}
+
+// PurgeExpiredIdempotencyKeys deletes the requests whose keys expired
+func (ups *UzorgPgStorer) PurgeExpiredIdempotencyKeys() (int64, error) {
+	res, err := ups.db.Exec("DELETE FROM idempotency_keys WHERE expires_at < NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,309 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: uzorg/v1/organisations.proto
+
+package uzorgv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	OrganisationService_ListOrganisations_FullMethodName  = "/uzorg.v1.OrganisationService/ListOrganisations"
+	OrganisationService_GetOrganisation_FullMethodName    = "/uzorg.v1.OrganisationService/GetOrganisation"
+	OrganisationService_CreateOrganisation_FullMethodName = "/uzorg.v1.OrganisationService/CreateOrganisation"
+	OrganisationService_DeleteOrganisation_FullMethodName = "/uzorg.v1.OrganisationService/DeleteOrganisation"
+	OrganisationService_ListMembers_FullMethodName        = "/uzorg.v1.OrganisationService/ListMembers"
+	OrganisationService_AddMember_FullMethodName          = "/uzorg.v1.OrganisationService/AddMember"
+)
+
+// OrganisationServiceClient is the client API for OrganisationService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type OrganisationServiceClient interface {
+	// List the caller's organisations. Needs the orgs:read scope.
+	ListOrganisations(ctx context.Context, in *ListOrganisationsRequest, opts ...grpc.CallOption) (*ListOrganisationsResponse, error)
+	// Retrieve an organisation of the caller. Needs the orgs:read scope.
+	GetOrganisation(ctx context.Context, in *GetOrganisationRequest, opts ...grpc.CallOption) (*Organisation, error)
+	// Create an organisation owned by the caller. Needs the orgs:write scope.
+	CreateOrganisation(ctx context.Context, in *CreateOrganisationRequest, opts ...grpc.CallOption) (*Organisation, error)
+	// Delete an organisation the caller owns. Needs the orgs:write scope and the ETag of the
+	// organisation in if-match metadata.
+	DeleteOrganisation(ctx context.Context, in *DeleteOrganisationRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// List the members of an organisation of the caller. Needs the members:read scope.
+	ListMembers(ctx context.Context, in *ListMembersRequest, opts ...grpc.CallOption) (*ListMembersResponse, error)
+	// Add a user to an organisation of the caller. Needs the members:write scope.
+	AddMember(ctx context.Context, in *AddMemberRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+}
+
+type organisationServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOrganisationServiceClient(cc grpc.ClientConnInterface) OrganisationServiceClient {
+	return &organisationServiceClient{cc}
+}
+
+func (c *organisationServiceClient) ListOrganisations(ctx context.Context, in *ListOrganisationsRequest, opts ...grpc.CallOption) (*ListOrganisationsResponse, error) {
+	out := new(ListOrganisationsResponse)
+	err := c.cc.Invoke(ctx, OrganisationService_ListOrganisations_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *organisationServiceClient) GetOrganisation(ctx context.Context, in *GetOrganisationRequest, opts ...grpc.CallOption) (*Organisation, error) {
+	out := new(Organisation)
+	err := c.cc.Invoke(ctx, OrganisationService_GetOrganisation_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *organisationServiceClient) CreateOrganisation(ctx context.Context, in *CreateOrganisationRequest, opts ...grpc.CallOption) (*Organisation, error) {
+	out := new(Organisation)
+	err := c.cc.Invoke(ctx, OrganisationService_CreateOrganisation_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *organisationServiceClient) DeleteOrganisation(ctx context.Context, in *DeleteOrganisationRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, OrganisationService_DeleteOrganisation_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *organisationServiceClient) ListMembers(ctx context.Context, in *ListMembersRequest, opts ...grpc.CallOption) (*ListMembersResponse, error) {
+	out := new(ListMembersResponse)
+	err := c.cc.Invoke(ctx, OrganisationService_ListMembers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *organisationServiceClient) AddMember(ctx context.Context, in *AddMemberRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, OrganisationService_AddMember_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OrganisationServiceServer is the server API for OrganisationService service.
+// All implementations must embed UnimplementedOrganisationServiceServer
+// for forward compatibility
+type OrganisationServiceServer interface {
+	// List the caller's organisations. Needs the orgs:read scope.
+	ListOrganisations(context.Context, *ListOrganisationsRequest) (*ListOrganisationsResponse, error)
+	// Retrieve an organisation of the caller. Needs the orgs:read scope.
+	GetOrganisation(context.Context, *GetOrganisationRequest) (*Organisation, error)
+	// Create an organisation owned by the caller. Needs the orgs:write scope.
+	CreateOrganisation(context.Context, *CreateOrganisationRequest) (*Organisation, error)
+	// Delete an organisation the caller owns. Needs the orgs:write scope and the ETag of the
+	// organisation in if-match metadata.
+	DeleteOrganisation(context.Context, *DeleteOrganisationRequest) (*emptypb.Empty, error)
+	// List the members of an organisation of the caller. Needs the members:read scope.
+	ListMembers(context.Context, *ListMembersRequest) (*ListMembersResponse, error)
+	// Add a user to an organisation of the caller. Needs the members:write scope.
+	AddMember(context.Context, *AddMemberRequest) (*emptypb.Empty, error)
+	mustEmbedUnimplementedOrganisationServiceServer()
+}
+
+// UnimplementedOrganisationServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedOrganisationServiceServer struct {
+}
+
+func (UnimplementedOrganisationServiceServer) ListOrganisations(context.Context, *ListOrganisationsRequest) (*ListOrganisationsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListOrganisations not implemented")
+}
+func (UnimplementedOrganisationServiceServer) GetOrganisation(context.Context, *GetOrganisationRequest) (*Organisation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOrganisation not implemented")
+}
+func (UnimplementedOrganisationServiceServer) CreateOrganisation(context.Context, *CreateOrganisationRequest) (*Organisation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateOrganisation not implemented")
+}
+func (UnimplementedOrganisationServiceServer) DeleteOrganisation(context.Context, *DeleteOrganisationRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteOrganisation not implemented")
+}
+func (UnimplementedOrganisationServiceServer) ListMembers(context.Context, *ListMembersRequest) (*ListMembersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMembers not implemented")
+}
+func (UnimplementedOrganisationServiceServer) AddMember(context.Context, *AddMemberRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddMember not implemented")
+}
+func (UnimplementedOrganisationServiceServer) mustEmbedUnimplementedOrganisationServiceServer() {}
+
+// UnsafeOrganisationServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OrganisationServiceServer will
+// result in compilation errors.
+type UnsafeOrganisationServiceServer interface {
+	mustEmbedUnimplementedOrganisationServiceServer()
+}
+
+func RegisterOrganisationServiceServer(s grpc.ServiceRegistrar, srv OrganisationServiceServer) {
+	s.RegisterService(&OrganisationService_ServiceDesc, srv)
+}
+
+func _OrganisationService_ListOrganisations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListOrganisationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganisationServiceServer).ListOrganisations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganisationService_ListOrganisations_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganisationServiceServer).ListOrganisations(ctx, req.(*ListOrganisationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrganisationService_GetOrganisation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetOrganisationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganisationServiceServer).GetOrganisation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganisationService_GetOrganisation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganisationServiceServer).GetOrganisation(ctx, req.(*GetOrganisationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrganisationService_CreateOrganisation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateOrganisationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganisationServiceServer).CreateOrganisation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganisationService_CreateOrganisation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganisationServiceServer).CreateOrganisation(ctx, req.(*CreateOrganisationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrganisationService_DeleteOrganisation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteOrganisationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganisationServiceServer).DeleteOrganisation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganisationService_DeleteOrganisation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganisationServiceServer).DeleteOrganisation(ctx, req.(*DeleteOrganisationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrganisationService_ListMembers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListMembersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganisationServiceServer).ListMembers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganisationService_ListMembers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganisationServiceServer).ListMembers(ctx, req.(*ListMembersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrganisationService_AddMember_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddMemberRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrganisationServiceServer).AddMember(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrganisationService_AddMember_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrganisationServiceServer).AddMember(ctx, req.(*AddMemberRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// OrganisationService_ServiceDesc is the grpc.ServiceDesc for OrganisationService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OrganisationService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "uzorg.v1.OrganisationService",
+	HandlerType: (*OrganisationServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListOrganisations",
+			Handler:    _OrganisationService_ListOrganisations_Handler,
+		},
+		{
+			MethodName: "GetOrganisation",
+			Handler:    _OrganisationService_GetOrganisation_Handler,
+		},
+		{
+			MethodName: "CreateOrganisation",
+			Handler:    _OrganisationService_CreateOrganisation_Handler,
+		},
+		{
+			MethodName: "DeleteOrganisation",
+			Handler:    _OrganisationService_DeleteOrganisation_Handler,
+		},
+		{
+			MethodName: "ListMembers",
+			Handler:    _OrganisationService_ListMembers_Handler,
+		},
+		{
+			MethodName: "AddMember",
+			Handler:    _OrganisationService_AddMember_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "uzorg/v1/organisations.proto",
+}
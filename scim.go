@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// SCIM 2.0 lets the identity provider of an organisation provision its members. A SCIM token
+// belongs to one organisation: its Users are the members of the organisation and its only
+// Group is the organisation itself.
+const (
+	scimPrefix      = "/scim/v2"
+	scimContentType = "application/scim+json"
+	// scimMaxResults is the most resources a list returns
+	scimMaxResults = 200
+
+	scimUserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema         = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema       = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimSchemaSchema       = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	scimResourceTypeSchema = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+// writeSCIMResponse writes a SCIM resource or message
+func writeSCIMResponse(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeSCIMError writes a SCIM error. scimType is one of the error types of RFC 7644 or empty.
+func writeSCIMError(w http.ResponseWriter, statusCode int, scimType, detail string) {
+	writeSCIMResponse(w, statusCode, SCIMError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(statusCode),
+		SCIMType: scimType,
+		Detail:   detail,
+	})
+}
+
+// SCIMAuthMiddleware authenticates SCIM requests with a SCIM token and puts the organisation
+// the token belongs to in the context as scimOrgId, and the token as scimTokenId to record it
+// as the actor of audit events
+func (h *ReqHandler) SCIMAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(tokenString, scimTokenPrefix) {
+			writeSCIMError(w, http.StatusUnauthorized, "", "A SCIM token is required")
+			return
+		}
+
+		token, err := h.uzorgStore.UseSCIMToken(hashAPIKey(tokenString))
+		if err != nil {
+			log.Printf("SCIM token lookup error: %v", err)
+			writeSCIMError(w, http.StatusUnauthorized, "", "Invalid SCIM token")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "scimOrgId", token.OrgID)
+		ctx = context.WithValue(ctx, "scimTokenId", token.TokenID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func scimUserFromUser(u *User) *SCIMUser {
+	active := true
+	su := &SCIMUser{
+		Schemas:  []string{scimUserSchema},
+		ID:       u.UserID,
+		UserName: u.Email,
+		Name: &SCIMName{
+			Formatted:  strings.TrimSpace(u.FirstName + " " + u.LastName),
+			GivenName:  u.FirstName,
+			FamilyName: u.LastName,
+		},
+		DisplayName: strings.TrimSpace(u.FirstName + " " + u.LastName),
+		Emails:      []SCIMMultiValue{{Value: u.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &SCIMMeta{
+			ResourceType: "User",
+			Location:     publicURL(scimPrefix + "/Users/" + u.UserID),
+		},
+	}
+	if u.Phone != "" {
+		su.PhoneNumbers = []SCIMMultiValue{{Value: u.Phone, Type: "work"}}
+	}
+	return su
+}
+
+func scimGroupFromOrg(org *Org, users []*User) *SCIMGroup {
+	g := &SCIMGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          org.OrgID,
+		DisplayName: org.Name,
+		Members:     []SCIMMultiValue{},
+		Meta: &SCIMMeta{
+			ResourceType: "Group",
+			Location:     publicURL(scimPrefix + "/Groups/" + org.OrgID),
+		},
+	}
+	for _, u := range users {
+		g.Members = append(g.Members, SCIMMultiValue{
+			Value:   u.UserID,
+			Display: u.Email,
+			Ref:     publicURL(scimPrefix + "/Users/" + u.UserID),
+		})
+	}
+	return g
+}
+
+// scimUserAttributes are the values of a user that filters compare, by lower case attribute path
+func scimUserAttributes(su *SCIMUser) map[string][]string {
+	attrs := map[string][]string{
+		"id":              {su.ID},
+		"username":        {su.UserName},
+		"displayname":     {su.DisplayName},
+		"name.givenname":  {su.Name.GivenName},
+		"name.familyname": {su.Name.FamilyName},
+		"name.formatted":  {su.Name.Formatted},
+		"active":          {strconv.FormatBool(*su.Active)},
+	}
+	for _, e := range su.Emails {
+		attrs["emails"] = append(attrs["emails"], e.Value)
+		attrs["emails.value"] = append(attrs["emails.value"], e.Value)
+	}
+	for _, p := range su.PhoneNumbers {
+		attrs["phonenumbers"] = append(attrs["phonenumbers"], p.Value)
+		attrs["phonenumbers.value"] = append(attrs["phonenumbers.value"], p.Value)
+	}
+	return attrs
+}
+
+// scimGroupAttributes are the values of a group that filters compare, by lower case attribute path
+func scimGroupAttributes(g *SCIMGroup) map[string][]string {
+	attrs := map[string][]string{
+		"id":          {g.ID},
+		"displayname": {g.DisplayName},
+	}
+	for _, m := range g.Members {
+		attrs["members"] = append(attrs["members"], m.Value)
+		attrs["members.value"] = append(attrs["members.value"], m.Value)
+	}
+	return attrs
+}
+
+// scimFilterTerm compares an attribute with a value, like userName eq "ann@example.com"
+type scimFilterTerm struct {
+	attr  string
+	op    string
+	value string
+}
+
+// scimFilter matches resources for which all terms of any of its groups match, as "and" binds
+// closer than "or". Parentheses, not and value paths like emails[type eq "work"] are not
+// supported; identity providers look resources up with single terms.
+type scimFilter [][]scimFilterTerm
+
+// parseSCIMFilter parses the filter query parameter of a list request
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	var tokens []string
+	var quoted []bool
+	for rest := strings.TrimSpace(filter); rest != ""; rest = strings.TrimSpace(rest) {
+		if rest[0] == '"' {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, errors.New("unterminated string")
+			}
+			var value string
+			if err := json.Unmarshal([]byte(rest[:end+1]), &value); err != nil {
+				return nil, fmt.Errorf("invalid string %s", rest[:end+1])
+			}
+			tokens, quoted = append(tokens, value), append(quoted, true)
+			rest = rest[end+1:]
+			continue
+		}
+		token, after, _ := strings.Cut(rest, " ")
+		if strings.ContainsAny(token, "()[]") {
+			return nil, errors.New("grouping and value paths are not supported")
+		}
+		tokens, quoted = append(tokens, token), append(quoted, false)
+		rest = after
+	}
+
+	f := scimFilter{nil}
+	for i := 0; i < len(tokens); {
+		if quoted[i] || i+1 == len(tokens) {
+			return nil, errors.New("expected an attribute and an operator")
+		}
+		term := scimFilterTerm{attr: strings.ToLower(tokens[i]), op: strings.ToLower(tokens[i+1])}
+		// attributes may be qualified by the URN of their schema
+		if strings.HasPrefix(term.attr, "urn:") {
+			term.attr = term.attr[strings.LastIndex(term.attr, ":")+1:]
+		}
+		i += 2
+		switch term.op {
+		case "pr":
+		case "eq", "ne", "co", "sw", "ew":
+			if i == len(tokens) {
+				return nil, fmt.Errorf("%s needs a value", term.op)
+			}
+			term.value = tokens[i]
+			i++
+		default:
+			return nil, fmt.Errorf("operator %q is not supported", term.op)
+		}
+		f[len(f)-1] = append(f[len(f)-1], term)
+
+		if i == len(tokens) {
+			break
+		}
+		switch strings.ToLower(tokens[i]) {
+		case "and":
+		case "or":
+			f = append(f, nil)
+		default:
+			return nil, fmt.Errorf("expected and or or, got %q", tokens[i])
+		}
+		i++
+		if i == len(tokens) {
+			return nil, errors.New("filter ends with a logical operator")
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether a resource with the given attributes matches the filter. Values
+// are compared case-insensitively.
+func (f scimFilter) matches(attrs map[string][]string) bool {
+	for _, group := range f {
+		all := true
+		for _, term := range group {
+			if !term.matches(attrs[term.attr]) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+func (t scimFilterTerm) matches(values []string) bool {
+	if t.op == "ne" {
+		return !scimFilterTerm{attr: t.attr, op: "eq", value: t.value}.matches(values)
+	}
+	want := strings.ToLower(t.value)
+	for _, v := range values {
+		v = strings.ToLower(v)
+		switch {
+		case t.op == "pr" && v != "",
+			t.op == "eq" && v == want,
+			t.op == "co" && strings.Contains(v, want),
+			t.op == "sw" && strings.HasPrefix(v, want),
+			t.op == "ew" && strings.HasSuffix(v, want):
+			return true
+		}
+	}
+	return false
+}
+
+// writeSCIMList filters resources and writes the page startIndex and count ask for
+func writeSCIMList(w http.ResponseWriter, r *http.Request, resources []interface{}, attrs func(interface{}) map[string][]string) {
+	query := r.URL.Query()
+
+	if filter := query.Get("filter"); filter != "" {
+		f, err := parseSCIMFilter(filter)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidFilter", fmt.Sprintf("Invalid filter: %v", err))
+			return
+		}
+		var matched []interface{}
+		for _, res := range resources {
+			if f.matches(attrs(res)) {
+				matched = append(matched, res)
+			}
+		}
+		resources = matched
+	}
+
+	startIndex, count := 1, scimMaxResults
+	for name, target := range map[string]*int{"startIndex": &startIndex, "count": &count} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidValue", name+" must be an integer")
+				return
+			}
+			*target = n
+		}
+	}
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > scimMaxResults {
+		count = scimMaxResults
+	}
+
+	page := []interface{}{}
+	if startIndex <= len(resources) {
+		end := startIndex - 1 + count
+		if end > len(resources) {
+			end = len(resources)
+		}
+		page = append(page, resources[startIndex-1:end]...)
+	}
+
+	writeSCIMResponse(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+// scimMember retrieves a member of the organisation of a SCIM request. It returns nil when the
+// user doesn't exist or isn't a member.
+func (h *ReqHandler) scimMember(orgID, userID string) (*User, error) {
+	if _, err := uuid.Parse(userID); err != nil {
+		return nil, nil
+	}
+	if _, err := h.uzorgStore.GetMemberRole(orgID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	user, err := h.uzorgStore.GetUserByID(userID)
+	if err == sql.ErrNoRows || err == nil && user.DeletedAt != nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// decodeSCIM reads a SCIM request body, writing the error response when it isn't valid JSON
+func decodeSCIM(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", fmt.Sprintf("Error decoding request: %v", err))
+		return false
+	}
+	return true
+}
+
+// handler for GET /scim/v2/Users that lists the members of the organisation of the SCIM token
+func (h *ReqHandler) SCIMGetUsers(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	users, err := h.uzorgStore.GetOrgUsers(orgID)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting org users: %v", err))
+		return
+	}
+	// a stable order keeps pages from overlapping
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+
+	resources := make([]interface{}, 0, len(users))
+	for _, u := range users {
+		resources = append(resources, scimUserFromUser(u))
+	}
+	writeSCIMList(w, r, resources, func(res interface{}) map[string][]string {
+		return scimUserAttributes(res.(*SCIMUser))
+	})
+}
+
+// handler for GET /scim/v2/Users/{id} that retrieves a member of the organisation of the SCIM token
+func (h *ReqHandler) SCIMGetUser(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	user, err := h.scimMember(orgID, mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if user == nil {
+		writeSCIMError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	writeSCIMResponse(w, http.StatusOK, scimUserFromUser(user))
+}
+
+// handler for POST /scim/v2/Users that provisions a member of the organisation of the SCIM
+// token. userName is the email of the user. Users who already have an account are added to
+// the organisation; others are created without a password.
+func (h *ReqHandler) SCIMCreateUser(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	var su SCIMUser
+	if !decodeSCIM(w, r, &su) {
+		return
+	}
+
+	email := strings.TrimSpace(su.UserName)
+	if validator.New().Var(email, "required,email") != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "userName must be the email address of the user")
+		return
+	}
+	if su.Active != nil && !*su.Active {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "Only active users can be provisioned")
+		return
+	}
+
+	existing, err := h.uzorgStore.GetUserByEmail(email)
+	if err != nil && err != sql.ErrNoRows {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+
+	if err == nil {
+		if existing.DeletedAt != nil {
+			writeSCIMError(w, http.StatusConflict, "uniqueness", "The account with this userName is being deleted")
+			return
+		}
+		if _, err := h.uzorgStore.GetMemberRole(orgID, existing.UserID); err == nil {
+			writeSCIMError(w, http.StatusConflict, "uniqueness", "A member with this userName already exists")
+			return
+		} else if err != sql.ErrNoRows {
+			writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error checking membership: %v", err))
+			return
+		}
+
+		ev := newAuditEvent(r, AuditMemberAdded, "user", existing.UserID)
+		ev.OrgID = orgID
+		if err := h.uzorgStore.AddUserToOrg(existing.UserID, orgID, ev); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error adding user to org: %v", err))
+			return
+		}
+
+		writeSCIMResponse(w, http.StatusCreated, scimUserFromUser(&existing))
+		return
+	}
+
+	user := User{
+		UserID: uuid.New().String(),
+		Email:  email,
+	}
+	if su.Name != nil {
+		user.FirstName, user.LastName = su.Name.GivenName, su.Name.FamilyName
+	}
+	if len(su.PhoneNumbers) > 0 {
+		user.Phone = su.PhoneNumbers[0].Value
+		if validator.New().Var(user.Phone, "e164") != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "phoneNumbers must be in E.164 format")
+			return
+		}
+	}
+
+	ev := newAuditEvent(r, AuditUserRegistered, "user", user.UserID)
+	ev.OrgID = orgID
+	if err := h.uzorgStore.InsertUserIntoOrg(&user, orgID, ev); err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error creating user: %v", err))
+		return
+	}
+
+	writeSCIMResponse(w, http.StatusCreated, scimUserFromUser(&user))
+}
+
+// applySCIMUser makes a member look like su. userName can't change. Setting active to false
+// removes the user from the organisation, which it reports. The name and phone number only
+// change for users who belong to no other organisation, as the profile isn't the
+// organisation's alone; omitted phoneNumbers leave the phone number as it is.
+func (h *ReqHandler) applySCIMUser(w http.ResponseWriter, r *http.Request, orgID string, user *User, su *SCIMUser) (removed, ok bool) {
+	if su.UserName != "" && !strings.EqualFold(su.UserName, user.Email) {
+		writeSCIMError(w, http.StatusBadRequest, "mutability", "userName is the email of the user and can't be changed")
+		return false, false
+	}
+
+	if su.Active != nil && !*su.Active {
+		return true, h.removeSCIMUser(w, r, orgID, user)
+	}
+
+	changed := *user
+	if su.Name != nil {
+		changed.FirstName, changed.LastName = su.Name.GivenName, su.Name.FamilyName
+	}
+	if su.PhoneNumbers != nil {
+		changed.Phone = ""
+		if len(su.PhoneNumbers) > 0 {
+			changed.Phone = su.PhoneNumbers[0].Value
+		}
+		if validator.New().Var(changed.Phone, "omitempty,e164") != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "phoneNumbers must be in E.164 format")
+			return false, false
+		}
+	}
+	if changed == *user {
+		return false, true
+	}
+
+	orgs, err := h.uzorgStore.GetUserOrgs(user.UserID)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting user orgs: %v", err))
+		return false, false
+	}
+	if len(orgs) > 1 {
+		return false, true
+	}
+
+	ev := newAuditEvent(r, AuditUserUpdated, "user", user.UserID)
+	ev.OrgID = orgID
+	updated, err := h.uzorgStore.UpdateUser(&changed, user.Version, ev)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error updating user: %v", err))
+		return false, false
+	}
+	if !updated {
+		writeSCIMError(w, http.StatusConflict, "", "The user was modified concurrently, retry the request")
+		return false, false
+	}
+
+	*user = changed
+	return false, true
+}
+
+// removeSCIMUser removes a user from the organisation. Owners stay until they transfer ownership.
+func (h *ReqHandler) removeSCIMUser(w http.ResponseWriter, r *http.Request, orgID string, user *User) bool {
+	ev := newAuditEvent(r, AuditMemberRemoved, "user", "")
+	ev.OrgID = orgID
+	results, err := h.uzorgStore.RemoveUsersFromOrg(orgID, []MemberRef{{UserID: user.UserID}}, ev)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error removing user from org: %v", err))
+		return false
+	}
+	if len(results) == 1 && results[0].Status == BatchMemberOwner {
+		writeSCIMError(w, http.StatusConflict, "mutability", "Owners are removed after transferring ownership")
+		return false
+	}
+	return true
+}
+
+// handler for PUT /scim/v2/Users/{id} that replaces a member of the organisation of the SCIM token
+func (h *ReqHandler) SCIMReplaceUser(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	user, err := h.scimMember(orgID, mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if user == nil {
+		writeSCIMError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	var su SCIMUser
+	if !decodeSCIM(w, r, &su) {
+		return
+	}
+	if su.Name == nil {
+		su.Name = &SCIMName{}
+	}
+
+	h.writeAppliedSCIMUser(w, r, orgID, user, &su)
+}
+
+// handler for PATCH /scim/v2/Users/{id} that changes attributes of a member of the organisation
+// of the SCIM token. The operations can replace active, name, name.givenName, name.familyName
+// and phoneNumbers, or set several of them with a value without a path.
+func (h *ReqHandler) SCIMPatchUser(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	user, err := h.scimMember(orgID, mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if user == nil {
+		writeSCIMError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	var req SCIMPatchRequest
+	if !decodeSCIM(w, r, &req) {
+		return
+	}
+
+	su := scimUserFromUser(user)
+	for _, op := range req.Operations {
+		if err := patchSCIMUser(su, op); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidPath", err.Error())
+			return
+		}
+	}
+
+	h.writeAppliedSCIMUser(w, r, orgID, user, su)
+}
+
+// writeAppliedSCIMUser applies su to a member and writes the resulting user
+func (h *ReqHandler) writeAppliedSCIMUser(w http.ResponseWriter, r *http.Request, orgID string, user *User, su *SCIMUser) {
+	removed, ok := h.applySCIMUser(w, r, orgID, user, su)
+	if !ok {
+		return
+	}
+
+	resp := scimUserFromUser(user)
+	if removed {
+		*resp.Active = false
+	}
+	writeSCIMResponse(w, http.StatusOK, resp)
+}
+
+// patchSCIMUser applies a PATCH operation to a user
+func patchSCIMUser(su *SCIMUser, op SCIMPatchOperation) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return fmt.Errorf("op %q is not supported", op.Op)
+	}
+
+	path := strings.ToLower(op.Path)
+	if strings.HasPrefix(path, "urn:") {
+		path = path[strings.LastIndex(path, ":")+1:]
+	}
+	if kind == "remove" {
+		if path != "phonenumbers" {
+			return fmt.Errorf("%q can't be removed", op.Path)
+		}
+		su.PhoneNumbers = []SCIMMultiValue{}
+		return nil
+	}
+
+	if path == "" {
+		// the value holds the attributes to set, with values that may be strings like "False"
+		values, ok := op.Value.(map[string]interface{})
+		if !ok {
+			return errors.New("operations without a path need an object value")
+		}
+		for name, value := range values {
+			if err := patchSCIMUser(su, SCIMPatchOperation{Op: op.Op, Path: name, Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var target interface{}
+	switch path {
+	case "active":
+		if s, ok := op.Value.(string); ok {
+			active, err := strconv.ParseBool(s)
+			if err != nil {
+				return errors.New("active must be a boolean")
+			}
+			su.Active = &active
+			return nil
+		}
+		target = &su.Active
+	case "username":
+		target = &su.UserName
+	case "name":
+		target = su.Name
+	case "name.givenname":
+		target = &su.Name.GivenName
+	case "name.familyname":
+		target = &su.Name.FamilyName
+	case "phonenumbers":
+		target = &su.PhoneNumbers
+	case "name.formatted", "displayname", "emails", "externalid":
+		// derived from the other attributes or not stored
+		return nil
+	default:
+		return fmt.Errorf("path %q is not supported", op.Path)
+	}
+
+	raw, err := json.Marshal(op.Value)
+	if err == nil {
+		err = json.Unmarshal(raw, target)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %v", op.Path, err)
+	}
+	return nil
+}
+
+// handler for DELETE /scim/v2/Users/{id} that removes a member from the organisation of the
+// SCIM token. The account of the user is kept.
+func (h *ReqHandler) SCIMDeleteUser(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	user, err := h.scimMember(orgID, mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if user == nil {
+		writeSCIMError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	if !h.removeSCIMUser(w, r, orgID, user) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scimGroup retrieves the organisation of the SCIM token as a group
+func (h *ReqHandler) scimGroup(orgID string) (*SCIMGroup, []*User, error) {
+	org, err := h.uzorgStore.GetOrg(orgID)
+	if err != nil {
+		return nil, nil, err
+	}
+	users, err := h.uzorgStore.GetOrgUsers(orgID)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return scimGroupFromOrg(&org, users), users, nil
+}
+
+// handler for GET /scim/v2/Groups that lists the organisation of the SCIM token, the only group it can see
+func (h *ReqHandler) SCIMGetGroups(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	group, _, err := h.scimGroup(orgID)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting org: %v", err))
+		return
+	}
+	attrs := scimGroupAttributes(group)
+	if strings.Contains(strings.ToLower(r.URL.Query().Get("excludedAttributes")), "members") {
+		group.Members = nil
+	}
+
+	writeSCIMList(w, r, []interface{}{group}, func(interface{}) map[string][]string { return attrs })
+}
+
+// handler for GET /scim/v2/Groups/{id} that retrieves the organisation of the SCIM token
+func (h *ReqHandler) SCIMGetGroup(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	if mux.Vars(r)["id"] != orgID {
+		writeSCIMError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	group, _, err := h.scimGroup(orgID)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting org: %v", err))
+		return
+	}
+	if strings.Contains(strings.ToLower(r.URL.Query().Get("excludedAttributes")), "members") {
+		group.Members = nil
+	}
+
+	writeSCIMResponse(w, http.StatusOK, group)
+}
+
+// handler for PUT /scim/v2/Groups/{id} that replaces the members of the organisation of the
+// SCIM token. The display name is the name of the organisation and can't be changed.
+func (h *ReqHandler) SCIMReplaceGroup(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	if mux.Vars(r)["id"] != orgID {
+		writeSCIMError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	var g SCIMGroup
+	if !decodeSCIM(w, r, &g) {
+		return
+	}
+
+	group, users, err := h.scimGroup(orgID)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting org: %v", err))
+		return
+	}
+	if g.DisplayName != "" && g.DisplayName != group.DisplayName {
+		writeSCIMError(w, http.StatusBadRequest, "mutability", "displayName is the name of the organisation and can't be changed")
+		return
+	}
+
+	want := map[string]bool{}
+	for _, m := range g.Members {
+		want[m.Value] = true
+	}
+	h.writeSCIMGroupMembers(w, r, orgID, users, want)
+}
+
+// handler for PATCH /scim/v2/Groups/{id} that adds and removes members of the organisation of
+// the SCIM token
+func (h *ReqHandler) SCIMPatchGroup(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value("scimOrgId").(string)
+
+	if mux.Vars(r)["id"] != orgID {
+		writeSCIMError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	var req SCIMPatchRequest
+	if !decodeSCIM(w, r, &req) {
+		return
+	}
+
+	group, users, err := h.scimGroup(orgID)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting org: %v", err))
+		return
+	}
+
+	want := map[string]bool{}
+	for _, u := range users {
+		want[u.UserID] = true
+	}
+	for _, op := range req.Operations {
+		if err := patchSCIMGroup(group, want, op); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, err.scimType, err.detail)
+			return
+		}
+	}
+	h.writeSCIMGroupMembers(w, r, orgID, users, want)
+}
+
+// scimOpError is an operation a SCIM PATCH request can't apply
+type scimOpError struct {
+	scimType string
+	detail   string
+}
+
+// patchSCIMGroup applies a PATCH operation to the IDs of the members a group should have
+func patchSCIMGroup(group *SCIMGroup, want map[string]bool, op SCIMPatchOperation) *scimOpError {
+	kind := strings.ToLower(op.Op)
+	path := op.Path
+	value := op.Value
+
+	if path == "" {
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return &scimOpError{"invalidSyntax", "Operations without a path need an object value"}
+		}
+		for name, v := range values {
+			if err := patchSCIMGroup(group, want, SCIMPatchOperation{Op: op.Op, Path: name, Value: v}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if strings.EqualFold(path, "displayName") {
+		if kind != "remove" && value == group.DisplayName {
+			return nil
+		}
+		return &scimOpError{"mutability", "displayName is the name of the organisation and can't be changed"}
+	}
+
+	// a single member is named by a filter, like members[value eq "id"]
+	if strings.HasPrefix(path, `members[value eq "`) && strings.HasSuffix(path, `"]`) {
+		if kind != "remove" {
+			return &scimOpError{"invalidPath", "Single members can only be removed"}
+		}
+		delete(want, strings.TrimSuffix(strings.TrimPrefix(path, `members[value eq "`), `"]`))
+		return nil
+	}
+	if !strings.EqualFold(path, "members") {
+		return &scimOpError{"invalidPath", fmt.Sprintf("Path %q is not supported", path)}
+	}
+
+	var members []SCIMMultiValue
+	if value != nil {
+		raw, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(raw, &members)
+		}
+		if err != nil {
+			return &scimOpError{"invalidValue", fmt.Sprintf("Invalid members: %v", err)}
+		}
+	}
+
+	switch kind {
+	case "add":
+		for _, m := range members {
+			want[m.Value] = true
+		}
+	case "remove":
+		if value == nil {
+			for id := range want {
+				delete(want, id)
+			}
+		}
+		for _, m := range members {
+			delete(want, m.Value)
+		}
+	case "replace":
+		for id := range want {
+			delete(want, id)
+		}
+		for _, m := range members {
+			want[m.Value] = true
+		}
+	default:
+		return &scimOpError{"invalidSyntax", fmt.Sprintf("Op %q is not supported", op.Op)}
+	}
+	return nil
+}
+
+// writeSCIMGroupMembers makes the members of the organisation the users in want and writes the
+// resulting group. Nothing changes when a user doesn't exist or an owner would be removed.
+func (h *ReqHandler) writeSCIMGroupMembers(w http.ResponseWriter, r *http.Request, orgID string, users []*User, want map[string]bool) {
+	var add, remove []MemberRef
+	current := map[string]bool{}
+	for _, u := range users {
+		current[u.UserID] = true
+		if want[u.UserID] {
+			continue
+		}
+		if u.Role == RoleOwner {
+			writeSCIMError(w, http.StatusConflict, "mutability", fmt.Sprintf("Owner %s is removed after transferring ownership", u.UserID))
+			return
+		}
+		remove = append(remove, MemberRef{UserID: u.UserID})
+	}
+	for id := range want {
+		if current[id] {
+			continue
+		}
+		if _, err := uuid.Parse(id); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", fmt.Sprintf("No user %s", id))
+			return
+		}
+		user, err := h.uzorgStore.GetUserByID(id)
+		if err == sql.ErrNoRows || err == nil && user.DeletedAt != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", fmt.Sprintf("No user %s", id))
+			return
+		}
+		if err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting user: %v", err))
+			return
+		}
+		add = append(add, MemberRef{UserID: id})
+	}
+
+	if len(add) > 0 || len(remove) > 0 {
+		addEv := newAuditEvent(r, AuditMemberAdded, "user", "")
+		addEv.OrgID = orgID
+		removeEv := newAuditEvent(r, AuditMemberRemoved, "user", "")
+		removeEv.OrgID = orgID
+		if err := h.uzorgStore.UpdateOrgMembers(orgID, add, remove, addEv, removeEv); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error updating members of org: %v", err))
+			return
+		}
+	}
+
+	group, _, err := h.scimGroup(orgID)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error getting org: %v", err))
+		return
+	}
+	writeSCIMResponse(w, http.StatusOK, group)
+}
+
+// handler for GET /scim/v2/ServiceProviderConfig that describes the SCIM features the server supports
+func (h *ReqHandler) SCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	writeSCIMResponse(w, http.StatusOK, SCIMServiceProviderConfig{
+		Schemas:        []string{scimConfigSchema},
+		Patch:          SCIMSupported{Supported: true},
+		Bulk:           SCIMBulkSupport{Supported: false},
+		Filter:         SCIMFilterSupport{Supported: true, MaxResults: scimMaxResults},
+		ChangePassword: SCIMSupported{Supported: false},
+		Sort:           SCIMSupported{Supported: false},
+		ETag:           SCIMSupported{Supported: false},
+		AuthenticationSchemes: []SCIMAuthenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "SCIM token",
+			Description: "Bearer token starting with " + scimTokenPrefix + " created by an owner or admin of the organisation",
+			Primary:     true,
+		}},
+		Meta: &SCIMMeta{
+			ResourceType: "ServiceProviderConfig",
+			Location:     publicURL(scimPrefix + "/ServiceProviderConfig"),
+		},
+	})
+}
+
+// scimSchemas describe the attributes of users and groups the server supports
+var scimSchemas = []SCIMSchema{
+	{
+		Schemas:     []string{scimSchemaSchema},
+		ID:          scimUserSchema,
+		Name:        "User",
+		Description: "Member of the organisation",
+		Attributes: []SCIMAttribute{
+			{Name: "userName", Type: "string", Required: true, Mutability: "immutable", Returned: "default", Uniqueness: "server"},
+			{Name: "name", Type: "complex", Mutability: "readWrite", Returned: "default", Uniqueness: "none", SubAttributes: []SCIMAttribute{
+				{Name: "formatted", Type: "string", Mutability: "readOnly", Returned: "default", Uniqueness: "none"},
+				{Name: "givenName", Type: "string", Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+				{Name: "familyName", Type: "string", Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+			}},
+			{Name: "displayName", Type: "string", Mutability: "readOnly", Returned: "default", Uniqueness: "none"},
+			{Name: "emails", Type: "complex", MultiValued: true, Mutability: "readOnly", Returned: "default", Uniqueness: "none", SubAttributes: []SCIMAttribute{
+				{Name: "value", Type: "string", Mutability: "readOnly", Returned: "default", Uniqueness: "server"},
+				{Name: "type", Type: "string", Mutability: "readOnly", Returned: "default", Uniqueness: "none"},
+				{Name: "primary", Type: "boolean", Mutability: "readOnly", Returned: "default", Uniqueness: "none"},
+			}},
+			{Name: "phoneNumbers", Type: "complex", MultiValued: true, Mutability: "readWrite", Returned: "default", Uniqueness: "none", SubAttributes: []SCIMAttribute{
+				{Name: "value", Type: "string", Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+				{Name: "type", Type: "string", Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+			}},
+			{Name: "active", Type: "boolean", Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+		},
+		Meta: &SCIMMeta{ResourceType: "Schema", Location: publicURL(scimPrefix + "/Schemas/" + scimUserSchema)},
+	},
+	{
+		Schemas:     []string{scimSchemaSchema},
+		ID:          scimGroupSchema,
+		Name:        "Group",
+		Description: "The organisation",
+		Attributes: []SCIMAttribute{
+			{Name: "displayName", Type: "string", Required: true, Mutability: "readOnly", Returned: "default", Uniqueness: "none"},
+			{Name: "members", Type: "complex", MultiValued: true, Mutability: "readWrite", Returned: "default", Uniqueness: "none", SubAttributes: []SCIMAttribute{
+				{Name: "value", Type: "string", Mutability: "immutable", Returned: "default", Uniqueness: "none"},
+				{Name: "display", Type: "string", Mutability: "readOnly", Returned: "default", Uniqueness: "none"},
+				{Name: "$ref", Type: "reference", Mutability: "readOnly", Returned: "default", Uniqueness: "none"},
+			}},
+		},
+		Meta: &SCIMMeta{ResourceType: "Schema", Location: publicURL(scimPrefix + "/Schemas/" + scimGroupSchema)},
+	},
+}
+
+// handler for GET /scim/v2/Schemas that lists the schemas of users and groups
+func (h *ReqHandler) SCIMSchemas(w http.ResponseWriter, r *http.Request) {
+	resources := make([]interface{}, 0, len(scimSchemas))
+	for _, s := range scimSchemas {
+		resources = append(resources, s)
+	}
+	writeSCIMResponse(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(resources),
+		StartIndex:   1,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// handler for GET /scim/v2/ResourceTypes that lists the kinds of resources the server provisions
+func (h *ReqHandler) SCIMResourceTypes(w http.ResponseWriter, r *http.Request) {
+	resources := []interface{}{
+		SCIMResourceType{
+			Schemas:     []string{scimResourceTypeSchema},
+			ID:          "User",
+			Name:        "User",
+			Endpoint:    "/Users",
+			Description: "Member of the organisation",
+			Schema:      scimUserSchema,
+			Meta:        &SCIMMeta{ResourceType: "ResourceType", Location: publicURL(scimPrefix + "/ResourceTypes/User")},
+		},
+		SCIMResourceType{
+			Schemas:     []string{scimResourceTypeSchema},
+			ID:          "Group",
+			Name:        "Group",
+			Endpoint:    "/Groups",
+			Description: "The organisation",
+			Schema:      scimGroupSchema,
+			Meta:        &SCIMMeta{ResourceType: "ResourceType", Location: publicURL(scimPrefix + "/ResourceTypes/Group")},
+		},
+	}
+	writeSCIMResponse(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(resources),
+		StartIndex:   1,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) InsertUserIntoOrg(u *User, orgID string, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u.Version = 1
+	user := *u
+	s.users[u.UserID] = &user
+	s.addMember(orgID, u.UserID, RoleMember)
+	s.auditEvents = append(s.auditEvents, ev)
+	return nil
+}
+
+func (s *memoryStore) InsertSCIMToken(t *SCIMToken, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := *t
+	s.scimTokens[t.TokenHash] = &token
+	return nil
+}
+
+func (s *memoryStore) UseSCIMToken(tokenHash string) (SCIMToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.scimTokens[tokenHash]
+	if !ok {
+		return SCIMToken{}, sql.ErrNoRows
+	}
+	return *t, nil
+}
+
+func (s *memoryStore) RevokeSCIMToken(orgID, tokenID string, ev *AuditEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, t := range s.scimTokens {
+		if t.OrgID == orgID && t.TokenID == tokenID {
+			delete(s.scimTokens, hash)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestParseSCIMFilter(t *testing.T) {
+	attrs := map[string][]string{
+		"username":       {"Ann@Example.com"},
+		"name.givenname": {"Ann"},
+		"emails.value":   {"ann@example.com", "ann@work.example.com"},
+	}
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{`userName eq "ann@example.com"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "ann@example.com"`, true},
+		{`userName ne "ann@example.com"`, false},
+		{`emails.value ew "work.example.com"`, true},
+		{`name.givenName sw "B" or userName co "example"`, true},
+		{`name.givenName sw "B" or userName co "example" and name.familyName pr`, false},
+		{`name.givenName eq "Ann" and name.familyName pr or userName eq "ann@example.com"`, true},
+		{`name.givenName eq "say \"hi\""`, false},
+	}
+	for _, tt := range tests {
+		f, err := parseSCIMFilter(tt.filter)
+		if err != nil {
+			t.Errorf("parsing %s: %v", tt.filter, err)
+			continue
+		}
+		if got := f.matches(attrs); got != tt.match {
+			t.Errorf("%s matched %v, want %v", tt.filter, got, tt.match)
+		}
+	}
+
+	for _, filter := range []string{
+		`userName eq`, `userName gt "a"`, `userName eq "a" and`, `(userName eq "a")`,
+		`emails[type eq "work"]`, `"userName" eq "a"`, `userName eq "a" nor id pr`, `userName eq "a`,
+	} {
+		if _, err := parseSCIMFilter(filter); err == nil {
+			t.Errorf("got no error for filter %s", filter)
+		}
+	}
+}
+
+func TestSCIMProvisioning(t *testing.T) {
+	store, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	owner := client.New(server.URL)
+	ownerUser := registerTestUser(t, owner, "Ore", "ore@example.com")
+	registerTestUser(t, client.New(server.URL), "Kemi", "kemi@example.com")
+
+	org, err := owner.CreateOrg(ctx, client.CreateOrgRequest{Name: "Provisioned", Description: "Kept in sync"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(token, method, path, body string, out interface{}) int {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatalf("decoding %s %s: %v", method, path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var created CreateSCIMTokenResponse
+	status := do(owner.Token(), "POST", "/api/v1/organisations/"+org.OrgID+"/scim-tokens", `{"name":"Identity provider"}`, &created)
+	if status != http.StatusCreated || !strings.HasPrefix(created.Data.Token, scimTokenPrefix) {
+		t.Fatalf("got %d %+v creating a SCIM token", status, created.Data)
+	}
+	token := created.Data.Token
+
+	if status := do("not-a-scim-token", "GET", "/scim/v2/Users", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("got %d without a SCIM token, want 401", status)
+	}
+
+	var provisioned SCIMUser
+	status = do(token, "POST", "/scim/v2/Users", `{"schemas":["`+scimUserSchema+`"],"userName":"new@example.com","name":{"givenName":"New","familyName":"Hire"}}`, &provisioned)
+	if status != http.StatusCreated || provisioned.ID == "" || provisioned.Name.GivenName != "New" {
+		t.Fatalf("got %d %+v provisioning a new user", status, provisioned)
+	}
+	store.mu.Lock()
+	ev := store.auditEvents[len(store.auditEvents)-1]
+	store.mu.Unlock()
+	if ev.ActorID != created.Data.TokenID || ev.ActorType != AuditActorSCIMToken {
+		t.Errorf("got actor %q of type %q provisioning a user, want the SCIM token", ev.ActorID, ev.ActorType)
+	}
+	if e, ok := domainEventFromAudit(&AuditEvent{Action: AuditMemberAdded, ActorID: ev.ActorID, ActorType: ev.ActorType}).(*MemberAdded); !ok || e.AddedBy != "" || e.Meta().ActorID != "" {
+		t.Errorf("got %+v for a member added over SCIM, want no user as actor", e)
+	}
+	if status := do(token, "POST", "/scim/v2/Users", `{"userName":"new@example.com"}`, nil); status != http.StatusConflict {
+		t.Errorf("got %d provisioning a member again, want 409", status)
+	}
+
+	var existing SCIMUser
+	if status := do(token, "POST", "/scim/v2/Users", `{"userName":"kemi@example.com"}`, &existing); status != http.StatusCreated {
+		t.Fatalf("got %d provisioning an existing user", status)
+	}
+
+	var list SCIMListResponse
+	do(token, "GET", `/scim/v2/Users?filter=userName+sw+%22new%22+or+userName+eq+%22KEMI@example.com%22`, "", &list)
+	if list.TotalResults != 2 || len(list.Resources) != 2 {
+		t.Errorf("got %d results for a filter, want 2", list.TotalResults)
+	}
+	do(token, "GET", "/scim/v2/Users?startIndex=2&count=1", "", &list)
+	if list.TotalResults != 3 || list.StartIndex != 2 || list.ItemsPerPage != 1 {
+		t.Errorf("got page %+v, want the second of 3 users", list)
+	}
+
+	patch := `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"name.givenName","value":"Renamed"}]}`
+	var patched SCIMUser
+	do(token, "PATCH", "/scim/v2/Users/"+provisioned.ID, patch, &patched)
+	if patched.Name.GivenName != "Renamed" {
+		t.Errorf("got name %+v, want the patched name", patched.Name)
+	}
+	do(token, "PATCH", "/scim/v2/Users/"+existing.ID, patch, &patched)
+	if patched.Name.GivenName != "Kemi" {
+		t.Errorf("got name %+v, want the name of a user of another organisation unchanged", patched.Name)
+	}
+	if status := do(token, "PATCH", "/scim/v2/Users/"+existing.ID, `{"Operations":[{"op":"replace","path":"userName","value":"other@example.com"}]}`, nil); status != http.StatusBadRequest {
+		t.Errorf("got %d changing userName, want 400", status)
+	}
+
+	var group SCIMGroup
+	status = do(token, "PATCH", "/scim/v2/Groups/"+org.OrgID, `{"Operations":[{"op":"remove","path":"members[value eq \"`+existing.ID+`\"]"}]}`, &group)
+	if status != http.StatusOK || len(group.Members) != 2 {
+		t.Fatalf("got %d with %d members removing a member, want 2", status, len(group.Members))
+	}
+	if status := do(token, "GET", "/scim/v2/Users/"+existing.ID, "", nil); status != http.StatusNotFound {
+		t.Errorf("got %d for a removed member, want 404", status)
+	}
+	do(token, "PATCH", "/scim/v2/Groups/"+org.OrgID, `{"Operations":[{"op":"add","path":"members","value":[{"value":"`+existing.ID+`"}]}]}`, &group)
+	if len(group.Members) != 3 {
+		t.Errorf("got %d members after adding one back, want 3", len(group.Members))
+	}
+	if status := do(token, "PUT", "/scim/v2/Groups/"+org.OrgID, `{"displayName":"Provisioned","members":[]}`, nil); status != http.StatusConflict {
+		t.Errorf("got %d replacing the members without the owner, want 409", status)
+	}
+	if status := do(token, "GET", "/scim/v2/Groups/"+ownerUser.UserID, "", nil); status != http.StatusNotFound {
+		t.Errorf("got %d for another group, want 404", status)
+	}
+
+	if status := do(token, "DELETE", "/scim/v2/Users/"+ownerUser.UserID, "", nil); status != http.StatusConflict {
+		t.Errorf("got %d deprovisioning the owner, want 409", status)
+	}
+	var deactivated SCIMUser
+	do(token, "PATCH", "/scim/v2/Users/"+provisioned.ID, `{"Operations":[{"op":"replace","value":{"active":"False"}}]}`, &deactivated)
+	if deactivated.Active == nil || *deactivated.Active {
+		t.Errorf("got %+v deactivating a user, want active false", deactivated)
+	}
+
+	var members SCIMListResponse
+	do(token, "GET", "/scim/v2/Users", "", &members)
+	var ids []string
+	for _, res := range members.Resources {
+		ids = append(ids, res.(map[string]interface{})["id"].(string))
+	}
+	if want := []string{existing.ID, ownerUser.UserID}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got members %v, want %v", ids, want)
+	}
+
+	status = do(owner.Token(), "DELETE", "/api/v1/organisations/"+org.OrgID+"/scim-tokens/"+created.Data.TokenID, "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("got %d revoking the SCIM token", status)
+	}
+	if status := do(token, "GET", "/scim/v2/Users", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("got %d with a revoked SCIM token, want 401", status)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// scimTokenPrefix marks the bearer tokens of SCIM clients
+const scimTokenPrefix = "uzs_"
+
+// handler for POST /api/organisations/{id}/scim-tokens that creates a token the identity provider
+// of an organisation provisions its members with. Only owners and admins can create one, and
+// the token is returned only once.
+func (h *ReqHandler) CreateSCIMToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	var req CreateSCIMTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error generating SCIM token: %v", err))
+		return
+	}
+	token := scimTokenPrefix + secret
+
+	scimToken := SCIMToken{
+		TokenID:   uuid.New().String(),
+		OrgID:     orgID,
+		Name:      req.Name,
+		Prefix:    token[:len(scimTokenPrefix)+6],
+		TokenHash: hashAPIKey(token),
+		CreatedBy: userID,
+	}
+
+	ev := newAuditEvent(r, AuditSCIMTokenCreated, "scimtoken", scimToken.TokenID)
+	ev.OrgID = orgID
+	err = h.uzorgStore.InsertSCIMToken(&scimToken, ev)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error inserting SCIM token: %v", err))
+		return
+	}
+
+	response := CreateSCIMTokenResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "SCIM token created successfully",
+		},
+		Data: &CreatedSCIMToken{
+			SCIMToken: scimToken,
+			Token:     token,
+		},
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for GET /api/organisations/{id}/scim-tokens that lists the SCIM tokens of an organisation
+func (h *ReqHandler) GetSCIMTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	tokens, err := h.uzorgStore.GetOrgSCIMTokens(orgID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting SCIM tokens: %v", err))
+		return
+	}
+
+	response := GetSCIMTokensResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "SCIM tokens retrieved successfully",
+		},
+		Data: tokens,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for DELETE /api/organisations/{id}/scim-tokens/{tokenId} that revokes a SCIM token
+func (h *ReqHandler) RevokeSCIMToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+	tokenID := vars["tokenId"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	ev := newAuditEvent(r, AuditSCIMTokenRevoked, "scimtoken", tokenID)
+	ev.OrgID = orgID
+	revoked, err := h.uzorgStore.RevokeSCIMToken(orgID, tokenID, ev)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error revoking SCIM token: %v", err))
+		return
+	}
+
+	if !revoked {
+		writeBadRequestResponse(w, http.StatusNotFound, "SCIM token not found")
+		return
+	}
+
+	response := ResponseStatus{
+		Status:  SuccessStatus,
+		Message: "SCIM token revoked successfully",
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
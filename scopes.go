@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Scopes that can be granted to access tokens and API keys
+const (
+	ScopeUsersRead     = "users:read"
+	ScopeUsersWrite    = "users:write"
+	ScopeOrgsRead      = "orgs:read"
+	ScopeOrgsWrite     = "orgs:write"
+	ScopeMembersRead   = "members:read"
+	ScopeMembersWrite  = "members:write"
+	ScopeAPIKeysRead   = "apikeys:read"
+	ScopeAPIKeysWrite  = "apikeys:write"
+	ScopeClientsRead   = "clients:read"
+	ScopeClientsWrite  = "clients:write"
+	ScopeWebhooksRead  = "webhooks:read"
+	ScopeWebhooksWrite = "webhooks:write"
+	// ScopeOAuthAuthorize allows approving sign ins to client applications on the user's behalf
+	ScopeOAuthAuthorize = "oauth:authorize"
+)
+
+// AllScopes lists every scope known to the server. Tokens issued on login carry all of them.
+var AllScopes = []string{
+	ScopeUsersRead,
+	ScopeUsersWrite,
+	ScopeOrgsRead,
+	ScopeOrgsWrite,
+	ScopeMembersRead,
+	ScopeMembersWrite,
+	ScopeAPIKeysRead,
+	ScopeAPIKeysWrite,
+	ScopeClientsRead,
+	ScopeClientsWrite,
+	ScopeWebhooksRead,
+	ScopeWebhooksWrite,
+	ScopeOAuthAuthorize,
+}
+
+func isKnownScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// missingScopes returns the scopes in required that are not present in granted
+func missingScopes(granted, required []string) []string {
+	var missing []string
+	for _, r := range required {
+		found := false
+		for _, g := range granted {
+			if g == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+// scopesFromContext returns the scopes granted to the authenticated principal
+func scopesFromContext(ctx context.Context) []string {
+	scopes, _ := ctx.Value("scopes").([]string)
+	return scopes
+}
+
+// RequireScopes rejects requests whose token or API key was not granted every one of the given scopes.
+// It must run after AuthMiddleware.
+func RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			missing := missingScopes(scopesFromContext(r.Context()), scopes)
+			if len(missing) > 0 {
+				w.Header().Set("Content-Type", "application/json")
+				writeForbiddenResponse(w, "Insufficient scope", missing)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) InsertAPIKey(k *APIKey, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := *k
+	s.apiKeys[k.KeyHash] = &key
+	return nil
+}
+
+func (s *memoryStore) UseAPIKey(keyHash string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.apiKeys[keyHash]
+	if !ok {
+		return APIKey{}, sql.ErrNoRows
+	}
+	return *k, nil
+}
+
+func TestRequireScopes(t *testing.T) {
+	store, server := newClientTestServer(t)
+
+	c := client.New(server.URL)
+	user := registerTestUser(t, c, "Scott", "scott@example.com")
+	userPath := server.URL + "/api/v1/users/" + user.UserID
+	orgsPath := server.URL + "/api/v1/organisations"
+
+	var created CreateAPIKeyResponse
+	resp := doTestRequest(t, "POST", server.URL+"/api/v1/users/me/api-keys", c.Token(), `{"name":"reader","scopes":["orgs:read"]}`, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got %d creating an API key", resp.StatusCode)
+	}
+	key := created.Data.Key
+
+	// a JWT granting only orgs:read, like one issued to a client application
+	session := Session{SessionID: uuid.New().String(), UserID: user.UserID, ExpiresAt: time.Now().Add(time.Hour)}
+	store.InsertSession(&session, nil)
+	token, err := GenerateJWT(User{UserID: user.UserID}, &session, []string{ScopeOrgsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a token issued before scopes existed carries none
+	legacy, err := GenerateJWT(User{UserID: user.UserID}, &session, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, credential := range map[string]string{"API key": key, "token": token} {
+		if resp := doTestRequest(t, "GET", orgsPath, credential, "", nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("got %d for a route the %s has the scope of, want 200", resp.StatusCode, name)
+		}
+
+		var forbidden ForbiddenResponse
+		resp := doTestRequest(t, "GET", userPath, credential, "", &forbidden)
+		if resp.StatusCode != http.StatusForbidden || !reflect.DeepEqual(forbidden.MissingScopes, []string{ScopeUsersRead}) {
+			t.Errorf("got %d missing %v with the %s, want 403 missing users:read", resp.StatusCode, forbidden.MissingScopes, name)
+		}
+	}
+
+	var forbidden ForbiddenResponse
+	resp = doTestRequest(t, "GET", userPath, legacy, "", &forbidden)
+	if resp.StatusCode != http.StatusForbidden || len(forbidden.MissingScopes) != 1 {
+		t.Errorf("got %d missing %v with a token without scopes, want 403", resp.StatusCode, forbidden.MissingScopes)
+	}
+
+	// keys can't be granted scopes the credential creating them lacks
+	resp = doTestRequest(t, "POST", server.URL+"/api/v1/users/me/api-keys", key, `{"name":"writer","scopes":["orgs:write"]}`, &forbidden)
+	if resp.StatusCode != http.StatusForbidden || !reflect.DeepEqual(forbidden.MissingScopes, []string{ScopeAPIKeysWrite}) {
+		t.Errorf("got %d missing %v creating a key with a key, want 403 missing apikeys:write", resp.StatusCode, forbidden.MissingScopes)
+	}
+
+	if resp := doTestRequest(t, "GET", userPath, c.Token(), "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d with a login token, want 200", resp.StatusCode)
+	}
+}
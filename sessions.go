@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// how long a login session and the token bound to it stay valid
+const sessionTTL = 24 * time.Hour
+
+// clientIP returns the address of the client that sent a request. X-Forwarded-For is only
+// trusted when UZORG_TRUST_PROXY is set, since clients can send it themselves.
+func clientIP(r *http.Request) string {
+	if os.Getenv("UZORG_TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// startSession records a new login session for user and returns an access token bound to it
+func (h *ReqHandler) startSession(user *User, r *http.Request) (string, error) {
+	session := Session{
+		SessionID: uuid.New().String(),
+		UserID:    user.UserID,
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+		ExpiresAt: time.Now().Add(sessionTTL),
+	}
+
+	ev := newAuditEvent(r, AuditUserLogin, "session", session.SessionID)
+	ev.ActorID = user.UserID
+	if err := h.uzorgStore.InsertSession(&session, ev); err != nil {
+		return "", fmt.Errorf("inserting session: %w", err)
+	}
+	return GenerateJWT(*user, &session, AllScopes)
+}
+
+// handler for GET /api/users/me/sessions that lists the logged in user's active sessions
+func (h *ReqHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// retrieve userId and sessionId from context claim
+	userID := r.Context().Value("userId").(string)
+	sessionID, _ := r.Context().Value("sessionId").(string)
+
+	sessions, err := h.uzorgStore.GetUserSessions(userID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting sessions: %v", err))
+		return
+	}
+
+	for _, s := range sessions {
+		s.Current = s.SessionID == sessionID
+	}
+
+	response := GetSessionsResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Sessions retrieved successfully",
+		},
+		Data: sessions,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for DELETE /api/users/me/sessions/{id} that revokes one of the logged in user's sessions.
+// Tokens bound to the session are rejected from then on.
+func (h *ReqHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	sessionID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	revoked, err := h.uzorgStore.RevokeSession(userID, sessionID, newAuditEvent(r, AuditSessionRevoked, "session", sessionID))
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error revoking session: %v", err))
+		return
+	}
+
+	if !revoked {
+		writeBadRequestResponse(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	response := ResponseStatus{
+		Status:  SuccessStatus,
+		Message: "Session revoked successfully",
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
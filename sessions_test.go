@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) GetUserSessions(userID string) ([]*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sessions []*Session
+	for _, session := range s.sessions {
+		if session.UserID == userID && time.Now().Before(session.ExpiresAt) {
+			stored := *session
+			sessions = append(sessions, &stored)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+func (s *memoryStore) RevokeSession(userID, sessionID string, ev *AuditEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok || session.UserID != userID {
+		return false, nil
+	}
+	delete(s.sessions, sessionID)
+	return true, nil
+}
+
+func TestSessionRevocation(t *testing.T) {
+	store, server := newClientTestServer(t)
+	ctx := context.Background()
+
+	registered := client.New(server.URL)
+	registerTestUser(t, registered, "Ada", "ada@example.com")
+	other := client.New(server.URL)
+	if _, err := other.Login(ctx, "ada@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	bob := client.New(server.URL)
+	registerTestUser(t, bob, "Bob", "bob@example.com")
+
+	var list GetSessionsResponse
+	resp := doTestRequest(t, http.MethodGet, server.URL+"/api/v1/users/me/sessions", other.Token(), "", &list)
+	if resp.StatusCode != http.StatusOK || len(list.Data) != 2 {
+		t.Fatalf("got status %d with %d sessions, want Ada's 2", resp.StatusCode, len(list.Data))
+	}
+	var current, registeredSession string
+	for _, s := range list.Data {
+		if s.Current {
+			current = s.SessionID
+		} else {
+			registeredSession = s.SessionID
+		}
+	}
+	if current == "" || registeredSession == "" {
+		t.Fatalf("got sessions %+v, want exactly one marked current", list.Data)
+	}
+
+	// other users cannot revoke Ada's sessions
+	resp = doTestRequest(t, http.MethodDelete, server.URL+"/api/v1/users/me/sessions/"+current, bob.Token(), "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d revoking another user's session, want 404", resp.StatusCode)
+	}
+
+	resp = doTestRequest(t, http.MethodDelete, server.URL+"/api/v1/users/me/sessions/"+registeredSession, other.Token(), "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d revoking a session, want 200", resp.StatusCode)
+	}
+	resp = doTestRequest(t, http.MethodDelete, server.URL+"/api/v1/users/me/sessions/"+registeredSession, other.Token(), "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d revoking a session twice, want 404", resp.StatusCode)
+	}
+
+	assertRejected := func(token, why string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/organisations", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(body), "Session is no longer active") {
+			t.Errorf("got status %d, %q for the token of %s, want 401", resp.StatusCode, body, why)
+		}
+	}
+	assertRejected(registered.Token(), "a revoked session")
+
+	resp = doTestRequest(t, http.MethodGet, server.URL+"/api/v1/organisations", other.Token(), "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d for the session left, want 200", resp.StatusCode)
+	}
+
+	store.mu.Lock()
+	store.sessions[current].ExpiresAt = time.Now().Add(-time.Minute)
+	store.mu.Unlock()
+	assertRejected(other.Token(), "an expired session")
+}
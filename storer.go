@@ -1,15 +1,107 @@
 package main
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when the record an operation applies to does not exist or is no longer valid
+var ErrNotFound = errors.New("not found")
+
+// ErrEmailTaken is returned when an email change would break the uniqueness of users.email
+var ErrEmailTaken = errors.New("email already in use")
+
+// UzorgStorer persists users, organisations and everything attached to them. Methods taking
+// an *AuditEvent record it in the same transaction as their change; nil records nothing.
 type UzorgStorer interface {
-	InsertUserAndDefaultOrg(u *User, o *Org) error
-	InsertOrgAndAddUser(o *Org, userID string) error
+	InsertUserAndDefaultOrg(u *User, o *Org, ev *AuditEvent) error
+	InsertOrgAndAddUser(o *Org, userID string, ev *AuditEvent) error
 	InsertUser(u *User) error
-	AddUserToOrg(userID, orgID string) error
+	AddUserToOrg(userID, orgID string, ev *AuditEvent) error
+	AddUsersToOrg(orgID string, refs []MemberRef, ev *AuditEvent) ([]*BatchMemberResult, error)
+	RemoveUsersFromOrg(orgID string, refs []MemberRef, ev *AuditEvent) ([]*BatchMemberResult, error)
+	UpdateOrgMembers(orgID string, add, remove []MemberRef, addEv, removeEv *AuditEvent) error
+	StreamOrgUsers(orgID string, fn func(*User) error) error
+	GetOrgMembersByEmail(orgID string, emails []string) (map[string]*User, error)
+	ApplyMemberImport(orgID string, rows []*MemberImportRow, invitations []*Invitation, ev *AuditEvent) error
+	AcceptInvitation(tokenHash, userID string, ev *AuditEvent) (Invitation, error)
+	PurgeExpiredInvitations() (int64, error)
+	InsertUserIntoOrg(u *User, orgID string, ev *AuditEvent) error
+	InsertSCIMToken(t *SCIMToken, ev *AuditEvent) error
+	UseSCIMToken(tokenHash string) (SCIMToken, error)
+	GetOrgSCIMTokens(orgID string) ([]*SCIMToken, error)
+	RevokeSCIMToken(orgID, tokenID string, ev *AuditEvent) (bool, error)
 	GetUserByEmail(email string) (User, error)
 	GetUserByID(userID string) (User, error)
+	UpdateUser(u *User, expectedVersion int, ev *AuditEvent) (bool, error)
+	UpdateUserPassword(userID, hashedPassword string, ev *AuditEvent) error
 	InsertOrg(o *Org) error
 	GetOrg(orgID string) (Org, error)
 	GetUserOrgs(userID string) ([]*Org, error)
 	GetOrgUsers(orgID string) ([]*User, error)
+	GetOrgsOfUsers(userIDs []string) (map[string][]*Org, error)
+	GetUsersOfOrgs(orgIDs []string) (map[string][]*User, error)
 	UserBelongsToOrg(userID, orgID string) (bool, error)
+	UsersShareOrg(userID, otherUserID string) (bool, error)
+	InsertAPIKey(k *APIKey, ev *AuditEvent) error
+	UseAPIKey(keyHash string) (APIKey, error)
+	GetUserAPIKeys(userID string) ([]*APIKey, error)
+	RevokeAPIKey(userID, keyID string, ev *AuditEvent) (bool, error)
+	InsertOIDCLoginState(s *OIDCLoginState) error
+	ConsumeOIDCLoginState(state string) (OIDCLoginState, error)
+	GetUserByIdentity(issuer, subject string) (User, error)
+	InsertUserIdentity(userID, issuer, subject string) error
+	InsertOAuthClient(c *OAuthClient) error
+	GetOAuthClient(clientID string) (OAuthClient, error)
+	GetUserOAuthClients(userID string) ([]*OAuthClient, error)
+	DeleteOAuthClient(userID, clientID string) (bool, error)
+	GetOAuthConsent(userID, clientID string) ([]string, error)
+	UpsertOAuthConsent(userID, clientID string, scopes []string) error
+	InsertOAuthCode(c *OAuthCode) error
+	ConsumeOAuthCode(codeHash string) (OAuthCode, error)
+	InsertSession(s *Session, ev *AuditEvent) error
+	TouchSession(sessionID string) (Session, error)
+	GetUserSessions(userID string) ([]*Session, error)
+	RevokeSession(userID, sessionID string, ev *AuditEvent) (bool, error)
+	RevokeUserSessions(userID, exceptSessionID string) error
+	InsertEmailChange(c *EmailChange) error
+	ConfirmEmailChange(tokenHash string, ev *AuditEvent) (User, error)
+	GetMemberRole(orgID, userID string) (string, error)
+	SetMemberRole(orgID, userID, role string, ev *AuditEvent) (bool, error)
+	GetAllOrgs() ([]*Org, error)
+	TransferOrgOwnership(orgID, fromUserID, toUserID string, ev *AuditEvent) error
+	DeleteOrg(orgID string, expectedVersion int, ev *AuditEvent) (bool, error)
+	SoftDeleteUser(userID string, ev *AuditEvent) ([]*Org, error)
+	RestoreUser(userID string, deletedAfter time.Time, ev *AuditEvent) (bool, error)
+	PurgeDeletedUsers(deletedBefore time.Time) (int64, error)
+	CountUserExportRecords(userID string) (int, error)
+	GetActiveDataExport(userID string) (DataExport, error)
+	InsertDataExport(e *DataExport) error
+	ClaimDataExport(leaseUntil time.Time) (DataExport, error)
+	CompleteDataExport(exportID string, archive []byte) error
+	FailDataExport(exportID, message string) error
+	GetDataExport(userID, exportID string) (DataExport, error)
+	GetDataExportArchive(userID, exportID string) ([]byte, error)
+	PurgeFinishedDataExports(finishedBefore time.Time) (int64, error)
+	GetOrgAuditEvents(orgID string, filter AuditEventFilter) ([]*AuditEvent, error)
+	GetUserAuditEvents(userID string) ([]*AuditEvent, error)
+	InsertWebhook(wh *Webhook, ev *AuditEvent) error
+	GetOrgWebhooks(orgID string) ([]*Webhook, error)
+	DeleteWebhook(orgID, webhookID string, ev *AuditEvent) (bool, error)
+	ClaimWebhookDelivery(leaseUntil time.Time) (WebhookDelivery, error)
+	CompleteWebhookDelivery(deliveryID string, statusCode int) error
+	FailWebhookDelivery(deliveryID string, statusCode int, message string, retryAt *time.Time) error
+	GetWebhookDeliveries(orgID, webhookID string, limit int) ([]*WebhookDelivery, error)
+	EnqueueWebhookDeliveries(orgID, eventID, eventType string, payload []byte) error
+	PurgeOrphanedWebhookDeliveries() (int64, error)
+	PurgeDeliveredWebhookDeliveries(deliveredBefore time.Time) (int64, error)
+	ClaimOutboxEvent(leaseUntil time.Time) (OutboxEvent, error)
+	MarkOutboxEventHandled(eventID, subscriber string) error
+	CompleteOutboxEvent(eventID, message string) error
+	FailOutboxEvent(eventID, message string, retryAt *time.Time) error
+	PurgeDispatchedOutboxEvents(dispatchedBefore time.Time) (int64, error)
+	ReserveIdempotencyKey(k *IdempotencyKey, lockedUntil time.Time) (IdempotencyKey, bool, error)
+	CompleteIdempotencyKey(k *IdempotencyKey) error
+	ReleaseIdempotencyKey(userID, key string) error
+	PurgeExpiredIdempotencyKeys() (int64, error)
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 
@@ -46,3 +48,26 @@ func writeServerErrorResponse(w http.ResponseWriter, message string) {
 		Code: http.StatusInternalServerError,
 	})
 }
+
+func writeForbiddenResponse(w http.ResponseWriter, message string, missing []string) {
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(ForbiddenResponse{
+		ErrorResponse: ErrorResponse{
+			ResponseStatus: ResponseStatus{
+				Status:  ForbiddenStatus,
+				Message: message,
+			},
+			Code: http.StatusForbidden,
+		},
+		MissingScopes: missing,
+	})
+}
+
+// randomToken returns n random bytes encoded as unpadded base64url
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
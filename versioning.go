@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiV1Prefix is where v1 of the API is mounted
+const apiV1Prefix = "/api/v1"
+
+// The unversioned paths of the API were deprecated when v1 was mounted under apiV1Prefix.
+// After legacySunset they may be removed.
+var (
+	legacyDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset       = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// versionedPathPattern matches the paths of a mounted version of the API
+var versionedPathPattern = regexp.MustCompile(`^/api/v[0-9]+(/|$)`)
+
+// isUnversioned matches the requests of legacy paths. Unknown paths of a version are not
+// aliases of v1 and are left to the router to answer with 404 or 405.
+func isUnversioned(r *http.Request, _ *mux.RouteMatch) bool {
+	return !versionedPathPattern.MatchString(r.URL.Path)
+}
+
+// legacyAlias serves the unversioned paths /auth/... and /api/... with the routes of v1 mounted
+// at prefix. Responses announce the deprecation (RFC 9745) and sunset (RFC 8594) of the path
+// and link the versioned path that replaces it.
+func legacyAlias(v1 *mux.Router, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successor := prefix + strings.TrimPrefix(r.URL.Path, "/api")
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyDeprecatedAt.Unix()))
+		w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+
+		aliased := r.Clone(r.Context())
+		aliased.URL.Path = successor
+		if r.URL.RawPath != "" {
+			aliased.URL.RawPath = prefix + strings.TrimPrefix(r.URL.RawPath, "/api")
+		}
+		v1.ServeHTTP(w, aliased)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLegacyPathsAliasV1(t *testing.T) {
+	_, server := newClientTestServer(t)
+
+	for _, tc := range []struct {
+		path       string
+		status     int
+		deprecated bool
+		successor  string
+	}{
+		{path: "/api/v1/organisations", status: http.StatusUnauthorized},
+		{path: "/api/organisations", status: http.StatusUnauthorized, deprecated: true, successor: "/api/v1/organisations"},
+		{path: "/auth/login", status: http.StatusMethodNotAllowed, deprecated: true, successor: "/api/v1/auth/login"},
+		{path: "/api/nothing-here", status: http.StatusNotFound, deprecated: true, successor: "/api/v1/nothing-here"},
+		{path: "/api/v1/nothing-here", status: http.StatusNotFound},
+		{path: "/api/v2/organisations", status: http.StatusNotFound},
+		{path: "/api/v1/auth/login", status: http.StatusMethodNotAllowed},
+		{path: "/openapi.json", status: http.StatusOK},
+	} {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("GET %s: got status %d, want %d", tc.path, resp.StatusCode, tc.status)
+		}
+		if got := resp.Header.Get("Deprecation") != ""; got != tc.deprecated {
+			t.Errorf("GET %s: got Deprecation header %q", tc.path, resp.Header.Get("Deprecation"))
+		}
+		if tc.deprecated {
+			if resp.Header.Get("Sunset") == "" {
+				t.Errorf("GET %s: missing Sunset header", tc.path)
+			}
+			if link := resp.Header.Get("Link"); !strings.Contains(link, "<"+tc.successor+">") {
+				t.Errorf("GET %s: got Link %q, want successor %s", tc.path, link, tc.successor)
+			}
+		}
+	}
+}
+
+func TestLegacyPathsServeV1Handlers(t *testing.T) {
+	_, server := newClientTestServer(t)
+
+	resp, err := http.Post(server.URL+"/auth/register", "application/json", strings.NewReader(`{
+		"firstName": "Mary", "lastName": "Tester", "email": "mary@example.com",
+		"password": "correct horse battery", "phone": "+2348012345678"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+}
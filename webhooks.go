@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// webhookSecretPrefix marks the secrets webhook deliveries are signed with
+const webhookSecretPrefix = "whsec_"
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryDead      = "dead"
+)
+
+const (
+	// the first retry waits webhookRetryBase, and each one after twice as long as the previous
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = 6 * time.Hour
+	// how long a claimed delivery is left to its worker before another one retries it
+	webhookDeliveryLease = time.Minute
+	// how long delivered deliveries are listed before they are purged
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+// webhookEvents lists the audit actions organisations can subscribe webhooks to
+var webhookEvents = []string{
+	AuditOrgCreated,
+	AuditOrgDeleted,
+	AuditMemberAdded,
+	AuditMemberRemoved,
+	AuditMemberRoleChanged,
+	AuditOrgOwnerTransferred,
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookMaxAttempts is how many times a delivery is attempted before it is dead lettered.
+// It is configured with UZORG_WEBHOOK_MAX_ATTEMPTS.
+func webhookMaxAttempts() int {
+	return envInt("UZORG_WEBHOOK_MAX_ATTEMPTS", 8)
+}
+
+// webhookRetryDelay is how long to wait before the next attempt after a failed one
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for i := 1; i < attempts && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > webhookRetryMax {
+		delay = webhookRetryMax
+	}
+	return delay
+}
+
+// WebhookPayload is the body POSTed to webhooks
+type WebhookPayload struct {
+	EventID   string      `json:"id"`
+	Type      string      `json:"type"`
+	OrgID     string      `json:"orgId"`
+	ActorID   string      `json:"actorId,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      DomainEvent `json:"data"`
+}
+
+var errWebhookAddressBlocked = errors.New("webhook address is not publicly routable")
+
+// webhookBlockedNets lists the networks webhooks are not delivered to besides the loopback, private,
+// link-local, multicast and unspecified addresses, so that webhooks cannot reach internal services
+var webhookBlockedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // this network
+		"100.64.0.0/10", // carrier-grade NAT, also used by cloud metadata services
+		"192.0.0.0/24",  // IETF protocol assignments, also used by cloud metadata services
+		"198.18.0.0/15", // benchmarking
+		"240.0.0.0/4",   // reserved and broadcast
+		"64:ff9b::/96",  // NAT64, which maps to any IPv4 address
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// webhookAddressAllowed reports whether webhooks may be delivered to ip. Cloud metadata endpoints
+// such as 169.254.169.254 are link-local.
+func webhookAddressAllowed(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range webhookBlockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookClient returns the client webhooks are delivered with. The address of each connection
+// is checked once the host is resolved, right before connecting, so hosts that resolve to an internal
+// address at delivery time are refused even if they resolved to a public one before.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+				return fmt.Errorf("%w: %s", errWebhookAddressBlocked, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// without a proxy, since the dialer would check the address of the proxy instead
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		// redirects are not followed, they count as failed deliveries
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// webhookPayload encodes the body delivered to webhooks for a domain event
+func webhookPayload(e DomainEvent) ([]byte, error) {
+	meta := e.Meta()
+	return json.Marshal(WebhookPayload{
+		EventID:   meta.EventID,
+		Type:      e.EventType(),
+		OrgID:     meta.OrgID,
+		ActorID:   meta.ActorID,
+		CreatedAt: meta.OccurredAt,
+		Data:      e,
+	})
+}
+
+// enqueueWebhooks queues the delivery of a domain event to the webhooks of its organisation
+// subscribed to it. Deliveries already queued for the event are left alone.
+func (h *ReqHandler) enqueueWebhooks(e DomainEvent) error {
+	payload, err := webhookPayload(e)
+	if err != nil {
+		return err
+	}
+	meta := e.Meta()
+	return h.uzorgStore.EnqueueWebhookDeliveries(meta.OrgID, meta.EventID, e.EventType(), payload)
+}
+
+// signWebhookPayload computes the value of the X-Uzorg-Signature header of a delivery. The signature is
+// the hex HMAC-SHA256 of "<timestamp>.<body>" so receivers can reject replays of old deliveries.
+func signWebhookPayload(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook POSTs a delivery to its webhook. It returns the status code of the response,
+// and an error unless the webhook answered with a 2xx status.
+func deliverWebhook(client *http.Client, d *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Uzorg-Webhooks/1.0")
+	req.Header.Set("X-Uzorg-Event", d.EventType)
+	req.Header.Set("X-Uzorg-Delivery", d.DeliveryID)
+	req.Header.Set("X-Uzorg-Signature", signWebhookPayload(d.Secret, time.Now(), d.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliverNextWebhook attempts the pending delivery that has been due the longest and records the
+// outcome. Failed deliveries are retried with exponential backoff until they run out of attempts.
+// It returns sql.ErrNoRows when no delivery is due.
+func deliverNextWebhook(store UzorgStorer, client *http.Client) error {
+	d, err := store.ClaimWebhookDelivery(time.Now().Add(webhookDeliveryLease))
+	if err != nil {
+		return err
+	}
+
+	statusCode, err := deliverWebhook(client, &d)
+	if err == nil {
+		err = store.CompleteWebhookDelivery(d.DeliveryID, statusCode)
+	} else {
+		log.Printf("Error delivering webhook delivery %s (attempt %d): %v", d.DeliveryID, d.Attempts, err)
+
+		// a nil retry time dead letters the delivery
+		var retryAt *time.Time
+		if d.Attempts < webhookMaxAttempts() {
+			t := time.Now().Add(webhookRetryDelay(d.Attempts))
+			retryAt = &t
+		}
+		err = store.FailWebhookDelivery(d.DeliveryID, statusCode, err.Error(), retryAt)
+	}
+	if err != nil {
+		log.Printf("Error saving webhook delivery %s: %v", d.DeliveryID, err)
+	}
+	return nil
+}
+
+// runWebhookWorker delivers due webhook deliveries, checking for new ones every interval
+func runWebhookWorker(store UzorgStorer, client *http.Client, interval time.Duration) {
+	for {
+		err := deliverNextWebhook(store, client)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("Error claiming webhook delivery: ", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// handler for POST /api/organisations/{id}/webhooks that subscribes a URL to events of an organisation.
+// Only owners and admins can manage webhooks. The signing secret is returned only once.
+func (h *ReqHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequestResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Error decoding request: %v", err),
+		)
+		return
+	}
+
+	errs := req.Validate()
+	if len(errs) > 0 {
+		writeValidationErrorResponse(w, errs)
+		return
+	}
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error generating secret: %v", err))
+		return
+	}
+
+	webhook := Webhook{
+		WebhookID: uuid.New().String(),
+		OrgID:     orgID,
+		URL:       req.URL,
+		Secret:    webhookSecretPrefix + secret,
+		Events:    req.Events,
+	}
+
+	ev := newAuditEvent(r, AuditWebhookCreated, "webhook", webhook.WebhookID)
+	ev.OrgID = orgID
+	err = h.uzorgStore.InsertWebhook(&webhook, ev)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error inserting webhook: %v", err))
+		return
+	}
+
+	response := CreateWebhookResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Webhook created successfully, store the secret as it will not be shown again",
+		},
+		Data: &CreatedWebhook{
+			Webhook: webhook,
+			Secret:  webhook.Secret,
+		},
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for GET /api/organisations/{id}/webhooks that lists the webhooks of an organisation
+func (h *ReqHandler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	webhooks, err := h.uzorgStore.GetOrgWebhooks(orgID)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting webhooks: %v", err))
+		return
+	}
+
+	response := GetWebhooksResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Webhooks retrieved successfully",
+		},
+		Data: webhooks,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for DELETE /api/organisations/{id}/webhooks/{webhookId} that deletes a webhook and its pending deliveries
+func (h *ReqHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+	webhookID := vars["webhookId"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	if _, err := uuid.Parse(webhookID); err != nil {
+		writeBadRequestResponse(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	ev := newAuditEvent(r, AuditWebhookDeleted, "webhook", webhookID)
+	ev.OrgID = orgID
+	deleted, err := h.uzorgStore.DeleteWebhook(orgID, webhookID, ev)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error deleting webhook: %v", err))
+		return
+	}
+
+	if !deleted {
+		writeBadRequestResponse(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	response := ResponseStatus{
+		Status:  SuccessStatus,
+		Message: "Webhook deleted successfully",
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handler for GET /api/organisations/{id}/webhooks/{webhookId}/deliveries that lists the most
+// recent deliveries of a webhook with the outcome of their last attempt
+func (h *ReqHandler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+	webhookID := vars["webhookId"]
+
+	// retrieve userId from context claim
+	userID := r.Context().Value("userId").(string)
+
+	if !h.requireOrgRole(w, orgID, userID, RoleOwner, RoleAdmin) {
+		return
+	}
+
+	if _, err := uuid.Parse(webhookID); err != nil {
+		writeBadRequestResponse(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			writeValidationErrorResponse(w, []*ValidationError{{Field: "limit", Message: "limit must be between 1 and 200"}})
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := h.uzorgStore.GetWebhookDeliveries(orgID, webhookID, limit)
+	if err != nil {
+		writeServerErrorResponse(w, fmt.Sprintf("Error getting webhook deliveries: %v", err))
+		return
+	}
+
+	response := GetWebhookDeliveriesResponse{
+		ResponseStatus: ResponseStatus{
+			Status:  SuccessStatus,
+			Message: "Webhook deliveries retrieved successfully",
+		},
+		Data: deliveries,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/utukj/user-org-crud/client"
+)
+
+func (s *memoryStore) InsertWebhook(wh *Webhook, ev *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wh.CreatedAt = time.Now()
+	stored := *wh
+	s.webhooks[wh.WebhookID] = &stored
+	return nil
+}
+
+func (s *memoryStore) EnqueueWebhookDeliveries(orgID, eventID, eventType string, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, wh := range s.webhooks {
+		if wh.OrgID != orgID || !containsString(wh.Events, eventType) {
+			continue
+		}
+		queued := false
+		for _, d := range s.webhookDeliveries {
+			queued = queued || (d.WebhookID == wh.WebhookID && d.EventID == eventID)
+		}
+		if queued {
+			continue
+		}
+		now := time.Now()
+		s.webhookDeliveries = append(s.webhookDeliveries, &WebhookDelivery{
+			DeliveryID:    uuid.New().String(),
+			WebhookID:     wh.WebhookID,
+			EventID:       eventID,
+			EventType:     eventType,
+			Payload:       payload,
+			Status:        WebhookDeliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+			URL:           wh.URL,
+			Secret:        wh.Secret,
+		})
+	}
+	return nil
+}
+
+func (s *memoryStore) ClaimWebhookDelivery(leaseUntil time.Time) (WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due *WebhookDelivery
+	for _, d := range s.webhookDeliveries {
+		if d.Status == WebhookDeliveryPending && !d.NextAttemptAt.After(time.Now()) &&
+			(due == nil || d.NextAttemptAt.Before(*due.NextAttemptAt)) {
+			due = d
+		}
+	}
+	if due == nil {
+		return WebhookDelivery{}, sql.ErrNoRows
+	}
+	due.Attempts++
+	due.NextAttemptAt = &leaseUntil
+	return *due, nil
+}
+
+func (s *memoryStore) webhookDelivery(deliveryID string) *WebhookDelivery {
+	for _, d := range s.webhookDeliveries {
+		if d.DeliveryID == deliveryID {
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) CompleteWebhookDelivery(deliveryID string, statusCode int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.webhookDelivery(deliveryID)
+	now := time.Now()
+	d.Status, d.LastStatusCode, d.LastError, d.NextAttemptAt, d.DeliveredAt = WebhookDeliveryDelivered, &statusCode, "", nil, &now
+	return nil
+}
+
+func (s *memoryStore) FailWebhookDelivery(deliveryID string, statusCode int, message string, retryAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.webhookDelivery(deliveryID)
+	d.Status = WebhookDeliveryPending
+	if retryAt == nil {
+		d.Status = WebhookDeliveryDead
+	}
+	d.LastStatusCode = nil
+	if statusCode != 0 {
+		d.LastStatusCode = &statusCode
+	}
+	d.LastError, d.NextAttemptAt = message, retryAt
+	return nil
+}
+
+func (s *memoryStore) PurgeDeliveredWebhookDeliveries(deliveredBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []*WebhookDelivery
+	for _, d := range s.webhookDeliveries {
+		if d.Status != WebhookDeliveryDelivered || !d.DeliveredAt.Before(deliveredBefore) {
+			kept = append(kept, d)
+		}
+	}
+	n := int64(len(s.webhookDeliveries) - len(kept))
+	s.webhookDeliveries = kept
+	return n, nil
+}
+
+func (s *memoryStore) GetWebhookDeliveries(orgID, webhookID string, limit int) ([]*WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deliveries []*WebhookDelivery
+	if wh, ok := s.webhooks[webhookID]; !ok || wh.OrgID != orgID {
+		return deliveries, nil
+	}
+	for i := len(s.webhookDeliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if d := s.webhookDeliveries[i]; d.WebhookID == webhookID {
+			stored := *d
+			deliveries = append(deliveries, &stored)
+		}
+	}
+	return deliveries, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":          true,
+		"2606:2800:220:1::":      true,
+		"127.0.0.1":              false,
+		"::1":                    false,
+		"10.1.2.3":               false,
+		"172.16.0.1":             false,
+		"192.168.1.1":            false,
+		"169.254.169.254":        false,
+		"fe80::1":                false,
+		"fd00:ec2::254":          false,
+		"100.100.100.200":        false,
+		"192.0.0.192":            false,
+		"0.0.0.0":                false,
+		"::":                     false,
+		"255.255.255.255":        false,
+		"224.0.0.1":              false,
+		"::ffff:127.0.0.1":       false,
+		"::ffff:169.254.169.254": false,
+		"64:ff9b::a9fe:a9fe":     false,
+	} {
+		if got := webhookAddressAllowed(net.ParseIP(addr)); got != want {
+			t.Errorf("got %v for %s, want %v", got, addr, want)
+		}
+	}
+}
+
+func TestWebhookClientRefusesInternalAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the webhook client reached a loopback address")
+	}))
+	t.Cleanup(receiver.Close)
+	client := newWebhookClient(time.Second)
+
+	// by address, and by a name that resolves to it when the delivery is made
+	for _, url := range []string{receiver.URL, strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)} {
+		_, err := deliverWebhook(client, &WebhookDelivery{DeliveryID: "d1", EventType: AuditMemberAdded, URL: url, Secret: "whsec_test"})
+		if !errors.Is(err, errWebhookAddressBlocked) {
+			t.Errorf("got %v delivering to %s, want errWebhookAddressBlocked", err, url)
+		}
+	}
+}
+
+// webhookReceiver answers deliveries with the queued status codes, then with 200
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+	rcv := &webhookReceiver{}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.received = append(rcv.received, r)
+		rcv.bodies = append(rcv.bodies, body)
+		status := http.StatusOK
+		if len(rcv.statuses) > 0 {
+			status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *webhookReceiver) respondWith(statuses ...int) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.statuses = append(rcv.statuses, statuses...)
+}
+
+func (rcv *webhookReceiver) last() (*http.Request, []byte) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return rcv.received[len(rcv.received)-1], rcv.bodies[len(rcv.bodies)-1]
+}
+
+func (rcv *webhookReceiver) count() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.received)
+}
+
+// verifyWebhookSignature checks the X-Uzorg-Signature header of a delivery like a receiver would
+func verifyWebhookSignature(t *testing.T, r *http.Request, body []byte, secret string) {
+	t.Helper()
+	var timestamp, signature string
+	for _, part := range strings.Split(r.Header.Get("X-Uzorg-Signature"), ",") {
+		if v := strings.TrimPrefix(part, "t="); v != part {
+			timestamp = v
+		}
+		if v := strings.TrimPrefix(part, "v1="); v != part {
+			signature = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		t.Errorf("got signature header %q, want the HMAC-SHA256 of the timestamp and body", r.Header.Get("X-Uzorg-Signature"))
+	}
+	sent, _ := strconv.ParseInt(timestamp, 10, 64)
+	if time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Errorf("got signature timestamp %s, want the time of the delivery", timestamp)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	t.Setenv("UZORG_WEBHOOK_MAX_ATTEMPTS", "3")
+	store, h := newTestHandler(t)
+	server := httptest.NewServer(newRouter(h))
+	t.Cleanup(server.Close)
+	receiver := newWebhookReceiver(t)
+	ctx := context.Background()
+
+	ada := client.New(server.URL)
+	adaUser := registerTestUser(t, ada, "Ada", "ada@example.com")
+	bob := client.New(server.URL)
+	bobUser := registerTestUser(t, bob, "Bob", "bob@example.com")
+	org, err := ada.CreateOrg(ctx, client.CreateOrgRequest{Name: "Hooked", Description: "Calls back"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ada.AddUserToOrg(ctx, org.OrgID, bobUser.UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	webhooksURL := server.URL + "/api/v1/organisations/" + org.OrgID + "/webhooks"
+	body := `{"url":"` + receiver.URL + `/hook","events":["member.added","org.deleted"]}`
+	if resp := doTestRequest(t, http.MethodPost, webhooksURL, bob.Token(), body, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d creating a webhook as a member, want 403", resp.StatusCode)
+	}
+	if resp := doTestRequest(t, http.MethodPost, webhooksURL, ada.Token(), `{"url":"`+receiver.URL+`","events":["user.login"]}`, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d subscribing to an unknown event, want 422", resp.StatusCode)
+	}
+	var created CreateWebhookResponse
+	if resp := doTestRequest(t, http.MethodPost, webhooksURL, ada.Token(), body, &created); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d creating a webhook, want 201", resp.StatusCode)
+	}
+	webhook := created.Data
+	if !strings.HasPrefix(webhook.Secret, webhookSecretPrefix) {
+		t.Fatalf("got secret %q, want one starting with %s", webhook.Secret, webhookSecretPrefix)
+	}
+
+	enqueue := func(e DomainEvent) string {
+		t.Helper()
+		*e.Meta() = EventMeta{EventID: uuid.New().String(), OrgID: org.OrgID, ActorID: adaUser.UserID, OccurredAt: time.Now()}
+		if err := h.enqueueWebhooks(e); err != nil {
+			t.Fatal(err)
+		}
+		return e.Meta().EventID
+	}
+	deliver := func() error {
+		t.Helper()
+		return deliverNextWebhook(store, receiver.Client())
+	}
+	deliveries := func() []*WebhookDelivery {
+		t.Helper()
+		var list GetWebhookDeliveriesResponse
+		resp := doTestRequest(t, http.MethodGet, webhooksURL+"/"+webhook.WebhookID+"/deliveries", ada.Token(), "", &list)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d listing deliveries, want 200", resp.StatusCode)
+		}
+		return list.Data
+	}
+
+	// events the webhook is not subscribed to are not delivered
+	enqueue(&MemberRemoved{OrgID: org.OrgID, UserID: bobUser.UserID})
+	if err := deliver(); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("got %v for an event the webhook is not subscribed to, want no delivery", err)
+	}
+
+	eventID := enqueue(&MemberAdded{OrgID: org.OrgID, UserID: bobUser.UserID, AddedBy: adaUser.UserID})
+	if err := deliver(); err != nil {
+		t.Fatal(err)
+	}
+	r, payload := receiver.last()
+	verifyWebhookSignature(t, r, payload, webhook.Secret)
+	if r.URL.Path != "/hook" || r.Header.Get("X-Uzorg-Event") != AuditMemberAdded || r.Header.Get("X-Uzorg-Delivery") == "" {
+		t.Errorf("got delivery to %s with headers %v", r.URL.Path, r.Header)
+	}
+	var sent struct {
+		WebhookPayload
+		Data MemberAdded `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.EventID != eventID || sent.Type != AuditMemberAdded || sent.OrgID != org.OrgID || sent.Data.UserID != bobUser.UserID {
+		t.Errorf("got payload %s, want the member.added event", payload)
+	}
+	if list := deliveries(); len(list) != 1 || list[0].Status != WebhookDeliveryDelivered || list[0].Attempts != 1 ||
+		list[0].LastStatusCode == nil || *list[0].LastStatusCode != http.StatusOK || list[0].DeliveredAt == nil {
+		t.Errorf("got deliveries %+v, want one delivered on the first attempt", list)
+	}
+
+	// a delivery answered with 5xx is retried with backoff, then dead lettered after the last attempt
+	receiver.respondWith(http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusInternalServerError)
+	enqueue(&MemberAdded{OrgID: org.OrgID, UserID: adaUser.UserID, AddedBy: adaUser.UserID})
+	for attempt, wantDelay := range []time.Duration{webhookRetryBase, 2 * webhookRetryBase} {
+		if err := deliver(); err != nil {
+			t.Fatal(err)
+		}
+		d := deliveries()[0]
+		if d.Status != WebhookDeliveryPending || d.Attempts != attempt+1 || d.LastStatusCode == nil || *d.LastStatusCode < 500 ||
+			d.NextAttemptAt == nil || time.Until(*d.NextAttemptAt) < wantDelay-5*time.Second || time.Until(*d.NextAttemptAt) > wantDelay {
+			t.Fatalf("got %+v after attempt %d, want it pending and retried in %v", d, attempt+1, wantDelay)
+		}
+		if err := deliver(); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("got %v before the retry is due, want no delivery", err)
+		}
+
+		store.mu.Lock()
+		past := time.Now().Add(-time.Second)
+		store.webhookDelivery(d.DeliveryID).NextAttemptAt = &past
+		store.mu.Unlock()
+	}
+	if err := deliver(); err != nil {
+		t.Fatal(err)
+	}
+	d := deliveries()[0]
+	if d.Status != WebhookDeliveryDead || d.Attempts != 3 || d.NextAttemptAt != nil || !strings.Contains(d.LastError, "500") {
+		t.Errorf("got %+v after the last attempt, want it dead lettered", d)
+	}
+	if err := deliver(); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("got %v after dead lettering, want no more attempts", err)
+	}
+	if receiver.count() != 4 {
+		t.Errorf("got %d requests at the receiver, want 4", receiver.count())
+	}
+
+	if resp := doTestRequest(t, http.MethodGet, webhooksURL+"/"+webhook.WebhookID+"/deliveries", bob.Token(), "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d listing deliveries as a member, want 403", resp.StatusCode)
+	}
+	if resp := doTestRequest(t, http.MethodGet, webhooksURL+"/"+webhook.WebhookID+"/deliveries?limit=0", ada.Token(), "", nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for limit 0, want 422", resp.StatusCode)
+	}
+}